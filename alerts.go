@@ -0,0 +1,561 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	// maxAlertDeliveries is how many deliveries the in-memory delivery log keeps
+	maxAlertDeliveries = 500
+	// alertMaxAttempts is how often a webhook delivery is tried before giving up
+	alertMaxAttempts = 5
+	// alertRetryBase is the delay before the first retry, doubled for each further one
+	alertRetryBase = 5 * time.Second
+)
+
+// Alert event types
+const (
+	AlertQuotaStatus    = "quota_status"    // quota status changed (ok/warning/exceeded)
+	AlertQuotaThreshold = "quota_threshold" // quota usage crossed an alert threshold
+	AlertForwardMissing = "forward_missing" // a managed forward disappeared from nftables
+	AlertTest           = "test"            // sent by POST /api/v1/alerts/test
+)
+
+// webhook is a configured webhook with its payload template parsed
+type webhook struct {
+	WebhookConfig
+	tmpl *template.Template
+}
+
+// AlertManager watches quotas and forwards and POSTs events to webhooks.
+// Last seen statuses, fired thresholds and known forwards are persisted so
+// nothing is re-sent after a restart.
+type AlertManager struct {
+	mu         sync.Mutex
+	nft        *NFTManager
+	fwd        *ForwardingManager
+	logger     *log.Logger
+	client     *http.Client
+	path       string
+	interval   time.Duration
+	retryBase  time.Duration // delay before the first retry of a delivery
+	thresholds []float64
+	webhooks   []webhook
+	state      AlertsFile
+	forgotten  map[int]time.Time // srcPort -> when the forward was deleted through the API
+	deliveries []AlertDelivery
+	nextID     int64
+}
+
+// NewAlertManager creates a new AlertManager from the webhook configuration
+func NewAlertManager(cfg *Config, nft *NFTManager, fwd *ForwardingManager, logger *log.Logger) (*AlertManager, error) {
+	path := cfg.AlertsPath
+	if path == "" {
+		path = "/var/lib/nft-ui/alerts.json"
+	}
+
+	hooks := make([]webhook, 0, len(cfg.Webhooks))
+	for i, wc := range cfg.Webhooks {
+		if wc.URL == "" {
+			return nil, fmt.Errorf("webhook %d: url is required", i)
+		}
+		if wc.Name == "" {
+			wc.Name = wc.URL
+		}
+		for _, ev := range wc.Events {
+			switch ev {
+			case AlertQuotaStatus, AlertQuotaThreshold, AlertForwardMissing, AlertTest:
+			default:
+				return nil, fmt.Errorf("webhook %s: unknown event %q", wc.Name, ev)
+			}
+		}
+		h := webhook{WebhookConfig: wc}
+		if wc.Template != "" {
+			tmpl, err := template.New(wc.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(wc.Template)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: invalid template: %w", wc.Name, err)
+			}
+			h.tmpl = tmpl
+		}
+		hooks = append(hooks, h)
+	}
+
+	interval := time.Duration(cfg.AlertInterval) * time.Second
+	if interval <= 0 {
+		interval = 60 * time.Second
+	}
+
+	for _, t := range cfg.AlertThresholds {
+		if t <= 0 {
+			return nil, fmt.Errorf("invalid alert threshold: %v", t)
+		}
+	}
+
+	return &AlertManager{
+		nft:        nft,
+		fwd:        fwd,
+		logger:     logger,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		path:       path,
+		interval:   interval,
+		retryBase:  alertRetryBase,
+		thresholds: cfg.AlertThresholds,
+		webhooks:   hooks,
+		state: AlertsFile{
+			Ports:    make(map[int]*AlertPortState),
+			Forwards: []int{},
+		},
+		forgotten: make(map[int]time.Time),
+	}, nil
+}
+
+// Load reads persisted alert state from disk
+func (a *AlertManager) Load() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var file AlertsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", a.path, err)
+	}
+	if file.Ports == nil {
+		file.Ports = make(map[int]*AlertPortState)
+	}
+	if file.Forwards == nil {
+		file.Forwards = []int{}
+	}
+	a.state = file
+	return nil
+}
+
+// Run checks quotas and forwards every interval until the process exits
+func (a *AlertManager) Run() {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
+	a.check(time.Now())
+	for now := range ticker.C {
+		a.check(now)
+	}
+}
+
+// check compares the current quotas and forwards with the last seen state
+func (a *AlertManager) check(now time.Time) {
+	quotas, err := a.nft.ListQuotas()
+	if err != nil {
+		a.logger.Printf("Error listing quotas for alerts: %v", err)
+		return
+	}
+	forwards, err := a.fwd.ListForwardingRules()
+	if err != nil {
+		a.logger.Printf("Error listing forwarding rules for alerts: %v", err)
+		return
+	}
+
+	var events []AlertEvent
+
+	a.mu.Lock()
+
+	seen := make(map[int]bool)
+	for _, q := range quotas {
+		if seen[q.Port] {
+			continue
+		}
+		seen[q.Port] = true
+		events = append(events, a.checkQuota(q, now)...)
+	}
+	for port, ps := range a.state.Ports {
+		// Keep thresholds of quotas that are only briefly gone (e.g. mid-reset)
+		if !seen[port] && len(ps.Thresholds) == 0 {
+			delete(a.state.Ports, port)
+		}
+	}
+
+	events = append(events, a.checkForwards(forwards, now)...)
+
+	if err := a.save(); err != nil {
+		a.logger.Printf("Error saving alert state: %v", err)
+	}
+	a.mu.Unlock()
+
+	for _, ev := range events {
+		a.dispatch(ev)
+	}
+}
+
+// checkQuota returns the events for one quota and updates its state (requires lock to be held)
+func (a *AlertManager) checkQuota(q QuotaRule, now time.Time) []AlertEvent {
+	ps, ok := a.state.Ports[q.Port]
+	if !ok {
+		ps = &AlertPortState{}
+		a.state.Ports[q.Port] = ps
+	}
+
+	var events []AlertEvent
+	newEvent := func(typ string) AlertEvent {
+		return AlertEvent{
+			Type:         typ,
+			Time:         now.Truncate(time.Second),
+			Port:         q.Port,
+			Comment:      q.Comment,
+			Status:       q.Status,
+			UsedBytes:    q.UsedBytes,
+			QuotaBytes:   q.QuotaBytes,
+			UsagePercent: q.UsagePercent,
+		}
+	}
+
+	// The first time a quota is seen only establishes its status
+	if ps.Status != "" && ps.Status != q.Status {
+		ev := newEvent(AlertQuotaStatus)
+		ev.PreviousStatus = ps.Status
+		ev.Message = fmt.Sprintf("Quota on port %d is now %s (was %s): %s of %s used",
+			q.Port, q.Status, ps.Status, formatAlertBytes(q.UsedBytes), formatAlertBytes(q.QuotaBytes))
+		events = append(events, ev)
+	}
+	ps.Status = q.Status
+
+	thresholds := ps.Thresholds
+	if len(thresholds) == 0 {
+		thresholds = a.thresholds
+	}
+	fired := make(map[float64]bool, len(ps.Fired))
+	for _, t := range ps.Fired {
+		fired[t] = true
+	}
+	ps.Fired = ps.Fired[:0]
+	for _, t := range thresholds {
+		if q.UsagePercent < t {
+			// Re-arm once usage drops below again (e.g. after a reset)
+			continue
+		}
+		if !fired[t] {
+			ev := newEvent(AlertQuotaThreshold)
+			ev.Threshold = t
+			ev.Message = fmt.Sprintf("Quota on port %d crossed %.0f%%: %s of %s used",
+				q.Port, t, formatAlertBytes(q.UsedBytes), formatAlertBytes(q.QuotaBytes))
+			events = append(events, ev)
+		}
+		ps.Fired = append(ps.Fired, t)
+	}
+
+	return events
+}
+
+// checkForwards returns an event for every managed forward that disappeared (requires lock to be held)
+func (a *AlertManager) checkForwards(forwards []ForwardingRule, now time.Time) []AlertEvent {
+	present := make(map[int]bool)
+	for _, r := range forwards {
+		// Disabled forwards are listed too and do not count as missing
+		if r.Managed {
+			present[r.SrcPort] = true
+		}
+	}
+
+	var events []AlertEvent
+	for _, port := range a.state.Forwards {
+		if present[port] {
+			continue
+		}
+		if _, ok := a.forgotten[port]; ok {
+			continue // deleted on purpose
+		}
+		events = append(events, AlertEvent{
+			Type:    AlertForwardMissing,
+			Time:    now.Truncate(time.Second),
+			Port:    port,
+			Message: fmt.Sprintf("Forwarding rule for port %d disappeared from nftables", port),
+		})
+	}
+
+	known := make([]int, 0, len(present))
+	for port := range present {
+		// Deleted through the API while this check was listing
+		if _, ok := a.forgotten[port]; ok {
+			continue
+		}
+		known = append(known, port)
+	}
+	sort.Ints(known)
+	a.state.Forwards = known
+
+	for port, at := range a.forgotten {
+		if at.Before(now) {
+			delete(a.forgotten, port)
+		}
+	}
+
+	return events
+}
+
+// ForgetForward stops watching a forward that was deleted on purpose
+func (a *AlertManager) ForgetForward(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.forgotten[port] = time.Now()
+}
+
+// Thresholds returns the alert thresholds for a port and whether they are set per quota
+func (a *AlertManager) Thresholds(port int) ([]float64, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ps, ok := a.state.Ports[port]; ok && len(ps.Thresholds) > 0 {
+		return append([]float64(nil), ps.Thresholds...), true
+	}
+	return append([]float64{}, a.thresholds...), false
+}
+
+// SetThresholds overrides the alert thresholds for a port (empty restores the defaults)
+func (a *AlertManager) SetThresholds(port int, thresholds []float64) error {
+	for _, t := range thresholds {
+		if t <= 0 {
+			return fmt.Errorf("invalid threshold: %v (must be > 0)", t)
+		}
+	}
+	sorted := append([]float64(nil), thresholds...)
+	sort.Float64s(sorted)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ps, ok := a.state.Ports[port]
+	if !ok {
+		ps = &AlertPortState{}
+		a.state.Ports[port] = ps
+	}
+	ps.Thresholds = sorted
+	return a.save()
+}
+
+// DeleteQuota drops the alert state of a deleted quota
+func (a *AlertManager) DeleteQuota(port int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.state.Ports[port]; !ok {
+		return nil
+	}
+	delete(a.state.Ports, port)
+	return a.save()
+}
+
+// Test sends a test event to every webhook
+func (a *AlertManager) Test() {
+	a.dispatch(AlertEvent{
+		Type:    AlertTest,
+		Time:    time.Now().Truncate(time.Second),
+		Message: "Test alert from nft-ui",
+	})
+}
+
+// Deliveries returns the most recent deliveries, newest first
+func (a *AlertManager) Deliveries(limit int) []AlertDelivery {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n := len(a.deliveries)
+	if limit <= 0 || limit > n {
+		limit = n
+	}
+	result := make([]AlertDelivery, 0, limit)
+	for i := n - 1; i >= n-limit; i-- {
+		result = append(result, a.deliveries[i])
+	}
+	return result
+}
+
+// dispatch starts a delivery of ev to every webhook subscribed to its type
+func (a *AlertManager) dispatch(ev AlertEvent) {
+	for i := range a.webhooks {
+		h := &a.webhooks[i]
+		if !h.subscribed(ev.Type) {
+			continue
+		}
+		id := a.recordDelivery(h.Name, ev)
+		go a.deliver(id, h, ev)
+	}
+}
+
+// subscribed reports whether the webhook wants events of a type
+func (h *webhook) subscribed(typ string) bool {
+	if len(h.Events) == 0 || typ == AlertTest {
+		return true
+	}
+	for _, ev := range h.Events {
+		if ev == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver POSTs an event to a webhook, retrying with exponential backoff
+func (a *AlertManager) deliver(id int64, h *webhook, ev AlertEvent) {
+	body, err := h.payload(ev)
+	if err != nil {
+		a.updateDelivery(id, 0, 0, err, true)
+		a.logger.Printf("Error rendering alert for webhook %s: %v", h.Name, err)
+		return
+	}
+
+	delay := a.retryBase
+	for attempt := 1; attempt <= alertMaxAttempts; attempt++ {
+		code, err := a.post(h, body)
+		retryable := err != nil || code == http.StatusTooManyRequests || code >= 500
+		if err == nil && (code < 200 || code >= 300) {
+			err = fmt.Errorf("unexpected status %d", code)
+		}
+		done := err == nil || !retryable || attempt == alertMaxAttempts
+		a.updateDelivery(id, attempt, code, err, done)
+
+		if err == nil {
+			return
+		}
+		if done {
+			a.logger.Printf("Error delivering %s alert to webhook %s: %v", ev.Type, h.Name, err)
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post sends one request and returns the response status code
+func (a *AlertManager) post(h *webhook, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nft-ui")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// payload renders the request body for an event
+func (h *webhook) payload(ev AlertEvent) ([]byte, error) {
+	if h.tmpl == nil {
+		return json.Marshal(ev)
+	}
+	var buf bytes.Buffer
+	if err := h.tmpl.Execute(&buf, ev); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// recordDelivery adds a pending delivery to the log and returns its ID
+func (a *AlertManager) recordDelivery(name string, ev AlertEvent) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.nextID++
+	a.deliveries = append(a.deliveries, AlertDelivery{
+		ID:      a.nextID,
+		Webhook: name,
+		Event:   ev,
+		Status:  "pending",
+	})
+	if len(a.deliveries) > maxAlertDeliveries {
+		a.deliveries = a.deliveries[len(a.deliveries)-maxAlertDeliveries:]
+	}
+	return a.nextID
+}
+
+// updateDelivery records the outcome of a delivery attempt
+func (a *AlertManager) updateDelivery(id int64, attempts, code int, err error, done bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i := len(a.deliveries) - 1; i >= 0; i-- {
+		d := &a.deliveries[i]
+		if d.ID != id {
+			continue
+		}
+		d.Attempts = attempts
+		d.StatusCode = code
+		d.LastAttempt = time.Now().Truncate(time.Second)
+		d.Error = ""
+		switch {
+		case err == nil:
+			d.Status = "delivered"
+		case done:
+			d.Status = "failed"
+			d.Error = err.Error()
+		default:
+			d.Status = "retrying"
+			d.Error = err.Error()
+		}
+		return
+	}
+}
+
+// save writes the alert state to disk (requires lock to be held)
+func (a *AlertManager) save() error {
+	// Ensure directory exists
+	dir := filepath.Dir(a.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(a.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(a.path, data, 0644)
+}
+
+// toJSON is the "json" template function, for embedding values in JSON payloads
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// formatAlertBytes formats bytes for alert messages (1000-based like the UI)
+func formatAlertBytes(b int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB", "PB"}
+	v := float64(b)
+	i := 0
+	for v >= 1000 && i < len(units)-1 {
+		v /= 1000
+		i++
+	}
+	s := fmt.Sprintf("%.2f", v)
+	s = strings.TrimRight(strings.TrimRight(s, "0"), ".")
+	return s + " " + units[i]
+}
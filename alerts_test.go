@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder is a webhook endpoint answering with a scripted list of
+// status codes (200 once they run out) and keeping the events it received
+type webhookRecorder struct {
+	mu     sync.Mutex
+	codes  []int
+	events []AlertEvent
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var ev AlertEvent
+	if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.events = append(w.events, ev)
+	code := http.StatusOK
+	if len(w.codes) > 0 {
+		code, w.codes = w.codes[0], w.codes[1:]
+	}
+	rw.WriteHeader(code)
+}
+
+func (w *webhookRecorder) received() []AlertEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]AlertEvent(nil), w.events...)
+}
+
+// newTestAlertManager returns an AlertManager posting to url without waiting between retries
+func newTestAlertManager(t *testing.T, url string, thresholds ...float64) *AlertManager {
+	t.Helper()
+
+	cfg := DefaultConfig()
+	cfg.AlertsPath = t.TempDir() + "/alerts.json"
+	cfg.AlertThresholds = thresholds
+	cfg.Webhooks = []WebhookConfig{{Name: "test", URL: url}}
+	a, err := NewAlertManager(cfg, nil, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("NewAlertManager: %v", err)
+	}
+	a.retryBase = time.Millisecond
+	return a
+}
+
+// waitDelivered waits until no delivery is pending or retrying any more
+func waitDelivered(t *testing.T, a *AlertManager) []AlertDelivery {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries := a.Deliveries(0)
+		busy := false
+		for _, d := range deliveries {
+			busy = busy || d.Status == "pending" || d.Status == "retrying"
+		}
+		if !busy {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries still in progress: %+v", deliveries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// observe runs one quota through checkQuota and dispatches its events, like check does
+func observe(a *AlertManager, q QuotaRule) []AlertEvent {
+	a.mu.Lock()
+	events := a.checkQuota(q, time.Now())
+	a.mu.Unlock()
+
+	for _, ev := range events {
+		a.dispatch(ev)
+	}
+	return events
+}
+
+func TestAlertDeliveryRetriesAfterFailure(t *testing.T) {
+	hook := &webhookRecorder{codes: []int{http.StatusInternalServerError}}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	a := newTestAlertManager(t, srv.URL)
+	a.Test()
+
+	deliveries := waitDelivered(t, a)
+	if len(deliveries) != 1 {
+		t.Fatalf("got %d deliveries, want 1", len(deliveries))
+	}
+	d := deliveries[0]
+	if d.Status != "delivered" || d.Attempts != 2 || d.StatusCode != http.StatusOK || d.Error != "" {
+		t.Errorf("delivery = %+v, want delivered on the second attempt with status 200", d)
+	}
+	if got := hook.received(); len(got) != 2 || got[0].Type != AlertTest || got[1].Type != AlertTest {
+		t.Errorf("webhook received %+v, want the test event twice", got)
+	}
+}
+
+func TestAlertDeliveryGivesUpOnClientError(t *testing.T) {
+	hook := &webhookRecorder{codes: []int{http.StatusBadRequest}}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	a := newTestAlertManager(t, srv.URL)
+	a.Test()
+
+	d := waitDelivered(t, a)[0]
+	if d.Status != "failed" || d.Attempts != 1 || d.StatusCode != http.StatusBadRequest {
+		t.Errorf("delivery = %+v, want failed after one attempt with status 400", d)
+	}
+}
+
+func TestAlertDuplicateTransitionSuppressed(t *testing.T) {
+	hook := &webhookRecorder{}
+	srv := httptest.NewServer(hook)
+	defer srv.Close()
+
+	a := newTestAlertManager(t, srv.URL, 80)
+	q := QuotaRule{Port: 7100, Status: "ok", UsedBytes: 10, QuotaBytes: 100, UsagePercent: 10}
+
+	// The first check only establishes the status
+	if events := observe(a, q); len(events) != 0 {
+		t.Fatalf("first check: got %+v, want no events", events)
+	}
+
+	q.Status, q.UsedBytes, q.UsagePercent = "warning", 85, 85
+	if events := observe(a, q); len(events) != 2 {
+		t.Fatalf("transition: got %+v, want a status and a threshold event", events)
+	}
+
+	// Seeing the same status and usage again must not alert twice
+	q.UsedBytes, q.UsagePercent = 90, 90
+	if events := observe(a, q); len(events) != 0 {
+		t.Errorf("repeated check: got %+v, want no events", events)
+	}
+
+	waitDelivered(t, a)
+	got := hook.received()
+	if len(got) != 2 {
+		t.Fatalf("webhook received %d events, want 2: %+v", len(got), got)
+	}
+	for _, ev := range got {
+		switch ev.Type {
+		case AlertQuotaStatus:
+			if ev.Status != "warning" || ev.PreviousStatus != "ok" {
+				t.Errorf("status event = %+v, want ok -> warning", ev)
+			}
+		case AlertQuotaThreshold:
+			if ev.Threshold != 80 {
+				t.Errorf("threshold event = %+v, want threshold 80", ev)
+			}
+		default:
+			t.Errorf("unexpected event %+v", ev)
+		}
+	}
+}
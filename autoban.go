@@ -0,0 +1,403 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AutoBanComment identifies the rules of an auto-ban, followed by its target
+const AutoBanComment = "nft-ui autoban"
+
+// autoBanPreroutingPriority runs the auto-bans of forwards before their DNAT,
+// while packets still have the forward's port as destination
+const autoBanPreroutingPriority = -150
+
+// autoBanChains lists the chains of the blocklist table that hold auto-ban rules
+var autoBanChains = []string{"blocklist_input", "blocklist_prerouting"}
+
+// autoBanSetTimeout is the default timeout of the auto-ban sets: meters forget
+// an address after an hour without new connections, the longest period of a
+// rate; bans always get the auto-ban's ban time
+const autoBanSetTimeout = time.Hour
+
+// autoBanPeriods lists the periods of an auto-ban rate
+var autoBanPeriods = map[string]bool{"second": true, "minute": true, "hour": true}
+
+// autoBanTarget is what an auto-ban watches: an allowed port or a forward
+type autoBanTarget struct {
+	id       string // AutoBan.Target
+	sets     string // Common part of the set names, e.g. "port_22_tcp"
+	chain    string
+	iface    string // Input interface of a bound forward
+	listenIP string // Listen address of a bound forward
+	protocol string
+	ports    string
+	families []string
+}
+
+// autoBanRules is an auto-ban read back from its rules
+type autoBanRules struct {
+	ban     AutoBan
+	chains  []string // Chain of each handle
+	handles []int64
+	sets    []string
+	banSets []string
+}
+
+// portAutoBanTarget returns the target of an allowed port's auto-ban
+func (b *BlocklistManager) portAutoBanTarget(port AllowedPort) autoBanTarget {
+	return autoBanTarget{
+		id:       fmt.Sprintf("port_%s/%s", port.ports(), port.Protocol),
+		sets:     fmt.Sprintf("port_%s_%s", strings.Replace(port.ports(), "-", "_", 1), port.Protocol),
+		chain:    "blocklist_input",
+		protocol: port.Protocol,
+		ports:    port.ports(),
+		families: b.nft.inputFamilies(),
+	}
+}
+
+// forwardAutoBanTarget returns the target of a forward's auto-ban. Its rules
+// see the traffic of the destinations' families the blocklist table sees.
+func (b *BlocklistManager) forwardAutoBanTarget(rule *ForwardingRule) (autoBanTarget, error) {
+	t := autoBanTarget{
+		id:       rule.forwardingID(),
+		sets:     forwardSetName("fwd", rule.ref()),
+		chain:    "blocklist_prerouting",
+		iface:    rule.Interface,
+		listenIP: rule.ListenIP,
+		protocol: rule.Protocol,
+		ports:    rule.srcPorts(),
+	}
+	for _, dst := range rule.destinations() {
+		family := ipFamily(dst)
+		for _, f := range b.nft.inputFamilies() {
+			if f == family {
+				t.families = append(t.families, family)
+			}
+		}
+	}
+	if len(t.families) == 0 {
+		return autoBanTarget{}, fmt.Errorf("forward %s has no destination the %s %s table sees", t.id, b.family, b.table)
+	}
+	return t, nil
+}
+
+// ListAutoBans returns every auto-ban, those of ports first, with the addresses
+// it currently bans
+func (b *BlocklistManager) ListAutoBans() ([]AutoBan, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rules, err := b.loadAutoBans()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(rules))
+	for id := range rules {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		pi, pj := strings.HasPrefix(ids[i], "port_"), strings.HasPrefix(ids[j], "port_")
+		if pi != pj {
+			return pi
+		}
+		return ids[i] < ids[j]
+	})
+
+	now := time.Now()
+	bans := make([]AutoBan, 0, len(rules))
+	for _, id := range ids {
+		r := rules[id]
+		ban := r.ban
+		ban.Banned = []BlockedAddress{}
+		reason := fmt.Sprintf("more than %d new connections per %s to %s", ban.Connections, ban.Per, ban.Target)
+		for _, set := range r.banSets {
+			entries, err := b.backend.ListSetEntries(b.family, b.table, set)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list auto-ban set %s: %w", set, err)
+			}
+			for _, e := range entries {
+				expiresAt := now.Add(e.Expires).Truncate(time.Second)
+				ban.Banned = append(ban.Banned, BlockedAddress{
+					Address:   e.Element,
+					Reason:    reason,
+					Timeout:   int64(e.Timeout / time.Second),
+					ExpiresIn: int64(e.Expires / time.Second),
+					ExpiresAt: &expiresAt,
+				})
+			}
+		}
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+// SetPortAutoBan sets the auto-ban of an allowed port
+func (b *BlocklistManager) SetPortAutoBan(port AllowedPort, req SetAutoBanRequest) error {
+	return b.setAutoBan(b.portAutoBanTarget(port), req)
+}
+
+// SetForwardAutoBan sets the auto-ban of a forward
+func (b *BlocklistManager) SetForwardAutoBan(rule *ForwardingRule, req SetAutoBanRequest) error {
+	t, err := b.forwardAutoBanTarget(rule)
+	if err != nil {
+		return err
+	}
+	return b.setAutoBan(t, req)
+}
+
+// SyncForwardAutoBan rebuilds the auto-ban of an edited forward, if it has one,
+// for its current protocol and destinations
+func (b *BlocklistManager) SyncForwardAutoBan(rule *ForwardingRule) error {
+	b.mu.Lock()
+	rules, err := b.loadAutoBans()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	r, ok := rules[rule.forwardingID()]
+	if !ok {
+		return nil
+	}
+	req := SetAutoBanRequest{Connections: r.ban.Connections, Per: r.ban.Per, BanTime: r.ban.BanTime}
+	return b.SetForwardAutoBan(rule, req)
+}
+
+// setAutoBan replaces the rules of an auto-ban. Addresses it banned stay
+// banned; new thresholds apply to the connections that follow.
+func (b *BlocklistManager) setAutoBan(t autoBanTarget, req SetAutoBanRequest) error {
+	if err := validateAutoBan(req); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rules, err := b.loadAutoBans()
+	if err != nil {
+		return err
+	}
+	tx := &Transaction{}
+	b.queueSetup(tx)
+	if t.chain == "blocklist_prerouting" {
+		tx.AddBaseChain(b.family, b.table, t.chain,
+			ChainSpec{Type: "filter", Hook: "prerouting", Priority: autoBanPreroutingPriority, Policy: "accept"})
+	}
+	keep := make(map[string]bool)
+	for _, family := range t.families {
+		keyType := "ipv4_addr"
+		if family == "ip6" {
+			keyType = "ipv6_addr"
+		}
+		ban, meter := autoBanSetName("autoban", family, t.sets), autoBanSetName("abmeter", family, t.sets)
+		tx.AddTimedMeterSet(b.family, b.table, ban, keyType, autoBanSetTimeout)
+		tx.AddTimedMeterSet(b.family, b.table, meter, keyType, autoBanSetTimeout)
+		keep[ban], keep[meter] = true, true
+	}
+	if cur, ok := rules[t.id]; ok {
+		for i, h := range cur.handles {
+			tx.DeleteRule(b.family, b.table, cur.chains[i], h)
+		}
+		for _, set := range cur.sets {
+			if !keep[set] {
+				tx.DeleteSet(b.family, b.table, set)
+			}
+		}
+	}
+
+	// nft add rule inet filter blocklist_input ip saddr @autoban_port_22_tcp tcp dport 22 drop comment "nft-ui autoban port_22/tcp"
+	// nft add rule inet filter blocklist_input tcp dport 22 ct state new \
+	//	update @abmeter_port_22_tcp { ip saddr limit rate over 10/minute burst 10 packets } \
+	//	add @autoban_port_22_tcp { ip saddr timeout 3600s } drop comment "nft-ui autoban port_22/tcp"
+	comment := fmt.Sprintf(`"%s %s"`, AutoBanComment, t.id)
+	for _, family := range t.families {
+		ban, meter := autoBanSetName("autoban", family, t.sets), autoBanSetName("abmeter", family, t.sets)
+		match := t.match(family)
+		tx.AddRule(b.family, b.table, t.chain, append(append([]string{family, "saddr", "@" + ban}, match...),
+			"drop", "comment", comment)...)
+		rate := fmt.Sprintf("%d/%s", req.Connections, req.Per)
+		tx.AddRule(b.family, b.table, t.chain, append(match,
+			"ct", "state", "new",
+			"update", "@"+meter, "{", family, "saddr", "limit", "rate", "over", rate, "burst", strconv.Itoa(req.Connections), "packets", "}",
+			"add", "@"+ban, "{", family, "saddr", "timeout", fmt.Sprintf("%ds", req.BanTime), "}",
+			"drop", "comment", comment)...)
+	}
+	if err := b.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to set auto-ban of %s: %w", t.id, err)
+	}
+	return nil
+}
+
+// DeletePortAutoBan removes the auto-ban of an allowed port, lifting its bans
+func (b *BlocklistManager) DeletePortAutoBan(port AllowedPort) error {
+	return b.deleteAutoBan(b.portAutoBanTarget(port).id)
+}
+
+// DeleteForwardAutoBan removes the auto-ban of a forward, lifting its bans
+func (b *BlocklistManager) DeleteForwardAutoBan(ref forwardRef) error {
+	b.mu.Lock()
+	rules, err := b.loadAutoBans()
+	b.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Match by reference, the ID may give the ports of a range differently
+	for id := range rules {
+		key, ok := strings.CutPrefix(id, "fwd_")
+		if !ok {
+			continue
+		}
+		if r, err := parseForwardKey(key); err == nil && r == ref {
+			return b.deleteAutoBan(id)
+		}
+	}
+	return errAutoBanNotFound
+}
+
+// errAutoBanNotFound is returned when deleting an auto-ban that isn't set
+var errAutoBanNotFound = errors.New("auto-ban not found")
+
+// deleteAutoBan deletes the rules and sets of the auto-ban of target id
+func (b *BlocklistManager) deleteAutoBan(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	rules, err := b.loadAutoBans()
+	if err != nil {
+		return err
+	}
+	cur, ok := rules[id]
+	if !ok {
+		return errAutoBanNotFound
+	}
+	tx := &Transaction{}
+	for i, h := range cur.handles {
+		tx.DeleteRule(b.family, b.table, cur.chains[i], h)
+	}
+	for _, set := range cur.sets {
+		tx.DeleteSet(b.family, b.table, set)
+	}
+	if err := b.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to delete auto-ban of %s: %w", id, err)
+	}
+	return nil
+}
+
+// loadAutoBans reads the auto-bans back from their rules, by target
+func (b *BlocklistManager) loadAutoBans() (map[string]*autoBanRules, error) {
+	rules := make(map[string]*autoBanRules)
+	for _, chain := range autoBanChains {
+		ruleset, err := b.backend.ListChain(b.family, b.table, chain)
+		if err != nil {
+			if isNotFoundErr(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list auto-bans: %w", err)
+		}
+		for _, obj := range ruleset.NFTables {
+			rule := obj.Rule
+			if rule == nil {
+				continue
+			}
+			id, ok := strings.CutPrefix(rule.Comment, AutoBanComment+" ")
+			if !ok {
+				continue
+			}
+			r, ok := rules[id]
+			if !ok {
+				r = &autoBanRules{ban: AutoBan{Target: id}}
+				rules[id] = r
+			}
+			r.chains = append(r.chains, chain)
+			r.handles = append(r.handles, rule.Handle)
+			r.parse(rule)
+		}
+	}
+	return rules, nil
+}
+
+// parse records the thresholds and sets found in one of an auto-ban's rules
+func (r *autoBanRules) parse(rule *NFTRule) {
+	addSet := func(name string, ban bool) {
+		name = strings.TrimPrefix(name, "@")
+		for _, s := range r.sets {
+			if s == name {
+				return
+			}
+		}
+		r.sets = append(r.sets, name)
+		if ban {
+			r.banSets = append(r.banSets, name)
+		}
+	}
+	for _, e := range rule.Expr {
+		if m, ok := e["match"].(map[string]interface{}); ok {
+			if set, ok := m["right"].(string); ok && strings.HasPrefix(set, "@") {
+				addSet(set, strings.HasPrefix(set, "@autoban"))
+			}
+		}
+		s, ok := e["set"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := s["set"].(string)
+		elem, _ := s["elem"].(map[string]interface{})
+		if elem, ok := elem["elem"].(map[string]interface{}); ok {
+			if timeout, ok := elem["timeout"].(float64); ok {
+				r.ban.BanTime = int64(timeout)
+			}
+			addSet(name, true)
+			continue
+		}
+		addSet(name, false)
+		stmts, _ := s["stmt"].([]interface{})
+		for _, stmt := range stmts {
+			stmt, _ := stmt.(map[string]interface{})
+			if limit, ok := stmt["limit"].(map[string]interface{}); ok {
+				rate, _ := limit["rate"].(float64)
+				r.ban.Connections = int(rate)
+				r.ban.Per, _ = limit["per"].(string)
+			}
+		}
+	}
+}
+
+// match returns what the rules of a target match in a family: its binding and ports
+func (t autoBanTarget) match(family string) []string {
+	var args []string
+	if t.iface != "" {
+		args = append(args, "iifname", fmt.Sprintf(`"%s"`, t.iface))
+	}
+	if t.listenIP != "" {
+		args = append(args, family, "daddr", t.listenIP)
+	}
+	args = append(args, l4Match(t.protocol)...)
+	return append(args, "dport", t.ports)
+}
+
+// validateAutoBan checks the thresholds of an auto-ban
+func validateAutoBan(req SetAutoBanRequest) error {
+	if req.Connections < 1 {
+		return errors.New("connections must be at least 1")
+	}
+	if !autoBanPeriods[req.Per] {
+		return fmt.Errorf("invalid period: %q (must be second, minute or hour)", req.Per)
+	}
+	if req.BanTime < 1 {
+		return errors.New("ban time must be at least 1 second")
+	}
+	return nil
+}
+
+// autoBanSetName returns the name of an auto-ban's set of a family, e.g.
+// "autoban_port_22_tcp" or "abmeter6_fwd_8080"
+func autoBanSetName(prefix, family, sets string) string {
+	if family == "ip6" {
+		prefix += "6"
+	}
+	return prefix + "_" + sets
+}
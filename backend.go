@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backend abstracts how nft-ui reads and modifies the kernel ruleset.
+// Rules are written in nft syntax and read back in the nft JSON model,
+// so managers do not care whether the nft binary or netlink is used.
+type Backend interface {
+	// Name returns a short identifier for logging ("exec" or "netlink")
+	Name() string
+	// ListChain returns all rules of a chain, including handles
+	ListChain(family, table, chain string) (*NFTRuleset, error)
+	// TableExists reports whether a table exists
+	TableExists(family, table string) bool
+	// ChainExists reports whether a chain exists
+	ChainExists(family, table, chain string) bool
+	// ListSetElements returns the elements of a named set of addresses in nft
+	// syntax ("10.0.0.1", "10.0.0.0/8" or "10.0.0.1-10.0.0.9")
+	ListSetElements(family, table, set string) ([]string, error)
+	// ListSetEntries returns the elements of a named set of addresses like
+	// ListSetElements, with the time left until they expire and their comments
+	ListSetEntries(family, table, set string) ([]SetEntry, error)
+	// AddTable creates a table
+	AddTable(family, table string) error
+	// AddBaseChain creates a chain attached to a netfilter hook
+	AddBaseChain(family, table, chain string, spec ChainSpec) error
+	// AddRule appends a rule (nft syntax, e.g. "tcp", "dport", "22", "accept") to a chain
+	AddRule(family, table, chain string, rule ...string) error
+	// InsertRule prepends a rule (nft syntax) to a chain
+	InsertRule(family, table, chain string, rule ...string) error
+	// DeleteRule deletes a rule by handle
+	DeleteRule(family, table, chain string, handle int64) error
+	// ListRuleset returns the full ruleset in nft text syntax
+	ListRuleset() ([]byte, error)
+	// FlushRuleset removes all tables, chains and rules
+	FlushRuleset() error
+	// LoadFile applies an nft script file
+	LoadFile(path string) error
+	// Apply commits all commands of a transaction atomically
+	Apply(tx *Transaction) error
+}
+
+// ChainSpec describes the hook of a base chain
+type ChainSpec struct {
+	Type     string // "filter" | "nat"
+	Hook     string // "prerouting" | "input" | "forward" | "output" | "postrouting"
+	Priority int
+	Policy   string // "accept" | "drop"
+}
+
+// String renders the spec in nft syntax
+func (s ChainSpec) String() string {
+	return fmt.Sprintf("{ type %s hook %s priority %d ; policy %s ; }", s.Type, s.Hook, s.Priority, s.Policy)
+}
+
+// SetEntry is an element of a named address set
+type SetEntry struct {
+	Element string        // "10.0.0.1", "10.0.0.0/8" or "10.0.0.1-10.0.0.9"
+	Timeout time.Duration // 0 = never expires
+	Expires time.Duration // time left until the element expires
+	Comment string
+}
+
+// isNotFoundErr reports whether an error means the table or chain does not exist
+func isNotFoundErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such file or directory") ||
+		strings.Contains(msg, "does not exist")
+}
+
+// ExecBackend talks to nftables by running the nft binary
+type ExecBackend struct {
+	binary string
+}
+
+// NewExecBackend creates a new ExecBackend
+func NewExecBackend(cfg *Config) *ExecBackend {
+	return &ExecBackend{binary: cfg.NFTBinary}
+}
+
+// Name returns the backend identifier
+func (b *ExecBackend) Name() string {
+	return "exec"
+}
+
+// execNFT executes an nft command and returns the output
+func (b *ExecBackend) execNFT(args ...string) ([]byte, error) {
+	return b.execNFTInput("", args...)
+}
+
+// execNFTInput executes an nft command with the given stdin and returns the output
+func (b *ExecBackend) execNFTInput(stdin string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, b.binary, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	observeNFTCommand(args, time.Since(start), err)
+	if err != nil {
+		return nil, fmt.Errorf("nft %s: %w (output: %s)", strings.Join(args, " "), err, string(output))
+	}
+	return output, nil
+}
+
+// ListChain returns the rules of a chain parsed from nft -j output
+func (b *ExecBackend) ListChain(family, table, chain string) (*NFTRuleset, error) {
+	output, err := b.execNFT("-j", "-a", "list", "chain", family, table, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	var ruleset NFTRuleset
+	if err := json.Unmarshal(output, &ruleset); err != nil {
+		return nil, fmt.Errorf("failed to parse nft JSON: %w", err)
+	}
+	return &ruleset, nil
+}
+
+// TableExists reports whether a table exists
+func (b *ExecBackend) TableExists(family, table string) bool {
+	_, err := b.execNFT("list", "table", family, table)
+	return err == nil
+}
+
+// ChainExists reports whether a chain exists
+func (b *ExecBackend) ChainExists(family, table, chain string) bool {
+	_, err := b.execNFT("list", "chain", family, table, chain)
+	return err == nil
+}
+
+// ListSetElements returns the elements of a named set parsed from nft -j output
+func (b *ExecBackend) ListSetElements(family, table, set string) ([]string, error) {
+	output, err := b.execNFT("-j", "list", "set", family, table, set)
+	if err != nil {
+		return nil, err
+	}
+
+	var ruleset NFTRuleset
+	if err := json.Unmarshal(output, &ruleset); err != nil {
+		return nil, fmt.Errorf("failed to parse nft JSON: %w", err)
+	}
+	var elements []string
+	for _, obj := range ruleset.NFTables {
+		if obj.Set == nil {
+			continue
+		}
+		for _, e := range obj.Set.Elem {
+			if el := setElementString(e); el != "" {
+				elements = append(elements, el)
+			}
+		}
+	}
+	return elements, nil
+}
+
+// ListSetEntries returns the elements of a named set with their timeouts and
+// comments parsed from nft -j output
+func (b *ExecBackend) ListSetEntries(family, table, set string) ([]SetEntry, error) {
+	output, err := b.execNFT("-j", "list", "set", family, table, set)
+	if err != nil {
+		return nil, err
+	}
+
+	var ruleset NFTRuleset
+	if err := json.Unmarshal(output, &ruleset); err != nil {
+		return nil, fmt.Errorf("failed to parse nft JSON: %w", err)
+	}
+	var entries []SetEntry
+	for _, obj := range ruleset.NFTables {
+		if obj.Set == nil {
+			continue
+		}
+		for _, e := range obj.Set.Elem {
+			el := setElementString(e)
+			if el == "" {
+				continue
+			}
+			entry := SetEntry{Element: el}
+			// {"elem": {"val": ..., "timeout": 3600, "expires": 3542, "comment": "..."}}
+			if m, ok := e.(map[string]interface{}); ok {
+				if attrs, ok := m["elem"].(map[string]interface{}); ok {
+					timeout, _ := attrs["timeout"].(float64)
+					expires, _ := attrs["expires"].(float64)
+					entry.Timeout = time.Duration(timeout) * time.Second
+					entry.Expires = time.Duration(expires) * time.Second
+					entry.Comment, _ = attrs["comment"].(string)
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// setElementString renders an address set element of nft JSON in nft syntax
+func setElementString(e interface{}) string {
+	switch v := e.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		if p, ok := v["prefix"].(map[string]interface{}); ok {
+			addr, _ := p["addr"].(string)
+			length, _ := p["len"].(float64)
+			return fmt.Sprintf("%s/%d", addr, int(length))
+		}
+		if r, ok := v["range"].([]interface{}); ok && len(r) == 2 {
+			return fmt.Sprintf("%v-%v", r[0], r[1])
+		}
+		if el, ok := v["elem"].(map[string]interface{}); ok {
+			return setElementString(el["val"])
+		}
+	}
+	return ""
+}
+
+// AddTable creates a table
+func (b *ExecBackend) AddTable(family, table string) error {
+	_, err := b.execNFT("add", "table", family, table)
+	return err
+}
+
+// AddBaseChain creates a base chain
+func (b *ExecBackend) AddBaseChain(family, table, chain string, spec ChainSpec) error {
+	_, err := b.execNFT("add", "chain", family, table, chain, spec.String())
+	return err
+}
+
+// AddRule appends a rule to a chain
+func (b *ExecBackend) AddRule(family, table, chain string, rule ...string) error {
+	args := append([]string{"add", "rule", family, table, chain}, rule...)
+	_, err := b.execNFT(args...)
+	return err
+}
+
+// InsertRule prepends a rule to a chain
+func (b *ExecBackend) InsertRule(family, table, chain string, rule ...string) error {
+	args := append([]string{"insert", "rule", family, table, chain}, rule...)
+	_, err := b.execNFT(args...)
+	return err
+}
+
+// DeleteRule deletes a rule by handle
+func (b *ExecBackend) DeleteRule(family, table, chain string, handle int64) error {
+	_, err := b.execNFT("delete", "rule", family, table, chain, "handle", strconv.FormatInt(handle, 10))
+	return err
+}
+
+// ListRuleset returns the output of 'nft list ruleset'
+func (b *ExecBackend) ListRuleset() ([]byte, error) {
+	return b.execNFT("list", "ruleset")
+}
+
+// FlushRuleset runs 'nft flush ruleset'
+func (b *ExecBackend) FlushRuleset() error {
+	_, err := b.execNFT("flush", "ruleset")
+	return err
+}
+
+// LoadFile runs 'nft -f <path>'
+func (b *ExecBackend) LoadFile(path string) error {
+	_, err := b.execNFT("-f", path)
+	return err
+}
+
+// Apply renders the transaction as a script and loads it with 'nft -f -'
+func (b *ExecBackend) Apply(tx *Transaction) error {
+	if tx.Empty() {
+		return nil
+	}
+	_, err := b.execNFTInput(tx.Script(), "-f", "-")
+	return err
+}
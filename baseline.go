@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BaselineComment identifies the rules of the firewall baseline
+const BaselineComment = "nft-ui baseline"
+
+// baselineICMPTypes lists the ICMP types the baseline accepts, by family
+var baselineICMPTypes = map[string][]string{
+	"ip": {"destination-unreachable", "echo-request", "time-exceeded", "parameter-problem"},
+	"ip6": {"destination-unreachable", "packet-too-big", "time-exceeded", "parameter-problem", "echo-request",
+		"nd-router-solicit", "nd-router-advert", "nd-neighbor-solicit", "nd-neighbor-advert"},
+}
+
+// errBaselineLockout means the baseline would drop new connections of the
+// admin session turning it on
+var errBaselineLockout = errors.New("baseline would lock out the admin session")
+
+// BaselineManager turns the input chain into a default-drop firewall. The
+// baseline is a drop policy plus rules at the top of the chain accepting
+// loopback, established and related traffic, essential ICMP and ICMPv6 and
+// nft-ui's own listen ports; the allowed ports open everything else. Nothing
+// is stored outside the ruleset.
+type BaselineManager struct {
+	mu      sync.Mutex
+	nft     *NFTManager
+	backend Backend
+	family  string
+	table   string
+	ports   []int // Listen ports of nft-ui reachable from other hosts
+}
+
+// NewBaselineManager creates a new BaselineManager
+func NewBaselineManager(cfg *Config, nft *NFTManager, backend Backend) *BaselineManager {
+	return &BaselineManager{
+		nft:     nft,
+		backend: backend,
+		family:  cfg.TableFamily,
+		table:   cfg.TableName,
+		ports:   listenPorts(cfg.ListenAddr, cfg.MetricsListenAddr),
+	}
+}
+
+// AdminSession is how the client of an API request reaches nft-ui: its
+// address, and the local port it connects to, which is a reverse proxy's when
+// nft-ui is behind one on this host
+type AdminSession struct {
+	Addr net.IP
+	Port int
+}
+
+// Status returns the input chain's policy and whether the baseline is on
+func (m *BaselineManager) Status() (FirewallBaseline, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := FirewallBaseline{Policy: "accept", ListenPorts: m.ports, Rules: []string{}}
+	for _, rule := range m.rules() {
+		status.Rules = append(status.Rules, strings.Join(rule, " "))
+	}
+
+	policy, handles, err := m.load()
+	if err != nil {
+		return FirewallBaseline{}, err
+	}
+	if policy != "" {
+		status.Policy = policy
+	}
+	status.Enabled = len(handles) > 0
+	return status, nil
+}
+
+// Enable inserts the baseline rules at the top of the input chain, replacing
+// any earlier ones, and sets the chain's policy to drop. It fails with
+// errBaselineLockout if the session's next connections would be dropped.
+func (m *BaselineManager) Enable(session AdminSession) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkSession(session); err != nil {
+		return err
+	}
+	return m.apply()
+}
+
+// Sync re-applies the baseline if it is on, so its rules follow the listen
+// ports of the configuration
+func (m *BaselineManager) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, handles, err := m.load()
+	if err != nil || len(handles) == 0 {
+		return err
+	}
+	return m.apply()
+}
+
+// apply replaces the baseline rules and sets the drop policy in one transaction
+func (m *BaselineManager) apply() error {
+	_, handles, err := m.load()
+	if err != nil {
+		return err
+	}
+
+	tx := &Transaction{}
+	tx.AddTable(m.family, m.table)
+	tx.AddBaseChain(m.family, m.table, "input",
+		ChainSpec{Type: "filter", Hook: "input", Priority: 0, Policy: "drop"})
+	for _, handle := range handles {
+		tx.DeleteRule(m.family, m.table, "input", handle)
+	}
+	// Inserted rules go first, so the last one is inserted first
+	rules := m.rules()
+	for i := len(rules) - 1; i >= 0; i-- {
+		tx.InsertRule(m.family, m.table, "input", ruleArgs(BaselineComment, rules[i])...)
+	}
+
+	if err := m.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to enable firewall baseline: %w", err)
+	}
+	return nil
+}
+
+// Disable deletes the baseline rules and sets the input chain's policy back to accept
+func (m *BaselineManager) Disable() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.backend.ChainExists(m.family, m.table, "input") {
+		return nil
+	}
+	_, handles, err := m.load()
+	if err != nil {
+		return err
+	}
+
+	tx := &Transaction{}
+	tx.AddBaseChain(m.family, m.table, "input",
+		ChainSpec{Type: "filter", Hook: "input", Priority: 0, Policy: "accept"})
+	for _, handle := range handles {
+		tx.DeleteRule(m.family, m.table, "input", handle)
+	}
+	if err := m.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to disable firewall baseline: %w", err)
+	}
+	return nil
+}
+
+// load returns the input chain's policy and the handles of the baseline rules
+func (m *BaselineManager) load() (string, []int64, error) {
+	ruleset, err := m.backend.ListChain(m.family, m.table, "input")
+	if err != nil {
+		if isNotFoundErr(err) {
+			return "", nil, nil
+		}
+		return "", nil, fmt.Errorf("failed to list input chain: %w", err)
+	}
+
+	policy := ""
+	var handles []int64
+	for _, obj := range ruleset.NFTables {
+		if obj.Chain != nil && obj.Chain.Name == "input" {
+			policy = obj.Chain.Policy
+		}
+		if obj.Rule != nil && obj.Rule.Comment == BaselineComment {
+			handles = append(handles, obj.Rule.Handle)
+		}
+	}
+	return policy, handles, nil
+}
+
+// rules returns the baseline rules in chain order, without their comment
+func (m *BaselineManager) rules() [][]string {
+	// nft insert rule inet filter input iifname "lo" accept comment "nft-ui baseline"
+	// nft insert rule inet filter input ct state established,related accept comment "nft-ui baseline"
+	// nft insert rule inet filter input icmp type { echo-request, ... } accept comment "nft-ui baseline"
+	// nft insert rule inet filter input tcp dport 8080 accept comment "nft-ui baseline"
+	rules := [][]string{
+		{"iifname", `"lo"`, "accept"},
+		{"ct", "state", "established,related", "accept"},
+		{"ct", "state", "invalid", "drop"},
+	}
+	for _, family := range m.nft.inputFamilies() {
+		proto := map[string]string{"ip": "icmp", "ip6": "icmpv6"}[family]
+		rules = append(rules, []string{proto, "type", "{", strings.Join(baselineICMPTypes[family], ", "), "}", "accept"})
+	}
+	for _, port := range m.ports {
+		rules = append(rules, []string{"tcp", "dport", strconv.Itoa(port), "accept"})
+	}
+	return rules
+}
+
+// checkSession refuses a baseline that would drop the session's new
+// connections. Loopback clients and those connecting to a listen port of
+// nft-ui are accepted by the baseline; a client behind a reverse proxy on
+// this host needs the proxy's port allowed for its address.
+func (m *BaselineManager) checkSession(s AdminSession) error {
+	if s.Addr == nil {
+		return fmt.Errorf("%w: the client address is unknown", errBaselineLockout)
+	}
+	if s.Addr.IsLoopback() {
+		return nil
+	}
+	family := ipFamily(s.Addr.String())
+	seen := false
+	for _, f := range m.nft.inputFamilies() {
+		seen = seen || f == family
+	}
+	if !seen {
+		return nil // the input chain's table doesn't see the session
+	}
+	for _, port := range m.ports {
+		if port == s.Port {
+			return nil
+		}
+	}
+
+	ports, err := m.nft.ListAllowedPorts()
+	if err != nil {
+		return fmt.Errorf("failed to list allowed ports: %w", err)
+	}
+	for _, p := range ports {
+		if p.Protocol == "udp" || !p.overlaps(AllowedPort{Port: s.Port, Protocol: p.Protocol}) {
+			continue
+		}
+		if len(p.Sources) == 0 || sourcesContain(p.Sources, s.Addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: new connections from %s to port %d/tcp would be dropped, allow the port for it first",
+		errBaselineLockout, s.Addr, s.Port)
+}
+
+// sourcesContain reports whether an address is one of the sources of an allowed port
+func sourcesContain(sources []string, addr net.IP) bool {
+	ip, ok := parseAddrSpan(addr.String())
+	if !ok {
+		return false
+	}
+	for _, src := range sources {
+		if sp, ok := parseAddrSpan(src); ok && sp.overlaps(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenPorts returns the ports of listen addresses other hosts can reach,
+// skipping empty and loopback-only ones
+func listenPorts(addrs ...string) []int {
+	ports := []int{}
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port <= 0 {
+			continue
+		}
+		if ip := net.ParseIP(host); (ip != nil && ip.IsLoopback()) || host == "localhost" {
+			continue
+		}
+		dup := false
+		for _, p := range ports {
+			dup = dup || p == port
+		}
+		if !dup {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
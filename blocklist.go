@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BlocklistComment identifies the drop rules of the blocklist
+const BlocklistComment = "nft-ui blocklist"
+
+// blocklistPriority runs the blocklist chains before the filter table's input
+// and forward chains, so a blocked address is dropped whatever they accept
+const blocklistPriority = -10
+
+// maxImportLines caps the lines read from an imported blocklist file
+const maxImportLines = 100000
+
+// BlocklistManager bans addresses and CIDRs from the host and from forwards.
+// Bans are elements of a named set per address family in the filter table,
+// with their reason as comment and an optional timeout after which the kernel
+// removes them; the set is matched by drop rules in chains hooked to input and
+// forward. Nothing is stored outside the ruleset.
+type BlocklistManager struct {
+	mu      sync.Mutex
+	nft     *NFTManager
+	backend Backend
+	family  string
+	table   string
+}
+
+// NewBlocklistManager creates a new BlocklistManager
+func NewBlocklistManager(cfg *Config, nft *NFTManager, backend Backend) *BlocklistManager {
+	return &BlocklistManager{
+		nft:     nft,
+		backend: backend,
+		family:  cfg.TableFamily,
+		table:   cfg.TableName,
+	}
+}
+
+// blockConflict is an address that can't be blocked as requested
+type blockConflict struct {
+	span   addrSpan
+	reason string
+}
+
+// List returns the blocked addresses, IPv4 first, with the time left on their bans
+func (b *BlocklistManager) List() ([]BlockedAddress, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	var blocked []BlockedAddress
+	for _, family := range b.nft.inputFamilies() {
+		entries, err := b.backend.ListSetEntries(b.family, b.table, blocklistSetName(family))
+		if err != nil {
+			if isNotFoundErr(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list blocklist: %w", err)
+		}
+		for _, e := range entries {
+			addr := BlockedAddress{
+				Address: e.Element,
+				Reason:  e.Comment,
+				Timeout: int64(e.Timeout / time.Second),
+			}
+			if e.Timeout > 0 {
+				expiresAt := now.Add(e.Expires).Truncate(time.Second)
+				addr.ExpiresIn = int64(e.Expires / time.Second)
+				addr.ExpiresAt = &expiresAt
+			}
+			blocked = append(blocked, addr)
+		}
+	}
+	return blocked, nil
+}
+
+// Add blocks addresses and CIDRs for timeout (0 = until they are removed).
+// Addresses already blocked get the new timeout and reason; an address
+// overlapping a blocked CIDR, or another address of the list, is an error.
+func (b *BlocklistManager) Add(addresses []string, timeout time.Duration, reason string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(addresses) == 0 {
+		return errors.New("no addresses to block")
+	}
+	spans := make([]addrSpan, 0, len(addresses))
+	for _, addr := range addresses {
+		sp, err := b.parseAddress(addr)
+		if err != nil {
+			return err
+		}
+		spans = append(spans, sp)
+	}
+
+	tx, conflicts, err := b.plan(spans, timeout, reason)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("cannot block %s: %s", conflicts[0].span.entry, conflicts[0].reason)
+	}
+	if err := b.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to update blocklist: %w", err)
+	}
+	return nil
+}
+
+// Import blocks the addresses and CIDRs of a blocklist file, one per line with
+// '#' starting a comment. Lines that are invalid or overlap a blocked address
+// are skipped and returned with the reason.
+func (b *BlocklistManager) Import(r io.Reader, timeout time.Duration, reason string) (int, []string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var spans []addrSpan
+	var skipped []string
+	scanner := bufio.NewScanner(r)
+	for lines := 0; scanner.Scan(); lines++ {
+		if lines >= maxImportLines {
+			return 0, nil, fmt.Errorf("blocklist file has more than %d lines", maxImportLines)
+		}
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		sp, err := b.parseAddress(fields[0])
+		if err != nil {
+			skipped = append(skipped, err.Error())
+			continue
+		}
+		spans = append(spans, sp)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, nil, fmt.Errorf("failed to read blocklist file: %w", err)
+	}
+	if len(spans) == 0 {
+		return 0, skipped, nil
+	}
+
+	tx, conflicts, err := b.plan(spans, timeout, reason)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, c := range conflicts {
+		skipped = append(skipped, fmt.Sprintf("%s: %s", c.span.entry, c.reason))
+	}
+	if err := b.backend.Apply(tx); err != nil {
+		return 0, nil, fmt.Errorf("failed to update blocklist: %w", err)
+	}
+	return len(spans) - len(conflicts), skipped, nil
+}
+
+// Remove unblocks addresses and CIDRs, which must be blocked as given
+func (b *BlocklistManager) Remove(addresses []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(addresses) == 0 {
+		return errors.New("no addresses to unblock")
+	}
+	blocked, err := b.blocked()
+	if err != nil {
+		return err
+	}
+
+	tx := &Transaction{}
+	for _, addr := range addresses {
+		sp, err := b.parseAddress(addr)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, cur := range blocked {
+			if cur.entry == sp.entry {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("address not blocked: %s", sp.entry)
+		}
+		tx.DeleteElements(b.family, b.table, blocklistSetName(sp.family), sp.entry)
+	}
+	if err := b.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to update blocklist: %w", err)
+	}
+	return nil
+}
+
+// plan queues the setup of the blocklist and the addition of spans, replacing
+// the bans of addresses already blocked. Spans overlapping a blocked address
+// or a span before them are returned as conflicts instead.
+func (b *BlocklistManager) plan(spans []addrSpan, timeout time.Duration, reason string) (*Transaction, []blockConflict, error) {
+	blocked, err := b.blocked()
+	if err != nil {
+		return nil, nil, err
+	}
+	tx := &Transaction{}
+	b.queueSetup(tx)
+
+	// An address blocked again replaces its ban
+	type item struct {
+		addrSpan
+		current bool
+	}
+	replaced := make(map[string]bool)
+	for _, sp := range spans {
+		for _, cur := range blocked {
+			if cur.entry == sp.entry && !replaced[sp.entry] {
+				replaced[sp.entry] = true
+				tx.DeleteElements(b.family, b.table, blocklistSetName(sp.family), sp.entry)
+			}
+		}
+	}
+	items := make([]item, 0, len(spans)+len(blocked))
+	for _, cur := range blocked {
+		if !replaced[cur.entry] {
+			items = append(items, item{addrSpan: cur, current: true})
+		}
+	}
+	for _, sp := range spans {
+		items = append(items, item{addrSpan: sp})
+	}
+
+	// Sweep the spans by first address: a span may only overlap the last one
+	// kept, and blocked addresses win over the ones to add
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].family != items[j].family {
+			return items[i].family == "ip"
+		}
+		if c := bytes.Compare(items[i].first, items[j].first); c != 0 {
+			return c < 0
+		}
+		return items[i].current && !items[j].current
+	})
+	var kept []item
+	var conflicts []blockConflict
+	for _, it := range items {
+		if len(kept) > 0 && it.overlaps(kept[len(kept)-1].addrSpan) {
+			last := kept[len(kept)-1]
+			switch {
+			case !it.current && last.current:
+				conflicts = append(conflicts, blockConflict{it.addrSpan, "overlaps blocked " + last.entry})
+				continue
+			case !it.current && it.entry == last.entry:
+				conflicts = append(conflicts, blockConflict{it.addrSpan, "listed twice"})
+				continue
+			case !it.current:
+				conflicts = append(conflicts, blockConflict{it.addrSpan, "overlaps " + last.entry + " of the same list"})
+				continue
+			default:
+				conflicts = append(conflicts, blockConflict{last.addrSpan, "overlaps blocked " + it.entry})
+				kept = kept[:len(kept)-1]
+			}
+		}
+		kept = append(kept, it)
+	}
+
+	comment := sanitizeComment(reason)
+	for _, it := range kept {
+		if !it.current {
+			tx.AddTimedElement(b.family, b.table, blocklistSetName(it.family), it.entry, timeout, comment)
+		}
+	}
+	return tx, conflicts, nil
+}
+
+// blocked returns the spans of the blocked addresses
+func (b *BlocklistManager) blocked() ([]addrSpan, error) {
+	var spans []addrSpan
+	for _, family := range b.nft.inputFamilies() {
+		elements, err := b.backend.ListSetElements(b.family, b.table, blocklistSetName(family))
+		if err != nil {
+			if isNotFoundErr(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list blocklist: %w", err)
+		}
+		for _, el := range elements {
+			if sp, ok := parseAddrSpan(el); ok {
+				spans = append(spans, sp)
+			}
+		}
+	}
+	return spans, nil
+}
+
+// parseAddress validates an address or CIDR to block
+func (b *BlocklistManager) parseAddress(addr string) (addrSpan, error) {
+	addr = strings.TrimSpace(addr)
+	sp, ok := parseAddrSpan(addr)
+	if !ok {
+		return addrSpan{}, fmt.Errorf("invalid address: %q (must be an address or CIDR)", addr)
+	}
+	for _, family := range b.nft.inputFamilies() {
+		if family == sp.family {
+			return sp, nil
+		}
+	}
+	return addrSpan{}, fmt.Errorf("address %s doesn't match the %s %s table", addr, b.family, b.table)
+}
+
+// queueSetup queues creating the blocklist sets and the chains dropping their
+// addresses; the drop rules are only added along with a new chain
+func (b *BlocklistManager) queueSetup(tx *Transaction) {
+	families := b.nft.inputFamilies()
+	tx.AddTable(b.family, b.table)
+	for _, family := range families {
+		keyType := "ipv4_addr"
+		if family == "ip6" {
+			keyType = "ipv6_addr"
+		}
+		tx.AddTimeoutSet(b.family, b.table, blocklistSetName(family), keyType)
+	}
+
+	for _, hook := range []string{"input", "forward"} {
+		chain := "blocklist_" + hook
+		exists := b.backend.ChainExists(b.family, b.table, chain)
+		tx.AddBaseChain(b.family, b.table, chain,
+			ChainSpec{Type: "filter", Hook: hook, Priority: blocklistPriority, Policy: "accept"})
+		if exists {
+			continue
+		}
+		// nft add rule inet filter blocklist_input ip saddr @blocklist drop comment "nft-ui blocklist"
+		for _, family := range families {
+			tx.AddRule(b.family, b.table, chain,
+				family, "saddr", "@"+blocklistSetName(family),
+				"drop",
+				"comment", fmt.Sprintf(`"%s"`, BlocklistComment))
+		}
+	}
+}
+
+// blocklistSetName returns the name of the blocklist set of a family
+func blocklistSetName(family string) string {
+	if family == "ip6" {
+		return "blocklist6"
+	}
+	return "blocklist"
+}
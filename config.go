@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"strconv"
 
@@ -18,10 +19,50 @@ type Config struct {
 	TableFamily          string `yaml:"table_family"`
 	TableName            string `yaml:"table_name"`
 	ChainName            string `yaml:"chain_name"`
+	IngressChainName     string `yaml:"ingress_chain_name"`
 	TokenSalt            string `yaml:"token_salt"`
 	PublicQueryEnabled   bool   `yaml:"public_query_enabled"`
 	DisabledForwardsPath string `yaml:"disabled_forwards_path"`
 	RulesetPath          string `yaml:"ruleset_path"`
+	Backend              string `yaml:"backend"`
+	SchedulesPath        string `yaml:"schedules_path"`
+	LedgerPath           string `yaml:"ledger_path"`
+	HistoryPath          string `yaml:"history_path"`
+	HistoryInterval      int    `yaml:"history_interval"`
+	HistoryRetentionDays int    `yaml:"history_retention_days"`
+	MetricsEnabled       bool   `yaml:"metrics_enabled"`
+	MetricsListenAddr    string `yaml:"metrics_listen_addr"`
+	MetricsAuthUser      string `yaml:"metrics_auth_user"`
+	MetricsAuthPassword  string `yaml:"metrics_auth_password"`
+	QuotaMetaPath        string `yaml:"quota_meta_path"`
+
+	// Default quota status thresholds (percent of the limit), overridable per quota
+	WarningPercent  float64 `yaml:"warning_percent"`
+	ExceededPercent float64 `yaml:"exceeded_percent"`
+
+	// Alerting
+	AlertsPath      string          `yaml:"alerts_path"`
+	AlertInterval   int             `yaml:"alert_interval"`
+	AlertThresholds []float64       `yaml:"alert_thresholds"`
+	Webhooks        []WebhookConfig `yaml:"webhooks"`
+
+	// Forward health checks
+	HealthChecksPath    string `yaml:"health_checks_path"`
+	HealthCheckInterval int    `yaml:"health_check_interval"`
+	HealthCheckTimeout  int    `yaml:"health_check_timeout"`
+
+	// Forward destination hostnames
+	ForwardMetaPath string `yaml:"forward_meta_path"`
+	ResolveInterval int    `yaml:"resolve_interval"`
+}
+
+// WebhookConfig describes a webhook that receives alert events
+type WebhookConfig struct {
+	Name     string            `yaml:"name"`
+	URL      string            `yaml:"url"`
+	Events   []string          `yaml:"events"`   // empty = all events
+	Headers  map[string]string `yaml:"headers"`  // extra request headers, e.g. Authorization
+	Template string            `yaml:"template"` // Go text/template for the body, empty = event as JSON
 }
 
 // DefaultConfig returns the default configuration
@@ -36,10 +77,33 @@ func DefaultConfig() *Config {
 		TableFamily:          "inet",
 		TableName:            "filter",
 		ChainName:            "output",
+		IngressChainName:     "input_quota",
 		TokenSalt:            "",
 		PublicQueryEnabled:   false,
 		DisabledForwardsPath: "/var/lib/nft-ui/disabled-forwards.json",
 		RulesetPath:          "/var/lib/nft-ui/ruleset.nft",
+		Backend:              "netlink",
+		SchedulesPath:        "/var/lib/nft-ui/reset-schedules.json",
+		LedgerPath:           "/var/lib/nft-ui/quota-ledger.json",
+		HistoryPath:          "/var/lib/nft-ui/history.db",
+		HistoryInterval:      60,
+		HistoryRetentionDays: 90,
+		MetricsEnabled:       false,
+		MetricsListenAddr:    "",
+		MetricsAuthUser:      "",
+		MetricsAuthPassword:  "",
+		QuotaMetaPath:        "/var/lib/nft-ui/quota-meta.json",
+		WarningPercent:       70,
+		ExceededPercent:      100,
+		AlertsPath:           "/var/lib/nft-ui/alerts.json",
+		AlertInterval:        60,
+		AlertThresholds:      nil,
+		Webhooks:             nil,
+		HealthChecksPath:     "/var/lib/nft-ui/health-checks.json",
+		HealthCheckInterval:  10,
+		HealthCheckTimeout:   3,
+		ForwardMetaPath:      "/var/lib/nft-ui/forward-meta.json",
+		ResolveInterval:      300,
 	}
 }
 
@@ -94,6 +158,9 @@ func LoadConfig() (*Config, error) {
 	if v := os.Getenv("NFT_UI_CHAIN_NAME"); v != "" {
 		cfg.ChainName = v
 	}
+	if v := os.Getenv("NFT_UI_INGRESS_CHAIN_NAME"); v != "" {
+		cfg.IngressChainName = v
+	}
 	if v := os.Getenv("NFT_UI_TOKEN_SALT"); v != "" {
 		cfg.TokenSalt = v
 	}
@@ -106,6 +173,96 @@ func LoadConfig() (*Config, error) {
 	if v := os.Getenv("NFT_UI_RULESET_PATH"); v != "" {
 		cfg.RulesetPath = v
 	}
+	if v := os.Getenv("NFT_UI_BACKEND"); v != "" {
+		cfg.Backend = v
+	}
+	if v := os.Getenv("NFT_UI_SCHEDULES_PATH"); v != "" {
+		cfg.SchedulesPath = v
+	}
+	if v := os.Getenv("NFT_UI_LEDGER_PATH"); v != "" {
+		cfg.LedgerPath = v
+	}
+	if v := os.Getenv("NFT_UI_HISTORY_PATH"); v != "" {
+		cfg.HistoryPath = v
+	}
+	if v := os.Getenv("NFT_UI_HISTORY_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.HistoryInterval = n
+		}
+	}
+	if v := os.Getenv("NFT_UI_HISTORY_RETENTION_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			cfg.HistoryRetentionDays = n
+		}
+	}
+	if v := os.Getenv("NFT_UI_METRICS"); v != "" {
+		cfg.MetricsEnabled = v == "true" || v == "1"
+	}
+	if v := os.Getenv("NFT_UI_METRICS_LISTEN_ADDR"); v != "" {
+		cfg.MetricsListenAddr = v
+	}
+	if v := os.Getenv("NFT_UI_METRICS_AUTH_USER"); v != "" {
+		cfg.MetricsAuthUser = v
+	}
+	if v := os.Getenv("NFT_UI_METRICS_AUTH_PASSWORD"); v != "" {
+		cfg.MetricsAuthPassword = v
+	}
+	if v := os.Getenv("NFT_UI_QUOTA_META_PATH"); v != "" {
+		cfg.QuotaMetaPath = v
+	}
+	if v := os.Getenv("NFT_UI_WARNING_PERCENT"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			cfg.WarningPercent = f
+		}
+	}
+	if v := os.Getenv("NFT_UI_EXCEEDED_PERCENT"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			cfg.ExceededPercent = f
+		}
+	}
+	if v := os.Getenv("NFT_UI_ALERTS_PATH"); v != "" {
+		cfg.AlertsPath = v
+	}
+	if v := os.Getenv("NFT_UI_ALERT_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.AlertInterval = n
+		}
+	}
+	if v := os.Getenv("NFT_UI_ALERT_WEBHOOK_URL"); v != "" {
+		cfg.Webhooks = append(cfg.Webhooks, WebhookConfig{Name: "env", URL: v})
+	}
+
+	if v := os.Getenv("NFT_UI_HEALTH_CHECKS_PATH"); v != "" {
+		cfg.HealthChecksPath = v
+	}
+	if v := os.Getenv("NFT_UI_HEALTH_CHECK_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.HealthCheckInterval = n
+		}
+	}
+	if v := os.Getenv("NFT_UI_HEALTH_CHECK_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.HealthCheckTimeout = n
+		}
+	}
+
+	if v := os.Getenv("NFT_UI_FORWARD_META_PATH"); v != "" {
+		cfg.ForwardMetaPath = v
+	}
+	if v := os.Getenv("NFT_UI_RESOLVE_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.ResolveInterval = n
+		}
+	}
+
+	if cfg.Backend != "netlink" && cfg.Backend != "exec" {
+		return nil, fmt.Errorf("invalid backend %q: must be netlink or exec", cfg.Backend)
+	}
+
+	t := QuotaThresholds{WarningPercent: cfg.WarningPercent, ExceededPercent: cfg.ExceededPercent}
+	if err := t.validate(); err != nil {
+		return nil, fmt.Errorf("invalid quota thresholds: %w", err)
+	}
 
 	return cfg, nil
 }
@@ -115,6 +272,11 @@ func (c *Config) AuthEnabled() bool {
 	return c.AuthUser != "" && c.AuthPassword != ""
 }
 
+// MetricsAuthEnabled returns true if /metrics has its own credentials
+func (c *Config) MetricsAuthEnabled() bool {
+	return c.MetricsAuthUser != "" && c.MetricsAuthPassword != ""
+}
+
 // TokenEnabled returns true if token-based query is properly configured
 func (c *Config) TokenEnabled() bool {
 	return c.TokenSalt != "" && c.PublicQueryEnabled
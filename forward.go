@@ -1,15 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,64 +21,194 @@ import (
 // ForwardingComment is the prefix used to identify forwarding rules managed by nft-ui
 const ForwardingComment = "nft-ui fwd"
 
+// Load balancing modes of a forward with several backends
+const (
+	BalanceRandom     = "random"      // numgen random: each new connection picks a backend by weight
+	BalanceRoundRobin = "round-robin" // numgen inc: backends take turns, by weight
+	BalanceSourceHash = "source-hash" // jhash of the client address: a client keeps its backend
+)
+
+// Source NAT modes of a forward, applied in postrouting to traffic sent to its destinations
+const (
+	SnatMasquerade = "masquerade" // rewrite the client address to the outgoing interface's address
+	SnatPrefix     = "snat:"      // "snat:<ip>": rewrite the client address to a fixed local address
+	SnatNone       = "none"       // keep client addresses, the destination must route replies back through this host
+)
+
+// maxBackendWeight caps a backend's weight; each unit is one element of the DNAT map
+const maxBackendWeight = 100
+
+// resolveTimeout bounds the DNS lookup of a forward's destination hostname
+const resolveTimeout = 5 * time.Second
+
+// hostnameRegex matches a DNS hostname
+var hostnameRegex = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
+
+// interfaceRegex matches a network interface name (IFNAMSIZ is 16 with the NUL)
+var interfaceRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// forwardFamilies are the table families forwards are written to: ip for IPv4
+// destinations and ip6 for IPv6 destinations
+var forwardFamilies = []string{"ip", "ip6"}
+
 // ForwardingManager handles port forwarding (DNAT + MASQUERADE) operations
 type ForwardingManager struct {
-	mu                  sync.Mutex
-	binary              string
+	mu                   sync.Mutex
+	backend              Backend
 	disabledForwardsPath string
+	meta                 *ForwardMetaStore
+	nft                  *NFTManager // rebuilds the forward chain quotas of re-pointed forwards
+
+	// lookupIP resolves destination hostnames, replaceable by a stub resolver
+	lookupIP func(ctx context.Context, host string) ([]net.IP, error)
 }
 
 // NewForwardingManager creates a new ForwardingManager
-func NewForwardingManager(cfg *Config) *ForwardingManager {
+func NewForwardingManager(cfg *Config, backend Backend) *ForwardingManager {
 	path := cfg.DisabledForwardsPath
 	if path == "" {
 		path = "/var/lib/nft-ui/disabled-forwards.json"
 	}
 	return &ForwardingManager{
-		binary:              cfg.NFTBinary,
+		backend:              backend,
 		disabledForwardsPath: path,
+		lookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			return net.DefaultResolver.LookupIP(ctx, "ip", host)
+		},
 	}
 }
 
-// execNFT executes an nft command and returns the output
-func (m *ForwardingManager) execNFT(args ...string) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// SetForwardMetaStore sets the store holding per-forward settings such as destination hostnames
+func (m *ForwardingManager) SetForwardMetaStore(meta *ForwardMetaStore) {
+	m.meta = meta
+}
+
+// SetNFTManager sets the quota manager whose forward chain quotas follow edited forwards
+func (m *ForwardingManager) SetNFTManager(nft *NFTManager) {
+	m.nft = nft
+}
+
+// ResolveHost resolves a destination hostname to its first IPv4 address, or
+// its first IPv6 address if it has no IPv4 one
+func (m *ForwardingManager) ResolveHost(host string) (string, error) {
+	if len(host) > 253 || !hostnameRegex.MatchString(host) {
+		return "", fmt.Errorf("invalid hostname: %q", host)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
 	defer cancel()
+	ips, err := m.lookupIP(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	var ip6 string
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.String(), nil
+		}
+		if ip6 == "" {
+			ip6 = ip.String()
+		}
+	}
+	if ip6 == "" {
+		return "", fmt.Errorf("failed to resolve %s: no addresses", host)
+	}
+	return ip6, nil
+}
 
-	cmd := exec.CommandContext(ctx, m.binary, args...)
-	output, err := cmd.CombinedOutput()
+// resolveDestination points a forward with a destination hostname at the
+// address the hostname resolves to now
+func (m *ForwardingManager) resolveDestination(rule *ForwardingRule) error {
+	if rule.DstHost == "" {
+		return nil
+	}
+	if len(rule.Backends) > 0 {
+		return errors.New("a destination hostname can't be combined with backends")
+	}
+	ip, err := m.ResolveHost(rule.DstHost)
 	if err != nil {
-		return nil, fmt.Errorf("nft %s: %w (output: %s)", strings.Join(args, " "), err, string(output))
+		return err
+	}
+	now := time.Now().Truncate(time.Second)
+	rule.DstIP = ip
+	rule.ResolvedAt = &now
+	rule.resolved = true
+	return nil
+}
+
+// saveHostMeta records the destination hostname of a forward, and its
+// address as the last resolved one if it was just resolved
+func (m *ForwardingManager) saveHostMeta(rule ForwardingRule) error {
+	if m.meta == nil {
+		return nil
+	}
+	if rule.DstHost == "" {
+		return m.meta.Delete(rule.ref())
+	}
+
+	meta, ok := m.meta.Get(rule.ref())
+	if !ok || meta.DstHost != rule.DstHost {
+		meta = ForwardMeta{Port: rule.SrcPort, Bind: rule.binding(), DstHost: rule.DstHost}
+	}
+	if rule.resolved {
+		meta.ResolvedIP = rule.DstIP
+		meta.ResolvedAt = rule.ResolvedAt
+		meta.ResolveError = ""
+	}
+	return m.meta.Set(meta)
+}
+
+// deleteHostMeta drops the destination hostname of a deleted forward, once
+// the forward is gone so a failed delete keeps it re-resolved
+func (m *ForwardingManager) deleteHostMeta(ref forwardRef) error {
+	if m.meta == nil {
+		return nil
+	}
+	if err := m.meta.Delete(ref); err != nil {
+		return fmt.Errorf("failed to delete forward metadata: %w", err)
+	}
+	return nil
+}
+
+// annotateHosts fills destination hostnames and their resolution time into forwards
+func (m *ForwardingManager) annotateHosts(rules []ForwardingRule) {
+	if m.meta == nil {
+		return
+	}
+	for i := range rules {
+		rules[i].DstHost, rules[i].ResolvedAt = "", nil
+		if meta, ok := m.meta.Get(rules[i].ref()); ok {
+			rules[i].DstHost = meta.DstHost
+			rules[i].ResolvedAt = meta.ResolvedAt
+		}
 	}
-	return output, nil
 }
 
-// EnsureFilterForwardSetup ensures the filter table and forward chain exist,
-// and that the established/related fast-path rule is present
-func (m *ForwardingManager) EnsureFilterForwardSetup() error {
+// EnsureFilterForwardSetup ensures the filter table and forward chain of a
+// family (ip or ip6) exist, and that the established/related fast-path rule is present
+func (m *ForwardingManager) EnsureFilterForwardSetup(family string) error {
 	// Check if filter table exists
-	_, err := m.execNFT("list", "table", "ip", "filter")
-	if err != nil {
+	if !m.backend.TableExists(family, "filter") {
 		// Create filter table
-		if _, err := m.execNFT("add", "table", "ip", "filter"); err != nil {
-			return fmt.Errorf("failed to create filter table: %w", err)
+		if err := m.backend.AddTable(family, "filter"); err != nil {
+			return fmt.Errorf("failed to create %s filter table: %w", family, err)
 		}
 	}
 
 	chainCreated := false
 	// Check if forward chain exists
-	_, err = m.execNFT("list", "chain", "ip", "filter", "forward")
-	if err != nil {
+	if !m.backend.ChainExists(family, "filter", "forward") {
 		// Create forward chain
-		if _, err := m.execNFT("add", "chain", "ip", "filter", "forward",
-			"{ type filter hook forward priority filter ; policy accept ; }"); err != nil {
-			return fmt.Errorf("failed to create forward chain: %w", err)
+		if err := m.backend.AddBaseChain(family, "filter", "forward",
+			ChainSpec{Type: "filter", Hook: "forward", Priority: 0, Policy: "accept"}); err != nil {
+			return fmt.Errorf("failed to create %s forward chain: %w", family, err)
 		}
 		chainCreated = true
 	}
 
 	// Ensure ct state established,related accept rule exists as fast-path
-	if err := m.ensureConntrackFastPath(chainCreated); err != nil {
+	if err := m.ensureConntrackFastPath(family, chainCreated); err != nil {
 		return err
 	}
 
@@ -85,21 +217,16 @@ func (m *ForwardingManager) EnsureFilterForwardSetup() error {
 
 // ensureConntrackFastPath ensures a "ct state established,related accept" rule
 // exists at the top of the forward chain for performance
-func (m *ForwardingManager) ensureConntrackFastPath(chainJustCreated bool) error {
+func (m *ForwardingManager) ensureConntrackFastPath(family string, chainJustCreated bool) error {
 	const ctComment = "nft-ui ct-fastpath"
 
 	if !chainJustCreated {
 		// Check if rule already exists
-		output, err := m.execNFT("-j", "-a", "list", "chain", "ip", "filter", "forward")
+		ruleset, err := m.backend.ListChain(family, "filter", "forward")
 		if err != nil {
 			return nil // best effort
 		}
 
-		var ruleset NFTRuleset
-		if err := json.Unmarshal(output, &ruleset); err != nil {
-			return nil
-		}
-
 		for _, obj := range ruleset.NFTables {
 			if obj.Rule == nil || obj.Rule.Chain != "forward" {
 				continue
@@ -111,7 +238,7 @@ func (m *ForwardingManager) ensureConntrackFastPath(chainJustCreated bool) error
 	}
 
 	// Insert at position 0 (top of chain)
-	if _, err := m.execNFT("insert", "rule", "ip", "filter", "forward",
+	if err := m.backend.InsertRule(family, "filter", "forward",
 		"ct", "state", "established,related",
 		"accept",
 		"comment", fmt.Sprintf(`"%s"`, ctComment)); err != nil {
@@ -121,44 +248,40 @@ func (m *ForwardingManager) ensureConntrackFastPath(chainJustCreated bool) error
 	return nil
 }
 
-// EnsureNatSetup ensures the nat table and required chains exist
-func (m *ForwardingManager) EnsureNatSetup() error {
-	// Check if nat table exists by trying to list it
-	_, err := m.execNFT("list", "table", "ip", "nat")
-	if err != nil {
+// EnsureNatSetup ensures the nat table of a family (ip or ip6) and its required chains exist
+func (m *ForwardingManager) EnsureNatSetup(family string) error {
+	// Check if nat table exists
+	if !m.backend.TableExists(family, "nat") {
 		// Table doesn't exist, create it
-		if _, err := m.execNFT("add", "table", "ip", "nat"); err != nil {
-			return fmt.Errorf("failed to create nat table: %w", err)
+		if err := m.backend.AddTable(family, "nat"); err != nil {
+			return fmt.Errorf("failed to create %s nat table: %w", family, err)
 		}
 	}
 
 	// Check if prerouting chain exists
-	_, err = m.execNFT("list", "chain", "ip", "nat", "prerouting")
-	if err != nil {
+	if !m.backend.ChainExists(family, "nat", "prerouting") {
 		// Create prerouting chain
-		if _, err := m.execNFT("add", "chain", "ip", "nat", "prerouting",
-			"{ type nat hook prerouting priority -100 ; policy accept ; }"); err != nil {
-			return fmt.Errorf("failed to create prerouting chain: %w", err)
+		if err := m.backend.AddBaseChain(family, "nat", "prerouting",
+			ChainSpec{Type: "nat", Hook: "prerouting", Priority: -100, Policy: "accept"}); err != nil {
+			return fmt.Errorf("failed to create %s prerouting chain: %w", family, err)
 		}
 	}
 
 	// Check if postrouting chain exists
-	_, err = m.execNFT("list", "chain", "ip", "nat", "postrouting")
-	if err != nil {
+	if !m.backend.ChainExists(family, "nat", "postrouting") {
 		// Create postrouting chain
-		if _, err := m.execNFT("add", "chain", "ip", "nat", "postrouting",
-			"{ type nat hook postrouting priority 100 ; policy accept ; }"); err != nil {
-			return fmt.Errorf("failed to create postrouting chain: %w", err)
+		if err := m.backend.AddBaseChain(family, "nat", "postrouting",
+			ChainSpec{Type: "nat", Hook: "postrouting", Priority: 100, Policy: "accept"}); err != nil {
+			return fmt.Errorf("failed to create %s postrouting chain: %w", family, err)
 		}
 	}
 
 	// Check if output chain exists
-	_, err = m.execNFT("list", "chain", "ip", "nat", "output")
-	if err != nil {
+	if !m.backend.ChainExists(family, "nat", "output") {
 		// Create output chain
-		if _, err := m.execNFT("add", "chain", "ip", "nat", "output",
-			"{ type nat hook output priority -100 ; policy accept ; }"); err != nil {
-			return fmt.Errorf("failed to create output chain: %w", err)
+		if err := m.backend.AddBaseChain(family, "nat", "output",
+			ChainSpec{Type: "nat", Hook: "output", Priority: -100, Policy: "accept"}); err != nil {
+			return fmt.Errorf("failed to create %s output chain: %w", family, err)
 		}
 	}
 
@@ -171,35 +294,30 @@ func (m *ForwardingManager) ListForwardingRules() ([]ForwardingRule, error) {
 	defer m.mu.Unlock()
 
 	// Ensure nat table exists
-	if err := m.EnsureNatSetup(); err != nil {
+	if err := m.EnsureNatSetup("ip"); err != nil {
 		return nil, err
 	}
 
-	// Get prerouting rules (DNAT)
-	preOutput, err := m.execNFT("-j", "-a", "list", "chain", "ip", "nat", "prerouting")
-	if err != nil {
-		return nil, fmt.Errorf("failed to list prerouting chain: %w", err)
-	}
-
-	// Get postrouting rules (MASQUERADE)
-	postOutput, err := m.execNFT("-j", "-a", "list", "chain", "ip", "nat", "postrouting")
-	if err != nil {
-		return nil, fmt.Errorf("failed to list postrouting chain: %w", err)
-	}
-
-	// Parse enabled rules from nftables
-	enabledRules, err := m.parseForwardingRules(preOutput, postOutput)
+	// Parse enabled rules from the ip and ip6 nat tables
+	enabledRules, err := m.readEnabledRules()
 	if err != nil {
 		return nil, err
 	}
 
-	// Get limit information from filter forward chain
+	// Get bandwidth and connection limits from filter forward chain
 	limitMap := m.extractLimitsFromForwardChain()
 
-	// Apply limits to enabled rules
+	// Get traffic counters from filter forward chain
+	counterMap := m.extractCountersFromForwardChain()
+
+	// Apply limits and counters to enabled rules
 	for i := range enabledRules {
-		if limit, ok := limitMap[enabledRules[i].SrcPort]; ok {
-			enabledRules[i].LimitMbps = limit
+		if limits, ok := limitMap[enabledRules[i].ref()]; ok {
+			limits.apply(&enabledRules[i])
+		}
+		if c, ok := counterMap[enabledRules[i].ref()]; ok {
+			enabledRules[i].Bytes = c.Bytes
+			enabledRules[i].Packets = c.Packets
 		}
 	}
 
@@ -212,79 +330,227 @@ func (m *ForwardingManager) ListForwardingRules() ([]ForwardingRule, error) {
 
 	// Merge enabled and disabled rules
 	allRules := append(enabledRules, disabledRules...)
+	m.annotateHosts(allRules)
 	return allRules, nil
 }
 
-// extractLimitsFromForwardChain extracts bandwidth limits from filter forward chain
-func (m *ForwardingManager) extractLimitsFromForwardChain() map[int]int {
-	limitMap := make(map[int]int)
-
-	output, err := m.execNFT("-j", "-a", "list", "chain", "ip", "filter", "forward")
+// GetForwardingRule returns the enabled or disabled forwarding rule with the given ID
+func (m *ForwardingManager) GetForwardingRule(id string) (*ForwardingRule, error) {
+	rules, err := m.ListForwardingRules()
 	if err != nil {
-		// Chain might not exist, return empty map
-		return limitMap
+		return nil, err
+	}
+	for i := range rules {
+		if rules[i].ID == id {
+			return &rules[i], nil
+		}
 	}
+	return nil, fmt.Errorf("forwarding rule not found: %s", id)
+}
+
+// readEnabledRules reads the forwards active in the ip and ip6 nat tables.
+// The IPv4 and IPv6 rules of a dual-stack forward are merged into one rule.
+func (m *ForwardingManager) readEnabledRules() ([]ForwardingRule, error) {
+	var rules []ForwardingRule
+	for _, family := range forwardFamilies {
+		// Get prerouting rules (DNAT)
+		preRuleset, err := m.backend.ListChain(family, "nat", "prerouting")
+		if err != nil {
+			// The ip6 nat table only exists once an IPv6 forward was added
+			if isNotFoundErr(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list %s prerouting chain: %w", family, err)
+		}
 
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(output, &ruleset); err != nil {
-		return limitMap
+		// Get postrouting rules (MASQUERADE)
+		postRuleset, err := m.backend.ListChain(family, "nat", "postrouting")
+		if err != nil {
+			postRuleset = &NFTRuleset{}
+		}
+
+		for _, rule := range m.parseForwardingRules(preRuleset, postRuleset) {
+			if rule.sourceSet != "" {
+				sources, err := m.backend.ListSetElements(family, "nat", rule.sourceSet)
+				if err != nil {
+					return nil, fmt.Errorf("failed to list allowed sources of forward %s: %w", rule.key(), err)
+				}
+				rule.Sources = sources
+			}
+			if family == "ip6" && rule.Managed {
+				if v4 := findManagedRule(rules, rule.ref()); v4 != nil && ipFamily(v4.DstIP) == "ip" {
+					v4.DstIP6 = rule.DstIP
+					v4.Sources = append(v4.Sources, rule.Sources...)
+					continue
+				}
+			}
+			rules = append(rules, rule)
+		}
 	}
+	return rules, nil
+}
 
-	for _, obj := range ruleset.NFTables {
-		if obj.Rule == nil || obj.Rule.Chain != "forward" {
-			continue
+// findManagedRule returns the managed forward identified by ref, or nil
+func findManagedRule(rules []ForwardingRule, ref forwardRef) *ForwardingRule {
+	for i := range rules {
+		if rules[i].Managed && rules[i].ref() == ref {
+			return &rules[i]
 		}
+	}
+	return nil
+}
 
-		// Only process rules with our comment
-		if !strings.HasPrefix(obj.Rule.Comment, ForwardingComment) {
+// listManagedForwardRules returns the managed rules of the ip and ip6 filter forward chains
+func (m *ForwardingManager) listManagedForwardRules() []*NFTRule {
+	var rules []*NFTRule
+	for _, family := range forwardFamilies {
+		ruleset, err := m.backend.ListChain(family, "filter", "forward")
+		if err != nil {
+			// Chain might not exist
 			continue
 		}
+		for _, obj := range ruleset.NFTables {
+			if obj.Rule == nil || obj.Rule.Chain != "forward" {
+				continue
+			}
+			// Only process rules with our comment
+			if strings.HasPrefix(obj.Rule.Comment, ForwardingComment) {
+				rules = append(rules, obj.Rule)
+			}
+		}
+	}
+	return rules
+}
+
+// forwardLimits are the limits of a forward kept in the filter forward chains
+type forwardLimits struct {
+	mbps  int // LimitMbps
+	conns int // MaxConns
+	perIP int // MaxPerIP
+}
+
+// apply copies the limits to a forwarding rule
+func (l forwardLimits) apply(r *ForwardingRule) {
+	r.LimitMbps = l.mbps
+	r.MaxConns = l.conns
+	r.MaxPerIP = l.perIP
+}
 
-		// Extract source port from comment
-		srcPort := m.extractSrcPortFromComment(obj.Rule.Comment)
-		if srcPort == 0 {
+// extractLimitsFromForwardChain extracts bandwidth and connection limits from the filter forward chains
+func (m *ForwardingManager) extractLimitsFromForwardChain() map[forwardRef]forwardLimits {
+	limitMap := make(map[forwardRef]forwardLimits)
+
+	for _, rule := range m.listManagedForwardRules() {
+		// Extract the forward from the comment
+		ref, ok := m.extractForwardRef(rule.Comment)
+		if !ok {
 			continue
 		}
 
-		// Look for limit expression
-		for _, expr := range obj.Rule.Expr {
+		l := limitMap[ref]
+		for _, expr := range rule.Expr {
+			// Look for limit expression
 			if limitData, ok := expr["limit"]; ok {
 				if lm, ok := limitData.(map[string]interface{}); ok {
 					if rate, ok := lm["rate"].(float64); ok {
 						// Convert kbytes/second back to Mbps
 						// rate is in kbytes/s, convert: kbytes/s * 8 / 1000 = Mbps
-						limitMbps := int((rate * 8) / 1000)
-						limitMap[srcPort] = limitMbps
-						break
+						l.mbps = int((rate * 8) / 1000)
 					}
 				}
 			}
+			// A connection count of its own limits the whole forward
+			if n, ok := ctCount(expr); ok {
+				l.conns = n
+			}
+		}
+		if n := perIPLimit(rule); n > 0 {
+			l.perIP = n
 		}
+		limitMap[ref] = l
 	}
 
 	return limitMap
 }
 
-// parseForwardingRules parses JSON output from prerouting and postrouting chains
-func (m *ForwardingManager) parseForwardingRules(preData, postData []byte) ([]ForwardingRule, error) {
-	var preRuleset, postRuleset NFTRuleset
-	if err := json.Unmarshal(preData, &preRuleset); err != nil {
-		return nil, fmt.Errorf("failed to parse prerouting JSON: %w", err)
+// perIPLimit returns the connection limit a rule keeps per client address in
+// a set (nft may list it as a meter), 0 if it has none
+func perIPLimit(rule *NFTRule) int {
+	for _, expr := range rule.Expr {
+		for _, key := range []string{"set", "meter"} {
+			if n, ok := ctCount(expr[key]); ok {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// ctCount finds the limit of a "ct count" statement in an expression of a rule
+// or nested in a set or meter statement
+func ctCount(v interface{}) (int, bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if cc, ok := v["ct count"].(map[string]interface{}); ok {
+			if val, ok := cc["val"].(float64); ok {
+				return int(val), true
+			}
+		}
+		if stmt, ok := v["stmt"]; ok {
+			return ctCount(stmt)
+		}
+	case []interface{}:
+		for _, e := range v {
+			if n, ok := ctCount(e); ok {
+				return n, true
+			}
+		}
 	}
-	if err := json.Unmarshal(postData, &postRuleset); err != nil {
-		return nil, fmt.Errorf("failed to parse postrouting JSON: %w", err)
+	return 0, false
+}
+
+// extractCountersFromForwardChain sums the counter rules of each forward in the filter forward chains
+func (m *ForwardingManager) extractCountersFromForwardChain() map[forwardRef]ForwardCounters {
+	counterMap := make(map[forwardRef]ForwardCounters)
+
+	for _, rule := range m.listManagedForwardRules() {
+		ref, ok := m.extractForwardRef(rule.Comment)
+		if !ok {
+			continue
+		}
+
+		for _, expr := range rule.Expr {
+			if counterData, ok := expr["counter"]; ok {
+				if cm, ok := counterData.(map[string]interface{}); ok {
+					c := counterMap[ref]
+					if b, ok := cm["bytes"].(float64); ok {
+						c.Bytes += int64(b)
+					}
+					if p, ok := cm["packets"].(float64); ok {
+						c.Packets += int64(p)
+					}
+					counterMap[ref] = c
+				}
+			}
+		}
 	}
 
-	// Build a map of postrouting handles by srcPort for managed rules
-	postHandles := make(map[int]int64)
+	return counterMap
+}
+
+// parseForwardingRules extracts forwarding rules from prerouting and postrouting chain listings
+func (m *ForwardingManager) parseForwardingRules(preRuleset, postRuleset *NFTRuleset) []ForwardingRule {
+	// Build maps of postrouting handles and source NAT modes by forward for managed rules
+	postHandles := make(map[forwardRef]int64)
+	snatModes := make(map[forwardRef]string)
 	for _, obj := range postRuleset.NFTables {
 		if obj.Rule == nil || obj.Rule.Chain != "postrouting" {
 			continue
 		}
 		if strings.HasPrefix(obj.Rule.Comment, ForwardingComment) {
-			srcPort := m.extractSrcPortFromComment(obj.Rule.Comment)
-			if srcPort > 0 {
-				postHandles[srcPort] = obj.Rule.Handle
+			if ref, ok := m.extractForwardRef(obj.Rule.Comment); ok {
+				postHandles[ref] = obj.Rule.Handle
+				snatModes[ref] = extractSnatMode(obj.Rule)
 			}
 		}
 	}
@@ -305,9 +571,11 @@ func (m *ForwardingManager) parseForwardingRules(preData, postData []byte) ([]Fo
 			// Check if this is a managed rule (has our comment)
 			if strings.HasPrefix(obj.Rule.Comment, ForwardingComment) {
 				rule.Managed = true
-				// Try to find matching postrouting handle
-				if handle, ok := postHandles[rule.SrcPort]; ok {
+				// Try to find matching postrouting handle, a forward without one doesn't NAT sources
+				rule.SnatMode = SnatNone
+				if handle, ok := postHandles[rule.ref()]; ok {
 					rule.PostHandle = handle
+					rule.SnatMode = snatModes[rule.ref()]
 				}
 			} else {
 				rule.Managed = false
@@ -317,26 +585,43 @@ func (m *ForwardingManager) parseForwardingRules(preData, postData []byte) ([]Fo
 		}
 	}
 
-	return rules, nil
+	return rules
+}
+
+// extractSnatMode returns the source NAT mode of a postrouting rule: "masquerade" or "snat:<ip>"
+func extractSnatMode(rule *NFTRule) string {
+	for _, e := range rule.Expr {
+		if snat, ok := e["snat"].(map[string]interface{}); ok {
+			if addr, ok := snat["addr"].(string); ok {
+				return SnatPrefix + addr
+			}
+		}
+	}
+	return SnatMasquerade
 }
 
-// extractSrcPortFromComment extracts source port from comment like "nft-ui fwd 12103 some comment"
-func (m *ForwardingManager) extractSrcPortFromComment(comment string) int {
+// extractForwardRef extracts the forward from a comment like "nft-ui fwd 12103 some comment"
+// or "nft-ui fwd 443@192.0.2.1". For a range like "nft-ui fwd 30000-30100" it refers to the first port.
+func (m *ForwardingManager) extractForwardRef(comment string) (forwardRef, bool) {
 	parts := strings.Fields(comment)
 	if len(parts) >= 3 {
-		port, err := strconv.Atoi(parts[2])
+		ref, err := parseForwardKey(parts[2])
 		if err == nil {
-			return port
+			return ref, true
 		}
 	}
-	return 0
+	return forwardRef{}, false
 }
 
 // extractForwardingRule extracts forwarding rule info from a prerouting DNAT rule
 func (m *ForwardingManager) extractForwardingRule(rule *NFTRule) *ForwardingRule {
-	var srcPort, dstPort int
+	var srcPort, srcPortEnd, dstPort int
 	var dstIP string
+	var backends []ForwardBackend
+	var balance string
 	var protocol string
+	var sourceSet string
+	var iface, listenIP string
 
 	for _, expr := range rule.Expr {
 		// Look for protocol meta match
@@ -344,6 +629,12 @@ func (m *ForwardingManager) extractForwardingRule(rule *NFTRule) *ForwardingRule
 			if mm, ok := metaData.(map[string]interface{}); ok {
 				if left, ok := mm["left"].(map[string]interface{}); ok {
 					if meta, ok := left["meta"].(map[string]interface{}); ok {
+						// Check for an interface binding (iifname "eth0")
+						if key, ok := meta["key"].(string); ok && key == "iifname" {
+							if right, ok := mm["right"].(string); ok {
+								iface = right
+							}
+						}
 						if key, ok := meta["key"].(string); ok && key == "l4proto" {
 							// Check for protocol set
 							if right, ok := mm["right"].(map[string]interface{}); ok {
@@ -375,6 +666,20 @@ func (m *ForwardingManager) extractForwardingRule(rule *NFTRule) *ForwardingRule
 						if field, ok := payload["field"].(string); ok && field == "dport" {
 							if right, ok := mm["right"].(float64); ok {
 								srcPort = int(right)
+							} else if first, last, ok := rangeBounds(mm["right"]); ok {
+								srcPort, srcPortEnd = first, last
+							}
+						}
+						// Check for a client allowlist (ip saddr @set)
+						if field, ok := payload["field"].(string); ok && field == "saddr" {
+							if right, ok := mm["right"].(string); ok && strings.HasPrefix(right, "@") {
+								sourceSet = strings.TrimPrefix(right, "@")
+							}
+						}
+						// Check for a listen address binding (ip daddr 192.0.2.1)
+						if field, ok := payload["field"].(string); ok && field == "daddr" {
+							if right, ok := mm["right"].(string); ok && ipFamily(right) != "" {
+								listenIP = right
 							}
 						}
 					}
@@ -387,9 +692,14 @@ func (m *ForwardingManager) extractForwardingRule(rule *NFTRule) *ForwardingRule
 			if dm, ok := dnatData.(map[string]interface{}); ok {
 				if addr, ok := dm["addr"].(string); ok {
 					dstIP = addr
+				} else if b, mode := parseBalanceMap(dm["addr"]); len(b) > 0 {
+					backends, balance = b, mode
+					dstIP = b[0].IP
 				}
 				if port, ok := dm["port"].(float64); ok {
 					dstPort = int(port)
+				} else if first, _, ok := rangeBounds(dm["port"]); ok {
+					dstPort = first
 				}
 			}
 		}
@@ -401,7 +711,7 @@ func (m *ForwardingManager) extractForwardingRule(rule *NFTRule) *ForwardingRule
 			if matchData, ok := expr["match"]; ok {
 				if mm, ok := matchData.(map[string]interface{}); ok {
 					if left, ok := mm["left"].(map[string]interface{}); ok {
-						if payload, ok := left["payload"].(map[string]interface{}); ok {
+						if payload, ok := left["payload"].(map[string]interface{}); ok && payload["field"] == "dport" {
 							if proto, ok := payload["protocol"].(string); ok {
 								protocol = proto
 							}
@@ -433,381 +743,896 @@ func (m *ForwardingManager) extractForwardingRule(rule *NFTRule) *ForwardingRule
 		userComment = rule.Comment
 	}
 
-	return &ForwardingRule{
-		ID:       fmt.Sprintf("fwd_%d", srcPort),
-		SrcPort:  srcPort,
-		DstIP:    dstIP,
-		DstPort:  dstPort,
-		Protocol: protocol,
-		Comment:  userComment,
+	fwd := &ForwardingRule{
+		SrcPort:    srcPort,
+		SrcPortEnd: srcPortEnd,
+		Interface:  iface,
+		ListenIP:   listenIP,
+		DstIP:      dstIP,
+		Backends:   backends,
+		Balance:    balance,
+		DstPort:    dstPort,
+		Protocol:   protocol,
+		Comment:    userComment,
+		sourceSet:  sourceSet,
 		// LimitMbps will be filled by extractLimitsFromForwardChain()
 	}
+	fwd.ID = fwd.forwardingID()
+	return fwd
 }
 
-// AddForwardingRule adds a new port forwarding rule
-func (m *ForwardingManager) AddForwardingRule(srcPort int, dstIP string, dstPort int, protocol string, comment string, limitMbps int) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// parseBalanceMap parses the address of a load-balanced DNAT rule, a numgen
+// or jhash map like {"map": {"key": {"numgen": ...}, "data": {"set": [[0, "10.0.0.2"], ...]}}},
+// into backends weighted by their number of map elements and the balance mode
+func parseBalanceMap(v interface{}) ([]ForwardBackend, string) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, ""
+	}
+	mm, ok := m["map"].(map[string]interface{})
+	if !ok {
+		return nil, ""
+	}
+
+	key, _ := mm["key"].(map[string]interface{})
+	var balance string
+	if ng, ok := key["numgen"].(map[string]interface{}); ok {
+		balance = BalanceRandom
+		if ng["mode"] == "inc" {
+			balance = BalanceRoundRobin
+		}
+	} else if _, ok := key["jhash"]; ok {
+		balance = BalanceSourceHash
+	} else {
+		return nil, ""
+	}
+
+	data, _ := mm["data"].(map[string]interface{})
+	elements, _ := data["set"].([]interface{})
+	var backends []ForwardBackend
+	index := make(map[string]int)
+	for _, el := range elements {
+		pair, ok := el.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		addr, ok := pair[1].(string)
+		if !ok {
+			continue
+		}
+		if i, ok := index[addr]; ok {
+			backends[i].Weight++
+			continue
+		}
+		index[addr] = len(backends)
+		backends = append(backends, ForwardBackend{IP: addr, Weight: 1})
+	}
+	return backends, balance
+}
 
-	// Validate inputs
-	if srcPort < 1 || srcPort > 65535 {
-		return fmt.Errorf("invalid source port: %d", srcPort)
+// rangeBounds returns the bounds of a decoded {"range": [first, last]} value
+func rangeBounds(v interface{}) (int, int, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return 0, 0, false
 	}
-	if dstPort < 1 || dstPort > 65535 {
-		return fmt.Errorf("invalid destination port: %d", dstPort)
+	bounds, ok := m["range"].([]interface{})
+	if !ok || len(bounds) != 2 {
+		return 0, 0, false
 	}
-	if !isValidIPv4(dstIP) {
-		return fmt.Errorf("invalid destination IP: %s", dstIP)
+	first, ok1 := bounds[0].(float64)
+	last, ok2 := bounds[1].(float64)
+	if !ok1 || !ok2 {
+		return 0, 0, false
 	}
-	if protocol != "tcp" && protocol != "udp" && protocol != "both" {
-		return fmt.Errorf("invalid protocol: %s", protocol)
+	return int(first), int(last), true
+}
+
+// AddForwardingRule adds a new port forwarding rule. DstIP may be IPv4 or IPv6;
+// an IPv4 forward can also take an IPv6 DstIP6 for IPv6 clients. A SrcPortEnd
+// above SrcPort forwards the whole range SrcPort-SrcPortEnd to the same ports,
+// and several Backends spread new connections over the backends by weight.
+func (m *ForwardingManager) AddForwardingRule(rule ForwardingRule) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Resolve the destination hostname unless the caller already did
+	if rule.DstHost != "" && rule.DstIP == "" {
+		if err := m.resolveDestination(&rule); err != nil {
+			return err
+		}
 	}
 
-	// Sanitize comment
-	comment = sanitizeComment(comment)
+	// Validate inputs and sanitize comment
+	if err := rule.normalize(); err != nil {
+		return err
+	}
 
-	// Ensure nat table exists
-	if err := m.EnsureNatSetup(); err != nil {
+	// Ensure nat table and filter forward chain exist
+	if err := m.ensureSetup(rule); err != nil {
 		return err
 	}
 
-	// Check for duplicate source port
-	preOutput, _ := m.execNFT("-j", "-a", "list", "chain", "ip", "nat", "prerouting")
-	postOutput, _ := m.execNFT("-j", "-a", "list", "chain", "ip", "nat", "postrouting")
-	existingRules, _ := m.parseForwardingRules(preOutput, postOutput)
+	// Check for source ports used by another forward
+	existingRules := m.listEnabledRules()
 	for _, r := range existingRules {
-		if r.SrcPort == srcPort {
-			return fmt.Errorf("source port %d is already in use", srcPort)
+		if r.overlaps(rule) {
+			return fmt.Errorf("source port %s is already in use by forward %s", rule.srcPorts(), r.key())
 		}
 	}
 
 	// Also check disabled rules
 	disabledRules, _ := m.loadDisabledRules()
 	for _, r := range disabledRules {
-		if r.SrcPort == srcPort {
-			return fmt.Errorf("source port %d is already in use (disabled rule)", srcPort)
+		if r.overlaps(rule) {
+			return fmt.Errorf("source port %s is already in use by forward %s (disabled rule)", rule.srcPorts(), r.key())
 		}
 	}
 
-	// Validate limit
-	if limitMbps < 0 {
-		return fmt.Errorf("invalid limit: %d (must be >= 0)", limitMbps)
+	// Add all rules in one transaction
+	tx := &Transaction{}
+	m.queueForwardingRules(tx, rule)
+	if err := m.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to add forwarding rules: %w", err)
 	}
 
-	// Build comment string
-	fullComment := fmt.Sprintf("%s %d", ForwardingComment, srcPort)
-	if comment != "" {
-		fullComment = fmt.Sprintf("%s %s", fullComment, comment)
-	}
+	return m.saveHostMeta(rule)
+}
 
-	// Add prerouting DNAT rule
-	if err := m.addDNATRule(srcPort, dstIP, dstPort, protocol, fullComment, limitMbps); err != nil {
-		return fmt.Errorf("failed to add DNAT rule: %w", err)
+// ensureSetup ensures the nat tables and filter forward chains used by a forward exist
+func (m *ForwardingManager) ensureSetup(rule ForwardingRule) error {
+	for _, dstIP := range rule.destinations() {
+		family := ipFamily(dstIP)
+		if err := m.EnsureNatSetup(family); err != nil {
+			return err
+		}
+		if err := m.EnsureFilterForwardSetup(family); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Add postrouting MASQUERADE rule
-	if err := m.addMasqueradeRule(dstIP, dstPort, protocol, fullComment); err != nil {
-		// Rollback: delete the DNAT rule
-		m.deleteDNATRuleBySrcPort(srcPort)
-		return fmt.Errorf("failed to add MASQUERADE rule: %w", err)
+// lastSrcPort returns the last source port of a forward, SrcPort unless it forwards a range
+func (r *ForwardingRule) lastSrcPort() int {
+	if r.SrcPortEnd > r.SrcPort {
+		return r.SrcPortEnd
 	}
+	return r.SrcPort
+}
 
-	// Add output DNAT rule for local traffic
-	if err := m.addOutputDNATRule(srcPort, dstIP, dstPort, protocol, fullComment, limitMbps); err != nil {
-		// Rollback: delete previous rules
-		m.deleteDNATRuleBySrcPort(srcPort)
-		m.deleteMasqueradeRuleBySrcPort(srcPort)
-		return fmt.Errorf("failed to add output DNAT rule: %w", err)
-	}
+// srcPorts returns the source port or port range in nft syntax ("8080" or "30000-30100")
+func (r *ForwardingRule) srcPorts() string {
+	return formatPortRange(r.SrcPort, r.lastSrcPort())
+}
 
-	// Add bandwidth limit rules in filter forward chain (if limit > 0)
-	if err := m.addForwardLimitRules(dstIP, dstPort, protocol, fullComment, limitMbps); err != nil {
-		// Rollback: delete previous rules
-		m.deleteDNATRuleBySrcPort(srcPort)
-		m.deleteMasqueradeRuleBySrcPort(srcPort)
-		m.deleteOutputDNATRuleBySrcPort(srcPort)
-		return fmt.Errorf("failed to add forward limit rules: %w", err)
-	}
+// dstPorts returns the destination port or port range; a range is as long as the source range
+func (r *ForwardingRule) dstPorts() string {
+	return formatPortRange(r.DstPort, r.DstPort+r.lastSrcPort()-r.SrcPort)
+}
 
-	// Add TCP MSS clamping rule to prevent MTU-related stalls
-	if err := m.addMSSClampRule(dstIP, fullComment); err != nil {
-		// Rollback: delete previous rules
-		m.deleteDNATRuleBySrcPort(srcPort)
-		m.deleteMasqueradeRuleBySrcPort(srcPort)
-		m.deleteOutputDNATRuleBySrcPort(srcPort)
-		m.deleteForwardLimitRules(srcPort)
-		return fmt.Errorf("failed to add MSS clamp rule: %w", err)
-	}
+// forwardRef identifies a forward: its first source port and what it is bound to
+type forwardRef struct {
+	port int
+	bind string // binding(), empty for a forward on every interface and address
+}
 
-	return nil
+// String returns the first source port and binding of a forward, e.g. "443@192.0.2.1"
+func (r forwardRef) String() string {
+	return strconv.Itoa(r.port) + r.bind
 }
 
-// addDNATRule adds a prerouting DNAT rule (without limit - limit goes in filter forward)
-func (m *ForwardingManager) addDNATRule(srcPort int, dstIP string, dstPort int, protocol string, comment string, limitMbps int) error {
-	var args []string
+// binding returns what a forward is bound to: "+<interface>", "@<listen ip>",
+// both, or "" for a forward on every interface and address
+func (r *ForwardingRule) binding() string {
+	var bind string
+	if r.Interface != "" {
+		bind += "+" + r.Interface
+	}
+	if r.ListenIP != "" {
+		bind += "@" + r.ListenIP
+	}
+	return bind
+}
 
-	switch protocol {
-	case "tcp":
-		args = []string{
-			"add", "rule", "ip", "nat", "prerouting",
-			"tcp", "dport", strconv.Itoa(srcPort),
-			"dnat", "to", fmt.Sprintf("%s:%d", dstIP, dstPort),
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
-	case "udp":
-		args = []string{
-			"add", "rule", "ip", "nat", "prerouting",
-			"udp", "dport", strconv.Itoa(srcPort),
-			"dnat", "to", fmt.Sprintf("%s:%d", dstIP, dstPort),
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
-	default: // "both"
-		args = []string{
-			"add", "rule", "ip", "nat", "prerouting",
-			"meta", "l4proto", "{", "tcp,", "udp", "}",
-			"th", "dport", strconv.Itoa(srcPort),
-			"dnat", "to", fmt.Sprintf("%s:%d", dstIP, dstPort),
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
+// splitBinding returns the interface and listen IP of a binding()
+func splitBinding(bind string) (string, string) {
+	iface, listenIP := "", ""
+	if i := strings.Index(bind, "@"); i >= 0 {
+		bind, listenIP = bind[:i], bind[i+1:]
 	}
+	if strings.HasPrefix(bind, "+") {
+		iface = bind[1:]
+	}
+	return iface, listenIP
+}
 
-	_, err := m.execNFT(args...)
-	return err
+// ref returns the reference that identifies a forward
+func (r *ForwardingRule) ref() forwardRef {
+	return forwardRef{port: r.SrcPort, bind: r.binding()}
 }
 
-// addMasqueradeRule adds a postrouting MASQUERADE rule
-func (m *ForwardingManager) addMasqueradeRule(dstIP string, dstPort int, protocol string, comment string) error {
-	var args []string
+// key returns the source ports and binding of a forward, e.g. "8080", "30000-30100"
+// or "443+eth0@192.0.2.1", as used in its ID and rule comments
+func (r *ForwardingRule) key() string {
+	return r.srcPorts() + r.binding()
+}
 
-	switch protocol {
-	case "tcp":
-		args = []string{
-			"add", "rule", "ip", "nat", "postrouting",
-			"ip", "daddr", dstIP,
-			"tcp", "dport", strconv.Itoa(dstPort),
-			"masquerade",
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
-	case "udp":
-		args = []string{
-			"add", "rule", "ip", "nat", "postrouting",
-			"ip", "daddr", dstIP,
-			"udp", "dport", strconv.Itoa(dstPort),
-			"masquerade",
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
-	default: // "both"
-		args = []string{
-			"add", "rule", "ip", "nat", "postrouting",
-			"ip", "daddr", dstIP,
-			"meta", "l4proto", "{", "tcp,", "udp", "}",
-			"th", "dport", strconv.Itoa(dstPort),
-			"masquerade",
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
+// parseForwardKey parses the key() of a forward into its reference
+func parseForwardKey(key string) (forwardRef, error) {
+	ports, bind := key, ""
+	if i := strings.IndexAny(key, "+@"); i >= 0 {
+		ports, bind = key[:i], key[i:]
 	}
-
-	_, err := m.execNFT(args...)
-	return err
+	port, _, err := parsePortRange(ports)
+	if err != nil {
+		return forwardRef{}, err
+	}
+	return forwardRef{port: port, bind: bind}, nil
 }
 
-// addOutputDNATRule adds an output chain DNAT rule for local traffic (without limit)
-func (m *ForwardingManager) addOutputDNATRule(srcPort int, dstIP string, dstPort int, protocol string, comment string, limitMbps int) error {
-	var args []string
+// forwardingID returns the ID of a forward: "fwd_" and its key()
+func (r *ForwardingRule) forwardingID() string {
+	return "fwd_" + r.key()
+}
 
-	switch protocol {
-	case "tcp":
-		args = []string{
-			"add", "rule", "ip", "nat", "output",
-			"tcp", "dport", strconv.Itoa(srcPort),
-			"dnat", "to", fmt.Sprintf("%s:%d", dstIP, dstPort),
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
-	case "udp":
-		args = []string{
-			"add", "rule", "ip", "nat", "output",
-			"udp", "dport", strconv.Itoa(srcPort),
-			"dnat", "to", fmt.Sprintf("%s:%d", dstIP, dstPort),
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
-	default: // "both"
-		args = []string{
-			"add", "rule", "ip", "nat", "output",
-			"meta", "l4proto", "{", "tcp,", "udp", "}",
-			"th", "dport", strconv.Itoa(srcPort),
-			"dnat", "to", fmt.Sprintf("%s:%d", dstIP, dstPort),
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
+// overlaps reports whether two forwards can take the same traffic: they
+// share a source port and neither is bound to a different interface or
+// listen address than the other
+func (r *ForwardingRule) overlaps(other ForwardingRule) bool {
+	if r.Interface != "" && other.Interface != "" && r.Interface != other.Interface {
+		return false
 	}
-
-	_, err := m.execNFT(args...)
-	return err
+	if r.ListenIP != "" && other.ListenIP != "" && r.ListenIP != other.ListenIP {
+		return false
+	}
+	return r.SrcPort <= other.lastSrcPort() && other.SrcPort <= r.lastSrcPort()
 }
 
-// addMSSClampRule adds bidirectional TCP MSS clamping rules in filter forward chain to prevent MTU-related stalls
-func (m *ForwardingManager) addMSSClampRule(dstIP string, comment string) error {
-	// Ensure filter table and forward chain exist
-	if err := m.EnsureFilterForwardSetup(); err != nil {
+// normalize validates a new or edited forward, fills in defaults and sanitizes the comment
+func (r *ForwardingRule) normalize() error {
+	if r.DstHost != "" && len(r.Backends) > 0 {
+		return errors.New("a destination hostname can't be combined with backends")
+	}
+	if err := r.normalizeBackends(); err != nil {
 		return err
 	}
-
-	// Outbound: to destination
-	if _, err := m.execNFT("add", "rule", "ip", "filter", "forward",
-		"ip", "daddr", dstIP,
-		"tcp", "flags", "syn",
-		"tcp", "option", "maxseg", "size", "set", "1452",
-		"comment", fmt.Sprintf(`"%s"`, comment)); err != nil {
-		return fmt.Errorf("failed to add outbound MSS clamp rule: %w", err)
+	if err := r.validatePorts(); err != nil {
+		return err
 	}
-
-	// Inbound: SYN-ACK from destination
-	if _, err := m.execNFT("add", "rule", "ip", "filter", "forward",
-		"ip", "saddr", dstIP,
-		"tcp", "flags", "syn",
-		"tcp", "option", "maxseg", "size", "set", "1452",
-		"comment", fmt.Sprintf(`"%s"`, comment)); err != nil {
-		return fmt.Errorf("failed to add inbound MSS clamp rule: %w", err)
+	if err := validateDestinations(r.DstIP, r.DstIP6); err != nil {
+		return err
 	}
-
+	if err := r.normalizeSources(); err != nil {
+		return err
+	}
+	if err := r.normalizeSnat(); err != nil {
+		return err
+	}
+	if err := r.normalizeBinding(); err != nil {
+		return err
+	}
+	if r.Protocol != "tcp" && r.Protocol != "udp" && r.Protocol != "both" {
+		return fmt.Errorf("invalid protocol: %s", r.Protocol)
+	}
+	if r.LimitMbps < 0 {
+		return fmt.Errorf("invalid limit: %d (must be >= 0)", r.LimitMbps)
+	}
+	if r.MaxConns < 0 || r.MaxPerIP < 0 {
+		return errors.New("connection limits must be >= 0")
+	}
+	if r.MaxConns > 0 && r.MaxPerIP > r.MaxConns {
+		return fmt.Errorf("max connections per IP (%d) exceeds max connections (%d)", r.MaxPerIP, r.MaxConns)
+	}
+	r.Comment = sanitizeComment(r.Comment)
 	return nil
 }
 
-// deleteMSSClampRules deletes TCP MSS clamping rules from filter forward chain
-func (m *ForwardingManager) deleteMSSClampRules(srcPort int) error {
-	output, err := m.execNFT("-j", "-a", "list", "chain", "ip", "filter", "forward")
-	if err != nil {
+// normalizeBackends validates the backends of a load-balanced forward. A
+// single backend makes a plain forward to it; with several, DstIP is the first.
+func (r *ForwardingRule) normalizeBackends() error {
+	if len(r.Backends) == 0 {
+		r.Backends, r.Balance = nil, ""
 		return nil
 	}
 
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(output, &ruleset); err != nil {
-		return err
-	}
-
-	commentPrefix := fmt.Sprintf("%s %d", ForwardingComment, srcPort)
-	for _, obj := range ruleset.NFTables {
-		if obj.Rule == nil || obj.Rule.Chain != "forward" {
-			continue
+	seen := make(map[string]bool)
+	family := ""
+	for i := range r.Backends {
+		b := &r.Backends[i]
+		f := ipFamily(b.IP)
+		if f == "" {
+			return fmt.Errorf("invalid backend IP: %s", b.IP)
 		}
-		if !strings.HasPrefix(obj.Rule.Comment, commentPrefix) {
-			continue
+		if family != "" && f != family {
+			return errors.New("backends must be all IPv4 or all IPv6")
 		}
-		// Check if this rule has a mangle expression (MSS clamping)
-		for _, expr := range obj.Rule.Expr {
-			if _, ok := expr["mangle"]; ok {
-				m.execNFT("delete", "rule", "ip", "filter", "forward", "handle", strconv.FormatInt(obj.Rule.Handle, 10))
-				break
-			}
+		family = f
+		if seen[b.IP] {
+			return fmt.Errorf("duplicate backend: %s", b.IP)
+		}
+		seen[b.IP] = true
+		if b.Weight == 0 {
+			b.Weight = 1
+		}
+		if b.Weight < 1 || b.Weight > maxBackendWeight {
+			return fmt.Errorf("invalid weight for backend %s: %d (must be 1-%d)", b.IP, b.Weight, maxBackendWeight)
 		}
 	}
 
+	r.DstIP = r.Backends[0].IP
+	if len(r.Backends) == 1 {
+		r.Backends, r.Balance = nil, ""
+		return nil
+	}
+	if r.DstIP6 != "" {
+		return errors.New("a load-balanced forward can't have a separate IPv6 destination")
+	}
+	switch r.Balance {
+	case "":
+		r.Balance = BalanceRandom
+	case BalanceRandom, BalanceRoundRobin, BalanceSourceHash:
+	default:
+		return fmt.Errorf("invalid balance mode: %s", r.Balance)
+	}
 	return nil
 }
 
-// addForwardLimitRules adds bandwidth limit rules in filter forward chain (bidirectional)
-func (m *ForwardingManager) addForwardLimitRules(dstIP string, dstPort int, protocol string, comment string, limitMbps int) error {
-	if limitMbps <= 0 {
-		return nil // No limit needed
+// normalizeSources validates the client allowlist of a forward. Entries are
+// addresses or CIDRs of a destination's family.
+func (r *ForwardingRule) normalizeSources() error {
+	families := make(map[string]bool)
+	for _, dstIP := range r.destinations() {
+		families[ipFamily(dstIP)] = true
 	}
 
-	// Convert Mbps to kbytes/second for nftables
-	// 1 Mbps = 1000 kbits/s = 125 KByte/s (using 1000-based conversion for network speeds)
-	limitKbytes := (limitMbps * 1000) / 8
-
-	// Ensure filter table and forward chain exist
-	if err := m.EnsureFilterForwardSetup(); err != nil {
-		return err
+	sources, err := normalizeSourceList(r.Sources, func(src, family string) error {
+		if families[family] {
+			return nil
+		}
+		if family == "ip6" {
+			return fmt.Errorf("allowed source %s is IPv6 but the forward has no IPv6 destination", src)
+		}
+		return fmt.Errorf("allowed source %s is IPv4 but the forward has no IPv4 destination", src)
+	})
+	if err != nil {
+		return err
 	}
+	r.Sources = sources
+	return nil
+}
 
-	// Outbound limit (to destination)
-	switch protocol {
-	case "tcp":
-		// TCP outbound
-		if _, err := m.execNFT("add", "rule", "ip", "filter", "forward",
-			"ip", "daddr", dstIP, "tcp", "dport", strconv.Itoa(dstPort),
-			"limit", "rate", "over", strconv.Itoa(limitKbytes), "kbytes/second",
-			"drop", "comment", fmt.Sprintf(`"%s"`, comment)); err != nil {
-			return fmt.Errorf("failed to add TCP outbound limit: %w", err)
-		}
-		// TCP inbound
-		if _, err := m.execNFT("add", "rule", "ip", "filter", "forward",
-			"ip", "saddr", dstIP, "tcp", "sport", strconv.Itoa(dstPort),
-			"limit", "rate", "over", strconv.Itoa(limitKbytes), "kbytes/second",
-			"drop", "comment", fmt.Sprintf(`"%s"`, comment)); err != nil {
-			return fmt.Errorf("failed to add TCP inbound limit: %w", err)
-		}
-	case "udp":
-		// UDP outbound
-		if _, err := m.execNFT("add", "rule", "ip", "filter", "forward",
-			"ip", "daddr", dstIP, "udp", "dport", strconv.Itoa(dstPort),
-			"limit", "rate", "over", strconv.Itoa(limitKbytes), "kbytes/second",
-			"drop", "comment", fmt.Sprintf(`"%s"`, comment)); err != nil {
-			return fmt.Errorf("failed to add UDP outbound limit: %w", err)
-		}
-		// UDP inbound
-		if _, err := m.execNFT("add", "rule", "ip", "filter", "forward",
-			"ip", "saddr", dstIP, "udp", "sport", strconv.Itoa(dstPort),
-			"limit", "rate", "over", strconv.Itoa(limitKbytes), "kbytes/second",
-			"drop", "comment", fmt.Sprintf(`"%s"`, comment)); err != nil {
-			return fmt.Errorf("failed to add UDP inbound limit: %w", err)
+// normalizeSourceList validates a list of client addresses or CIDRs, each of a
+// family accepted by checkFamily. Entries are returned canonical and sorted,
+// IPv4 first, and may not overlap since the kernel rejects overlapping intervals.
+func normalizeSourceList(list []string, checkFamily func(src, family string) error) ([]string, error) {
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	spans := make([]addrSpan, 0, len(list))
+	for _, src := range list {
+		src = strings.TrimSpace(src)
+		sp, ok := parseAddrSpan(src)
+		if !ok {
+			return nil, fmt.Errorf("invalid allowed source: %q (must be an address or CIDR)", src)
 		}
-	default: // "both"
-		// Both TCP/UDP outbound
-		if _, err := m.execNFT("add", "rule", "ip", "filter", "forward",
-			"ip", "daddr", dstIP, "meta", "l4proto", "{", "tcp,", "udp", "}",
-			"th", "dport", strconv.Itoa(dstPort),
-			"limit", "rate", "over", strconv.Itoa(limitKbytes), "kbytes/second",
-			"drop", "comment", fmt.Sprintf(`"%s"`, comment)); err != nil {
-			return fmt.Errorf("failed to add outbound limit: %w", err)
+		if err := checkFamily(src, sp.family); err != nil {
+			return nil, err
+		}
+		spans = append(spans, sp)
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		if spans[i].family != spans[j].family {
+			return spans[i].family == "ip"
+		}
+		return bytes.Compare(spans[i].first, spans[j].first) < 0
+	})
+	sources := make([]string, 0, len(spans))
+	for i, sp := range spans {
+		if i > 0 && sp.entry == spans[i-1].entry {
+			return nil, fmt.Errorf("duplicate allowed source: %s", sp.entry)
+		}
+		if i > 0 && sp.overlaps(spans[i-1]) {
+			return nil, fmt.Errorf("allowed sources %s and %s overlap", spans[i-1].entry, sp.entry)
+		}
+		sources = append(sources, sp.entry)
+	}
+	return sources, nil
+}
+
+// addrSpan is an address or CIDR with the range of addresses it covers
+type addrSpan struct {
+	entry       string // canonical form
+	family      string // "ip" | "ip6"
+	first, last net.IP // 16-byte form
+}
+
+// parseAddrSpan parses an address or CIDR; a full-length prefix is a single address
+func parseAddrSpan(src string) (addrSpan, bool) {
+	ipNet := &net.IPNet{IP: net.ParseIP(src)}
+	if ipNet.IP == nil {
+		var err error
+		if _, ipNet, err = net.ParseCIDR(src); err != nil {
+			return addrSpan{}, false
 		}
-		// Both TCP/UDP inbound
-		if _, err := m.execNFT("add", "rule", "ip", "filter", "forward",
-			"ip", "saddr", dstIP, "meta", "l4proto", "{", "tcp,", "udp", "}",
-			"th", "sport", strconv.Itoa(dstPort),
-			"limit", "rate", "over", strconv.Itoa(limitKbytes), "kbytes/second",
-			"drop", "comment", fmt.Sprintf(`"%s"`, comment)); err != nil {
-			return fmt.Errorf("failed to add inbound limit: %w", err)
+	}
+
+	sp := addrSpan{entry: ipNet.IP.String(), family: ipFamily(ipNet.IP.String()), first: ipNet.IP.To16(), last: ipNet.IP.To16()}
+	if ones, bits := ipNet.Mask.Size(); ipNet.Mask != nil && ones < bits {
+		last := make(net.IP, len(ipNet.IP))
+		for i := range last {
+			last[i] = ipNet.IP[i] | ^ipNet.Mask[i]
 		}
+		sp.entry, sp.last = ipNet.String(), last.To16()
 	}
+	return sp, true
+}
 
+// overlaps reports whether two spans share an address
+func (sp addrSpan) overlaps(o addrSpan) bool {
+	return sp.family == o.family && bytes.Compare(sp.first, o.last) <= 0 && bytes.Compare(o.first, sp.last) <= 0
+}
+
+// normalizeSnat validates the source NAT mode of a forward, masquerading by
+// default. A fixed SNAT address must be of the destination's family.
+func (r *ForwardingRule) normalizeSnat() error {
+	switch {
+	case r.SnatMode == "" || r.SnatMode == SnatMasquerade:
+		r.SnatMode = SnatMasquerade
+	case r.SnatMode == SnatNone:
+	case strings.HasPrefix(r.SnatMode, SnatPrefix):
+		addr := strings.TrimPrefix(r.SnatMode, SnatPrefix)
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return fmt.Errorf("invalid SNAT address: %s", addr)
+		}
+		if r.DstIP6 != "" {
+			return errors.New("a dual-stack forward can't SNAT to a single address, use masquerade or none")
+		}
+		if ipFamily(addr) != ipFamily(r.DstIP) {
+			return fmt.Errorf("SNAT address %s is not of the destination's address family", addr)
+		}
+		r.SnatMode = SnatPrefix + ip.String()
+	default:
+		return fmt.Errorf("invalid SNAT mode: %s (must be masquerade, snat:<ip> or none)", r.SnatMode)
+	}
 	return nil
 }
 
-// deleteForwardLimitRules deletes bandwidth limit rules from filter forward chain
-func (m *ForwardingManager) deleteForwardLimitRules(srcPort int) error {
-	output, err := m.execNFT("-j", "-a", "list", "chain", "ip", "filter", "forward")
-	if err != nil {
-		// Chain might not exist, ignore
+// normalizeBinding validates what a forward is bound to. A listen IP must be
+// of the destination's family, so it can't be combined with a dual-stack forward.
+func (r *ForwardingRule) normalizeBinding() error {
+	if r.Interface != "" && !interfaceRegex.MatchString(r.Interface) {
+		return fmt.Errorf("invalid interface name: %s", r.Interface)
+	}
+	if r.ListenIP == "" {
 		return nil
 	}
+	ip := net.ParseIP(r.ListenIP)
+	if ip == nil {
+		return fmt.Errorf("invalid listen IP: %s", r.ListenIP)
+	}
+	r.ListenIP = ip.String()
+	if r.DstIP6 != "" {
+		return errors.New("a dual-stack forward can't listen on a single address")
+	}
+	if ipFamily(r.ListenIP) != ipFamily(r.DstIP) {
+		return fmt.Errorf("listen IP %s is not of the destination's address family", r.ListenIP)
+	}
+	return nil
+}
+
+// sourcesFor returns the allowed sources of a family
+func (r *ForwardingRule) sourcesFor(family string) []string {
+	return sourcesOfFamily(r.Sources, family)
+}
+
+// sourcesOfFamily returns the addresses and CIDRs of a family in a source list
+func sourcesOfFamily(list []string, family string) []string {
+	var sources []string
+	for _, src := range list {
+		if strings.Contains(src, ":") == (family == "ip6") {
+			sources = append(sources, src)
+		}
+	}
+	return sources
+}
 
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(output, &ruleset); err != nil {
-		return err
+// sourceSetName returns the name of the set holding the allowed sources of a forward
+func sourceSetName(ref forwardRef) string {
+	return forwardSetName("fwd_src", ref)
+}
+
+// connSetName returns the name of the set counting the connections of each client of a forward
+func connSetName(ref forwardRef) string {
+	return forwardSetName("fwd_conn", ref)
+}
+
+// forwardSetName returns the name of one of a forward's sets. Bound forwards
+// get a hash of their binding, which has characters set names can't have.
+func forwardSetName(prefix string, ref forwardRef) string {
+	if ref.bind == "" {
+		return fmt.Sprintf("%s_%d", prefix, ref.port)
 	}
+	h := fnv.New32a()
+	h.Write([]byte(ref.bind))
+	return fmt.Sprintf("%s_%d_%08x", prefix, ref.port, h.Sum32())
+}
 
-	// Find and delete all limit rules with matching comment
-	commentPrefix := fmt.Sprintf("%s %d", ForwardingComment, srcPort)
-	for _, obj := range ruleset.NFTables {
-		if obj.Rule == nil || obj.Rule.Chain != "forward" {
-			continue
+// backendsFor returns the addresses a forward sends the traffic of dstIP's
+// family to: every backend of a load-balanced forward, or dstIP itself
+func (r *ForwardingRule) backendsFor(dstIP string) []string {
+	if len(r.Backends) < 2 {
+		return []string{dstIP}
+	}
+	addrs := make([]string, 0, len(r.Backends))
+	for _, b := range r.Backends {
+		addrs = append(addrs, b.IP)
+	}
+	return addrs
+}
+
+// balanceArgs builds the DNAT statement of a load-balanced forward: a numgen
+// or jhash value picks an address from a map with one element per weight unit
+//
+//	dnat to numgen random mod 3 map { 0 : 10.0.0.2, 1 : 10.0.0.2, 2 : 10.0.0.3 } : 80
+func (r *ForwardingRule) balanceArgs(family string) []string {
+	total := 0
+	for _, b := range r.Backends {
+		total += b.Weight
+	}
+
+	args := []string{"dnat", "to"}
+	switch r.Balance {
+	case BalanceRoundRobin:
+		args = append(args, "numgen", "inc")
+	case BalanceSourceHash:
+		args = append(args, "jhash", family, "saddr")
+	default:
+		args = append(args, "numgen", "random")
+	}
+	args = append(args, "mod", strconv.Itoa(total), "map", "{")
+
+	n := 0
+	for _, b := range r.Backends {
+		for w := 0; w < b.Weight; w++ {
+			addr := b.IP
+			if n < total-1 {
+				addr += ","
+			}
+			args = append(args, strconv.Itoa(n), ":", addr)
+			n++
+		}
+	}
+	return append(args, "}", ":", r.dstPorts())
+}
+
+// validatePorts checks the source and destination ports of a forward. The
+// kernel keeps a connection's port when it lies in the DNAT range, so a range
+// can only be forwarded to the same ports.
+func (r *ForwardingRule) validatePorts() error {
+	if r.SrcPort < 1 || r.SrcPort > 65535 {
+		return fmt.Errorf("invalid source port: %d", r.SrcPort)
+	}
+	if r.SrcPortEnd != 0 && (r.SrcPortEnd <= r.SrcPort || r.SrcPortEnd > 65535) {
+		return fmt.Errorf("invalid source port range: %d-%d", r.SrcPort, r.SrcPortEnd)
+	}
+	if r.DstPort < 1 || r.DstPort > 65535 {
+		return fmt.Errorf("invalid destination port: %d", r.DstPort)
+	}
+	if r.SrcPortEnd != 0 && r.DstPort != r.SrcPort {
+		return fmt.Errorf("a port range must be forwarded to the same ports: destination port must be %d", r.SrcPort)
+	}
+	return nil
+}
+
+// parsePortRange parses a port ("8080") or an inclusive port range ("30000-30100")
+// and returns its first and last port
+func parsePortRange(s string) (int, int, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	first, err := strconv.Atoi(lo)
+	if err != nil || first < 0 || first > 65535 {
+		return 0, 0, fmt.Errorf("invalid port: %s", s)
+	}
+	if !isRange {
+		return first, first, nil
+	}
+	last, err := strconv.Atoi(hi)
+	if err != nil || last < first || last > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	return first, last, nil
+}
+
+// formatPortRange formats a port range in nft syntax, or a single port if first equals last
+func formatPortRange(first, last int) string {
+	if last > first {
+		return fmt.Sprintf("%d-%d", first, last)
+	}
+	return strconv.Itoa(first)
+}
+
+// destinations returns the destination addresses of a forward, at most one per family
+func (r *ForwardingRule) destinations() []string {
+	if r.DstIP6 != "" {
+		return []string{r.DstIP, r.DstIP6}
+	}
+	return []string{r.DstIP}
+}
+
+// queueForwardingRules appends every nftables rule that makes up a forward to tx.
+// Each destination gets its rules in the tables of its family.
+func (m *ForwardingManager) queueForwardingRules(tx *Transaction, rule ForwardingRule) {
+	// Build comment string
+	fullComment := fmt.Sprintf("%s %s", ForwardingComment, rule.key())
+	if rule.Comment != "" {
+		fullComment = fmt.Sprintf("%s %s", fullComment, rule.Comment)
+	}
+
+	for _, dstIP := range rule.destinations() {
+		family := ipFamily(dstIP)
+		dnat := dnatArgs(dstIP, rule.dstPorts())
+		if len(rule.Backends) > 1 {
+			dnat = rule.balanceArgs(family)
+		}
+		// A bound forward only takes traffic to its listen address; local
+		// traffic has no input interface, so an interface binding only
+		// applies in prerouting
+		var listen []string
+		if rule.ListenIP != "" {
+			listen = []string{family, "daddr", rule.ListenIP}
+		}
+		match := listen
+		if rule.Interface != "" {
+			match = append([]string{"iifname", fmt.Sprintf(`"%s"`, rule.Interface)}, listen...)
+		}
+		// Only clients in the forward's set are forwarded; the set can
+		// change without touching the DNAT rule
+		if len(rule.Sources) > 0 {
+			set := sourceSetName(rule.ref())
+			m.queueSourceSet(tx, family, set, rule.sourcesFor(family))
+			match = append(match, family, "saddr", "@"+set)
+		}
+		m.addDNATRule(tx, family, match, rule.srcPorts(), dnat, rule.Protocol, fullComment)
+		if rule.Interface == "" || rule.ListenIP != "" {
+			m.addOutputDNATRule(tx, family, listen, rule.srcPorts(), dnat, rule.Protocol, fullComment)
+		}
+
+		// Every backend gets its own masquerade, limit, MSS and counter rules
+		for _, addr := range rule.backendsFor(dstIP) {
+			m.addMasqueradeRule(tx, family, addr, rule.dstPorts(), rule.Protocol, rule.SnatMode, fullComment)
+			m.addForwardLimitRules(tx, family, addr, rule.dstPorts(), rule.Protocol, fullComment, rule.LimitMbps)
+			m.addMSSClampRule(tx, family, addr, fullComment)
+			m.addForwardCounterRules(tx, family, addr, rule.dstPorts(), rule.Protocol, fullComment)
+		}
+		m.addForwardConnLimitRules(tx, family, rule.backendsFor(dstIP), rule, fullComment)
+	}
+}
+
+// l4Match returns the protocol part of a port match: "tcp", "udp", or
+// "meta l4proto { tcp, udp } th" for both
+func l4Match(protocol string) []string {
+	switch protocol {
+	case "tcp", "udp":
+		return []string{protocol}
+	default: // "both"
+		return []string{"meta", "l4proto", "{", "tcp,", "udp", "}", "th"}
+	}
+}
+
+// dnatArgs builds the "dnat to <addr>:<ports>" statement, with IPv6 addresses in brackets
+func dnatArgs(dstIP string, dstPorts string) []string {
+	return []string{"dnat", "to", net.JoinHostPort(dstIP, dstPorts)}
+}
+
+// queueSourceSet creates or replaces the elements of a forward's allowed source set
+func (m *ForwardingManager) queueSourceSet(tx *Transaction, family string, set string, sources []string) {
+	keyType := "ipv4_addr"
+	if family == "ip6" {
+		keyType = "ipv6_addr"
+	}
+	tx.AddIntervalSet(family, "nat", set, keyType)
+	tx.FlushSet(family, "nat", set)
+	tx.AddElements(family, "nat", set, sources...)
+}
+
+// addDNATRule adds a prerouting DNAT rule (without limit - limit goes in filter forward),
+// behind match if the forward only accepts some clients
+func (m *ForwardingManager) addDNATRule(tx *Transaction, family string, match []string, srcPorts string, dnat []string, protocol string, comment string) {
+	args := append(append([]string{}, match...), l4Match(protocol)...)
+	args = append(args, "dport", srcPorts)
+	args = append(args, dnat...)
+	args = append(args, "comment", fmt.Sprintf(`"%s"`, comment))
+
+	tx.AddRule(family, "nat", "prerouting", args...)
+}
+
+// addMasqueradeRule adds a postrouting MASQUERADE or SNAT rule for the forward's snat mode,
+// none for SnatNone
+func (m *ForwardingManager) addMasqueradeRule(tx *Transaction, family string, dstIP string, dstPorts string, protocol string, snatMode string, comment string) {
+	nat := []string{"masquerade"}
+	switch {
+	case snatMode == SnatNone:
+		return
+	case strings.HasPrefix(snatMode, SnatPrefix):
+		nat = []string{"snat", "to", strings.TrimPrefix(snatMode, SnatPrefix)}
+	}
+	args := append([]string{family, "daddr", dstIP}, l4Match(protocol)...)
+	args = append(args, "dport", dstPorts)
+	args = append(args, nat...)
+	args = append(args, "comment", fmt.Sprintf(`"%s"`, comment))
+
+	tx.AddRule(family, "nat", "postrouting", args...)
+}
+
+// addOutputDNATRule adds an output chain DNAT rule for local traffic (without limit),
+// behind match if the forward only listens on one address
+func (m *ForwardingManager) addOutputDNATRule(tx *Transaction, family string, match []string, srcPorts string, dnat []string, protocol string, comment string) {
+	args := append(append([]string{}, match...), l4Match(protocol)...)
+	args = append(args, "dport", srcPorts)
+	args = append(args, dnat...)
+	args = append(args, "comment", fmt.Sprintf(`"%s"`, comment))
+
+	tx.AddRule(family, "nat", "output", args...)
+}
+
+// addMSSClampRule adds bidirectional TCP MSS clamping rules in filter forward chain to prevent MTU-related stalls
+func (m *ForwardingManager) addMSSClampRule(tx *Transaction, family string, dstIP string, comment string) {
+	// IPv6 headers are 20 bytes longer
+	mss := "1452"
+	if family == "ip6" {
+		mss = "1432"
+	}
+
+	// Outbound: to destination
+	tx.AddRule(family, "filter", "forward",
+		family, "daddr", dstIP,
+		"tcp", "flags", "syn",
+		"tcp", "option", "maxseg", "size", "set", mss,
+		"comment", fmt.Sprintf(`"%s"`, comment))
+
+	// Inbound: SYN-ACK from destination
+	tx.AddRule(family, "filter", "forward",
+		family, "saddr", dstIP,
+		"tcp", "flags", "syn",
+		"tcp", "option", "maxseg", "size", "set", mss,
+		"comment", fmt.Sprintf(`"%s"`, comment))
+}
+
+// addForwardCounterRules adds byte/packet counter rules in filter forward chain (bidirectional).
+// They are inserted at the top so they see established traffic before the conntrack fast-path.
+func (m *ForwardingManager) addForwardCounterRules(tx *Transaction, family string, dstIP string, dstPorts string, protocol string, comment string) {
+	match := l4Match(protocol)
+
+	// Outbound (to destination)
+	args := append([]string{family, "daddr", dstIP}, match...)
+	args = append(args, "dport", dstPorts, "counter", "comment", fmt.Sprintf(`"%s"`, comment))
+	tx.InsertRule(family, "filter", "forward", args...)
+
+	// Inbound (from destination)
+	args = append([]string{family, "saddr", dstIP}, match...)
+	args = append(args, "sport", dstPorts, "counter", "comment", fmt.Sprintf(`"%s"`, comment))
+	tx.InsertRule(family, "filter", "forward", args...)
+}
+
+// addForwardLimitRules adds bandwidth limit rules in filter forward chain (bidirectional)
+func (m *ForwardingManager) addForwardLimitRules(tx *Transaction, family string, dstIP string, dstPorts string, protocol string, comment string, limitMbps int) {
+	if limitMbps <= 0 {
+		return // No limit needed
+	}
+
+	// Convert Mbps to kbytes/second for nftables
+	// 1 Mbps = 1000 kbits/s = 125 KByte/s (using 1000-based conversion for network speeds)
+	limitKbytes := (limitMbps * 1000) / 8
+	limit := []string{"limit", "rate", "over", strconv.Itoa(limitKbytes), "kbytes/second",
+		"drop", "comment", fmt.Sprintf(`"%s"`, comment)}
+	match := l4Match(protocol)
+
+	// Outbound limit (to destination)
+	args := append([]string{family, "daddr", dstIP}, match...)
+	args = append(args, "dport", dstPorts)
+	tx.AddRule(family, "filter", "forward", append(args, limit...)...)
+
+	// Inbound limit (from destination)
+	args = append([]string{family, "saddr", dstIP}, match...)
+	args = append(args, "sport", dstPorts)
+	tx.AddRule(family, "filter", "forward", append(args, limit...)...)
+}
+
+// addForwardConnLimitRules adds rules in filter forward chain that drop new connections
+// beyond the forward's total and per client limits, counted across all of its backends
+func (m *ForwardingManager) addForwardConnLimitRules(tx *Transaction, family string, addrs []string, rule ForwardingRule, comment string) {
+	if rule.MaxConns <= 0 && rule.MaxPerIP <= 0 {
+		return
+	}
+
+	match := []string{family, "daddr", addrs[0]}
+	if len(addrs) > 1 {
+		match = []string{family, "daddr", "{", strings.Join(addrs, ", "), "}"}
+	}
+	match = append(match, l4Match(rule.Protocol)...)
+	match = append(match, "dport", rule.dstPorts(), "ct", "state", "new")
+
+	if rule.MaxConns > 0 {
+		args := append(append([]string{}, match...), "ct", "count", "over", strconv.Itoa(rule.MaxConns))
+		args = append(args, "drop", "comment", fmt.Sprintf(`"%s"`, comment))
+		tx.AddRule(family, "filter", "forward", args...)
+	}
+
+	if rule.MaxPerIP > 0 {
+		// Each client address gets an element counting its connections
+		set := connSetName(rule.ref())
+		keyType := "ipv4_addr"
+		if family == "ip6" {
+			keyType = "ipv6_addr"
+		}
+		tx.AddMeterSet(family, "filter", set, keyType)
+		args := append(append([]string{}, match...), "add", "@"+set,
+			"{", family, "saddr", "ct", "count", "over", strconv.Itoa(rule.MaxPerIP), "}")
+		args = append(args, "drop", "comment", fmt.Sprintf(`"%s"`, comment))
+		tx.AddRule(family, "filter", "forward", args...)
+	}
+}
+
+// forwardingChains lists every chain that can hold rules belonging to a forward
+var forwardingChains = []struct{ family, table, chain string }{
+	{"ip", "nat", "prerouting"},
+	{"ip", "nat", "postrouting"},
+	{"ip", "nat", "output"},
+	{"ip", "filter", "forward"},
+	{"ip6", "nat", "prerouting"},
+	{"ip6", "nat", "postrouting"},
+	{"ip6", "nat", "output"},
+	{"ip6", "filter", "forward"},
+}
+
+// queueDeleteForwardingRules appends deletion of every nftables rule that belongs
+// to the forward ref and reports whether its DNAT rule was found
+func (m *ForwardingManager) queueDeleteForwardingRules(tx *Transaction, ref forwardRef) (bool, error) {
+	found := false
+	var setFamilies, connFamilies []string
+	for _, c := range forwardingChains {
+		ruleset, err := m.backend.ListChain(c.family, c.table, c.chain)
+		if err != nil {
+			if isNotFoundErr(err) {
+				continue
+			}
+			return false, fmt.Errorf("failed to list %s %s chain: %w", c.family, c.chain, err)
 		}
-		if strings.HasPrefix(obj.Rule.Comment, commentPrefix) {
-			// Check if this rule has a limit expression
-			hasLimit := false
-			for _, expr := range obj.Rule.Expr {
-				if _, ok := expr["limit"]; ok {
-					hasLimit = true
-					break
+
+		for _, obj := range ruleset.NFTables {
+			if obj.Rule == nil || obj.Rule.Chain != c.chain {
+				continue
+			}
+			if !strings.HasPrefix(obj.Rule.Comment, ForwardingComment+" ") {
+				continue
+			}
+			if r, ok := m.extractForwardRef(obj.Rule.Comment); !ok || r != ref {
+				continue
+			}
+			tx.DeleteRule(c.family, c.table, c.chain, obj.Rule.Handle)
+			if c.chain == "prerouting" {
+				found = true
+				if fwd := m.extractForwardingRule(obj.Rule); fwd != nil && fwd.sourceSet == sourceSetName(ref) {
+					setFamilies = append(setFamilies, c.family)
 				}
 			}
-			if hasLimit {
-				m.execNFT("delete", "rule", "ip", "filter", "forward", "handle", strconv.FormatInt(obj.Rule.Handle, 10))
+			if c.chain == "forward" && perIPLimit(obj.Rule) > 0 {
+				connFamilies = append(connFamilies, c.family)
 			}
 		}
 	}
 
-	return nil
+	// The allowed source sets go once no rule refers to them
+	for _, family := range setFamilies {
+		tx.DeleteSet(family, "nat", sourceSetName(ref))
+	}
+	for _, family := range connFamilies {
+		tx.DeleteSet(family, "filter", connSetName(ref))
+	}
+	return found, nil
 }
 
 // DeleteForwardingRule deletes a forwarding rule by ID
@@ -815,8 +1640,8 @@ func (m *ForwardingManager) DeleteForwardingRule(id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Parse source port from ID
-	srcPort, err := m.parseSrcPortFromID(id)
+	// Parse the forward from ID
+	ref, err := m.parseForwardID(id)
 	if err != nil {
 		return err
 	}
@@ -824,126 +1649,164 @@ func (m *ForwardingManager) DeleteForwardingRule(id string) error {
 	// Check if it's a disabled rule
 	disabledRules, _ := m.loadDisabledRules()
 	for i, r := range disabledRules {
-		if r.SrcPort == srcPort {
+		if r.ref() == ref {
 			// Remove from disabled rules
 			disabledRules = append(disabledRules[:i], disabledRules[i+1:]...)
-			return m.saveDisabledRules(disabledRules)
+			if err := m.saveDisabledRules(disabledRules); err != nil {
+				return err
+			}
+			return m.deleteHostMeta(ref)
 		}
 	}
 
 	// It's an enabled rule, delete from nftables
-	if err := m.deleteDNATRuleBySrcPort(srcPort); err != nil {
-		return fmt.Errorf("failed to delete DNAT rule: %w", err)
-	}
-
-	if err := m.deleteMasqueradeRuleBySrcPort(srcPort); err != nil {
-		// Log warning but don't fail
-		fmt.Printf("Warning: failed to delete MASQUERADE rule: %v\n", err)
-	}
-
-	if err := m.deleteOutputDNATRuleBySrcPort(srcPort); err != nil {
-		// Log warning but don't fail
-		fmt.Printf("Warning: failed to delete output DNAT rule: %v\n", err)
+	tx := &Transaction{}
+	found, err := m.queueDeleteForwardingRules(tx, ref)
+	if err != nil {
+		return err
 	}
-
-	if err := m.deleteForwardLimitRules(srcPort); err != nil {
-		// Log warning but don't fail
-		fmt.Printf("Warning: failed to delete forward limit rules: %v\n", err)
+	if !found {
+		return errors.New("DNAT rule not found")
 	}
-
-	if err := m.deleteMSSClampRules(srcPort); err != nil {
-		fmt.Printf("Warning: failed to delete MSS clamp rules: %v\n", err)
+	if err := m.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to delete forwarding rules: %w", err)
 	}
 
-	return nil
+	return m.deleteHostMeta(ref)
 }
 
 // EditForwardingRule modifies an existing forwarding rule
-func (m *ForwardingManager) EditForwardingRule(id string, dstIP string, dstPort int, protocol string, comment string, limitMbps int) error {
+func (m *ForwardingManager) EditForwardingRule(id string, rule ForwardingRule) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Parse source port from ID
-	srcPort, err := m.parseSrcPortFromID(id)
+	// Parse the forward from ID
+	ref, err := m.parseForwardID(id)
 	if err != nil {
 		return err
 	}
+	rule.SrcPort = ref.port
+	rule.Interface, rule.ListenIP = splitBinding(ref.bind)
 
-	// Validate inputs
-	if dstPort < 1 || dstPort > 65535 {
-		return fmt.Errorf("invalid destination port: %d", dstPort)
-	}
-	if !isValidIPv4(dstIP) {
-		return fmt.Errorf("invalid destination IP: %s", dstIP)
-	}
-	if protocol != "tcp" && protocol != "udp" && protocol != "both" {
-		return fmt.Errorf("invalid protocol: %s", protocol)
-	}
-	if limitMbps < 0 {
-		return fmt.Errorf("invalid limit: %d (must be >= 0)", limitMbps)
+	// Resolve the destination hostname unless the caller already did
+	if rule.DstHost != "" && rule.DstIP == "" {
+		if err := m.resolveDestination(&rule); err != nil {
+			return err
+		}
 	}
 
-	comment = sanitizeComment(comment)
-
 	// Check if it's a disabled rule
 	disabledRules, _ := m.loadDisabledRules()
 	for i, r := range disabledRules {
-		if r.SrcPort == srcPort {
-			// Update the disabled rule
-			disabledRules[i].DstIP = dstIP
-			disabledRules[i].DstPort = dstPort
-			disabledRules[i].Protocol = protocol
-			disabledRules[i].Comment = comment
-			disabledRules[i].LimitMbps = limitMbps
+		if r.ref() == ref {
+			// The source ports can't change, so a range keeps its destination ports
+			rule.SrcPortEnd = r.SrcPortEnd
+			if err := rule.normalize(); err != nil {
+				return err
+			}
+
+			if err := m.saveHostMeta(rule); err != nil {
+				return err
+			}
+
+			// Update the disabled rule, its hostname is kept with the metadata
+			rule.ID = r.ID
+			rule.Enabled = false
+			rule.DstHost, rule.ResolvedAt = "", nil
+			disabledRules[i] = rule
 			return m.saveDisabledRules(disabledRules)
 		}
 	}
 
-	// It's an enabled rule - delete and recreate
-	// Delete existing rules
-	m.deleteDNATRuleBySrcPort(srcPort)
-	m.deleteMasqueradeRuleBySrcPort(srcPort)
-	m.deleteOutputDNATRuleBySrcPort(srcPort)
-	m.deleteForwardLimitRules(srcPort)
-	m.deleteMSSClampRules(srcPort)
-
-	// Build comment string
-	fullComment := fmt.Sprintf("%s %d", ForwardingComment, srcPort)
-	if comment != "" {
-		fullComment = fmt.Sprintf("%s %s", fullComment, comment)
+	// It's an enabled rule - replace old rules with new ones in one transaction
+	if current := findManagedRule(m.listEnabledRules(), ref); current != nil {
+		rule.SrcPortEnd = current.SrcPortEnd
+	}
+	if err := rule.normalize(); err != nil {
+		return err
+	}
+	if err := m.ensureSetup(rule); err != nil {
+		return err
 	}
 
-	// Add new rules
-	if err := m.addDNATRule(srcPort, dstIP, dstPort, protocol, fullComment, limitMbps); err != nil {
-		return fmt.Errorf("failed to add DNAT rule: %w", err)
+	tx := &Transaction{}
+	if _, err := m.queueDeleteForwardingRules(tx, ref); err != nil {
+		return err
+	}
+	m.queueForwardingRules(tx, rule)
+	if err := m.queueQuotaRebuild(tx, rule); err != nil {
+		return err
+	}
+	if err := m.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to replace forwarding rules: %w", err)
 	}
 
-	if err := m.addMasqueradeRule(dstIP, dstPort, protocol, fullComment); err != nil {
-		m.deleteDNATRuleBySrcPort(srcPort)
-		return fmt.Errorf("failed to add MASQUERADE rule: %w", err)
+	return m.saveHostMeta(rule)
+}
+
+// queueQuotaRebuild queues the forward chain quotas of a forward's ports again,
+// so they count the traffic of its current destinations
+func (m *ForwardingManager) queueQuotaRebuild(tx *Transaction, rule ForwardingRule) error {
+	if m.nft == nil {
+		return nil
 	}
+	if err := m.nft.queueForwardQuotaRebuild(tx, rule); err != nil {
+		return fmt.Errorf("failed to rebuild forward quotas: %w", err)
+	}
+	return nil
+}
 
-	if err := m.addOutputDNATRule(srcPort, dstIP, dstPort, protocol, fullComment, limitMbps); err != nil {
-		m.deleteDNATRuleBySrcPort(srcPort)
-		m.deleteMasqueradeRuleBySrcPort(srcPort)
-		return fmt.Errorf("failed to add output DNAT rule: %w", err)
+// SetAllowedSources replaces the client allowlist of a forward. A forward
+// that stays restricted only has its sets updated, so its DNAT rules and
+// their connections are left alone.
+func (m *ForwardingManager) SetAllowedSources(id string, sources []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ref, err := m.parseForwardID(id)
+	if err != nil {
+		return err
 	}
 
-	if err := m.addForwardLimitRules(dstIP, dstPort, protocol, fullComment, limitMbps); err != nil {
-		m.deleteDNATRuleBySrcPort(srcPort)
-		m.deleteMasqueradeRuleBySrcPort(srcPort)
-		m.deleteOutputDNATRuleBySrcPort(srcPort)
-		return fmt.Errorf("failed to add forward limit rules: %w", err)
+	// Check if it's a disabled rule
+	disabledRules, _ := m.loadDisabledRules()
+	for i := range disabledRules {
+		if disabledRules[i].ref() == ref {
+			disabledRules[i].Sources = sources
+			if err := disabledRules[i].normalizeSources(); err != nil {
+				return err
+			}
+			return m.saveDisabledRules(disabledRules)
+		}
 	}
 
-	if err := m.addMSSClampRule(dstIP, fullComment); err != nil {
-		m.deleteDNATRuleBySrcPort(srcPort)
-		m.deleteMasqueradeRuleBySrcPort(srcPort)
-		m.deleteOutputDNATRuleBySrcPort(srcPort)
-		m.deleteForwardLimitRules(srcPort)
-		return fmt.Errorf("failed to add MSS clamp rule: %w", err)
+	current := findManagedRule(m.listEnabledRules(), ref)
+	if current == nil {
+		return fmt.Errorf("forwarding rule not found: %s", id)
+	}
+	rule := *current
+	rule.Sources = sources
+	if err := rule.normalizeSources(); err != nil {
+		return err
 	}
 
+	tx := &Transaction{}
+	if current.sourceSet == sourceSetName(ref) && len(rule.Sources) > 0 {
+		for _, dstIP := range rule.destinations() {
+			family := ipFamily(dstIP)
+			m.queueSourceSet(tx, family, current.sourceSet, rule.sourcesFor(family))
+		}
+	} else {
+		// Adding or removing the allowlist changes the DNAT rules
+		m.extractLimitsFromForwardChain()[ref].apply(&rule)
+		if _, err := m.queueDeleteForwardingRules(tx, ref); err != nil {
+			return err
+		}
+		m.queueForwardingRules(tx, rule)
+	}
+	if err := m.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to update allowed sources: %w", err)
+	}
 	return nil
 }
 
@@ -952,7 +1815,7 @@ func (m *ForwardingManager) EnableForwardingRule(id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	srcPort, err := m.parseSrcPortFromID(id)
+	ref, err := m.parseForwardID(id)
 	if err != nil {
 		return err
 	}
@@ -966,7 +1829,7 @@ func (m *ForwardingManager) EnableForwardingRule(id string) error {
 	var rule *ForwardingRule
 	var idx int
 	for i, r := range disabledRules {
-		if r.SrcPort == srcPort {
+		if r.ref() == ref {
 			rule = &disabledRules[i]
 			idx = i
 			break
@@ -977,51 +1840,53 @@ func (m *ForwardingManager) EnableForwardingRule(id string) error {
 		return fmt.Errorf("disabled rule not found: %s", id)
 	}
 
-	// Ensure nat table exists
-	if err := m.EnsureNatSetup(); err != nil {
-		return err
-	}
-
-	// Build comment string
-	fullComment := fmt.Sprintf("%s %d", ForwardingComment, rule.SrcPort)
-	if rule.Comment != "" {
-		fullComment = fmt.Sprintf("%s %s", fullComment, rule.Comment)
-	}
-
-	// Create nftables rules
-	if err := m.addDNATRule(rule.SrcPort, rule.DstIP, rule.DstPort, rule.Protocol, fullComment, rule.LimitMbps); err != nil {
-		return fmt.Errorf("failed to add DNAT rule: %w", err)
-	}
-
-	if err := m.addMasqueradeRule(rule.DstIP, rule.DstPort, rule.Protocol, fullComment); err != nil {
-		m.deleteDNATRuleBySrcPort(rule.SrcPort)
-		return fmt.Errorf("failed to add MASQUERADE rule: %w", err)
+	// A destination hostname may point elsewhere by now; keep the last
+	// address if it doesn't resolve
+	resolved := false
+	if m.meta != nil {
+		if meta, ok := m.meta.Get(ref); ok {
+			r := *rule
+			r.DstHost = meta.DstHost
+			err := m.resolveDestination(&r)
+			if err == nil {
+				err = validateDestinations(r.DstIP, r.DstIP6)
+			}
+			if err == nil {
+				*rule = r
+				resolved = true
+			} else {
+				meta.ResolveError = err.Error()
+				if err := m.meta.Set(meta); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
-	if err := m.addOutputDNATRule(rule.SrcPort, rule.DstIP, rule.DstPort, rule.Protocol, fullComment, rule.LimitMbps); err != nil {
-		m.deleteDNATRuleBySrcPort(rule.SrcPort)
-		m.deleteMasqueradeRuleBySrcPort(rule.SrcPort)
-		return fmt.Errorf("failed to add output DNAT rule: %w", err)
+	// Ensure nat table and filter forward chain exist
+	if err := m.ensureSetup(*rule); err != nil {
+		return err
 	}
 
-	if err := m.addForwardLimitRules(rule.DstIP, rule.DstPort, rule.Protocol, fullComment, rule.LimitMbps); err != nil {
-		m.deleteDNATRuleBySrcPort(rule.SrcPort)
-		m.deleteMasqueradeRuleBySrcPort(rule.SrcPort)
-		m.deleteOutputDNATRuleBySrcPort(rule.SrcPort)
-		return fmt.Errorf("failed to add forward limit rules: %w", err)
+	// Create nftables rules in one transaction
+	tx := &Transaction{}
+	m.queueForwardingRules(tx, *rule)
+	if err := m.queueQuotaRebuild(tx, *rule); err != nil {
+		return err
 	}
-
-	if err := m.addMSSClampRule(rule.DstIP, fullComment); err != nil {
-		m.deleteDNATRuleBySrcPort(rule.SrcPort)
-		m.deleteMasqueradeRuleBySrcPort(rule.SrcPort)
-		m.deleteOutputDNATRuleBySrcPort(rule.SrcPort)
-		m.deleteForwardLimitRules(rule.SrcPort)
-		return fmt.Errorf("failed to add MSS clamp rule: %w", err)
+	if err := m.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to add forwarding rules: %w", err)
 	}
 
 	// Remove from disabled rules
 	disabledRules = append(disabledRules[:idx], disabledRules[idx+1:]...)
-	return m.saveDisabledRules(disabledRules)
+	if err := m.saveDisabledRules(disabledRules); err != nil {
+		return err
+	}
+	if resolved {
+		return m.saveHostMeta(*rule)
+	}
+	return nil
 }
 
 // DisableForwardingRule disables an enabled forwarding rule
@@ -1029,23 +1894,18 @@ func (m *ForwardingManager) DisableForwardingRule(id string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	srcPort, err := m.parseSrcPortFromID(id)
+	ref, err := m.parseForwardID(id)
 	if err != nil {
 		return err
 	}
 
 	// Get current enabled rules
-	preOutput, _ := m.execNFT("-j", "-a", "list", "chain", "ip", "nat", "prerouting")
-	postOutput, _ := m.execNFT("-j", "-a", "list", "chain", "ip", "nat", "postrouting")
-	enabledRules, err := m.parseForwardingRules(preOutput, postOutput)
-	if err != nil {
-		return err
-	}
+	enabledRules := m.listEnabledRules()
 
 	// Find the rule to disable
 	var rule *ForwardingRule
 	for i, r := range enabledRules {
-		if r.SrcPort == srcPort {
+		if r.ref() == ref {
 			rule = &enabledRules[i]
 			break
 		}
@@ -1055,25 +1915,39 @@ func (m *ForwardingManager) DisableForwardingRule(id string) error {
 		return fmt.Errorf("enabled rule not found: %s", id)
 	}
 
-	// Delete from nftables
-	if err := m.deleteDNATRuleBySrcPort(srcPort); err != nil {
-		return fmt.Errorf("failed to delete DNAT rule: %w", err)
+	// Read the limits before their rules are gone
+	limits := m.extractLimitsFromForwardChain()[ref]
+
+	// Delete from nftables in one transaction
+	tx := &Transaction{}
+	if _, err := m.queueDeleteForwardingRules(tx, ref); err != nil {
+		return err
+	}
+	if err := m.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to delete forwarding rules: %w", err)
 	}
-	m.deleteMasqueradeRuleBySrcPort(srcPort)   // Ignore errors
-	m.deleteOutputDNATRuleBySrcPort(srcPort)   // Ignore errors
-	m.deleteForwardLimitRules(srcPort)         // Ignore errors
-	m.deleteMSSClampRules(srcPort)             // Ignore errors
 
 	// Save to disabled rules
 	disabledRules, _ := m.loadDisabledRules()
 	disabledRule := ForwardingRule{
-		ID:       rule.ID,
-		SrcPort:  rule.SrcPort,
-		DstIP:    rule.DstIP,
-		DstPort:  rule.DstPort,
-		Protocol: rule.Protocol,
-		Enabled:  false,
-		Comment:  rule.Comment,
+		ID:         rule.ID,
+		SrcPort:    rule.SrcPort,
+		SrcPortEnd: rule.SrcPortEnd,
+		Interface:  rule.Interface,
+		ListenIP:   rule.ListenIP,
+		DstIP:      rule.DstIP,
+		DstIP6:     rule.DstIP6,
+		Backends:   rule.Backends,
+		Balance:    rule.Balance,
+		Sources:    rule.Sources,
+		SnatMode:   rule.SnatMode,
+		DstPort:    rule.DstPort,
+		Protocol:   rule.Protocol,
+		Enabled:    false,
+		Comment:    rule.Comment,
+		LimitMbps:  limits.mbps,
+		MaxConns:   limits.conns,
+		MaxPerIP:   limits.perIP,
 	}
 	disabledRules = append(disabledRules, disabledRule)
 	return m.saveDisabledRules(disabledRules)
@@ -1081,88 +1955,22 @@ func (m *ForwardingManager) DisableForwardingRule(id string) error {
 
 // Helper functions
 
-func (m *ForwardingManager) parseSrcPortFromID(id string) (int, error) {
+// parseForwardID returns the forward an ID refers to, by the first port for a range
+func (m *ForwardingManager) parseForwardID(id string) (forwardRef, error) {
 	if !strings.HasPrefix(id, "fwd_") {
-		return 0, fmt.Errorf("invalid forwarding rule ID: %s", id)
-	}
-	portStr := strings.TrimPrefix(id, "fwd_")
-	port, err := strconv.Atoi(portStr)
-	if err != nil {
-		return 0, fmt.Errorf("invalid forwarding rule ID: %s", id)
-	}
-	return port, nil
-}
-
-func (m *ForwardingManager) deleteDNATRuleBySrcPort(srcPort int) error {
-	output, err := m.execNFT("-j", "-a", "list", "chain", "ip", "nat", "prerouting")
-	if err != nil {
-		return err
-	}
-
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(output, &ruleset); err != nil {
-		return err
-	}
-
-	for _, obj := range ruleset.NFTables {
-		if obj.Rule == nil || obj.Rule.Chain != "prerouting" {
-			continue
-		}
-		if strings.HasPrefix(obj.Rule.Comment, fmt.Sprintf("%s %d", ForwardingComment, srcPort)) {
-			_, err := m.execNFT("delete", "rule", "ip", "nat", "prerouting", "handle", strconv.FormatInt(obj.Rule.Handle, 10))
-			return err
-		}
+		return forwardRef{}, fmt.Errorf("invalid forwarding rule ID: %s", id)
 	}
-
-	return errors.New("DNAT rule not found")
-}
-
-func (m *ForwardingManager) deleteMasqueradeRuleBySrcPort(srcPort int) error {
-	output, err := m.execNFT("-j", "-a", "list", "chain", "ip", "nat", "postrouting")
+	ref, err := parseForwardKey(strings.TrimPrefix(id, "fwd_"))
 	if err != nil {
-		return err
-	}
-
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(output, &ruleset); err != nil {
-		return err
+		return forwardRef{}, fmt.Errorf("invalid forwarding rule ID: %s", id)
 	}
-
-	for _, obj := range ruleset.NFTables {
-		if obj.Rule == nil || obj.Rule.Chain != "postrouting" {
-			continue
-		}
-		if strings.HasPrefix(obj.Rule.Comment, fmt.Sprintf("%s %d", ForwardingComment, srcPort)) {
-			_, err := m.execNFT("delete", "rule", "ip", "nat", "postrouting", "handle", strconv.FormatInt(obj.Rule.Handle, 10))
-			return err
-		}
-	}
-
-	return errors.New("MASQUERADE rule not found")
+	return ref, nil
 }
 
-func (m *ForwardingManager) deleteOutputDNATRuleBySrcPort(srcPort int) error {
-	output, err := m.execNFT("-j", "-a", "list", "chain", "ip", "nat", "output")
-	if err != nil {
-		return err
-	}
-
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(output, &ruleset); err != nil {
-		return err
-	}
-
-	for _, obj := range ruleset.NFTables {
-		if obj.Rule == nil || obj.Rule.Chain != "output" {
-			continue
-		}
-		if strings.HasPrefix(obj.Rule.Comment, fmt.Sprintf("%s %d", ForwardingComment, srcPort)) {
-			_, err := m.execNFT("delete", "rule", "ip", "nat", "output", "handle", strconv.FormatInt(obj.Rule.Handle, 10))
-			return err
-		}
-	}
-
-	return errors.New("output DNAT rule not found")
+// listEnabledRules returns forwarding rules currently in nftables (best effort, without limits)
+func (m *ForwardingManager) listEnabledRules() []ForwardingRule {
+	rules, _ := m.readEnabledRules()
+	return rules
 }
 
 func (m *ForwardingManager) loadDisabledRules() ([]ForwardingRule, error) {
@@ -1182,7 +1990,7 @@ func (m *ForwardingManager) loadDisabledRules() ([]ForwardingRule, error) {
 	// Mark all as disabled
 	for i := range file.Rules {
 		file.Rules[i].Enabled = false
-		file.Rules[i].ID = fmt.Sprintf("fwd_%d", file.Rules[i].SrcPort)
+		file.Rules[i].ID = file.Rules[i].forwardingID()
 	}
 
 	return file.Rules, nil
@@ -1204,14 +2012,37 @@ func (m *ForwardingManager) saveDisabledRules(rules []ForwardingRule) error {
 	return os.WriteFile(m.disabledForwardsPath, data, 0644)
 }
 
-// isValidIPv4 validates an IPv4 address
-func isValidIPv4(ip string) bool {
-	parsed := net.ParseIP(ip)
-	if parsed == nil {
-		return false
+// ipFamily returns the nft family of an address: "ip" for IPv4, "ip6" for IPv6,
+// or "" if it is not an IP address
+func ipFamily(addr string) string {
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "ip"
+	default:
+		return "ip6"
 	}
-	// Ensure it's IPv4 (not IPv6)
-	return parsed.To4() != nil
+}
+
+// validateDestinations checks the destination addresses of a forward: dstIP
+// of either family, and optionally an IPv6 dstIP6 next to an IPv4 dstIP
+func validateDestinations(dstIP, dstIP6 string) error {
+	family := ipFamily(dstIP)
+	if family == "" {
+		return fmt.Errorf("invalid destination IP: %s", dstIP)
+	}
+	if dstIP6 == "" {
+		return nil
+	}
+	if ipFamily(dstIP6) != "ip6" {
+		return fmt.Errorf("invalid destination IPv6 address: %s", dstIP6)
+	}
+	if family != "ip" {
+		return errors.New("a second IPv6 destination requires an IPv4 destination")
+	}
+	return nil
 }
 
 // sanitizeForwardingComment removes invalid characters from comment
@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBoundForwardsKeepTheirQuotas(t *testing.T) {
+	m := newTestManagers(t)
+
+	// Subtests would run outside the test's namespace, so the cases share it
+	for _, tc := range []struct {
+		port      int
+		direction string
+	}{
+		{7104, DirectionEgress},
+		{7105, DirectionBoth}, // shared limit, jumping to a chain of each forward
+	} {
+		first := ForwardingRule{SrcPort: tc.port, ListenIP: "192.0.2.1", DstIP: "10.0.0.5", DstPort: 80, Protocol: "tcp"}
+		second := ForwardingRule{SrcPort: tc.port, ListenIP: "192.0.2.2", DstIP: "10.0.0.6", DstPort: 80, Protocol: "tcp"}
+		for _, rule := range []ForwardingRule{first, second} {
+			if err := m.fwd.AddForwardingRule(rule); err != nil {
+				t.Fatalf("port %d: AddForwardingRule(%s): %v", tc.port, rule.key(), err)
+			}
+		}
+		if err := m.nft.AddQuota(tc.port, tc.direction, 10_000_000, 0, QuotaAction{}, "app"); err != nil {
+			t.Fatalf("port %d: AddQuota: %v", tc.port, err)
+		}
+		if tc.direction == DirectionEgress {
+			m.seedForwardUsage(t, tc.port, 4096)
+		}
+
+		// expect checks a forward's quota rule matches only dst, and jumps to
+		// the forward's own chain for a shared limit
+		expect := func(stage string, rule ForwardingRule, dst, old string) {
+			t.Helper()
+
+			ref := forwardRef{port: tc.port, bind: rule.binding()}
+			got := m.forwardQuotaRules(t, "ip", ref)
+			if len(got) != 1 || !strings.Contains(got[0], `"`+dst+`"`) || (old != "" && strings.Contains(got[0], `"`+old+`"`)) {
+				t.Errorf("port %d %s: quota of %s = %v, want one rule matching only %s", tc.port, stage, ref, got, dst)
+				return
+			}
+			if tc.direction == DirectionBoth && !strings.Contains(got[0], `"`+forwardSharedQuotaChain(ref)+`"`) {
+				t.Errorf("port %d %s: quota of %s = %s, want a jump to %s", tc.port, stage, ref, got[0], forwardSharedQuotaChain(ref))
+			}
+			if tc.direction == DirectionEgress {
+				if used := m.forwardQuotaUsed(ref); used != 4096 {
+					t.Errorf("port %d %s: usage of %s = %d, want 4096", tc.port, stage, ref, used)
+				}
+			}
+		}
+
+		expect("added", first, "10.0.0.5", "")
+		expect("added", second, "10.0.0.6", "")
+
+		edited := first
+		edited.DstIP = "10.0.0.7"
+		if err := m.fwd.EditForwardingRule(first.forwardingID(), edited); err != nil {
+			t.Fatalf("port %d: EditForwardingRule: %v", tc.port, err)
+		}
+
+		expect("edited", first, "10.0.0.7", "10.0.0.5")
+		expect("other forward", second, "10.0.0.6", "")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ForwardMetaStore keeps per-forward settings that have no place in the nft rules,
+// such as the hostname a destination is resolved from. Metadata is keyed by
+// source port and binding like forward IDs, for enabled and disabled forwards alike.
+type ForwardMetaStore struct {
+	mu   sync.Mutex
+	path string
+	meta map[forwardRef]ForwardMeta
+}
+
+// NewForwardMetaStore creates a new ForwardMetaStore
+func NewForwardMetaStore(cfg *Config) *ForwardMetaStore {
+	path := cfg.ForwardMetaPath
+	if path == "" {
+		path = "/var/lib/nft-ui/forward-meta.json"
+	}
+	return &ForwardMetaStore{
+		path: path,
+		meta: make(map[forwardRef]ForwardMeta),
+	}
+}
+
+// Load reads persisted metadata from disk
+func (s *ForwardMetaStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var file ForwardMetaFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	for _, m := range file.Forwards {
+		s.meta[m.ref()] = m
+	}
+	return nil
+}
+
+// Get returns the metadata of a forward
+func (s *ForwardMetaStore) Get(ref forwardRef) (ForwardMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.meta[ref]
+	return m, ok
+}
+
+// List returns the metadata of all forwards, sorted by source port and binding
+func (s *ForwardMetaStore) List() []ForwardMeta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]ForwardMeta, 0, len(s.meta))
+	for _, m := range s.meta {
+		list = append(list, m)
+	}
+	sortForwardMeta(list)
+	return list
+}
+
+// Set creates or replaces the metadata of a forward
+func (s *ForwardMetaStore) Set(m ForwardMeta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.meta[m.ref()] = m
+	return s.save()
+}
+
+// Delete removes all metadata of a forward
+func (s *ForwardMetaStore) Delete(ref forwardRef) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.meta[ref]; !ok {
+		return nil
+	}
+	delete(s.meta, ref)
+	return s.save()
+}
+
+// save writes all metadata to disk (requires lock to be held)
+func (s *ForwardMetaStore) save() error {
+	// Ensure directory exists
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file := ForwardMetaFile{Forwards: make([]ForwardMeta, 0, len(s.meta))}
+	for _, m := range s.meta {
+		file.Forwards = append(file.Forwards, m)
+	}
+	sortForwardMeta(file.Forwards)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.path, data, 0644)
+}
+
+// ref returns the reference of the forward the metadata belongs to
+func (m ForwardMeta) ref() forwardRef {
+	return forwardRef{port: m.Port, bind: m.Bind}
+}
+
+// sortForwardMeta sorts metadata by source port, then binding
+func sortForwardMeta(list []ForwardMeta) {
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Port != list[j].Port {
+			return list[i].Port < list[j].Port
+		}
+		return list[i].Bind < list[j].Bind
+	})
+}
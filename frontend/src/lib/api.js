@@ -35,17 +35,33 @@ export async function batchResetQuotas(ids) {
   });
 }
 
-export async function modifyQuota(id, bytes) {
+export async function modifyQuota(id, bytes, resetUsage = false, ingressBytes = 0, overQuota = {}) {
   return request(`/quotas/${encodeURIComponent(id)}`, {
     method: 'PUT',
-    body: JSON.stringify({ bytes }),
+    body: JSON.stringify({ bytes, ingress_bytes: ingressBytes, reset_usage: resetUsage, ...overQuota }),
   });
 }
 
-export async function addQuota(port, bytes, comment) {
+export async function fetchQuotaHistory(id, from, to, step) {
+  const params = new URLSearchParams();
+  if (from) params.set('from', from);
+  if (to) params.set('to', to);
+  if (step) params.set('step', step);
+  const query = params.toString();
+  return request(`/quotas/${encodeURIComponent(id)}/history${query ? `?${query}` : ''}`);
+}
+
+export async function setQuotaThresholds(id, warningPercent, exceededPercent) {
+  return request(`/quotas/${encodeURIComponent(id)}/thresholds`, {
+    method: 'PUT',
+    body: JSON.stringify({ warning_percent: warningPercent, exceeded_percent: exceededPercent }),
+  });
+}
+
+export async function addQuota(port, bytes, comment, direction = 'egress', ingressBytes = 0, overQuota = {}) {
   return request('/quotas', {
     method: 'POST',
-    body: JSON.stringify({ port, bytes, comment }),
+    body: JSON.stringify({ port, bytes, comment, direction, ingress_bytes: ingressBytes, ...overQuota }),
   });
 }
 
@@ -58,7 +74,19 @@ export async function deleteQuota(id) {
 export async function addPort(port) {
   return request('/ports', {
     method: 'POST',
-    body: JSON.stringify({ port }),
+    body: JSON.stringify({
+      port: port.port,
+      port_end: port.portEnd || 0,
+      protocol: port.protocol,
+      allowed_sources: port.sources || [],
+    }),
+  });
+}
+
+export async function setPortSources(handle, sources) {
+  return request(`/ports/${handle}/sources`, {
+    method: 'PUT',
+    body: JSON.stringify({ allowed_sources: sources }),
   });
 }
 
@@ -68,35 +96,121 @@ export async function deletePort(handle) {
   });
 }
 
+// Firewall baseline API functions
+export async function fetchBaseline() {
+  return request('/baseline');
+}
+
+export async function setBaseline(enabled) {
+  return request('/baseline', {
+    method: 'PUT',
+    body: JSON.stringify({ enabled }),
+  });
+}
+
+// Blocklist API functions
+export async function fetchBlocklist() {
+  return request('/blocklist');
+}
+
+export async function blockAddresses(addresses, timeout, reason) {
+  return request('/blocklist', {
+    method: 'POST',
+    body: JSON.stringify({ addresses, timeout, reason }),
+  });
+}
+
+// Upload a blocklist file; the browser sets the multipart content type
+export async function importBlocklist(file, timeout, reason) {
+  const form = new FormData();
+  form.append('file', file);
+  form.append('timeout', String(timeout));
+  form.append('reason', reason);
+  return request('/blocklist/import', {
+    method: 'POST',
+    headers: {},
+    body: form,
+  });
+}
+
+export async function unblockAddresses(addresses) {
+  const params = new URLSearchParams();
+  addresses.forEach((address) => params.append('address', address));
+  return request(`/blocklist?${params}`, {
+    method: 'DELETE',
+  });
+}
+
+// Auto-ban API functions
+export async function fetchAutoBans() {
+  return request('/autoban');
+}
+
+// autoBanPath returns the auto-ban endpoint of a port ({ handle }) or a forward ({ forwardId })
+function autoBanPath(target) {
+  return target.forwardId
+    ? `/forwarding/${encodeURIComponent(target.forwardId)}/autoban`
+    : `/ports/${target.handle}/autoban`;
+}
+
+export async function setAutoBan(target, config) {
+  return request(autoBanPath(target), {
+    method: 'PUT',
+    body: JSON.stringify({
+      connections: config.connections,
+      per: config.per,
+      ban_time: config.banTime,
+    }),
+  });
+}
+
+export async function deleteAutoBan(target) {
+  return request(autoBanPath(target), {
+    method: 'DELETE',
+  });
+}
+
 // Forwarding API functions
 export async function fetchForwardingRules() {
   return request('/forwarding');
 }
 
-export async function addForwardingRule(srcPort, dstIP, dstPort, protocol, comment, limitMbps) {
+// forwardingBody builds the request body of a forward add or edit
+function forwardingBody(rule) {
+  return {
+    dst_ip: rule.dstIP || '',
+    dst_host: rule.dstHost || '',
+    dst_ip6: rule.dstIP6 || '',
+    backends: rule.backends || [],
+    balance: rule.balance || '',
+    allowed_sources: rule.sources || [],
+    snat_mode: rule.snatMode || '',
+    dst_port: rule.dstPort,
+    protocol: rule.protocol,
+    comment: rule.comment,
+    limit_mbps: rule.limitMbps || 0,
+    max_connections: rule.maxConns || 0,
+    max_connections_per_ip: rule.maxPerIP || 0,
+  };
+}
+
+export async function addForwardingRule(rule) {
   return request('/forwarding', {
     method: 'POST',
     body: JSON.stringify({
-      src_port: srcPort,
-      dst_ip: dstIP,
-      dst_port: dstPort,
-      protocol,
-      comment,
-      limit_mbps: limitMbps || 0,
+      src_port: rule.srcPort,
+      src_port_end: rule.srcPortEnd || 0,
+      in_interface: rule.inInterface || '',
+      listen_ip: rule.listenIP || '',
+      ...forwardingBody(rule),
     }),
   });
 }
 
-export async function editForwardingRule(id, dstIP, dstPort, protocol, comment, limitMbps) {
+export async function editForwardingRule(id, rule) {
   return request(`/forwarding/${encodeURIComponent(id)}`, {
     method: 'PUT',
-    body: JSON.stringify({
-      dst_ip: dstIP,
-      dst_port: dstPort,
-      protocol,
-      comment,
-      limit_mbps: limitMbps || 0,
-    }),
+    body: JSON.stringify(forwardingBody(rule)),
   });
 }
 
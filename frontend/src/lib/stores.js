@@ -3,6 +3,16 @@ import {
   fetchQuotas,
   addPort,
   deletePort,
+  setPortSources,
+  fetchBaseline,
+  setBaseline as apiSetBaseline,
+  fetchBlocklist,
+  blockAddresses,
+  importBlocklist,
+  unblockAddresses,
+  fetchAutoBans,
+  setAutoBan as apiSetAutoBan,
+  deleteAutoBan as apiDeleteAutoBan,
   fetchForwardingRules,
   addForwardingRule as apiAddForwarding,
   editForwardingRule as apiEditForwarding,
@@ -133,6 +143,115 @@ export async function removeAllowedPort(handle) {
   }
 }
 
+export async function setAllowedPortSources(handle, sources) {
+  try {
+    await setPortSources(handle, sources);
+    success('Allowed sources updated successfully');
+    await loadQuotas();
+  } catch (e) {
+    errorNotify(`Failed to update allowed sources: ${e.message}`);
+    throw e;
+  }
+}
+
+// Firewall baseline state: the input chain's policy and the rules keeping it usable
+export const baseline = writable(null);
+
+export async function loadBaseline() {
+  try {
+    baseline.set(await fetchBaseline());
+  } catch (e) {
+    errorNotify(`Failed to load firewall baseline: ${e.message}`);
+  }
+}
+
+export async function setFirewallBaseline(enabled) {
+  try {
+    await apiSetBaseline(enabled);
+    success(enabled ? 'Firewall baseline enabled' : 'Firewall baseline disabled');
+    await loadBaseline();
+  } catch (e) {
+    errorNotify(`Failed to ${enabled ? 'enable' : 'disable'} firewall baseline: ${e.message}`);
+    throw e;
+  }
+}
+
+// Blocklist state
+export const blocklist = writable([]);
+export const autoBans = writable([]);
+
+// Loads the blocklist along with the auto-bans and the addresses they banned
+export async function loadBlocklist() {
+  try {
+    const [data, auto] = await Promise.all([fetchBlocklist(), fetchAutoBans()]);
+    blocklist.set(data.addresses || []);
+    autoBans.set(auto.auto_bans || []);
+  } catch (e) {
+    errorNotify(`Failed to load blocklist: ${e.message}`);
+  }
+}
+
+// Auto-ban actions; target is { handle } for a port or { forwardId } for a forward
+export async function saveAutoBan(target, config) {
+  try {
+    await apiSetAutoBan(target, config);
+    success('Auto-ban saved');
+    await loadBlocklist();
+  } catch (e) {
+    errorNotify(`Failed to save auto-ban: ${e.message}`);
+    throw e;
+  }
+}
+
+export async function removeAutoBan(target) {
+  try {
+    await apiDeleteAutoBan(target);
+    success('Auto-ban removed');
+    await loadBlocklist();
+  } catch (e) {
+    errorNotify(`Failed to remove auto-ban: ${e.message}`);
+    throw e;
+  }
+}
+
+export async function addToBlocklist(addresses, timeout, reason) {
+  try {
+    await blockAddresses(addresses, timeout, reason);
+    success(addresses.length === 1 ? `${addresses[0]} blocked` : `${addresses.length} addresses blocked`);
+    await loadBlocklist();
+  } catch (e) {
+    errorNotify(`Failed to block: ${e.message}`);
+    throw e;
+  }
+}
+
+export async function importBlocklistFile(file, timeout, reason) {
+  try {
+    const data = await importBlocklist(file, timeout, reason);
+    const skipped = data.skipped || [];
+    if (skipped.length > 0) {
+      addNotification(`Imported ${data.added} addresses, skipped ${skipped.length}: ${skipped.slice(0, 3).join('; ')}${skipped.length > 3 ? '; ...' : ''}`, 'warning', 8000);
+    } else {
+      success(`Imported ${data.added} addresses`);
+    }
+    await loadBlocklist();
+  } catch (e) {
+    errorNotify(`Failed to import blocklist: ${e.message}`);
+    throw e;
+  }
+}
+
+export async function removeFromBlocklist(address) {
+  try {
+    await unblockAddresses([address]);
+    success(`${address} unblocked`);
+    await loadBlocklist();
+  } catch (e) {
+    errorNotify(`Failed to unblock: ${e.message}`);
+    throw e;
+  }
+}
+
 // Forwarding state
 export const forwardingRules = writable([]);
 export const forwardingLoading = writable(false);
@@ -161,9 +280,9 @@ export async function loadForwardingRules() {
 }
 
 // Add forwarding rule
-export async function addForwardingRule(srcPort, dstIP, dstPort, protocol, comment, limitMbps) {
+export async function addForwardingRule(rule) {
   try {
-    await apiAddForwarding(srcPort, dstIP, dstPort, protocol, comment, limitMbps);
+    await apiAddForwarding(rule);
     success('Forwarding rule added');
     await loadForwardingRules();
   } catch (e) {
@@ -173,9 +292,9 @@ export async function addForwardingRule(srcPort, dstIP, dstPort, protocol, comme
 }
 
 // Edit forwarding rule
-export async function editForwardingRule(id, dstIP, dstPort, protocol, comment, limitMbps) {
+export async function editForwardingRule(id, rule) {
   try {
-    await apiEditForwarding(id, dstIP, dstPort, protocol, comment, limitMbps);
+    await apiEditForwarding(id, rule);
     success('Forwarding rule updated');
     await loadForwardingRules();
   } catch (e) {
@@ -22,6 +22,38 @@ export function parseBytes(value, unit) {
   return value * (units[unit] || 1);
 }
 
+// Split bytes into a value and the largest unit accepted by parseBytes
+export function splitBytes(bytes) {
+  if (bytes >= 1000 * 1000 * 1000 * 1000) {
+    return { value: (bytes / (1000 * 1000 * 1000 * 1000)).toString(), unit: 'TB' };
+  }
+  if (bytes >= 1000 * 1000 * 1000) {
+    return { value: (bytes / (1000 * 1000 * 1000)).toString(), unit: 'GB' };
+  }
+  return { value: (bytes / (1000 * 1000)).toString(), unit: 'MB' };
+}
+
+// Format an ISO timestamp in the browser's locale
+export function formatDateTime(value) {
+  if (!value) return '-';
+  return new Date(value).toLocaleString();
+}
+
+// Format a number of seconds as a short duration, e.g. "2d 3h", "5m 10s"
+export function formatDuration(seconds) {
+  if (seconds <= 0) return '0s';
+  const units = [['d', 86400], ['h', 3600], ['m', 60], ['s', 1]];
+  const parts = [];
+  for (const [unit, size] of units) {
+    if (seconds >= size) {
+      parts.push(`${Math.floor(seconds / size)}${unit}`);
+      seconds %= size;
+    }
+    if (parts.length === 2) break;
+  }
+  return parts.join(' ');
+}
+
 // Format percentage
 export function formatPercent(value) {
   return value.toFixed(1) + '%';
@@ -39,13 +71,6 @@ export function getStatusColor(status) {
   }
 }
 
-// Get progress bar color based on percentage
-export function getProgressColor(percent) {
-  if (percent >= 90) return 'var(--color-danger)';
-  if (percent >= 70) return 'var(--color-warning)';
-  return 'var(--color-ok)';
-}
-
 // Validate IPv4 address
 export function isValidIPv4(ip) {
   if (!ip) return false;
@@ -54,6 +79,214 @@ export function isValidIPv4(ip) {
   return pattern.test(ip);
 }
 
+// Parse a port ("8080") or an inclusive port range ("30000-30100").
+// Returns { start, end } with end 0 for a single port, or null if invalid.
+export function parsePortRange(value) {
+  const match = String(value).trim().match(/^(\d+)(?:\s*-\s*(\d+))?$/);
+  if (!match) return null;
+  const start = parseInt(match[1], 10);
+  const end = match[2] ? parseInt(match[2], 10) : 0;
+  if (start < 1 || start > 65535) return null;
+  if (end && (end <= start || end > 65535)) return null;
+  return { start, end };
+}
+
+// Format the port or port range of an allowed port with its protocol, e.g. "30000-30100/udp"
+export function formatAllowedPort(port) {
+  const ports = port.port_end ? `${port.port}-${port.port_end}` : `${port.port}`;
+  return `${ports}/${port.protocol === 'both' ? 'tcp+udp' : port.protocol}`;
+}
+
+// Target of an allowed port's auto-ban, as listed by the API: "port_22/tcp"
+export function portAutoBanTarget(port) {
+  const ports = port.port_end ? `${port.port}-${port.port_end}` : `${port.port}`;
+  return `port_${ports}/${port.protocol}`;
+}
+
+// Format the thresholds of an auto-ban, e.g. "over 10/minute, banned 1h"
+export function formatAutoBan(ban) {
+  return `over ${ban.connections}/${ban.per}, banned ${formatDuration(ban.ban_time)}`;
+}
+
+// Format the source ports of a forwarding rule
+export function formatSrcPorts(rule) {
+  return rule.src_port_end ? `${rule.src_port}-${rule.src_port_end}` : `${rule.src_port}`;
+}
+
+// Format the interface and listen address a forwarding rule is bound to, if any
+export function formatBinding(rule) {
+  const parts = [];
+  if (rule.in_interface) parts.push(`iif ${rule.in_interface}`);
+  if (rule.listen_ip) parts.push(rule.listen_ip);
+  return parts.join(' / ');
+}
+
+// Format the destination ports of a forwarding rule; a range maps to the same number of ports
+export function formatDstPorts(rule) {
+  if (!rule.src_port_end) return `${rule.dst_port}`;
+  return `${rule.dst_port}-${rule.dst_port + rule.src_port_end - rule.src_port}`;
+}
+
+// Validate IPv6 address
+export function isValidIPv6(ip) {
+  if (!ip || !ip.includes(':')) return false;
+  try {
+    new URL(`http://[${ip}]/`);
+    return true;
+  } catch {
+    return false;
+  }
+}
+
+// Validate IPv4 or IPv6 address
+export function isValidIP(ip) {
+  return isValidIPv4(ip) || isValidIPv6(ip);
+}
+
+// Validate a DNS hostname; an all-numeric last label is taken for a mistyped IP
+export function isValidHostname(host) {
+  if (!host || host.length > 253) return false;
+  const label = '[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?';
+  const pattern = new RegExp(`^(?:${label}\\.)*${label}\\.?$`);
+  return pattern.test(host) && !/^[0-9]+$/.test(host.split('.').filter(Boolean).pop());
+}
+
+// Validate a network interface name as accepted by the kernel
+export function isValidInterface(name) {
+  return /^[a-zA-Z0-9_.-]{1,15}$/.test(name);
+}
+
+// Format an address with a port, bracketing IPv6 addresses
+export function formatHostPort(ip, port) {
+  return ip?.includes(':') ? `[${ip}]:${port}` : `${ip}:${port}`;
+}
+
+// Format a forward's load balancing mode for display
+export function formatBalance(balance) {
+  switch (balance) {
+    case 'round-robin':
+      return 'Round robin';
+    case 'source-hash':
+      return 'Source hash';
+    default:
+      return 'Random';
+  }
+}
+
+// Format a forward's source NAT mode: "masquerade", "snat:<ip>" or "none"
+export function formatSnatMode(snatMode) {
+  if (snatMode?.startsWith('snat:')) {
+    return `SNAT to ${snatMode.slice(5)}`;
+  }
+  if (snatMode === 'none') {
+    return 'None (client addresses kept)';
+  }
+  return 'Masquerade';
+}
+
+// Build a forward's source NAT mode from the form's mode and SNAT address.
+// Returns { value } or { error }.
+export function buildSnatMode(mode, address) {
+  if (mode !== 'snat') {
+    return { value: mode };
+  }
+  const addr = address.trim();
+  if (!isValidIP(addr)) {
+    return { error: 'Please enter a valid IPv4 or IPv6 SNAT address' };
+  }
+  return { value: `snat:${addr}` };
+}
+
+// Format the connection limits of a forwarding rule
+export function formatConnLimits(rule) {
+  const parts = [];
+  if (rule.max_connections > 0) parts.push(`${rule.max_connections} total`);
+  if (rule.max_connections_per_ip > 0) parts.push(`${rule.max_connections_per_ip} per client IP`);
+  return parts.join(', ');
+}
+
+// Build the connection limits of a forward from form values.
+// Returns { value: { maxConns, maxPerIP } } or { error }.
+export function buildConnLimits(maxConns, maxPerIP) {
+  const total = parseInt(maxConns, 10);
+  const perIP = parseInt(maxPerIP, 10);
+  if (isNaN(total) || total < 0 || isNaN(perIP) || perIP < 0) {
+    return { error: 'Connection limits must be 0 or positive (0 = no limit)' };
+  }
+  if (total > 0 && perIP > total) {
+    return { error: 'The per client limit cannot exceed the total limit' };
+  }
+  return { value: { maxConns: total, maxPerIP: perIP } };
+}
+
+// Build the backends of a load-balanced forward from form rows of { ip, weight }.
+// Returns { value } or { error }.
+export function buildBackends(rows) {
+  const backends = [];
+  for (const row of rows) {
+    const ip = row.ip.trim();
+    if (!isValidIP(ip)) {
+      return { error: `Invalid backend IP: ${ip || '(empty)'}` };
+    }
+    if (backends.some((b) => b.ip === ip)) {
+      return { error: `Duplicate backend: ${ip}` };
+    }
+    const weight = parseInt(row.weight, 10);
+    if (isNaN(weight) || weight < 1 || weight > 100) {
+      return { error: `Weight of ${ip} must be between 1 and 100` };
+    }
+    backends.push({ ip, weight });
+  }
+  if (backends.length < 2) {
+    return { error: 'Load balancing needs at least two backends' };
+  }
+  const v6 = isValidIPv6(backends[0].ip);
+  if (backends.some((b) => isValidIPv6(b.ip) !== v6)) {
+    return { error: 'Backends must be all IPv4 or all IPv6' };
+  }
+  return { value: backends };
+}
+
+// Parse the allowed sources of a forward or port from comma or space separated addresses and CIDRs.
+// Returns { value } or { error }; an empty list allows any source.
+export function parseSources(text) {
+  const sources = text.split(/[\s,]+/).filter(Boolean);
+  for (const src of sources) {
+    const [ip, len, ...rest] = src.split('/');
+    const max = isValidIPv6(ip) ? 128 : 32;
+    const prefixOk = len === undefined || (/^\d+$/.test(len) && parseInt(len, 10) <= max);
+    if (!isValidIP(ip) || !prefixOk || rest.length > 0) {
+      return { error: `Invalid allowed source: ${src}` };
+    }
+  }
+  return { value: sources };
+}
+
+// Format a forward's destination health for display
+export function formatHealth(health) {
+  let text = health.status === 'up' ? 'Up' : health.status === 'down' ? 'Down' : 'Unknown';
+  text += ` (${health.target})`;
+  if (health.failed_over) {
+    text += ', failed over to standby';
+  }
+  if (health.auto_disabled) {
+    text += ', disabled until it recovers';
+  }
+  return text;
+}
+
+// Get the color of a health status
+export function healthColor(status) {
+  switch (status) {
+    case 'up':
+      return 'var(--success)';
+    case 'down':
+      return 'var(--danger)';
+    default:
+      return 'var(--text-muted)';
+  }
+}
+
 // Format protocol for display
 export function formatProtocol(protocol) {
   switch (protocol) {
@@ -67,3 +300,49 @@ export function formatProtocol(protocol) {
       return protocol?.toUpperCase() || 'Unknown';
   }
 }
+
+// Format a quota's over-quota action for display
+export function formatQuotaAction(quota) {
+  switch (quota.action) {
+    case 'reject':
+      return 'Reject';
+    case 'ratelimit':
+      return `Throttle to ${quota.rate_mbps} Mbps`;
+    case 'mark':
+      return `Mark 0x${quota.mark.toString(16)}`;
+    default:
+      return 'Drop';
+  }
+}
+
+// Build the over-quota action fields of a quota request from form values.
+// Returns { value } or { error }.
+export function buildQuotaAction(action, rateMbps, mark) {
+  if (action === 'ratelimit') {
+    const rate = parseInt(rateMbps, 10);
+    if (isNaN(rate) || rate <= 0) {
+      return { error: 'Rate limit must be a positive number of Mbps' };
+    }
+    return { value: { action, rate_mbps: rate } };
+  }
+  if (action === 'mark') {
+    const value = Number(mark);
+    if (!Number.isInteger(value) || value <= 0 || value > 0xffffffff) {
+      return { error: 'Mark must be between 1 and 0xffffffff' };
+    }
+    return { value: { action, mark: value } };
+  }
+  return { value: { action } };
+}
+
+// Format quota direction for display
+export function formatDirection(direction) {
+  switch (direction) {
+    case 'ingress':
+      return 'Ingress';
+    case 'both':
+      return 'Ingress + Egress';
+    default:
+      return 'Egress';
+  }
+}
@@ -1,30 +1,48 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
 // Handler holds dependencies for HTTP handlers
 type Handler struct {
-	nft      *NFTManager
-	fwd      *ForwardingManager
-	cfg      *Config
-	logger   *log.Logger
-	tokenGen *TokenGenerator
+	nft       *NFTManager
+	fwd       *ForwardingManager
+	cfg       *Config
+	logger    *log.Logger
+	tokenGen  *TokenGenerator
+	scheduler *ResetScheduler
+	ledger    *QuotaLedger
+	history   *UsageCollector
+	alerts    *AlertManager
+	health    *HealthChecker
+	block     *BlocklistManager
+	baseline  *BaselineManager
 }
 
 // NewHandler creates a new Handler
-func NewHandler(nft *NFTManager, fwd *ForwardingManager, cfg *Config, logger *log.Logger, tokenGen *TokenGenerator) *Handler {
+func NewHandler(nft *NFTManager, fwd *ForwardingManager, cfg *Config, logger *log.Logger, tokenGen *TokenGenerator, scheduler *ResetScheduler, ledger *QuotaLedger, history *UsageCollector, alerts *AlertManager, health *HealthChecker, block *BlocklistManager, baseline *BaselineManager) *Handler {
 	return &Handler{
-		nft:      nft,
-		fwd:      fwd,
-		cfg:      cfg,
-		logger:   logger,
-		tokenGen: tokenGen,
+		nft:       nft,
+		fwd:       fwd,
+		cfg:       cfg,
+		logger:    logger,
+		tokenGen:  tokenGen,
+		scheduler: scheduler,
+		ledger:    ledger,
+		history:   history,
+		alerts:    alerts,
+		health:    health,
+		block:     block,
+		baseline:  baseline,
 	}
 }
 
@@ -35,6 +53,21 @@ func (h *Handler) saveRuleset() {
 	}
 }
 
+// recordLimitChange writes a quota limit change to the ledger
+func (h *Handler) recordLimitChange(port int, action string, oldBytes, newBytes int64, note string) {
+	entry := LedgerEntry{
+		Port:       port,
+		Action:     action,
+		DeltaBytes: newBytes - oldBytes,
+		OldBytes:   oldBytes,
+		NewBytes:   newBytes,
+		Note:       note,
+	}
+	if err := h.ledger.Record(entry); err != nil {
+		h.logger.Printf("Error recording ledger entry for port %d: %v", port, err)
+	}
+}
+
 // ListQuotas handles GET /api/v1/quotas
 func (h *Handler) ListQuotas(c echo.Context) error {
 	quotas, err := h.nft.ListQuotas()
@@ -133,7 +166,23 @@ func (h *Handler) ModifyQuota(c echo.Context) error {
 		})
 	}
 
-	if err := h.nft.ModifyQuota(id, req.Bytes); err != nil {
+	if req.Action != "" {
+		if _, err := req.QuotaAction.normalize(); err != nil {
+			return c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+		}
+	}
+
+	change, err := h.nft.ModifyQuota(id, req.Bytes, req.IngressBytes, req.QuotaAction, req.ResetUsage)
+	if err != nil {
+		if errors.Is(err, errQuotaLimit) {
+			return c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+		}
 		h.logger.Printf("Error modifying quota %s: %v", id, err)
 		return c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
@@ -141,17 +190,22 @@ func (h *Handler) ModifyQuota(c echo.Context) error {
 		})
 	}
 
-	h.logger.Printf("Quota modified: %s to %d bytes", id, req.Bytes)
+	h.recordLimitChange(change.Port, "modify", change.OldBytes, change.NewBytes, "")
+
+	h.logger.Printf("Quota modified: %s to %d bytes (reset usage: %v, action: %q)", id, change.NewBytes, req.ResetUsage, req.Action)
 	h.saveRuleset()
-	return c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Message: "Quota modified successfully",
+	return c.JSON(http.StatusOK, QuotaLimitResponse{
+		Success:          true,
+		Message:          "Quota modified successfully",
+		QuotaLimitChange: change,
 	})
 }
 
-// AddQuota handles POST /api/v1/quotas
-func (h *Handler) AddQuota(c echo.Context) error {
-	var req AddQuotaRequest
+// TopUpQuota handles POST /api/v1/quotas/:id/topup
+func (h *Handler) TopUpQuota(c echo.Context) error {
+	id := c.Param("id")
+
+	var req TopUpQuotaRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
@@ -159,59 +213,143 @@ func (h *Handler) AddQuota(c echo.Context) error {
 		})
 	}
 
-	if req.Port < 1 || req.Port > 65535 {
+	if req.Bytes <= 0 {
 		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
-			Error:   "Port must be between 1 and 65535",
+			Error:   "Top-up must be positive",
 		})
 	}
 
-	if req.Bytes <= 0 {
-		return c.JSON(http.StatusBadRequest, APIResponse{
+	change, err := h.nft.TopUpQuota(id, req.Bytes, req.Direction)
+	if err != nil {
+		if errors.Is(err, errQuotaLimit) {
+			return c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+		}
+		h.logger.Printf("Error topping up quota %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
-			Error:   "Quota limit must be positive",
+			Error:   err.Error(),
 		})
 	}
 
-	if err := h.nft.AddQuota(req.Port, req.Bytes, req.Comment); err != nil {
-		h.logger.Printf("Error adding quota for port %d: %v", req.Port, err)
+	h.recordLimitChange(change.Port, "topup", change.OldBytes, change.NewBytes, sanitizeComment(req.Note))
+
+	h.logger.Printf("Quota topped up: %s by %d bytes (direction: %q)", id, req.Bytes, req.Direction)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, QuotaLimitResponse{
+		Success:          true,
+		Message:          "Quota topped up successfully",
+		QuotaLimitChange: change,
+	})
+}
+
+// GetQuotaLedger handles GET /api/v1/quotas/:id/ledger
+func (h *Handler) GetQuotaLedger(c echo.Context) error {
+	id := c.Param("id")
+
+	quota, err := h.nft.GetQuota(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	entries, err := h.ledger.List(quota.Port)
+	if err != nil {
+		h.logger.Printf("Error reading quota ledger: %v", err)
 		return c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
 			Error:   err.Error(),
 		})
 	}
 
-	h.logger.Printf("Quota added: port %d, limit %d bytes", req.Port, req.Bytes)
-	h.saveRuleset()
-	return c.JSON(http.StatusCreated, APIResponse{
-		Success: true,
-		Message: "Quota added successfully",
+	return c.JSON(http.StatusOK, QuotaLedgerResponse{
+		Port:    quota.Port,
+		Entries: entries,
 	})
 }
 
-// DeleteQuota handles DELETE /api/v1/quotas/:id
-func (h *Handler) DeleteQuota(c echo.Context) error {
+// GetQuotaHistory handles GET /api/v1/quotas/:id/history
+func (h *Handler) GetQuotaHistory(c echo.Context) error {
+	if h.history == nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Usage history is disabled",
+		})
+	}
+
 	id := c.Param("id")
 
-	if err := h.nft.DeleteQuota(id); err != nil {
-		h.logger.Printf("Error deleting quota %s: %v", id, err)
-		return c.JSON(http.StatusInternalServerError, APIResponse{
+	quota, err := h.nft.GetQuota(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
 			Success: false,
 			Error:   err.Error(),
 		})
 	}
 
-	h.logger.Printf("Quota deleted: %s", id)
-	h.saveRuleset()
-	return c.JSON(http.StatusOK, APIResponse{
-		Success: true,
-		Message: "Quota deleted successfully",
+	to := time.Now()
+	if v := c.QueryParam("to"); v != "" {
+		if to, err = parseHistoryTime(v); err != nil {
+			return c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   "Invalid 'to': " + err.Error(),
+			})
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if v := c.QueryParam("from"); v != "" {
+		if from, err = parseHistoryTime(v); err != nil {
+			return c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   "Invalid 'from': " + err.Error(),
+			})
+		}
+	}
+
+	var step time.Duration
+	if v := c.QueryParam("step"); v != "" {
+		if step, err = parseHistoryStep(v); err != nil {
+			return c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   "Invalid 'step': " + err.Error(),
+			})
+		}
+	} else {
+		step = h.history.defaultStep(to.Sub(from))
+	}
+	from = from.Truncate(step)
+
+	points, err := h.history.History(quota.Port, from, to, step)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	var total int64
+	for _, p := range points {
+		total += p.Bytes
+	}
+
+	return c.JSON(http.StatusOK, QuotaHistoryResponse{
+		Port:       quota.Port,
+		From:       from,
+		To:         to,
+		Step:       int64(step / time.Second),
+		TotalBytes: total,
+		Points:     points,
 	})
 }
 
-// AddPort handles POST /api/v1/ports
-func (h *Handler) AddPort(c echo.Context) error {
-	var req AddPortRequest
+// AddQuota handles POST /api/v1/quotas
+func (h *Handler) AddQuota(c echo.Context) error {
+	var req AddQuotaRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
@@ -226,147 +364,152 @@ func (h *Handler) AddPort(c echo.Context) error {
 		})
 	}
 
-	if err := h.nft.AddAllowedPort(req.Port); err != nil {
-		h.logger.Printf("Error adding allowed port %d: %v", req.Port, err)
-		return c.JSON(http.StatusInternalServerError, APIResponse{
+	if req.Bytes <= 0 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
-			Error:   err.Error(),
+			Error:   "Quota limit must be positive",
 		})
 	}
 
-	h.logger.Printf("Allowed port added: %d", req.Port)
-	h.saveRuleset()
-	return c.JSON(http.StatusCreated, APIResponse{
-		Success: true,
-		Message: "Port added successfully",
-	})
-}
+	switch req.Direction {
+	case "", DirectionEgress, DirectionIngress, DirectionBoth:
+	default:
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Direction must be egress, ingress or both",
+		})
+	}
 
-// DeletePort handles DELETE /api/v1/ports/:handle
-func (h *Handler) DeletePort(c echo.Context) error {
-	handleStr := c.Param("handle")
-	handle, err := strconv.ParseInt(handleStr, 10, 64)
+	if req.IngressBytes < 0 || (req.IngressBytes > 0 && req.Direction != DirectionBoth) {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "A separate ingress limit requires direction both",
+		})
+	}
+
+	action, err := req.QuotaAction.normalize()
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
-			Error:   "Invalid handle",
+			Error:   err.Error(),
 		})
 	}
 
-	if err := h.nft.DeleteAllowedPort(handle); err != nil {
-		h.logger.Printf("Error deleting allowed port handle %d: %v", handle, err)
+	if err := h.nft.AddQuota(req.Port, req.Direction, req.Bytes, req.IngressBytes, action, req.Comment); err != nil {
+		h.logger.Printf("Error adding quota for port %d: %v", req.Port, err)
 		return c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
 			Error:   err.Error(),
 		})
 	}
 
-	h.logger.Printf("Allowed port deleted: handle %d", handle)
+	h.recordLimitChange(req.Port, "add", 0, req.Bytes+req.IngressBytes, "")
+
+	h.logger.Printf("Quota added: port %d, direction %q, limit %d bytes (ingress %d bytes), action %q", req.Port, req.Direction, req.Bytes, req.IngressBytes, action.Action)
 	h.saveRuleset()
-	return c.JSON(http.StatusOK, APIResponse{
+	return c.JSON(http.StatusCreated, APIResponse{
 		Success: true,
-		Message: "Port deleted successfully",
+		Message: "Quota added successfully",
 	})
 }
 
-// ListQuotasWithTokens handles GET /api/v1/quotas when tokens are enabled
-// Returns quotas with their query tokens for the admin panel
-func (h *Handler) ListQuotasWithTokens(c echo.Context) error {
-	quotas, err := h.nft.ListQuotas()
-	if err != nil {
-		h.logger.Printf("Error listing quotas: %v", err)
+// DeleteQuota handles DELETE /api/v1/quotas/:id
+func (h *Handler) DeleteQuota(c echo.Context) error {
+	id := c.Param("id")
+
+	// Look up the port first so its reset schedule can be removed too
+	quota, _ := h.nft.GetQuota(id)
+
+	if err := h.nft.DeleteQuota(id); err != nil {
+		h.logger.Printf("Error deleting quota %s: %v", id, err)
 		return c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
 			Error:   err.Error(),
 		})
 	}
 
-	allowedPorts, err := h.nft.ListAllowedPorts()
-	if err != nil {
-		h.logger.Printf("Error listing allowed ports: %v", err)
-		allowedPorts = []AllowedPort{}
-	}
-
-	// Add tokens to quotas
-	quotasWithTokens := make([]QuotaWithToken, len(quotas))
-	for i, q := range quotas {
-		quotasWithTokens[i] = QuotaWithToken{
-			QuotaRule: q,
-			Token:     h.tokenGen.Generate(q.Port),
+	if quota != nil {
+		if err := h.scheduler.Delete(quota.Port); err != nil {
+			h.logger.Printf("Error deleting reset schedule for port %d: %v", quota.Port, err)
+		}
+		if h.alerts != nil {
+			if err := h.alerts.DeleteQuota(quota.Port); err != nil {
+				h.logger.Printf("Error deleting alert state for port %d: %v", quota.Port, err)
+			}
 		}
 	}
 
-	return c.JSON(http.StatusOK, QuotasResponseWithTokens{
-		Quotas:          quotasWithTokens,
-		AllowedPorts:    allowedPorts,
-		ReadOnly:        h.cfg.ReadOnly,
-		RefreshInterval: h.cfg.RefreshInterval,
+	h.logger.Printf("Quota deleted: %s", id)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Quota deleted successfully",
 	})
 }
 
-// QueryByToken handles GET /api/v1/public/query/:token (NO AUTH REQUIRED)
-// Allows users to query quota usage with a token
-func (h *Handler) QueryByToken(c echo.Context) error {
-	token := c.Param("token")
+// SetQuotaThresholds handles PUT /api/v1/quotas/:id/thresholds
+func (h *Handler) SetQuotaThresholds(c echo.Context) error {
+	id := c.Param("id")
 
-	// Validate token format
-	if !IsValidTokenFormat(token) {
+	var req QuotaThresholds
+	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
-			Error:   "Invalid token format",
+			Error:   "Invalid request body",
 		})
 	}
 
-	// Get all quotas
-	quotas, err := h.nft.ListQuotas()
+	quota, err := h.nft.GetQuota(id)
 	if err != nil {
-		h.logger.Printf("Error listing quotas for token query: %v", err)
-		return c.JSON(http.StatusInternalServerError, APIResponse{
+		return c.JSON(http.StatusNotFound, APIResponse{
 			Success: false,
-			Error:   "Internal server error",
+			Error:   err.Error(),
 		})
 	}
 
-	// Find matching quota
-	quota := h.tokenGen.FindQuotaByToken(token, quotas)
-	if quota == nil {
-		// Return generic error to prevent enumeration
-		return c.JSON(http.StatusNotFound, APIResponse{
+	if err := h.nft.SetQuotaThresholds(id, req); err != nil {
+		h.logger.Printf("Error setting thresholds for %s: %v", id, err)
+		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
-			Error:   "Token not found",
+			Error:   err.Error(),
 		})
 	}
 
-	return c.JSON(http.StatusOK, PublicQueryResponse{
-		Port:         quota.Port,
-		UsedBytes:    quota.UsedBytes,
-		QuotaBytes:   quota.QuotaBytes,
-		UsagePercent: quota.UsagePercent,
-		Status:       quota.Status,
-		Comment:      quota.Comment,
+	h.logger.Printf("Quota thresholds set: port %d warning=%v%% exceeded=%v%%", quota.Port, req.WarningPercent, req.ExceededPercent)
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Quota thresholds saved successfully",
 	})
 }
 
-// ListForwarding handles GET /api/v1/forwarding
-func (h *Handler) ListForwarding(c echo.Context) error {
-	rules, err := h.fwd.ListForwardingRules()
+// GetQuotaSchedule handles GET /api/v1/quotas/:id/schedule
+func (h *Handler) GetQuotaSchedule(c echo.Context) error {
+	id := c.Param("id")
+
+	quota, err := h.nft.GetQuota(id)
 	if err != nil {
-		h.logger.Printf("Error listing forwarding rules: %v", err)
-		return c.JSON(http.StatusInternalServerError, APIResponse{
+		return c.JSON(http.StatusNotFound, APIResponse{
 			Success: false,
 			Error:   err.Error(),
 		})
 	}
 
-	return c.JSON(http.StatusOK, ForwardingResponse{
-		Rules:    rules,
-		ReadOnly: h.cfg.ReadOnly,
-	})
+	schedule, ok := h.scheduler.Get(quota.Port)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "No reset schedule for this quota",
+		})
+	}
+
+	return c.JSON(http.StatusOK, schedule)
 }
 
-// AddForwarding handles POST /api/v1/forwarding
-func (h *Handler) AddForwarding(c echo.Context) error {
-	var req AddForwardingRequest
+// SetQuotaSchedule handles PUT /api/v1/quotas/:id/schedule
+func (h *Handler) SetQuotaSchedule(c echo.Context) error {
+	id := c.Param("id")
+
+	var req SetResetScheduleRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
@@ -374,63 +517,635 @@ func (h *Handler) AddForwarding(c echo.Context) error {
 		})
 	}
 
-	if req.SrcPort < 1 || req.SrcPort > 65535 {
-		return c.JSON(http.StatusBadRequest, APIResponse{
+	quota, err := h.nft.GetQuota(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
 			Success: false,
-			Error:   "Source port must be between 1 and 65535",
+			Error:   err.Error(),
 		})
 	}
 
-	if req.DstPort < 1 || req.DstPort > 65535 {
+	schedule, err := h.scheduler.Set(quota.Port, req)
+	if err != nil {
+		h.logger.Printf("Error setting reset schedule for %s: %v", id, err)
 		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
-			Error:   "Destination port must be between 1 and 65535",
+			Error:   err.Error(),
 		})
 	}
 
-	if req.Protocol != "tcp" && req.Protocol != "udp" && req.Protocol != "both" {
-		return c.JSON(http.StatusBadRequest, APIResponse{
-			Success: false,
-			Error:   "Protocol must be 'tcp', 'udp', or 'both'",
-		})
-	}
+	h.logger.Printf("Reset schedule set: port %d %s, next reset %s", quota.Port, schedule.Type, schedule.NextReset.Format(time.RFC3339))
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Reset schedule saved successfully",
+	})
+}
 
-	if req.LimitMbps < 0 {
-		return c.JSON(http.StatusBadRequest, APIResponse{
+// DeleteQuotaSchedule handles DELETE /api/v1/quotas/:id/schedule
+func (h *Handler) DeleteQuotaSchedule(c echo.Context) error {
+	id := c.Param("id")
+
+	quota, err := h.nft.GetQuota(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
 			Success: false,
-			Error:   "Limit must be >= 0 (0 = no limit)",
+			Error:   err.Error(),
 		})
 	}
 
-	if err := h.fwd.AddForwardingRule(req.SrcPort, req.DstIP, req.DstPort, req.Protocol, req.Comment, req.LimitMbps); err != nil {
-		h.logger.Printf("Error adding forwarding rule: %v", err)
+	if err := h.scheduler.Delete(quota.Port); err != nil {
+		h.logger.Printf("Error deleting reset schedule for %s: %v", id, err)
 		return c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
 			Error:   err.Error(),
 		})
 	}
 
-	h.logger.Printf("Forwarding rule added: %d -> %s:%d (%s) limit=%d Mbps", req.SrcPort, req.DstIP, req.DstPort, req.Protocol, req.LimitMbps)
-	h.saveRuleset()
-	return c.JSON(http.StatusCreated, APIResponse{
+	h.logger.Printf("Reset schedule deleted: port %d", quota.Port)
+	return c.JSON(http.StatusOK, APIResponse{
 		Success: true,
-		Message: "Forwarding rule added successfully",
+		Message: "Reset schedule deleted successfully",
 	})
 }
 
-// EditForwarding handles PUT /api/v1/forwarding/:id
-func (h *Handler) EditForwarding(c echo.Context) error {
+// alertsDisabled is the response for alert endpoints when alerting failed to initialize
+func alertsDisabled(c echo.Context) error {
+	return c.JSON(http.StatusNotFound, APIResponse{
+		Success: false,
+		Error:   "Alerting is disabled",
+	})
+}
+
+// GetQuotaAlerts handles GET /api/v1/quotas/:id/alerts
+func (h *Handler) GetQuotaAlerts(c echo.Context) error {
+	if h.alerts == nil {
+		return alertsDisabled(c)
+	}
+
 	id := c.Param("id")
 
-	var req EditForwardingRequest
-	if err := c.Bind(&req); err != nil {
-		return c.JSON(http.StatusBadRequest, APIResponse{
+	quota, err := h.nft.GetQuota(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
 			Success: false,
-			Error:   "Invalid request body",
+			Error:   err.Error(),
 		})
 	}
 
-	if req.DstPort < 1 || req.DstPort > 65535 {
+	thresholds, custom := h.alerts.Thresholds(quota.Port)
+	return c.JSON(http.StatusOK, AlertThresholdsResponse{
+		Port:       quota.Port,
+		Thresholds: thresholds,
+		Custom:     custom,
+	})
+}
+
+// SetQuotaAlerts handles PUT /api/v1/quotas/:id/alerts
+func (h *Handler) SetQuotaAlerts(c echo.Context) error {
+	if h.alerts == nil {
+		return alertsDisabled(c)
+	}
+
+	id := c.Param("id")
+
+	var req SetAlertThresholdsRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+
+	quota, err := h.nft.GetQuota(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if err := h.alerts.SetThresholds(quota.Port, req.Thresholds); err != nil {
+		h.logger.Printf("Error setting alert thresholds for %s: %v", id, err)
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Alert thresholds set: port %d %v", quota.Port, req.Thresholds)
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Alert thresholds saved successfully",
+	})
+}
+
+// ListAlertDeliveries handles GET /api/v1/alerts/deliveries
+func (h *Handler) ListAlertDeliveries(c echo.Context) error {
+	if h.alerts == nil {
+		return alertsDisabled(c)
+	}
+
+	limit := 100
+	if v := c.QueryParam("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   "Invalid limit",
+			})
+		}
+		limit = n
+	}
+
+	return c.JSON(http.StatusOK, AlertDeliveriesResponse{
+		Deliveries: h.alerts.Deliveries(limit),
+	})
+}
+
+// TestAlert handles POST /api/v1/alerts/test
+func (h *Handler) TestAlert(c echo.Context) error {
+	if h.alerts == nil {
+		return alertsDisabled(c)
+	}
+
+	h.alerts.Test()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Test alert sent, see /api/v1/alerts/deliveries for the result",
+	})
+}
+
+// AddPort handles POST /api/v1/ports
+func (h *Handler) AddPort(c echo.Context) error {
+	var req AddPortRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+
+	if req.Port < 1 || req.Port > 65535 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Port must be between 1 and 65535",
+		})
+	}
+
+	if req.PortEnd != 0 && (req.PortEnd <= req.Port || req.PortEnd > 65535) {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "End of the port range must be above the first port and at most 65535",
+		})
+	}
+
+	if req.Protocol == "" {
+		req.Protocol = "tcp"
+	}
+	if req.Protocol != "tcp" && req.Protocol != "udp" && req.Protocol != "both" {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Protocol must be 'tcp', 'udp', or 'both'",
+		})
+	}
+
+	sources, err := h.nft.normalizePortSources(req.Sources)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	port := AllowedPort{Port: req.Port, PortEnd: req.PortEnd, Protocol: req.Protocol, Sources: sources}
+	if err := h.nft.AddAllowedPort(port); err != nil {
+		h.logger.Printf("Error adding allowed port %s/%s: %v", port.ports(), port.Protocol, err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Allowed port added: %s/%s sources=%v", port.ports(), port.Protocol, port.Sources)
+	h.saveRuleset()
+	return c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Message: "Port added successfully",
+	})
+}
+
+// DeletePort handles DELETE /api/v1/ports/:handle
+func (h *Handler) DeletePort(c echo.Context) error {
+	handleStr := c.Param("handle")
+	handle, err := strconv.ParseInt(handleStr, 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid handle",
+		})
+	}
+
+	port, portErr := h.nft.GetAllowedPort(handle)
+	if err := h.nft.DeleteAllowedPort(handle); err != nil {
+		h.logger.Printf("Error deleting allowed port handle %d: %v", handle, err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if portErr == nil {
+		if err := h.block.DeletePortAutoBan(port); err != nil && !errors.Is(err, errAutoBanNotFound) {
+			h.logger.Printf("Error deleting auto-ban of port %s/%s: %v", port.ports(), port.Protocol, err)
+		}
+	}
+
+	h.logger.Printf("Allowed port deleted: handle %d", handle)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Port deleted successfully",
+	})
+}
+
+// SetPortSources handles PUT /api/v1/ports/:handle/sources
+func (h *Handler) SetPortSources(c echo.Context) error {
+	handleStr := c.Param("handle")
+	handle, err := strconv.ParseInt(handleStr, 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid handle",
+		})
+	}
+
+	var req SetAllowedSourcesRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+
+	sources, err := h.nft.normalizePortSources(req.Sources)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if err := h.nft.SetAllowedPortSources(handle, sources); err != nil {
+		h.logger.Printf("Error setting allowed sources of port handle %d: %v", handle, err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Allowed sources set: port handle %d %v", handle, sources)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Allowed sources updated successfully",
+	})
+}
+
+// SetPortAutoBan handles PUT /api/v1/ports/:handle/autoban
+func (h *Handler) SetPortAutoBan(c echo.Context) error {
+	handleStr := c.Param("handle")
+	handle, err := strconv.ParseInt(handleStr, 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid handle",
+		})
+	}
+
+	var req SetAutoBanRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+	if err := validateAutoBan(req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	port, err := h.nft.GetAllowedPort(handle)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if err := h.block.SetPortAutoBan(port, req); err != nil {
+		h.logger.Printf("Error setting auto-ban of port %s/%s: %v", port.ports(), port.Protocol, err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Auto-ban set: port %s/%s over %d/%s ban=%ds", port.ports(), port.Protocol, req.Connections, req.Per, req.BanTime)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Auto-ban saved successfully",
+	})
+}
+
+// DeletePortAutoBan handles DELETE /api/v1/ports/:handle/autoban
+func (h *Handler) DeletePortAutoBan(c echo.Context) error {
+	handleStr := c.Param("handle")
+	handle, err := strconv.ParseInt(handleStr, 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid handle",
+		})
+	}
+
+	port, err := h.nft.GetAllowedPort(handle)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if err := h.block.DeletePortAutoBan(port); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errAutoBanNotFound) {
+			status = http.StatusNotFound
+		}
+		h.logger.Printf("Error deleting auto-ban of port %s/%s: %v", port.ports(), port.Protocol, err)
+		return c.JSON(status, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Auto-ban deleted: port %s/%s", port.ports(), port.Protocol)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Auto-ban deleted successfully",
+	})
+}
+
+// GetBaseline handles GET /api/v1/baseline
+func (h *Handler) GetBaseline(c echo.Context) error {
+	status, err := h.baseline.Status()
+	if err != nil {
+		h.logger.Printf("Error reading firewall baseline: %v", err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// SetBaseline handles PUT /api/v1/baseline. Turning the baseline on is
+// refused with 409 if it would lock out the client of the request.
+func (h *Handler) SetBaseline(c echo.Context) error {
+	var req SetBaselineRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+
+	if !req.Enabled {
+		if err := h.baseline.Disable(); err != nil {
+			h.logger.Printf("Error disabling firewall baseline: %v", err)
+			return c.JSON(http.StatusInternalServerError, APIResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+		}
+		h.logger.Printf("Firewall baseline disabled: input policy accept")
+		h.saveRuleset()
+		return c.JSON(http.StatusOK, APIResponse{
+			Success: true,
+			Message: "Firewall baseline disabled",
+		})
+	}
+
+	session := adminSession(c)
+	if err := h.baseline.Enable(session); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errBaselineLockout) {
+			status = http.StatusConflict
+		}
+		h.logger.Printf("Error enabling firewall baseline for %s port %d: %v", session.Addr, session.Port, err)
+		return c.JSON(status, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Firewall baseline enabled: input policy drop")
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Firewall baseline enabled",
+	})
+}
+
+// adminSession returns how the client of a request reaches nft-ui. A request
+// from loopback with forwarding headers comes through a reverse proxy on this
+// host: the client is the forwarded address, connecting to the proxy's port.
+func adminSession(c echo.Context) AdminSession {
+	req := c.Request()
+	host, _, _ := net.SplitHostPort(req.RemoteAddr)
+	session := AdminSession{Addr: net.ParseIP(host)}
+
+	proxied := req.Header.Get(echo.HeaderXForwardedFor) != "" || req.Header.Get(echo.HeaderXRealIP) != ""
+	if session.Addr != nil && session.Addr.IsLoopback() && proxied {
+		session.Addr = net.ParseIP(c.RealIP())
+		session.Port = forwardedPort(req)
+		return session
+	}
+
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if _, port, err := net.SplitHostPort(local.String()); err == nil {
+			session.Port, _ = strconv.Atoi(port)
+		}
+	}
+	return session
+}
+
+// forwardedPort returns the port a proxied request was sent to, from the
+// X-Forwarded-Port header, the Host header or the forwarded scheme
+func forwardedPort(req *http.Request) int {
+	if port, err := strconv.Atoi(req.Header.Get("X-Forwarded-Port")); err == nil {
+		return port
+	}
+	if _, p, err := net.SplitHostPort(req.Host); err == nil {
+		if port, err := strconv.Atoi(p); err == nil {
+			return port
+		}
+	}
+	if req.Header.Get(echo.HeaderXForwardedProto) == "https" {
+		return 443
+	}
+	return 80
+}
+
+// ListQuotasWithTokens handles GET /api/v1/quotas when tokens are enabled
+// Returns quotas with their query tokens for the admin panel
+func (h *Handler) ListQuotasWithTokens(c echo.Context) error {
+	quotas, err := h.nft.ListQuotas()
+	if err != nil {
+		h.logger.Printf("Error listing quotas: %v", err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	allowedPorts, err := h.nft.ListAllowedPorts()
+	if err != nil {
+		h.logger.Printf("Error listing allowed ports: %v", err)
+		allowedPorts = []AllowedPort{}
+	}
+
+	// Add tokens to quotas
+	quotasWithTokens := make([]QuotaWithToken, len(quotas))
+	for i, q := range quotas {
+		quotasWithTokens[i] = QuotaWithToken{
+			QuotaRule: q,
+			Token:     h.tokenGen.Generate(q.Port),
+		}
+	}
+
+	return c.JSON(http.StatusOK, QuotasResponseWithTokens{
+		Quotas:          quotasWithTokens,
+		AllowedPorts:    allowedPorts,
+		ReadOnly:        h.cfg.ReadOnly,
+		RefreshInterval: h.cfg.RefreshInterval,
+	})
+}
+
+// QueryByToken handles GET /api/v1/public/query/:token (NO AUTH REQUIRED)
+// Allows users to query quota usage with a token
+func (h *Handler) QueryByToken(c echo.Context) error {
+	token := c.Param("token")
+
+	// Validate token format
+	if !IsValidTokenFormat(token) {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid token format",
+		})
+	}
+
+	// Get all quotas
+	quotas, err := h.nft.ListQuotas()
+	if err != nil {
+		h.logger.Printf("Error listing quotas for token query: %v", err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   "Internal server error",
+		})
+	}
+
+	// Find matching quota
+	quota := h.tokenGen.FindQuotaByToken(token, quotas)
+	if quota == nil {
+		// Return generic error to prevent enumeration
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "Token not found",
+		})
+	}
+
+	return c.JSON(http.StatusOK, PublicQueryResponse{
+		Port:            quota.Port,
+		UsedBytes:       quota.UsedBytes,
+		QuotaBytes:      quota.QuotaBytes,
+		UsagePercent:    quota.UsagePercent,
+		Status:          quota.Status,
+		WarningPercent:  quota.WarningPercent,
+		ExceededPercent: quota.ExceededPercent,
+		Comment:         quota.Comment,
+		NextReset:       quota.NextReset,
+		LastReset:       quota.LastReset,
+		Direction:       quota.Direction,
+		Egress:          quota.Egress,
+		Ingress:         quota.Ingress,
+		Action:          quota.Action,
+		RateMbps:        quota.RateMbps,
+	})
+}
+
+// forwardingIDParam returns the forward ID of a request path. IDs of bound
+// forwards contain "+" and "@", which clients may percent-encode.
+func forwardingIDParam(c echo.Context) string {
+	id := c.Param("id")
+	if unescaped, err := url.PathUnescape(id); err == nil {
+		return unescaped
+	}
+	return id
+}
+
+// ListForwarding handles GET /api/v1/forwarding
+func (h *Handler) ListForwarding(c echo.Context) error {
+	rules, err := h.fwd.ListForwardingRules()
+	if err != nil {
+		h.logger.Printf("Error listing forwarding rules: %v", err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	h.health.annotate(rules)
+
+	return c.JSON(http.StatusOK, ForwardingResponse{
+		Rules:    rules,
+		ReadOnly: h.cfg.ReadOnly,
+	})
+}
+
+// AddForwarding handles POST /api/v1/forwarding
+func (h *Handler) AddForwarding(c echo.Context) error {
+	var req AddForwardingRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+
+	if req.SrcPort < 1 || req.SrcPort > 65535 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Source port must be between 1 and 65535",
+		})
+	}
+
+	if req.SrcPortEnd != 0 && (req.SrcPortEnd <= req.SrcPort || req.SrcPortEnd > 65535) {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Source port range end must be above the source port and at most 65535",
+		})
+	}
+
+	if req.SrcPortEnd != 0 && req.DstPort != req.SrcPort {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "A port range must be forwarded to the same ports",
+		})
+	}
+
+	if req.DstPort < 1 || req.DstPort > 65535 {
 		return c.JSON(http.StatusBadRequest, APIResponse{
 			Success: false,
 			Error:   "Destination port must be between 1 and 65535",
@@ -451,7 +1166,150 @@ func (h *Handler) EditForwarding(c echo.Context) error {
 		})
 	}
 
-	if err := h.fwd.EditForwardingRule(id, req.DstIP, req.DstPort, req.Protocol, req.Comment, req.LimitMbps); err != nil {
+	if req.MaxConns < 0 || req.MaxPerIP < 0 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Connection limits must be >= 0 (0 = no limit)",
+		})
+	}
+
+	rule := ForwardingRule{
+		SrcPort:    req.SrcPort,
+		SrcPortEnd: req.SrcPortEnd,
+		Interface:  req.Interface,
+		ListenIP:   req.ListenIP,
+		DstIP:      req.DstIP,
+		DstHost:    req.DstHost,
+		DstIP6:     req.DstIP6,
+		Backends:   req.Backends,
+		Balance:    req.Balance,
+		Sources:    req.Sources,
+		SnatMode:   req.SnatMode,
+		DstPort:    req.DstPort,
+		Protocol:   req.Protocol,
+		Comment:    req.Comment,
+		LimitMbps:  req.LimitMbps,
+		MaxConns:   req.MaxConns,
+		MaxPerIP:   req.MaxPerIP,
+	}
+	if err := h.fwd.resolveDestination(&rule); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if err := rule.normalize(); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if err := h.fwd.AddForwardingRule(rule); err != nil {
+		h.logger.Printf("Error adding forwarding rule: %v", err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Forwarding rule added: %s -> %s:%s (%s) bind=%s host=%s ipv6=%s backends=%d balance=%s sources=%d snat=%s limit=%d Mbps max_conns=%d/%d per IP", rule.srcPorts(), rule.DstIP, rule.dstPorts(), rule.Protocol, rule.binding(), rule.DstHost, rule.DstIP6, len(rule.Backends), rule.Balance, len(rule.Sources), rule.SnatMode, rule.LimitMbps, rule.MaxConns, rule.MaxPerIP)
+	h.saveRuleset()
+	return c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Message: "Forwarding rule added successfully",
+	})
+}
+
+// EditForwarding handles PUT /api/v1/forwarding/:id
+func (h *Handler) EditForwarding(c echo.Context) error {
+	id := forwardingIDParam(c)
+
+	var req EditForwardingRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+
+	if req.DstPort < 1 || req.DstPort > 65535 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Destination port must be between 1 and 65535",
+		})
+	}
+
+	if req.Protocol != "tcp" && req.Protocol != "udp" && req.Protocol != "both" {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Protocol must be 'tcp', 'udp', or 'both'",
+		})
+	}
+
+	if req.LimitMbps < 0 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Limit must be >= 0 (0 = no limit)",
+		})
+	}
+
+	if req.MaxConns < 0 || req.MaxPerIP < 0 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Connection limits must be >= 0 (0 = no limit)",
+		})
+	}
+
+	rule := ForwardingRule{
+		DstIP:     req.DstIP,
+		DstHost:   req.DstHost,
+		DstIP6:    req.DstIP6,
+		Backends:  req.Backends,
+		Balance:   req.Balance,
+		SnatMode:  req.SnatMode,
+		DstPort:   req.DstPort,
+		Protocol:  req.Protocol,
+		Comment:   req.Comment,
+		LimitMbps: req.LimitMbps,
+		MaxConns:  req.MaxConns,
+		MaxPerIP:  req.MaxPerIP,
+	}
+	current, _ := h.fwd.GetForwardingRule(id)
+	if req.Sources != nil {
+		rule.Sources = *req.Sources
+	} else if current != nil {
+		rule.Sources = current.Sources
+	}
+	if rule.SnatMode == "" && current != nil {
+		rule.SnatMode = current.SnatMode
+	}
+	if err := h.fwd.resolveDestination(&rule); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if err := rule.normalizeBackends(); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if err := validateDestinations(rule.DstIP, rule.DstIP6); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if err := rule.normalizeSnat(); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if err := h.fwd.EditForwardingRule(id, rule); err != nil {
 		h.logger.Printf("Error editing forwarding rule %s: %v", id, err)
 		return c.JSON(http.StatusInternalServerError, APIResponse{
 			Success: false,
@@ -459,7 +1317,14 @@ func (h *Handler) EditForwarding(c echo.Context) error {
 		})
 	}
 
-	h.logger.Printf("Forwarding rule edited: %s -> %s:%d (%s) limit=%d Mbps", id, req.DstIP, req.DstPort, req.Protocol, req.LimitMbps)
+	// The auto-ban follows the forward's protocol and destination families
+	if edited, err := h.fwd.GetForwardingRule(id); err == nil {
+		if err := h.block.SyncForwardAutoBan(edited); err != nil {
+			h.logger.Printf("Error updating auto-ban of forward %s: %v", id, err)
+		}
+	}
+
+	h.logger.Printf("Forwarding rule edited: %s -> %s:%d (%s) host=%s ipv6=%s backends=%d balance=%s sources=%d snat=%s limit=%d Mbps max_conns=%d/%d per IP", id, rule.DstIP, rule.DstPort, rule.Protocol, rule.DstHost, rule.DstIP6, len(rule.Backends), rule.Balance, len(rule.Sources), rule.SnatMode, rule.LimitMbps, rule.MaxConns, rule.MaxPerIP)
 	h.saveRuleset()
 	return c.JSON(http.StatusOK, APIResponse{
 		Success: true,
@@ -469,7 +1334,7 @@ func (h *Handler) EditForwarding(c echo.Context) error {
 
 // DeleteForwarding handles DELETE /api/v1/forwarding/:id
 func (h *Handler) DeleteForwarding(c echo.Context) error {
-	id := c.Param("id")
+	id := forwardingIDParam(c)
 
 	if err := h.fwd.DeleteForwardingRule(id); err != nil {
 		h.logger.Printf("Error deleting forwarding rule %s: %v", id, err)
@@ -479,6 +1344,19 @@ func (h *Handler) DeleteForwarding(c echo.Context) error {
 		})
 	}
 
+	if ref, err := h.fwd.parseForwardID(id); err == nil {
+		// Deleted on purpose, do not report it as missing
+		if h.alerts != nil {
+			h.alerts.ForgetForward(ref.port)
+		}
+		if err := h.health.Delete(ref); err != nil {
+			h.logger.Printf("Error deleting health check of forward %s: %v", id, err)
+		}
+		if err := h.block.DeleteForwardAutoBan(ref); err != nil && !errors.Is(err, errAutoBanNotFound) {
+			h.logger.Printf("Error deleting auto-ban of forward %s: %v", id, err)
+		}
+	}
+
 	h.logger.Printf("Forwarding rule deleted: %s", id)
 	h.saveRuleset()
 	return c.JSON(http.StatusOK, APIResponse{
@@ -489,7 +1367,7 @@ func (h *Handler) DeleteForwarding(c echo.Context) error {
 
 // EnableForwarding handles POST /api/v1/forwarding/:id/enable
 func (h *Handler) EnableForwarding(c echo.Context) error {
-	id := c.Param("id")
+	id := forwardingIDParam(c)
 
 	if err := h.fwd.EnableForwardingRule(id); err != nil {
 		h.logger.Printf("Error enabling forwarding rule %s: %v", id, err)
@@ -509,7 +1387,7 @@ func (h *Handler) EnableForwarding(c echo.Context) error {
 
 // DisableForwarding handles POST /api/v1/forwarding/:id/disable
 func (h *Handler) DisableForwarding(c echo.Context) error {
-	id := c.Param("id")
+	id := forwardingIDParam(c)
 
 	if err := h.fwd.DisableForwardingRule(id); err != nil {
 		h.logger.Printf("Error disabling forwarding rule %s: %v", id, err)
@@ -527,6 +1405,227 @@ func (h *Handler) DisableForwarding(c echo.Context) error {
 	})
 }
 
+// SetForwardingSources handles PUT /api/v1/forwarding/:id/sources
+func (h *Handler) SetForwardingSources(c echo.Context) error {
+	id := forwardingIDParam(c)
+
+	var req SetAllowedSourcesRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+
+	rule, err := h.fwd.GetForwardingRule(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if !rule.Managed && rule.Enabled {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Allowed sources are only supported for forwards managed by nft-ui",
+		})
+	}
+	rule.Sources = req.Sources
+	if err := rule.normalizeSources(); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if err := h.fwd.SetAllowedSources(id, rule.Sources); err != nil {
+		h.logger.Printf("Error setting allowed sources of %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Allowed sources set: forward %s %v", id, rule.Sources)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Allowed sources updated successfully",
+	})
+}
+
+// GetForwardingHealth handles GET /api/v1/forwarding/:id/health
+func (h *Handler) GetForwardingHealth(c echo.Context) error {
+	id := forwardingIDParam(c)
+
+	rule, err := h.fwd.GetForwardingRule(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	check, ok := h.health.Get(rule.ref())
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   "No health check for this forward",
+		})
+	}
+
+	return c.JSON(http.StatusOK, check)
+}
+
+// SetForwardingHealth handles PUT /api/v1/forwarding/:id/health
+func (h *Handler) SetForwardingHealth(c echo.Context) error {
+	id := forwardingIDParam(c)
+
+	var req SetHealthCheckRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+
+	rule, err := h.fwd.GetForwardingRule(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if !rule.Managed && rule.Enabled {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Health checks are only supported for forwards managed by nft-ui",
+		})
+	}
+
+	check, err := h.health.Set(*rule, req)
+	if err != nil {
+		h.logger.Printf("Error setting health check for %s: %v", id, err)
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Health check set: forward %s %s on_failure=%s standby=%s", id, check.Protocol, check.OnFailure, check.Standby)
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Health check saved successfully",
+	})
+}
+
+// DeleteForwardingHealth handles DELETE /api/v1/forwarding/:id/health
+func (h *Handler) DeleteForwardingHealth(c echo.Context) error {
+	id := forwardingIDParam(c)
+
+	ref, err := h.fwd.parseForwardID(id)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if err := h.health.Delete(ref); err != nil {
+		h.logger.Printf("Error deleting health check for %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Health check deleted: forward %s", id)
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Health check deleted successfully",
+	})
+}
+
+// SetForwardingAutoBan handles PUT /api/v1/forwarding/:id/autoban
+func (h *Handler) SetForwardingAutoBan(c echo.Context) error {
+	id := forwardingIDParam(c)
+
+	var req SetAutoBanRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+	if err := validateAutoBan(req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	rule, err := h.fwd.GetForwardingRule(id)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if !rule.Managed && rule.Enabled {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Auto-bans are only supported for forwards managed by nft-ui",
+		})
+	}
+
+	if err := h.block.SetForwardAutoBan(rule, req); err != nil {
+		h.logger.Printf("Error setting auto-ban of %s: %v", id, err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Auto-ban set: forward %s over %d/%s ban=%ds", id, req.Connections, req.Per, req.BanTime)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Auto-ban saved successfully",
+	})
+}
+
+// DeleteForwardingAutoBan handles DELETE /api/v1/forwarding/:id/autoban
+func (h *Handler) DeleteForwardingAutoBan(c echo.Context) error {
+	id := forwardingIDParam(c)
+
+	ref, err := h.fwd.parseForwardID(id)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	if err := h.block.DeleteForwardAutoBan(ref); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errAutoBanNotFound) {
+			status = http.StatusNotFound
+		}
+		h.logger.Printf("Error deleting auto-ban of %s: %v", id, err)
+		return c.JSON(status, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Auto-ban deleted: forward %s", id)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Auto-ban deleted successfully",
+	})
+}
+
 // GetRawRuleset handles GET /api/v1/raw-ruleset
 func (h *Handler) GetRawRuleset(c echo.Context) error {
 	rawData, err := h.nft.GetRawRuleset()
@@ -543,3 +1642,149 @@ func (h *Handler) GetRawRuleset(c echo.Context) error {
 		"data":    rawData,
 	})
 }
+
+// ListBlocklist handles GET /api/v1/blocklist
+func (h *Handler) ListBlocklist(c echo.Context) error {
+	blocked, err := h.block.List()
+	if err != nil {
+		h.logger.Printf("Error listing blocklist: %v", err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	if blocked == nil {
+		blocked = []BlockedAddress{}
+	}
+	return c.JSON(http.StatusOK, BlocklistResponse{Addresses: blocked})
+}
+
+// AddBlocklist handles POST /api/v1/blocklist
+func (h *Handler) AddBlocklist(c echo.Context) error {
+	var req BlockAddressesRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+	}
+
+	if len(req.Addresses) == 0 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "At least one address is required",
+		})
+	}
+	if req.Timeout < 0 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "Timeout must be 0 (permanent) or positive",
+		})
+	}
+
+	timeout := time.Duration(req.Timeout) * time.Second
+	if err := h.block.Add(req.Addresses, timeout, req.Reason); err != nil {
+		h.logger.Printf("Error blocking %v: %v", req.Addresses, err)
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Blocked: %v timeout=%ds reason=%q", req.Addresses, req.Timeout, req.Reason)
+	h.saveRuleset()
+	return c.JSON(http.StatusCreated, APIResponse{
+		Success: true,
+		Message: "Addresses blocked successfully",
+	})
+}
+
+// ImportBlocklist handles POST /api/v1/blocklist/import, a multipart form with
+// the blocklist in "file" and optional "timeout" (seconds) and "reason" fields
+func (h *Handler) ImportBlocklist(c echo.Context) error {
+	var timeout int64
+	if v := c.FormValue("timeout"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return c.JSON(http.StatusBadRequest, APIResponse{
+				Success: false,
+				Error:   "Timeout must be 0 (permanent) or positive",
+			})
+		}
+		timeout = n
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "A blocklist file is required",
+		})
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	defer f.Close()
+
+	added, skipped, err := h.block.Import(f, time.Duration(timeout)*time.Second, c.FormValue("reason"))
+	if err != nil {
+		h.logger.Printf("Error importing blocklist %s: %v", fh.Filename, err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Blocklist imported from %s: %d added, %d skipped", fh.Filename, added, len(skipped))
+	if added > 0 {
+		h.saveRuleset()
+	}
+	return c.JSON(http.StatusOK, BlocklistImportResponse{
+		Success: true,
+		Added:   added,
+		Skipped: skipped,
+	})
+}
+
+// DeleteBlocklist handles DELETE /api/v1/blocklist?address=<addr>[&address=...]
+func (h *Handler) DeleteBlocklist(c echo.Context) error {
+	addresses := c.QueryParams()["address"]
+	if len(addresses) == 0 {
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   "At least one address is required",
+		})
+	}
+
+	if err := h.block.Remove(addresses); err != nil {
+		h.logger.Printf("Error unblocking %v: %v", addresses, err)
+		return c.JSON(http.StatusBadRequest, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+
+	h.logger.Printf("Unblocked: %v", addresses)
+	h.saveRuleset()
+	return c.JSON(http.StatusOK, APIResponse{
+		Success: true,
+		Message: "Addresses unblocked successfully",
+	})
+}
+
+// ListAutoBans handles GET /api/v1/autoban
+func (h *Handler) ListAutoBans(c echo.Context) error {
+	bans, err := h.block.ListAutoBans()
+	if err != nil {
+		h.logger.Printf("Error listing auto-bans: %v", err)
+		return c.JSON(http.StatusInternalServerError, APIResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+	}
+	return c.JSON(http.StatusOK, AutoBanResponse{AutoBans: bans})
+}
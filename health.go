@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Health check actions taken when a forward's destination goes down
+const (
+	HealthActionNone     = "none"     // only report the destination as down
+	HealthActionFailover = "failover" // point the forward at the standby destination until the primary recovers
+	HealthActionDisable  = "disable"  // disable the forward until its destination recovers
+)
+
+// Destination health statuses
+const (
+	HealthUnknown = "unknown"
+	HealthUp      = "up"
+	HealthDown    = "down"
+)
+
+// maxHealthThreshold caps fail_after and recover_after
+const maxHealthThreshold = 100
+
+// healthState is the in-memory health of a forward's destination
+type healthState struct {
+	ForwardHealth
+	fails       int  // failed probes in a row
+	successes   int  // successful probes in a row
+	standbyDown bool // the standby was down at the last failover attempt
+}
+
+// HealthChecker probes the destinations of forwards with a health check and
+// fails them over to a standby destination or disables them while they are
+// down. Checks and what they changed are persisted, so a failover is undone
+// after a restart once the primary destination is back.
+type HealthChecker struct {
+	mu       sync.Mutex
+	nft      *NFTManager
+	fwd      *ForwardingManager
+	logger   *log.Logger
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+	checks   map[forwardRef]*HealthCheck
+	state    map[forwardRef]*healthState
+}
+
+// NewHealthChecker creates a new HealthChecker
+func NewHealthChecker(cfg *Config, nft *NFTManager, fwd *ForwardingManager, logger *log.Logger) *HealthChecker {
+	path := cfg.HealthChecksPath
+	if path == "" {
+		path = "/var/lib/nft-ui/health-checks.json"
+	}
+	interval := time.Duration(cfg.HealthCheckInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	timeout := time.Duration(cfg.HealthCheckTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	return &HealthChecker{
+		nft:      nft,
+		fwd:      fwd,
+		logger:   logger,
+		path:     path,
+		interval: interval,
+		timeout:  timeout,
+		checks:   make(map[forwardRef]*HealthCheck),
+		state:    make(map[forwardRef]*healthState),
+	}
+}
+
+// Load reads persisted health checks from disk
+func (h *HealthChecker) Load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var file HealthChecksFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", h.path, err)
+	}
+
+	for i := range file.Checks {
+		c := file.Checks[i]
+		h.checks[c.ref()] = &c
+	}
+	return nil
+}
+
+// Run probes the checked forwards every interval until the process exits
+func (h *HealthChecker) Run() {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	h.runChecks(time.Now())
+	for now := range ticker.C {
+		h.runChecks(now)
+	}
+}
+
+// runChecks probes every checked forward and fails over, disables or
+// restores the forwards whose destination changed health
+func (h *HealthChecker) runChecks(now time.Time) {
+	h.mu.Lock()
+	checks := make([]HealthCheck, 0, len(h.checks))
+	for _, c := range h.checks {
+		checks = append(checks, *c)
+	}
+	h.mu.Unlock()
+
+	if len(checks) == 0 {
+		return
+	}
+
+	rules, err := h.fwd.ListForwardingRules()
+	if err != nil {
+		h.logger.Printf("Error listing forwarding rules for health checks: %v", err)
+		return
+	}
+	forwards := make(map[forwardRef]ForwardingRule)
+	for _, r := range rules {
+		// Disabled forwards are listed as unmanaged
+		if r.Managed || !r.Enabled {
+			forwards[r.ref()] = r
+		}
+	}
+
+	// Probe all destinations in parallel, a dead one takes the whole timeout
+	results := make([]error, len(checks))
+	targets := make([]string, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		rule, ok := forwards[c.ref()]
+		if !ok || (!rule.Enabled && !c.AutoDisabled) {
+			continue // gone, or disabled by hand
+		}
+		targets[i] = rule.DstIP
+		if c.Primary != "" {
+			targets[i] = c.Primary
+		}
+		wg.Add(1)
+		go func(i int, c HealthCheck, port int) {
+			defer wg.Done()
+			results[i] = h.probe(c, targets[i], port)
+		}(i, c, rule.DstPort)
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := false
+	for i := range checks {
+		c, ok := h.checks[checks[i].ref()]
+		if !ok || targets[i] == "" {
+			continue // deleted while probing, or not probed
+		}
+		rule := forwards[c.ref()]
+
+		// The forward was edited or enabled by hand since the check changed it
+		if c.Primary != "" && rule.DstIP != c.Standby {
+			c.Primary = ""
+		}
+		if c.AutoDisabled && rule.Enabled {
+			c.AutoDisabled = false
+		}
+
+		status := h.record(c, targets[i], results[i], now)
+		if h.act(c, rule, status) {
+			changed = true
+		}
+	}
+
+	if changed {
+		if err := h.nft.SaveRuleset(); err != nil {
+			h.logger.Printf("Error saving ruleset: %v", err)
+		}
+	}
+	if err := h.save(); err != nil {
+		h.logger.Printf("Error saving health checks: %v", err)
+	}
+}
+
+// record counts a probe result and returns the destination's status, which
+// changes after fail_after failed or recover_after successful probes in a row
+// (requires lock to be held)
+func (h *HealthChecker) record(c *HealthCheck, target string, probeErr error, now time.Time) string {
+	st, ok := h.state[c.ref()]
+	if !ok || st.Target != target {
+		st = &healthState{ForwardHealth: ForwardHealth{Status: HealthUnknown, Target: target}}
+		h.state[c.ref()] = st
+	}
+
+	checked := now.Truncate(time.Second)
+	st.LastCheck = &checked
+	status := st.Status
+	if probeErr != nil {
+		st.LastError = probeErr.Error()
+		st.fails++
+		st.successes = 0
+		if st.fails >= c.FailAfter {
+			status = HealthDown
+		}
+	} else {
+		st.LastError = ""
+		st.successes++
+		st.fails = 0
+		if st.successes >= c.RecoverAfter {
+			status = HealthUp
+		}
+	}
+
+	if status != st.Status {
+		if status == HealthDown {
+			h.logger.Printf("Health check: forward %s destination %s is down: %v", c.ref(), target, probeErr)
+		} else {
+			h.logger.Printf("Health check: forward %s destination %s is up (was %s)", c.ref(), target, st.Status)
+		}
+		st.Status = status
+		st.LastChange = &checked
+	}
+	return status
+}
+
+// act fails over, disables or restores a forward for its destination's
+// status. Actions that fail are retried on the next check. Returns whether
+// the forward was changed (requires lock to be held).
+func (h *HealthChecker) act(c *HealthCheck, rule ForwardingRule, status string) bool {
+	switch status {
+	case HealthDown:
+		if c.OnFailure == HealthActionFailover && c.Primary == "" && rule.Enabled {
+			st := h.state[c.ref()]
+			if err := h.probe(*c, c.Standby, rule.DstPort); err != nil {
+				if !st.standbyDown {
+					h.logger.Printf("Health check: forward %s not failed over, standby %s is down too: %v", c.ref(), c.Standby, err)
+					st.standbyDown = true
+				}
+				return false
+			}
+			st.standbyDown = false
+			edited := rule
+			edited.DstIP = c.Standby
+			if err := h.fwd.EditForwardingRule(rule.ID, edited); err != nil {
+				h.logger.Printf("Error failing over forward %s to %s: %v", c.ref(), c.Standby, err)
+				return false
+			}
+			c.Primary = rule.DstIP
+			h.logger.Printf("Health check: forward %s failed over from %s to %s", c.ref(), rule.DstIP, c.Standby)
+			return true
+		}
+		if c.OnFailure == HealthActionDisable && rule.Enabled {
+			if err := h.fwd.DisableForwardingRule(rule.ID); err != nil {
+				h.logger.Printf("Error disabling forward %s: %v", c.ref(), err)
+				return false
+			}
+			c.AutoDisabled = true
+			h.logger.Printf("Health check: forward %s disabled until %s recovers", c.ref(), rule.DstIP)
+			return true
+		}
+
+	case HealthUp:
+		// Restored whatever the policy is now, it may have changed since
+		if c.Primary != "" {
+			edited := rule
+			edited.DstIP = c.Primary
+			if err := h.fwd.EditForwardingRule(rule.ID, edited); err != nil {
+				h.logger.Printf("Error failing back forward %s to %s: %v", c.ref(), c.Primary, err)
+				return false
+			}
+			h.logger.Printf("Health check: forward %s failed back from %s to %s", c.ref(), rule.DstIP, c.Primary)
+			c.Primary = ""
+			return true
+		}
+		if c.AutoDisabled {
+			if err := h.fwd.EnableForwardingRule(rule.ID); err != nil {
+				h.logger.Printf("Error re-enabling forward %s: %v", c.ref(), err)
+				return false
+			}
+			c.AutoDisabled = false
+			h.logger.Printf("Health check: forward %s re-enabled, %s recovered", c.ref(), rule.DstIP)
+			return true
+		}
+	}
+	return false
+}
+
+// probe checks that a destination accepts connections. A UDP probe fails only
+// when the destination answers with ICMP port unreachable: no answer at all
+// is what most UDP services reply to an unexpected datagram.
+func (h *HealthChecker) probe(c HealthCheck, ip string, port int) error {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+
+	if c.Protocol != "udp" {
+		conn, err := net.DialTimeout("tcp", addr, h.timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	conn, err := net.DialTimeout("udp", addr, h.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(h.timeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte(c.Payload)); err != nil {
+		return err
+	}
+	buf := make([]byte, 512)
+	if _, err := conn.Read(buf); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Get returns the health check of a forward
+func (h *HealthChecker) Get(ref forwardRef) (*HealthCheck, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c, ok := h.checks[ref]
+	if !ok {
+		return nil, false
+	}
+	cp := *c
+	return &cp, true
+}
+
+// Set creates or replaces the health check of a forward
+func (h *HealthChecker) Set(rule ForwardingRule, req SetHealthCheckRequest) (*HealthCheck, error) {
+	c := HealthCheck{
+		Port:         rule.SrcPort,
+		Bind:         rule.binding(),
+		Protocol:     req.Protocol,
+		Payload:      req.Payload,
+		OnFailure:    req.OnFailure,
+		Standby:      req.Standby,
+		FailAfter:    req.FailAfter,
+		RecoverAfter: req.RecoverAfter,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Keep what the old check changed so it is still undone on recovery
+	if old, ok := h.checks[c.ref()]; ok {
+		c.Primary = old.Primary
+		c.AutoDisabled = old.AutoDisabled
+		if old.Primary != "" {
+			rule.DstIP = old.Primary
+		}
+	}
+	if err := c.validate(rule); err != nil {
+		return nil, err
+	}
+	h.checks[c.ref()] = &c
+
+	if err := h.save(); err != nil {
+		return nil, fmt.Errorf("failed to save health checks: %w", err)
+	}
+	cp := c
+	return &cp, nil
+}
+
+// failedOver returns whether a forward is failed over to its standby
+func (h *HealthChecker) failedOver(ref forwardRef) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c, ok := h.checks[ref]
+	return ok && c.Primary != ""
+}
+
+// Delete removes the health check of a forward. A forward that is failed
+// over or disabled by the check stays as it is.
+func (h *HealthChecker) Delete(ref forwardRef) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.state, ref)
+	if _, ok := h.checks[ref]; !ok {
+		return nil
+	}
+	delete(h.checks, ref)
+	return h.save()
+}
+
+// annotate fills the destination health into forwards with a health check
+func (h *HealthChecker) annotate(rules []ForwardingRule) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := range rules {
+		c, ok := h.checks[rules[i].ref()]
+		if !ok {
+			continue
+		}
+		health := ForwardHealth{Status: HealthUnknown, Target: rules[i].DstIP}
+		if st, ok := h.state[c.ref()]; ok {
+			health = st.ForwardHealth
+		}
+		health.FailedOver = c.Primary != ""
+		health.AutoDisabled = c.AutoDisabled
+		rules[i].Health = &health
+	}
+}
+
+// save writes all health checks to disk (requires lock to be held)
+func (h *HealthChecker) save() error {
+	// Ensure directory exists
+	dir := filepath.Dir(h.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file := HealthChecksFile{Checks: make([]HealthCheck, 0, len(h.checks))}
+	for _, c := range h.checks {
+		file.Checks = append(file.Checks, *c)
+	}
+	sort.Slice(file.Checks, func(i, j int) bool {
+		if file.Checks[i].Port != file.Checks[j].Port {
+			return file.Checks[i].Port < file.Checks[j].Port
+		}
+		return file.Checks[i].Bind < file.Checks[j].Bind
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(h.path, data, 0644)
+}
+
+// ref returns the reference of the checked forward
+func (c HealthCheck) ref() forwardRef {
+	return forwardRef{port: c.Port, bind: c.Bind}
+}
+
+// validate checks the health check fields and fills in defaults
+func (c *HealthCheck) validate(rule ForwardingRule) error {
+	if len(rule.Backends) > 1 {
+		return errors.New("health checks are not supported for load-balanced forwards")
+	}
+
+	switch c.Protocol {
+	case "":
+		c.Protocol = "tcp"
+	case "tcp", "udp":
+	default:
+		return fmt.Errorf("invalid health check protocol: %s (must be tcp or udp)", c.Protocol)
+	}
+	if c.Protocol == "tcp" {
+		c.Payload = ""
+	}
+
+	switch c.OnFailure {
+	case "":
+		c.OnFailure = HealthActionNone
+	case HealthActionNone, HealthActionDisable:
+	case HealthActionFailover:
+		if ipFamily(c.Standby) == "" {
+			return fmt.Errorf("invalid standby destination: %q", c.Standby)
+		}
+		if ipFamily(c.Standby) != ipFamily(rule.DstIP) {
+			return errors.New("the standby destination must be the same IP version as the forward's destination")
+		}
+		if c.Standby == rule.DstIP {
+			return errors.New("the standby destination must differ from the forward's destination")
+		}
+	default:
+		return fmt.Errorf("invalid on_failure action: %s", c.OnFailure)
+	}
+	if c.OnFailure != HealthActionFailover {
+		c.Standby = ""
+	}
+
+	if c.FailAfter == 0 {
+		c.FailAfter = 3
+	}
+	if c.RecoverAfter == 0 {
+		c.RecoverAfter = 2
+	}
+	if c.FailAfter < 1 || c.FailAfter > maxHealthThreshold {
+		return fmt.Errorf("invalid fail_after: %d (must be 1-%d)", c.FailAfter, maxHealthThreshold)
+	}
+	if c.RecoverAfter < 1 || c.RecoverAfter > maxHealthThreshold {
+		return fmt.Errorf("invalid recover_after: %d (must be 1-%d)", c.RecoverAfter, maxHealthThreshold)
+	}
+	return nil
+}
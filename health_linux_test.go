@@ -0,0 +1,89 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthFailoverRepointsQuota(t *testing.T) {
+	m := newTestManagers(t)
+
+	// Only the standby accepts connections, the primary refuses them
+	ln, err := net.Listen("tcp", "127.0.0.3:8080")
+	if err != nil {
+		t.Fatalf("listen on standby: %v", err)
+	}
+	defer ln.Close()
+
+	rule := ForwardingRule{SrcPort: 7103, DstIP: "127.0.0.2", DstPort: 8080, Protocol: "tcp"}
+	if err := m.fwd.AddForwardingRule(rule); err != nil {
+		t.Fatalf("AddForwardingRule: %v", err)
+	}
+	if err := m.nft.AddQuota(7103, DirectionEgress, 10_000_000, 0, QuotaAction{}, "app"); err != nil {
+		t.Fatalf("AddQuota: %v", err)
+	}
+	m.seedForwardUsage(t, 7103, 4096)
+
+	health := NewHealthChecker(m.cfg, m.nft, m.fwd, log.New(io.Discard, "", 0))
+	if _, err := health.Set(rule, SetHealthCheckRequest{
+		OnFailure: HealthActionFailover, Standby: "127.0.0.3", FailAfter: 1, RecoverAfter: 1,
+	}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	// step records one probe of the destination and acts on it like runChecks,
+	// which probes from other goroutines outside the test's namespace
+	step := func(probeErr error) {
+		t.Helper()
+
+		current, err := m.fwd.GetForwardingRule("fwd_7103")
+		if err != nil {
+			t.Fatalf("GetForwardingRule: %v", err)
+		}
+
+		health.mu.Lock()
+		defer health.mu.Unlock()
+
+		c := health.checks[current.ref()]
+		target := current.DstIP
+		if c.Primary != "" {
+			target = c.Primary
+		}
+		if !health.act(c, *current, health.record(c, target, probeErr, time.Now())) {
+			t.Fatalf("health check left forward on %s unchanged", current.DstIP)
+		}
+	}
+
+	// expect checks the forward and its quota point at dst and kept their usage
+	expect := func(stage, dst, old string) {
+		t.Helper()
+
+		current, err := m.fwd.GetForwardingRule("fwd_7103")
+		if err != nil {
+			t.Fatalf("%s: GetForwardingRule: %v", stage, err)
+		}
+		if current.DstIP != dst {
+			t.Errorf("%s: forward destination = %s, want %s", stage, current.DstIP, dst)
+		}
+		got := m.forwardQuotaRules(t, "ip", forwardRef{port: 7103})
+		if len(got) != 1 || !strings.Contains(got[0], `"`+dst+`"`) || strings.Contains(got[0], `"`+old+`"`) {
+			t.Errorf("%s: forward quota = %v, want one rule matching only %s", stage, got, dst)
+		}
+		if used := m.forwardQuotaUsed(forwardRef{port: 7103}); used != 4096 {
+			t.Errorf("%s: forward quota usage = %d, want 4096 carried over", stage, used)
+		}
+	}
+
+	step(errors.New("connection refused"))
+	expect("failover", "127.0.0.3", "127.0.0.2")
+
+	step(nil)
+	expect("failback", "127.0.0.2", "127.0.0.3")
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// historySamplesBucket holds one sub-bucket per port with
+	// unix time -> traffic (local, forward) seen since the previous sample
+	historySamplesBucket = []byte("samples")
+	// historyStateBucket holds port -> last raw counters (local, forward)
+	historyStateBucket = []byte("state")
+)
+
+const (
+	// maxHistoryPoints caps the number of points returned by one history query
+	maxHistoryPoints = 2000
+	// defaultHistoryPoints is the number of points returned when no step is given
+	defaultHistoryPoints = 200
+)
+
+// UsageCollector periodically samples quota counters into an embedded
+// on-disk store. It records the traffic between two samples rather than the
+// raw counters, so quota resets and rule recreation do not lose history.
+type UsageCollector struct {
+	nft       *NFTManager
+	logger    *log.Logger
+	db        *bolt.DB
+	interval  time.Duration
+	retention time.Duration
+}
+
+// NewUsageCollector opens (or creates) the history store
+func NewUsageCollector(cfg *Config, nft *NFTManager, logger *log.Logger) (*UsageCollector, error) {
+	path := cfg.HistoryPath
+	if path == "" {
+		path = "/var/lib/nft-ui/history.db"
+	}
+
+	// Ensure directory exists
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(historySamplesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(historyStateBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize history store: %w", err)
+	}
+
+	return &UsageCollector{
+		nft:       nft,
+		logger:    logger,
+		db:        db,
+		interval:  time.Duration(cfg.HistoryInterval) * time.Second,
+		retention: time.Duration(cfg.HistoryRetentionDays) * 24 * time.Hour,
+	}, nil
+}
+
+// defaultStep picks a step giving about defaultHistoryPoints points for a range,
+// rounded up to a whole number of sampling intervals
+func (c *UsageCollector) defaultStep(span time.Duration) time.Duration {
+	step := span / defaultHistoryPoints
+	if step < c.interval {
+		return c.interval
+	}
+	if rem := step % c.interval; rem != 0 {
+		step += c.interval - rem
+	}
+	return step
+}
+
+// Run samples counters every interval until the process exits
+func (c *UsageCollector) Run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	c.sample(time.Now())
+	for now := range ticker.C {
+		c.sample(now)
+	}
+}
+
+func (c *UsageCollector) sample(now time.Time) {
+	if err := c.collect(now); err != nil {
+		c.logger.Printf("Error collecting usage history: %v", err)
+	}
+}
+
+// collect takes one sample of every quota's counters
+func (c *UsageCollector) collect(now time.Time) error {
+	counters, err := c.nft.QuotaCounters()
+	if err != nil {
+		return err
+	}
+
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(now.Unix()))
+
+	return c.db.Update(func(tx *bolt.Tx) error {
+		samples := tx.Bucket(historySamplesBucket)
+		state := tx.Bucket(historyStateBucket)
+
+		for port, qc := range counters {
+			portKey := []byte(strconv.Itoa(port))
+			current := [2]uint64{uint64(qc.Local), uint64(qc.Forward)}
+
+			var delta [2]uint64
+			if last := state.Get(portKey); len(last) == 16 {
+				prev := [2]uint64{binary.BigEndian.Uint64(last[0:8]), binary.BigEndian.Uint64(last[8:16])}
+				for i := range current {
+					if current[i] >= prev[i] {
+						delta[i] = current[i] - prev[i]
+					} else {
+						// Counter went down: the quota was reset or the rule
+						// recreated, everything counted so far is new traffic
+						delta[i] = current[i]
+					}
+				}
+			}
+			// First sample of a port only establishes the baseline
+
+			if err := state.Put(portKey, encodeCounters(current)); err != nil {
+				return err
+			}
+
+			b, err := samples.CreateBucketIfNotExists(portKey)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, encodeCounters(delta)); err != nil {
+				return err
+			}
+			if err := c.prune(b, now); err != nil {
+				return err
+			}
+		}
+
+		// Forget the baseline of ports whose quota is gone
+		var stale [][]byte
+		state.ForEach(func(k, _ []byte) error {
+			if port, err := strconv.Atoi(string(k)); err == nil {
+				if _, ok := counters[port]; !ok {
+					stale = append(stale, append([]byte(nil), k...))
+				}
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := state.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// prune deletes samples older than the retention period
+func (c *UsageCollector) prune(b *bolt.Bucket, now time.Time) error {
+	if c.retention <= 0 {
+		return nil
+	}
+	cutoff := uint64(now.Add(-c.retention).Unix())
+
+	cur := b.Cursor()
+	for k, _ := cur.First(); k != nil && binary.BigEndian.Uint64(k) < cutoff; k, _ = cur.Next() {
+		if err := cur.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History returns the traffic of a port between from and to, summed into step-sized buckets
+func (c *UsageCollector) History(port int, from, to time.Time, step time.Duration) ([]HistoryPoint, error) {
+	if !to.After(from) {
+		return nil, fmt.Errorf("'to' must be after 'from'")
+	}
+	if step < time.Second {
+		return nil, fmt.Errorf("step must be at least 1s")
+	}
+	count := int((to.Sub(from) + step - 1) / step)
+	if count > maxHistoryPoints {
+		return nil, fmt.Errorf("too many points (%d), use a larger step", count)
+	}
+
+	points := make([]HistoryPoint, count)
+	for i := range points {
+		points[i].Time = from.Add(time.Duration(i) * step)
+	}
+
+	start := make([]byte, 8)
+	binary.BigEndian.PutUint64(start, uint64(from.Unix()))
+	end := uint64(to.Unix())
+
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historySamplesBucket).Bucket([]byte(strconv.Itoa(port)))
+		if b == nil {
+			return nil
+		}
+
+		cur := b.Cursor()
+		for k, v := cur.Seek(start); k != nil; k, v = cur.Next() {
+			ts := binary.BigEndian.Uint64(k)
+			if ts >= end {
+				break
+			}
+			i := int(time.Unix(int64(ts), 0).Sub(from) / step)
+			if i < 0 || i >= count || len(v) != 16 {
+				continue
+			}
+			local := int64(binary.BigEndian.Uint64(v[0:8]))
+			fwd := int64(binary.BigEndian.Uint64(v[8:16]))
+			points[i].Bytes += local + fwd
+			points[i].ForwardBytes += fwd
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return points, nil
+}
+
+// parseHistoryTime parses an RFC 3339 timestamp or unix seconds
+func parseHistoryTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("must be RFC 3339 or unix seconds")
+	}
+	return t, nil
+}
+
+// parseHistoryStep parses a duration ("5m", "1h") or a number of seconds
+func parseHistoryStep(s string) (time.Duration, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.New("must be a duration like 5m or a number of seconds")
+	}
+	return d, nil
+}
+
+func encodeCounters(v [2]uint64) []byte {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[0:8], v[0])
+	binary.BigEndian.PutUint64(buf[8:16], v[1])
+	return buf
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// QuotaLedger keeps a persistent history of quota limit changes per port
+type QuotaLedger struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewQuotaLedger creates a new QuotaLedger
+func NewQuotaLedger(cfg *Config) *QuotaLedger {
+	path := cfg.LedgerPath
+	if path == "" {
+		path = "/var/lib/nft-ui/quota-ledger.json"
+	}
+	return &QuotaLedger{path: path}
+}
+
+// Record appends an entry to the ledger
+func (l *QuotaLedger) Record(entry LedgerEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		return err
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().Truncate(time.Second)
+	}
+	entries = append(entries, entry)
+	return l.save(entries)
+}
+
+// List returns the entries for a port, oldest first
+func (l *QuotaLedger) List(port int) ([]LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []LedgerEntry{}
+	for _, e := range entries {
+		if e.Port == port {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+func (l *QuotaLedger) load() ([]LedgerEntry, error) {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []LedgerEntry{}, nil
+		}
+		return nil, err
+	}
+
+	var file QuotaLedgerFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", l.path, err)
+	}
+	return file.Entries, nil
+}
+
+func (l *QuotaLedger) save(entries []LedgerEntry) error {
+	// Ensure directory exists
+	dir := filepath.Dir(l.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file := QuotaLedgerFile{Entries: entries}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(l.path, data, 0644)
+}
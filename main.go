@@ -10,6 +10,7 @@ import (
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 //go:embed frontend/dist/*
@@ -25,8 +26,27 @@ func main() {
 	// Initialize logger
 	logger := log.New(os.Stdout, "[nft-ui] ", log.LstdFlags)
 
+	// Initialize nftables backend (netlink, falling back to the nft binary)
+	var backend Backend = NewExecBackend(cfg)
+	if cfg.Backend == "netlink" {
+		nl, err := NewNetlinkBackend(cfg)
+		if err != nil {
+			logger.Printf("Warning: netlink backend unavailable, using %s: %v", cfg.NFTBinary, err)
+		} else {
+			backend = nl
+		}
+	}
+	logger.Printf("Using %s nftables backend", backend.Name())
+
 	// Initialize NFT manager
-	nftMgr := NewNFTManager(cfg)
+	nftMgr := NewNFTManager(cfg, backend)
+
+	// Load per-quota settings (thresholds)
+	quotaMeta := NewQuotaMetaStore(cfg)
+	if err := quotaMeta.Load(); err != nil {
+		logger.Printf("Warning: failed to load quota settings: %v", err)
+	}
+	nftMgr.SetQuotaMetaStore(quotaMeta)
 
 	// Restore saved ruleset (if any)
 	if err := nftMgr.RestoreRuleset(); err != nil {
@@ -35,11 +55,65 @@ func main() {
 		logger.Printf("Ruleset restored from %s", cfg.RulesetPath)
 	}
 
+	// Re-apply the firewall baseline for the configured listen ports
+	baseline := NewBaselineManager(cfg, nftMgr, backend)
+	if err := baseline.Sync(); err != nil {
+		logger.Printf("Warning: failed to sync firewall baseline: %v", err)
+	}
+
 	// Initialize forwarding manager
-	fwdMgr := NewForwardingManager(cfg)
+	fwdMgr := NewForwardingManager(cfg, backend)
+
+	// Load per-forward settings (destination hostnames)
+	forwardMeta := NewForwardMetaStore(cfg)
+	if err := forwardMeta.Load(); err != nil {
+		logger.Printf("Warning: failed to load forward settings: %v", err)
+	}
+	fwdMgr.SetForwardMetaStore(forwardMeta)
 
 	// Wire up forwarding manager for forward chain quota support
 	nftMgr.SetForwardingManager(fwdMgr)
+	fwdMgr.SetNFTManager(nftMgr)
+
+	// Initialize quota reset scheduler
+	scheduler := NewResetScheduler(cfg, nftMgr, logger)
+	if err := scheduler.Load(); err != nil {
+		logger.Printf("Warning: failed to load reset schedules: %v", err)
+	}
+	nftMgr.SetResetScheduler(scheduler)
+	go scheduler.Run()
+
+	// Initialize usage history collector (disabled with history_interval: 0)
+	var history *UsageCollector
+	if cfg.HistoryInterval > 0 {
+		history, err = NewUsageCollector(cfg, nftMgr, logger)
+		if err != nil {
+			logger.Printf("Warning: usage history disabled: %v", err)
+		} else {
+			go history.Run()
+		}
+	}
+
+	// Initialize alerting (webhooks are configured in the config file)
+	alerts, err := NewAlertManager(cfg, nftMgr, fwdMgr, logger)
+	if err != nil {
+		logger.Printf("Warning: alerting disabled: %v", err)
+	} else {
+		if err := alerts.Load(); err != nil {
+			logger.Printf("Warning: failed to load alert state: %v", err)
+		}
+		go alerts.Run()
+	}
+
+	// Initialize forward health checks
+	health := NewHealthChecker(cfg, nftMgr, fwdMgr, logger)
+	if err := health.Load(); err != nil {
+		logger.Printf("Warning: failed to load health checks: %v", err)
+	}
+	go health.Run()
+
+	// Re-resolve forward destination hostnames
+	go NewHostResolver(cfg, nftMgr, fwdMgr, forwardMeta, health, logger).Run()
 
 	// Initialize token generator (may be nil if not configured)
 	var tokenGen *TokenGenerator
@@ -48,7 +122,7 @@ func main() {
 	}
 
 	// Initialize handler
-	handler := NewHandler(nftMgr, fwdMgr, cfg, logger, tokenGen)
+	handler := NewHandler(nftMgr, fwdMgr, cfg, logger, tokenGen, scheduler, NewQuotaLedger(cfg), history, alerts, health, NewBlocklistManager(cfg, nftMgr, backend), baseline)
 
 	// Create Echo instance
 	e := echo.New()
@@ -87,10 +161,37 @@ func main() {
 	api.PUT("/quotas/:id", handler.ModifyQuota)
 	api.POST("/quotas", handler.AddQuota)
 	api.DELETE("/quotas/:id", handler.DeleteQuota)
+	api.PUT("/quotas/:id/thresholds", handler.SetQuotaThresholds)
+	api.POST("/quotas/:id/topup", handler.TopUpQuota)
+	api.GET("/quotas/:id/ledger", handler.GetQuotaLedger)
+	api.GET("/quotas/:id/history", handler.GetQuotaHistory)
+	api.GET("/quotas/:id/schedule", handler.GetQuotaSchedule)
+	api.PUT("/quotas/:id/schedule", handler.SetQuotaSchedule)
+	api.DELETE("/quotas/:id/schedule", handler.DeleteQuotaSchedule)
+	api.GET("/quotas/:id/alerts", handler.GetQuotaAlerts)
+	api.PUT("/quotas/:id/alerts", handler.SetQuotaAlerts)
+
+	// Alerting endpoints
+	api.GET("/alerts/deliveries", handler.ListAlertDeliveries)
+	api.POST("/alerts/test", handler.TestAlert)
 
 	// Port management endpoints
 	api.POST("/ports", handler.AddPort)
 	api.DELETE("/ports/:handle", handler.DeletePort)
+	api.PUT("/ports/:handle/sources", handler.SetPortSources)
+	api.PUT("/ports/:handle/autoban", handler.SetPortAutoBan)
+	api.DELETE("/ports/:handle/autoban", handler.DeletePortAutoBan)
+
+	// Firewall baseline endpoints
+	api.GET("/baseline", handler.GetBaseline)
+	api.PUT("/baseline", handler.SetBaseline)
+
+	// Blocklist endpoints
+	api.GET("/blocklist", handler.ListBlocklist)
+	api.POST("/blocklist", handler.AddBlocklist)
+	api.POST("/blocklist/import", handler.ImportBlocklist)
+	api.DELETE("/blocklist", handler.DeleteBlocklist)
+	api.GET("/autoban", handler.ListAutoBans)
 
 	// Forwarding management endpoints
 	api.GET("/forwarding", handler.ListForwarding)
@@ -99,10 +200,37 @@ func main() {
 	api.DELETE("/forwarding/:id", handler.DeleteForwarding)
 	api.POST("/forwarding/:id/enable", handler.EnableForwarding)
 	api.POST("/forwarding/:id/disable", handler.DisableForwarding)
+	api.PUT("/forwarding/:id/sources", handler.SetForwardingSources)
+	api.GET("/forwarding/:id/health", handler.GetForwardingHealth)
+	api.PUT("/forwarding/:id/health", handler.SetForwardingHealth)
+	api.DELETE("/forwarding/:id/health", handler.DeleteForwardingHealth)
+	api.PUT("/forwarding/:id/autoban", handler.SetForwardingAutoBan)
+	api.DELETE("/forwarding/:id/autoban", handler.DeleteForwardingAutoBan)
 
 	// Raw ruleset endpoint
 	api.GET("/raw-ruleset", handler.GetRawRuleset)
 
+	// Prometheus metrics, on the main listener or a separate one
+	if cfg.MetricsEnabled {
+		metrics := echo.WrapHandler(promhttp.HandlerFor(NewMetricsRegistry(nftMgr, fwdMgr),
+			promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))
+		if cfg.MetricsListenAddr != "" {
+			m := echo.New()
+			m.HideBanner = true
+			m.HidePort = true
+			m.GET("/metrics", metrics, MetricsAuthMiddleware(cfg, false))
+			go func() {
+				logger.Printf("Metrics endpoint enabled at %s/metrics", cfg.MetricsListenAddr)
+				if err := m.Start(cfg.MetricsListenAddr); err != nil {
+					logger.Printf("Error serving metrics: %v", err)
+				}
+			}()
+		} else {
+			e.GET("/metrics", metrics, MetricsAuthMiddleware(cfg, true))
+			logger.Printf("Metrics endpoint enabled at /metrics")
+		}
+	}
+
 	// Serve frontend
 	setupFrontend(e)
 
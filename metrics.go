@@ -0,0 +1,192 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// metricsNamespace prefixes every exported metric name
+const metricsNamespace = "nftui"
+
+var (
+	nftCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "nft_command_duration_seconds",
+		Help:      "Duration of nft commands, run by the nft binary or sent over netlink.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+
+	nftCommandErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "nft_command_errors_total",
+		Help:      "Number of failed nft commands, run by the nft binary or sent over netlink.",
+	}, []string{"command"})
+
+	authFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failures_total",
+		Help:      "Number of failed basic auth attempts.",
+	})
+
+	authLockoutsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_lockouts_total",
+		Help:      "Number of times an IP was locked out after repeated auth failures.",
+	})
+
+	rateLimitRejectionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "public_query_rate_limited_total",
+		Help:      "Number of public query requests rejected by the rate limiter.",
+	})
+)
+
+// NewMetricsRegistry creates a registry with all nft-ui metrics
+func NewMetricsRegistry(nft *NFTManager, fwd *ForwardingManager) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		nftCommandDuration,
+		nftCommandErrors,
+		authFailuresTotal,
+		authLockoutsTotal,
+		rateLimitRejectionsTotal,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "auth_locked_ips",
+			Help:      "Number of IPs currently locked out.",
+		}, func() float64 {
+			return float64(globalAuthTracker.LockedCount())
+		}),
+		&rulesetCollector{nft: nft, fwd: fwd},
+	)
+	return reg
+}
+
+// observeNFTCommand records the duration and outcome of an nft command
+func observeNFTCommand(args []string, d time.Duration, err error) {
+	cmd := nftCommandName(args)
+	nftCommandDuration.WithLabelValues(cmd).Observe(d.Seconds())
+	if err != nil {
+		nftCommandErrors.WithLabelValues(cmd).Inc()
+	}
+}
+
+// nftCommandName returns a low-cardinality label for nft arguments ("list", "add", "file", ...)
+func nftCommandName(args []string) string {
+	for _, a := range args {
+		switch a {
+		case "-j", "-a":
+			continue
+		case "-f":
+			return "file"
+		}
+		return a
+	}
+	return "unknown"
+}
+
+var (
+	quotaLimitDesc = prometheus.NewDesc(
+		metricsNamespace+"_quota_limit_bytes", "Quota limit per port.", []string{"port"}, nil)
+	quotaUsedDesc = prometheus.NewDesc(
+		metricsNamespace+"_quota_used_bytes", "Quota usage per port, including forwarded traffic.", []string{"port"}, nil)
+	quotaPercentDesc = prometheus.NewDesc(
+		metricsNamespace+"_quota_usage_percent", "Quota usage per port in percent of the limit.", []string{"port"}, nil)
+	quotaStatusDesc = prometheus.NewDesc(
+		metricsNamespace+"_quota_status", "Quota status per port (1 for the current status).", []string{"port", "status"}, nil)
+	forwardBytesDesc = prometheus.NewDesc(
+		metricsNamespace+"_forward_bytes_total", "Bytes forwarded per forwarding rule (both directions).",
+		[]string{"src_port", "bind", "dst_ip", "dst_port", "protocol"}, nil)
+	forwardPacketsDesc = prometheus.NewDesc(
+		metricsNamespace+"_forward_packets_total", "Packets forwarded per forwarding rule (both directions).",
+		[]string{"src_port", "bind", "dst_ip", "dst_port", "protocol"}, nil)
+	forwardEnabledDesc = prometheus.NewDesc(
+		metricsNamespace+"_forward_enabled", "Whether a forwarding rule is enabled.", []string{"src_port", "bind"}, nil)
+	allowedPortsDesc = prometheus.NewDesc(
+		metricsNamespace+"_allowed_ports", "Number of allowed inbound ports.", nil, nil)
+)
+
+// quotaStatuses lists every value of QuotaRule.Status
+var quotaStatuses = []string{"ok", "warning", "exceeded"}
+
+// rulesetCollector reads quotas, forwards and allowed ports from nftables on every scrape
+type rulesetCollector struct {
+	nft *NFTManager
+	fwd *ForwardingManager
+}
+
+// Describe implements prometheus.Collector
+func (c *rulesetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- quotaLimitDesc
+	ch <- quotaUsedDesc
+	ch <- quotaPercentDesc
+	ch <- quotaStatusDesc
+	ch <- forwardBytesDesc
+	ch <- forwardPacketsDesc
+	ch <- forwardEnabledDesc
+	ch <- allowedPortsDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *rulesetCollector) Collect(ch chan<- prometheus.Metric) {
+	if quotas, err := c.nft.ListQuotas(); err != nil {
+		ch <- prometheus.NewInvalidMetric(quotaUsedDesc, err)
+	} else {
+		seen := make(map[int]bool)
+		for _, q := range quotas {
+			// A port may appear in several rules, report the first like the UI does
+			if seen[q.Port] {
+				continue
+			}
+			seen[q.Port] = true
+
+			port := strconv.Itoa(q.Port)
+			ch <- prometheus.MustNewConstMetric(quotaLimitDesc, prometheus.GaugeValue, float64(q.QuotaBytes), port)
+			ch <- prometheus.MustNewConstMetric(quotaUsedDesc, prometheus.GaugeValue, float64(q.UsedBytes), port)
+			ch <- prometheus.MustNewConstMetric(quotaPercentDesc, prometheus.GaugeValue, q.UsagePercent, port)
+			for _, status := range quotaStatuses {
+				v := 0.0
+				if q.Status == status {
+					v = 1
+				}
+				ch <- prometheus.MustNewConstMetric(quotaStatusDesc, prometheus.GaugeValue, v, port, status)
+			}
+		}
+	}
+
+	if rules, err := c.fwd.ListForwardingRules(); err != nil {
+		ch <- prometheus.NewInvalidMetric(forwardBytesDesc, err)
+	} else {
+		seen := make(map[forwardRef]bool)
+		for _, r := range rules {
+			if seen[r.ref()] {
+				continue
+			}
+			seen[r.ref()] = true
+
+			srcPort := r.srcPorts()
+			enabled := 0.0
+			if r.Enabled {
+				enabled = 1
+			}
+			ch <- prometheus.MustNewConstMetric(forwardEnabledDesc, prometheus.GaugeValue, enabled, srcPort, r.binding())
+			if !r.Enabled || !r.Managed {
+				continue
+			}
+			labels := []string{srcPort, r.binding(), r.DstIP, r.dstPorts(), r.Protocol}
+			ch <- prometheus.MustNewConstMetric(forwardBytesDesc, prometheus.CounterValue, float64(r.Bytes), labels...)
+			ch <- prometheus.MustNewConstMetric(forwardPacketsDesc, prometheus.CounterValue, float64(r.Packets), labels...)
+		}
+	}
+
+	if ports, err := c.nft.ListAllowedPorts(); err != nil {
+		ch <- prometheus.NewInvalidMetric(allowedPortsDesc, err)
+	} else {
+		ch <- prometheus.MustNewConstMetric(allowedPortsDesc, prometheus.GaugeValue, float64(len(ports)))
+	}
+}
@@ -90,9 +90,13 @@ func (t *AuthFailureTracker) RecordFailure(ip string) {
 
 	// Increment failure count
 	t.failures[ip]++
+	authFailuresTotal.Inc()
 
 	// Check if we should lock this IP
 	if t.failures[ip] >= t.maxAttempts {
+		if _, locked := t.lockUntil[ip]; !locked {
+			authLockoutsTotal.Inc()
+		}
 		t.lockUntil[ip] = now.Add(t.lockDuration)
 	}
 }
@@ -115,6 +119,21 @@ func (t *AuthFailureTracker) GetRemainingAttempts(ip string) int {
 	return t.maxAttempts - t.failures[ip]
 }
 
+// LockedCount returns the number of IPs that are currently locked
+func (t *AuthFailureTracker) LockedCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, unlockTime := range t.lockUntil {
+		if now.Before(unlockTime) {
+			count++
+		}
+	}
+	return count
+}
+
 var globalAuthTracker = NewAuthFailureTracker()
 
 // BasicAuthMiddleware creates Echo middleware for HTTP Basic Auth with brute-force protection
@@ -126,6 +145,26 @@ func BasicAuthMiddleware(cfg *Config) echo.MiddlewareFunc {
 		}
 	}
 
+	return basicAuth(cfg.AuthUser, cfg.AuthPassword)
+}
+
+// MetricsAuthMiddleware protects /metrics with its own basic auth credentials,
+// if configured. On the main listener (shared) it falls back to the API
+// credentials, so metrics are never open where the API is protected.
+func MetricsAuthMiddleware(cfg *Config, shared bool) echo.MiddlewareFunc {
+	switch {
+	case cfg.MetricsAuthEnabled():
+		return basicAuth(cfg.MetricsAuthUser, cfg.MetricsAuthPassword)
+	case shared && cfg.AuthEnabled():
+		return basicAuth(cfg.AuthUser, cfg.AuthPassword)
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return next
+	}
+}
+
+// basicAuth checks basic auth credentials with brute-force protection
+func basicAuth(wantUser, wantPassword string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			ip := c.RealIP()
@@ -147,8 +186,8 @@ func BasicAuthMiddleware(cfg *Config) echo.MiddlewareFunc {
 			}
 
 			// Validate credentials using constant-time comparison
-			userMatch := subtle.ConstantTimeCompare([]byte(username), []byte(cfg.AuthUser)) == 1
-			passMatch := subtle.ConstantTimeCompare([]byte(password), []byte(cfg.AuthPassword)) == 1
+			userMatch := subtle.ConstantTimeCompare([]byte(username), []byte(wantUser)) == 1
+			passMatch := subtle.ConstantTimeCompare([]byte(password), []byte(wantPassword)) == 1
 
 			if userMatch && passMatch {
 				// Success - clear any failure records
@@ -256,6 +295,7 @@ func RateLimitMiddleware(limit int, window time.Duration) echo.MiddlewareFunc {
 
 			if len(validRequests) >= limit {
 				mu.Unlock()
+				rateLimitRejectionsTotal.Inc()
 				return c.JSON(http.StatusTooManyRequests, APIResponse{
 					Success: false,
 					Error:   "Rate limit exceeded. Please try again later.",
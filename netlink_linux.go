@@ -0,0 +1,2523 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// errUnsupportedExpr is returned when a rule cannot be translated between
+// nft syntax and netlink expressions; callers fall back to the nft binary
+var errUnsupportedExpr = errors.New("expression not supported by netlink backend")
+
+// NetlinkBackend talks to nftables directly over netlink.
+// Anything it cannot express natively is delegated to the nft binary.
+type NetlinkBackend struct {
+	mu   sync.Mutex
+	conn *nftables.Conn
+	exec *ExecBackend
+}
+
+// NewNetlinkBackend opens a netlink connection and verifies it can read the ruleset
+func NewNetlinkBackend(cfg *Config) (*NetlinkBackend, error) {
+	conn, err := nftables.New(nftables.AsLasting())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open netlink connection: %w", err)
+	}
+	if _, err := conn.ListTables(); err != nil {
+		conn.CloseLasting()
+		return nil, fmt.Errorf("failed to list tables over netlink: %w", err)
+	}
+	return &NetlinkBackend{
+		conn: conn,
+		exec: NewExecBackend(cfg),
+	}, nil
+}
+
+// Name returns the backend identifier
+func (b *NetlinkBackend) Name() string {
+	return "netlink"
+}
+
+// nlFamily maps an nft family name to its netlink value
+func nlFamily(family string) (nftables.TableFamily, error) {
+	switch family {
+	case "ip":
+		return nftables.TableFamilyIPv4, nil
+	case "ip6":
+		return nftables.TableFamilyIPv6, nil
+	case "inet":
+		return nftables.TableFamilyINet, nil
+	case "arp":
+		return nftables.TableFamilyARP, nil
+	case "bridge":
+		return nftables.TableFamilyBridge, nil
+	case "netdev":
+		return nftables.TableFamilyNetdev, nil
+	}
+	return 0, fmt.Errorf("unknown table family: %s", family)
+}
+
+// nlTable returns the table/chain references used in netlink messages
+func nlTable(family, table, chain string) (*nftables.Table, *nftables.Chain, error) {
+	fam, err := nlFamily(family)
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &nftables.Table{Name: table, Family: fam}
+	return t, &nftables.Chain{Name: chain, Table: t}, nil
+}
+
+// ListChain reads a chain over netlink and converts it to the nft JSON model.
+// If any rule uses an expression we cannot decode, the chain is read via nft -j instead.
+func (b *NetlinkBackend) ListChain(family, table, chain string) (_ *NFTRuleset, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, c, err := nlTable(family, table, chain)
+	if err != nil {
+		return b.exec.ListChain(family, table, chain)
+	}
+	// A fallback to the nft binary is counted by the exec backend instead
+	fallback := false
+	defer func(start time.Time) {
+		if !fallback {
+			observeNetlink("list", start, err)
+		}
+	}(time.Now())
+	info, err := b.conn.ListChain(t, chain)
+	if err != nil {
+		return nil, fmt.Errorf("chain %s %s %s: %w", family, table, chain, err)
+	}
+
+	rules, err := b.conn.GetRules(t, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chain %s %s %s: %w", family, table, chain, err)
+	}
+
+	dec := &nlDecoder{conn: b.conn, table: t, family: family}
+	ruleset := &NFTRuleset{NFTables: []NFTObject{{Chain: chainInfo(family, table, info)}}}
+	for _, r := range rules {
+		rule, err := dec.decodeRule(r, table, chain)
+		if err != nil {
+			if errors.Is(err, errUnsupportedExpr) {
+				fallback = true
+				return b.exec.ListChain(family, table, chain)
+			}
+			return nil, err
+		}
+		ruleset.NFTables = append(ruleset.NFTables, NFTObject{Rule: rule})
+	}
+	return ruleset, nil
+}
+
+// chainInfo describes a chain like nft's JSON output; the policy and hook are
+// only set for base chains
+func chainInfo(family, table string, c *nftables.Chain) *NFTChain {
+	info := &NFTChain{Family: family, Table: table, Name: c.Name, Type: string(c.Type)}
+	if c.Hooknum != nil {
+		for name, hook := range map[string]*nftables.ChainHook{
+			"prerouting":  nftables.ChainHookPrerouting,
+			"input":       nftables.ChainHookInput,
+			"forward":     nftables.ChainHookForward,
+			"output":      nftables.ChainHookOutput,
+			"postrouting": nftables.ChainHookPostrouting,
+		} {
+			if *c.Hooknum == *hook {
+				info.Hook = name
+			}
+		}
+	}
+	if c.Priority != nil {
+		info.Prio = int(*c.Priority)
+	}
+	if c.Policy != nil {
+		info.Policy = "accept"
+		if *c.Policy == nftables.ChainPolicyDrop {
+			info.Policy = "drop"
+		}
+	}
+	return info
+}
+
+// TableExists reports whether a table exists
+func (b *NetlinkBackend) TableExists(family, table string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fam, err := nlFamily(family)
+	if err != nil {
+		return false
+	}
+	defer observeNetlink("list", time.Now(), nil)
+	_, err = b.conn.ListTableOfFamily(table, fam)
+	return err == nil
+}
+
+// ChainExists reports whether a chain exists
+func (b *NetlinkBackend) ChainExists(family, table, chain string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, _, err := nlTable(family, table, chain)
+	if err != nil {
+		return false
+	}
+	defer observeNetlink("list", time.Now(), nil)
+	_, err = b.conn.ListChain(t, chain)
+	return err == nil
+}
+
+// ListSetElements reads the elements of a named address set over netlink
+func (b *NetlinkBackend) ListSetElements(family, table, set string) (_ []string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, _, err := nlTable(family, table, "")
+	if err != nil {
+		return b.exec.ListSetElements(family, table, set)
+	}
+	fallback := false
+	defer func(start time.Time) {
+		if !fallback {
+			observeNetlink("list", start, err)
+		}
+	}(time.Now())
+	s, err := b.conn.GetSetByName(t, set)
+	if err != nil {
+		return nil, fmt.Errorf("set %s %s %s: %w", family, table, set, err)
+	}
+	if s.IsMap || (s.KeyType.Bytes != 4 && s.KeyType.Bytes != 16) {
+		fallback = true
+		return b.exec.ListSetElements(family, table, set)
+	}
+	elements, err := b.conn.GetSetElements(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list set %s: %w", set, err)
+	}
+	if !s.Interval {
+		var out []string
+		for _, el := range elements {
+			out = append(out, net.IP(el.Key).String())
+		}
+		return out, nil
+	}
+	return intervalStrings(elements, int(s.KeyType.Bytes)), nil
+}
+
+// ListSetEntries reads the elements of a named address set over netlink, with
+// their timeouts and comments
+func (b *NetlinkBackend) ListSetEntries(family, table, set string) (_ []SetEntry, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, _, err := nlTable(family, table, "")
+	if err != nil {
+		return b.exec.ListSetEntries(family, table, set)
+	}
+	fallback := false
+	defer func(start time.Time) {
+		if !fallback {
+			observeNetlink("list", start, err)
+		}
+	}(time.Now())
+	s, err := b.conn.GetSetByName(t, set)
+	if err != nil {
+		return nil, fmt.Errorf("set %s %s %s: %w", family, table, set, err)
+	}
+	if s.IsMap || (s.KeyType.Bytes != 4 && s.KeyType.Bytes != 16) {
+		fallback = true
+		return b.exec.ListSetEntries(family, table, set)
+	}
+	elements, err := b.conn.GetSetElements(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list set %s: %w", set, err)
+	}
+	if !s.Interval {
+		var out []SetEntry
+		for _, el := range elements {
+			out = append(out, SetEntry{Element: net.IP(el.Key).String(), Timeout: el.Timeout, Expires: el.Expires, Comment: el.Comment})
+		}
+		return out, nil
+	}
+	return intervalEntries(elements, int(s.KeyType.Bytes)), nil
+}
+
+// intervalStrings renders the elements of an interval set as addresses,
+// prefixes or ranges
+func intervalStrings(elements []nftables.SetElement, size int) []string {
+	var out []string
+	for _, e := range intervalEntries(elements, size) {
+		out = append(out, e.Element)
+	}
+	return out
+}
+
+// intervalEntries returns the ranges of an interval set, where each range
+// starts with an element and ends before the next IntervalEnd element. The
+// timeout and comment of a range are those of its first element.
+func intervalEntries(elements []nftables.SetElement, size int) []SetEntry {
+	// The kernel returns elements in no particular order; ends sort before
+	// starts with the same key, which begin the next range
+	sort.SliceStable(elements, func(i, j int) bool {
+		ki, kj := padTo(elements[i].Key, size), padTo(elements[j].Key, size)
+		if c := strings.Compare(string(ki), string(kj)); c != 0 {
+			return c < 0
+		}
+		return elements[i].IntervalEnd && !elements[j].IntervalEnd
+	})
+
+	var out []SetEntry
+	for i, el := range elements {
+		if el.IntervalEnd {
+			continue
+		}
+		start := padTo(el.Key, size)
+		last := make([]byte, size)
+		for k := range last {
+			last[k] = 0xff // open-ended: the range runs to the last address
+		}
+		if i+1 < len(elements) && elements[i+1].IntervalEnd {
+			last = prevAddr(padTo(elements[i+1].Key, size))
+		}
+		out = append(out, SetEntry{Element: formatAddrRange(start, last), Timeout: el.Timeout, Expires: el.Expires, Comment: el.Comment})
+	}
+	return out
+}
+
+// prevAddr returns the address before addr
+func prevAddr(addr []byte) []byte {
+	prev := append([]byte(nil), addr...)
+	for k := len(prev) - 1; k >= 0; k-- {
+		prev[k]--
+		if prev[k] != 0xff {
+			break
+		}
+	}
+	return prev
+}
+
+// nextAddr returns the address after addr and false if addr is the last one
+func nextAddr(addr []byte) ([]byte, bool) {
+	next := append([]byte(nil), addr...)
+	for k := len(next) - 1; k >= 0; k-- {
+		next[k]++
+		if next[k] != 0 {
+			return next, true
+		}
+	}
+	return nil, false
+}
+
+// formatAddrRange renders the addresses first to last as one address, a prefix or a range
+func formatAddrRange(first, last []byte) string {
+	if string(first) == string(last) {
+		return net.IP(first).String()
+	}
+	mask := make([]byte, len(first))
+	for k := range mask {
+		mask[k] = ^(first[k] ^ last[k])
+	}
+	ones := maskLen(mask)
+	prefix := net.IPNet{IP: first, Mask: net.CIDRMask(ones, len(first)*8)}
+	if prefix.IP.Mask(prefix.Mask).Equal(net.IP(first)) && string(broadcast(prefix)) == string(last) {
+		return fmt.Sprintf("%s/%d", net.IP(first), ones)
+	}
+	return fmt.Sprintf("%s-%s", net.IP(first), net.IP(last))
+}
+
+// broadcast returns the last address of a prefix
+func broadcast(n net.IPNet) []byte {
+	last := make([]byte, len(n.IP))
+	for k := range last {
+		last[k] = n.IP[k] | ^n.Mask[k]
+	}
+	return last
+}
+
+// intervalElements encodes addresses and prefixes as interval set elements
+func intervalElements(values []string, l3 string) ([]nftables.SetElement, error) {
+	var elements []nftables.SetElement
+	for _, v := range values {
+		var first, last []byte
+		if _, ipNet, err := net.ParseCIDR(v); err == nil {
+			first = ipBytes(ipNet.IP, l3)
+			if first != nil {
+				last = broadcast(net.IPNet{IP: first, Mask: ipNet.Mask})
+			}
+		} else {
+			first = ipBytes(net.ParseIP(v), l3)
+			last = first
+		}
+		if first == nil {
+			return nil, fmt.Errorf("%w: %s set element %s", errUnsupportedExpr, l3, v)
+		}
+		elements = append(elements, nftables.SetElement{Key: first})
+		if end, ok := nextAddr(last); ok {
+			elements = append(elements, nftables.SetElement{Key: end, IntervalEnd: true})
+		}
+	}
+	return elements, nil
+}
+
+// setL3 returns the address family of an existing set's elements; the table
+// family stands in for sets of ip and ip6 tables and for unknown sets
+func (b *NetlinkBackend) setL3(family string, t *nftables.Table, name string) string {
+	if family != "inet" {
+		return family
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if set, err := b.conn.GetSetByName(t, name); err == nil && set.KeyType == nftables.TypeIP6Addr {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// AddTable creates a table
+func (b *NetlinkBackend) AddTable(family, table string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	fam, err := nlFamily(family)
+	if err != nil {
+		return err
+	}
+	b.conn.AddTable(&nftables.Table{Name: table, Family: fam})
+	if err := b.flush("add"); err != nil {
+		return fmt.Errorf("add table %s %s: %w", family, table, err)
+	}
+	return nil
+}
+
+// AddBaseChain creates a base chain
+func (b *NetlinkBackend) AddBaseChain(family, table, chain string, spec ChainSpec) error {
+	t, _, err := nlTable(family, table, chain)
+	if err != nil {
+		return b.exec.AddBaseChain(family, table, chain, spec)
+	}
+	c, err := nlBaseChain(t, chain, spec)
+	if err != nil {
+		return b.exec.AddBaseChain(family, table, chain, spec)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.conn.AddChain(c)
+	if err := b.flush("add"); err != nil {
+		return fmt.Errorf("add chain %s %s %s: %w", family, table, chain, err)
+	}
+	return nil
+}
+
+// nlBaseChain builds a base chain from its nft spec
+func nlBaseChain(t *nftables.Table, chain string, spec ChainSpec) (*nftables.Chain, error) {
+	var hook *nftables.ChainHook
+	switch spec.Hook {
+	case "prerouting":
+		hook = nftables.ChainHookPrerouting
+	case "input":
+		hook = nftables.ChainHookInput
+	case "forward":
+		hook = nftables.ChainHookForward
+	case "output":
+		hook = nftables.ChainHookOutput
+	case "postrouting":
+		hook = nftables.ChainHookPostrouting
+	default:
+		return nil, fmt.Errorf("%w: hook %s", errUnsupportedExpr, spec.Hook)
+	}
+
+	policy := nftables.ChainPolicyAccept
+	if spec.Policy == "drop" {
+		policy = nftables.ChainPolicyDrop
+	}
+
+	return &nftables.Chain{
+		Name:     chain,
+		Table:    t,
+		Type:     nftables.ChainType(spec.Type),
+		Hooknum:  hook,
+		Priority: nftables.ChainPriorityRef(nftables.ChainPriority(spec.Priority)),
+		Policy:   &policy,
+	}, nil
+}
+
+// AddRule appends a rule to a chain
+func (b *NetlinkBackend) AddRule(family, table, chain string, rule ...string) error {
+	return b.addRule(false, family, table, chain, rule)
+}
+
+// InsertRule prepends a rule to a chain
+func (b *NetlinkBackend) InsertRule(family, table, chain string, rule ...string) error {
+	return b.addRule(true, family, table, chain, rule)
+}
+
+// addRule compiles an nft syntax rule to netlink expressions and sends it in one batch
+func (b *NetlinkBackend) addRule(insert bool, family, table, chain string, rule []string) error {
+	t, c, err := nlTable(family, table, chain)
+	if err != nil {
+		return b.execAddRule(insert, family, table, chain, rule)
+	}
+
+	comp := &nlCompiler{family: family}
+	if err := comp.compile(tokenizeNFT(strings.Join(rule, " "))); err != nil {
+		if errors.Is(err, errUnsupportedExpr) {
+			return b.execAddRule(insert, family, table, chain, rule)
+		}
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	verb := "add rule"
+	if insert {
+		verb = "insert rule"
+	}
+	if err := b.queueRule(verb, 0, t, c, comp); err != nil {
+		return b.abort(strings.Fields(verb)[0], err)
+	}
+	if err := b.flush(strings.Fields(verb)[0]); err != nil {
+		return fmt.Errorf("add rule %s %s %s %s: %w", family, table, chain, strings.Join(rule, " "), err)
+	}
+	return nil
+}
+
+// queueRule adds a compiled rule and its anonymous sets to the pending batch,
+// appended, inserted or replacing the rule with handle as verb says.
+// The caller must hold b.mu.
+func (b *NetlinkBackend) queueRule(verb string, handle int64, t *nftables.Table, c *nftables.Chain, comp *nlCompiler) error {
+	for _, s := range comp.sets {
+		s.set.Table = t
+		if err := b.conn.AddSet(s.set, s.elements); err != nil {
+			return err
+		}
+		s.lookup.SetName = s.set.Name
+		s.lookup.SetID = s.set.ID
+	}
+
+	r := &nftables.Rule{Table: t, Chain: c, Exprs: comp.exprs}
+	if comp.comment != "" {
+		r.UserData = userdata.AppendString(nil, userdata.TypeComment, comp.comment)
+	}
+	switch verb {
+	case "insert rule":
+		b.conn.InsertRule(r)
+	case "replace rule":
+		r.Handle = uint64(handle)
+		b.conn.ReplaceRule(r)
+	default:
+		b.conn.AddRule(r)
+	}
+	return nil
+}
+
+// execAddRule adds a rule through the nft binary
+func (b *NetlinkBackend) execAddRule(insert bool, family, table, chain string, rule []string) error {
+	if insert {
+		return b.exec.InsertRule(family, table, chain, rule...)
+	}
+	return b.exec.AddRule(family, table, chain, rule...)
+}
+
+// DeleteRule deletes a rule by handle
+func (b *NetlinkBackend) DeleteRule(family, table, chain string, handle int64) error {
+	t, c, err := nlTable(family, table, chain)
+	if err != nil {
+		return b.exec.DeleteRule(family, table, chain, handle)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.conn.DelRule(&nftables.Rule{Table: t, Chain: c, Handle: uint64(handle)}); err != nil {
+		return b.abort("delete", err)
+	}
+	if err := b.flush("delete"); err != nil {
+		return fmt.Errorf("delete rule %s %s %s handle %d: %w", family, table, chain, handle, err)
+	}
+	return nil
+}
+
+// Apply sends all commands of a transaction in a single netlink batch,
+// which the kernel commits atomically. If any command cannot be expressed
+// natively, the whole transaction is handed to 'nft -f' instead so it is
+// never split between the two paths.
+func (b *NetlinkBackend) Apply(tx *Transaction) error {
+	if tx.Empty() {
+		return nil
+	}
+
+	type nlOp struct {
+		txOp
+		t        *nftables.Table
+		c        *nftables.Chain
+		comp     *nlCompiler
+		set      *nftables.Set
+		elements []nftables.SetElement
+	}
+	ops := make([]nlOp, 0, len(tx.ops))
+	setL3 := make(map[string]string) // address family of the sets created by tx
+	for _, op := range tx.ops {
+		t, c, err := nlTable(op.family, op.table, op.chain)
+		if err != nil {
+			return b.exec.Apply(tx)
+		}
+		o := nlOp{txOp: op, t: t, c: c}
+		switch op.verb {
+		case "add chain":
+			if op.spec.Hook == "" {
+				break // regular chain, o.c is all it needs
+			}
+			if o.c, err = nlBaseChain(t, op.chain, op.spec); err != nil {
+				return b.exec.Apply(tx)
+			}
+		case "add rule", "insert rule", "replace rule":
+			if op.verb == "replace rule" && op.handle <= 0 {
+				return fmt.Errorf("invalid rule handle %d", op.handle)
+			}
+			o.comp = &nlCompiler{family: op.family}
+			if err := o.comp.compile(tokenizeNFT(strings.Join(op.rule, " "))); err != nil {
+				if errors.Is(err, errUnsupportedExpr) {
+					return b.exec.Apply(tx)
+				}
+				return err
+			}
+		case "delete rule":
+			if op.handle <= 0 {
+				return fmt.Errorf("invalid rule handle %d", op.handle)
+			}
+		case "add set":
+			o.set = &nftables.Set{Table: t, Name: op.chain, Interval: true}
+			if len(op.rule) > 1 && op.rule[1] == "dynamic" {
+				o.set = &nftables.Set{Table: t, Name: op.chain, Dynamic: true, Size: meterSetSize,
+					HasTimeout: op.ttl > 0, Timeout: op.ttl}
+			}
+			if len(op.rule) > 1 && op.rule[1] == "timeout" {
+				o.set.HasTimeout = true
+			}
+			switch op.rule[0] {
+			case "ipv4_addr":
+				o.set.KeyType = nftables.TypeIPAddr
+				setL3[op.table+" "+op.chain] = "ip"
+			case "ipv6_addr":
+				o.set.KeyType = nftables.TypeIP6Addr
+				setL3[op.table+" "+op.chain] = "ip6"
+			default:
+				return b.exec.Apply(tx)
+			}
+		case "flush set", "delete set":
+			o.set = &nftables.Set{Table: t, Name: op.chain}
+		case "add element", "delete element":
+			o.set = &nftables.Set{Table: t, Name: op.chain, Interval: true, HasTimeout: op.ttl > 0}
+			l3, ok := setL3[op.table+" "+op.chain]
+			if !ok {
+				l3 = b.setL3(op.family, t, op.chain)
+			}
+			if o.elements, err = intervalElements(op.rule, l3); err != nil {
+				if errors.Is(err, errUnsupportedExpr) {
+					return b.exec.Apply(tx)
+				}
+				return err
+			}
+			for k := range o.elements {
+				if !o.elements[k].IntervalEnd {
+					o.elements[k].Timeout = op.ttl
+					o.elements[k].Comment = op.note
+				}
+			}
+		}
+		ops = append(ops, o)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Nothing of a transaction may stay queued on the lasting connection if
+	// any command fails, or the next batch would commit it
+	queue := func(o nlOp) error {
+		switch o.verb {
+		case "add table":
+			b.conn.AddTable(o.t)
+		case "add chain":
+			b.conn.AddChain(o.c)
+		case "delete chain":
+			b.conn.DelChain(o.c)
+		case "add rule", "insert rule", "replace rule":
+			if err := b.queueRule(o.verb, o.handle, o.t, o.c, o.comp); err != nil {
+				return err
+			}
+		case "delete rule":
+			if err := b.conn.DelRule(&nftables.Rule{Table: o.t, Chain: o.c, Handle: uint64(o.handle)}); err != nil {
+				return err
+			}
+		case "add set":
+			if err := b.conn.AddSet(o.set, nil); err != nil {
+				return err
+			}
+		case "flush set":
+			b.conn.FlushSet(o.set)
+		case "delete set":
+			b.conn.DelSet(o.set)
+		case "add element":
+			if err := b.conn.SetAddElements(o.set, o.elements); err != nil {
+				return err
+			}
+		case "delete element":
+			if err := b.conn.SetDeleteElements(o.set, o.elements); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, o := range ops {
+		if err := queue(o); err != nil {
+			return b.abort("file", fmt.Errorf("apply transaction: %s: %w", o.verb, err))
+		}
+	}
+	if err := b.flush("file"); err != nil {
+		return fmt.Errorf("apply transaction: %w", err)
+	}
+	return nil
+}
+
+// flush sends the pending batch, recorded in the metrics as the nft command
+// cmd. The connection is replaced if that fails, as a serialization error
+// would otherwise fail every later batch too. The caller must hold b.mu.
+func (b *NetlinkBackend) flush(cmd string) error {
+	start := time.Now()
+	err := b.conn.Flush()
+	observeNetlink(cmd, start, err)
+	if err != nil {
+		b.discard()
+		return err
+	}
+	return nil
+}
+
+// abort discards a batch that failed while being queued and records the
+// failure of the nft command cmd. The caller must hold b.mu.
+func (b *NetlinkBackend) abort(cmd string, err error) error {
+	b.discard()
+	observeNetlink(cmd, time.Now(), err)
+	return err
+}
+
+// observeNetlink records a netlink round trip in the nft command metrics under
+// the nft command it stands for ("list", "add", "insert", "delete", "flush");
+// a transaction counts as "file", like the nft -f applying it through the binary
+func observeNetlink(cmd string, start time.Time, err error) {
+	observeNFTCommand([]string{cmd}, time.Since(start), err)
+}
+
+// discard drops the commands queued on the connection by replacing it with a
+// new one; a connection opened per operation stands in if that fails.
+// The caller must hold b.mu.
+func (b *NetlinkBackend) discard() {
+	b.conn.CloseLasting()
+	conn, err := nftables.New(nftables.AsLasting())
+	if err != nil {
+		conn, _ = nftables.New()
+	}
+	b.conn = conn
+}
+
+// ListRuleset returns the ruleset in nft text syntax (rendered by the nft binary)
+func (b *NetlinkBackend) ListRuleset() ([]byte, error) {
+	return b.exec.ListRuleset()
+}
+
+// FlushRuleset removes all tables, chains and rules
+func (b *NetlinkBackend) FlushRuleset() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.conn.FlushRuleset()
+	return b.flush("flush")
+}
+
+// LoadFile applies an nft script file (parsed by the nft binary)
+func (b *NetlinkBackend) LoadFile(path string) error {
+	return b.exec.LoadFile(path)
+}
+
+// Decoding: netlink expressions -> nft JSON model
+
+// nlReg describes what a register was loaded with
+type nlReg struct {
+	kind   string // "meta" | "payload" | "ct" | "imm" | "numgen" | "jhash" | "map"
+	key    string // meta/ct key
+	base   expr.PayloadBase
+	offset uint32
+	length uint32
+	mask   []byte
+	data   []byte
+	value  map[string]interface{} // JSON of a numgen, jhash or map expression
+}
+
+// nlDecoder converts netlink rules of one table into NFTRule values
+type nlDecoder struct {
+	conn     *nftables.Conn
+	table    *nftables.Table
+	family   string
+	sets     map[string]*nftables.Set
+	elements map[string][]nftables.SetElement // elements of the sets read so far, by set name
+}
+
+// decodeRule converts a single netlink rule
+func (d *nlDecoder) decodeRule(r *nftables.Rule, table, chain string) (*NFTRule, error) {
+	regs := make(map[uint32]*nlReg)
+	var out []map[string]interface{}
+	var pending map[string]interface{} // implicit dependency match (meta l4proto/nfproto)
+	pendingKey := ""
+	l4 := ""
+	l3 := d.family
+
+	flush := func() {
+		if pending != nil {
+			out = append(out, pending)
+			pending = nil
+		}
+	}
+	emit := func(m map[string]interface{}) {
+		flush()
+		out = append(out, m)
+	}
+	// dropImplied discards a pending dependency that the payload match implies
+	dropImplied := func(src *nlReg) {
+		if pending == nil || src.kind != "payload" {
+			return
+		}
+		if (pendingKey == "l4proto" && src.base == expr.PayloadBaseTransportHeader) ||
+			(pendingKey == "nfproto" && src.base == expr.PayloadBaseNetworkHeader) {
+			pending = nil
+		}
+	}
+
+	for _, e := range r.Exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			if e.SourceRegister {
+				src := regs[e.Register]
+				if src == nil || src.kind != "imm" || metaKeyName(e.Key) != "mark" {
+					return nil, fmt.Errorf("%w: meta set %d", errUnsupportedExpr, e.Key)
+				}
+				emit(map[string]interface{}{"mangle": map[string]interface{}{
+					"key":   map[string]interface{}{"meta": map[string]interface{}{"key": "mark"}},
+					"value": float64(binaryutil.NativeEndian.Uint32(padTo(src.data, 4))),
+				}})
+				continue
+			}
+			key := metaKeyName(e.Key)
+			if key == "" {
+				return nil, fmt.Errorf("%w: meta key %d", errUnsupportedExpr, e.Key)
+			}
+			regs[e.Register] = &nlReg{kind: "meta", key: key}
+
+		case *expr.Payload:
+			if e.OperationType != expr.PayloadLoad {
+				return nil, fmt.Errorf("%w: payload write", errUnsupportedExpr)
+			}
+			regs[e.DestRegister] = &nlReg{kind: "payload", base: e.Base, offset: e.Offset, length: e.Len}
+
+		case *expr.Ct:
+			if e.SourceRegister {
+				return nil, fmt.Errorf("%w: ct set", errUnsupportedExpr)
+			}
+			regs[e.Register] = &nlReg{kind: "ct", key: ctKeyName(e.Key)}
+
+		case *expr.Bitwise:
+			src := regs[e.SourceRegister]
+			if src == nil {
+				return nil, fmt.Errorf("%w: bitwise on unknown register", errUnsupportedExpr)
+			}
+			masked := *src
+			masked.mask = e.Mask
+			regs[e.DestRegister] = &masked
+
+		case *expr.Immediate:
+			regs[e.Register] = &nlReg{kind: "imm", data: e.Data}
+
+		case *expr.Numgen:
+			mode := "inc"
+			if e.Type == unix.NFT_NG_RANDOM {
+				mode = "random"
+			}
+			regs[e.Register] = &nlReg{kind: "numgen", value: map[string]interface{}{"numgen": map[string]interface{}{
+				"mode":   mode,
+				"mod":    float64(e.Modulus),
+				"offset": float64(e.Offset),
+			}}}
+
+		case *expr.Hash:
+			src := regs[e.SourceRegister]
+			if src == nil || e.Type != expr.HashTypeJenkins {
+				return nil, fmt.Errorf("%w: hash", errUnsupportedExpr)
+			}
+			left, err := d.leftOf(src, l4, l3)
+			if err != nil {
+				return nil, err
+			}
+			regs[e.DestRegister] = &nlReg{kind: "jhash", value: map[string]interface{}{"jhash": map[string]interface{}{
+				"mod":    float64(e.Modulus),
+				"seed":   float64(e.Seed),
+				"offset": float64(e.Offset),
+				"expr":   left,
+			}}}
+
+		case *expr.Cmp:
+			src := regs[e.Register]
+			if src == nil {
+				return nil, fmt.Errorf("%w: cmp on unknown register", errUnsupportedExpr)
+			}
+
+			// Protocol dependencies are folded into the following payload match, like nft does
+			if src.kind == "meta" && src.mask == nil && e.Op == expr.CmpOpEq &&
+				(src.key == "l4proto" || src.key == "nfproto") && len(e.Data) == 1 {
+				flush()
+				var name string
+				if src.key == "l4proto" {
+					name = protoName(e.Data[0])
+					l4 = name
+				} else {
+					name = nfprotoName(e.Data[0])
+					l3 = map[string]string{"ipv4": "ip", "ipv6": "ip6"}[name]
+				}
+				pending = matchExpr("==", map[string]interface{}{"meta": map[string]interface{}{"key": src.key}}, name)
+				pendingKey = src.key
+				continue
+			}
+
+			left, err := d.leftOf(src, l4, l3)
+			if err != nil {
+				return nil, err
+			}
+			dropImplied(src)
+
+			op := cmpOpName(e.Op)
+			var right interface{}
+			if src.mask != nil && src.kind == "payload" && src.base == expr.PayloadBaseNetworkHeader {
+				right = map[string]interface{}{"prefix": map[string]interface{}{
+					"addr": net.IP(e.Data).String(),
+					"len":  float64(maskLen(src.mask)),
+				}}
+			} else if src.mask != nil {
+				// Flag tests: "ct state established,related", "tcp flags syn"
+				if e.Op != expr.CmpOpNeq || !isZero(e.Data) {
+					return nil, fmt.Errorf("%w: masked compare", errUnsupportedExpr)
+				}
+				op = "in"
+				right, err = flagNames(src, l4)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				right, err = valueOf(src, e.Data, l4)
+				if err != nil {
+					return nil, err
+				}
+			}
+			emit(matchExpr(op, left, right))
+
+		case *expr.Range:
+			src := regs[e.Register]
+			if src == nil {
+				return nil, fmt.Errorf("%w: range on unknown register", errUnsupportedExpr)
+			}
+			left, err := d.leftOf(src, l4, l3)
+			if err != nil {
+				return nil, err
+			}
+			dropImplied(src)
+			from, err := valueOf(src, e.FromData, l4)
+			if err != nil {
+				return nil, err
+			}
+			to, err := valueOf(src, e.ToData, l4)
+			if err != nil {
+				return nil, err
+			}
+			emit(matchExpr(cmpOpName(e.Op), left, map[string]interface{}{"range": []interface{}{from, to}}))
+
+		case *expr.Lookup:
+			src := regs[e.SourceRegister]
+			if src != nil && e.IsDestRegSet && src.value != nil {
+				data, err := d.mapRef(e.SetName)
+				if err != nil {
+					return nil, err
+				}
+				regs[e.DestRegister] = &nlReg{kind: "map", value: map[string]interface{}{"map": map[string]interface{}{
+					"key":  src.value,
+					"data": data,
+				}}}
+				continue
+			}
+			if src == nil || e.IsDestRegSet {
+				return nil, fmt.Errorf("%w: lookup", errUnsupportedExpr)
+			}
+			left, err := d.leftOf(src, l4, l3)
+			if err != nil {
+				return nil, err
+			}
+			dropImplied(src)
+			right, err := d.setRef(e.SetName, src, l4)
+			if err != nil {
+				return nil, err
+			}
+			op := "=="
+			if e.Invert {
+				op = "!="
+			}
+			emit(matchExpr(op, left, right))
+
+		case *expr.Quota:
+			val, valUnit := nftByteUnit(e.Bytes)
+			q := map[string]interface{}{
+				"val":      float64(val),
+				"val_unit": valUnit,
+				"inv":      e.Over,
+			}
+			if e.Consumed > 0 {
+				used, usedUnit := nftByteUnit(e.Consumed)
+				q["used"] = float64(used)
+				q["used_unit"] = usedUnit
+			}
+			emit(map[string]interface{}{"quota": q})
+
+		case *expr.Limit:
+			emit(limitExpr(e))
+
+		case *expr.Counter:
+			emit(map[string]interface{}{"counter": map[string]interface{}{
+				"packets": float64(e.Packets),
+				"bytes":   float64(e.Bytes),
+			}})
+
+		case *expr.NAT:
+			key := "dnat"
+			if e.Type == expr.NATTypeSourceNAT {
+				key = "snat"
+			}
+			nat := map[string]interface{}{}
+			if e.RegAddrMax != 0 && e.RegAddrMax != e.RegAddrMin {
+				return nil, fmt.Errorf("%w: nat address range", errUnsupportedExpr)
+			}
+			if e.RegAddrMin != 0 {
+				addr := regs[e.RegAddrMin]
+				switch {
+				case addr != nil && addr.kind == "imm":
+					nat["addr"] = net.IP(addr.data).String()
+				case addr != nil && addr.kind == "map":
+					nat["addr"] = addr.value
+				default:
+					return nil, fmt.Errorf("%w: nat address", errUnsupportedExpr)
+				}
+			}
+			if e.RegProtoMin != 0 {
+				lo := regs[e.RegProtoMin]
+				if lo == nil || lo.kind != "imm" {
+					return nil, fmt.Errorf("%w: nat port", errUnsupportedExpr)
+				}
+				from := float64(binaryutil.BigEndian.Uint16(padTo(lo.data, 2)))
+				nat["port"] = from
+				if e.RegProtoMax != 0 && e.RegProtoMax != e.RegProtoMin {
+					hi := regs[e.RegProtoMax]
+					if hi == nil || hi.kind != "imm" {
+						return nil, fmt.Errorf("%w: nat port range", errUnsupportedExpr)
+					}
+					to := float64(binaryutil.BigEndian.Uint16(padTo(hi.data, 2)))
+					nat["port"] = map[string]interface{}{"range": []interface{}{from, to}}
+				}
+			}
+			if d.family == "inet" {
+				nat["family"] = nfprotoName(byte(e.Family))
+			}
+			emit(map[string]interface{}{key: nat})
+
+		case *expr.Masq:
+			emit(map[string]interface{}{"masquerade": nil})
+
+		case *expr.Exthdr:
+			// Only "tcp option maxseg size set N" is written by nft-ui
+			src := regs[e.SourceRegister]
+			if e.SourceRegister == 0 || e.Op != expr.ExthdrOpTcpopt || e.Type != 2 || src == nil || src.kind != "imm" {
+				return nil, fmt.Errorf("%w: exthdr", errUnsupportedExpr)
+			}
+			emit(map[string]interface{}{"mangle": map[string]interface{}{
+				"key": map[string]interface{}{"tcp option": map[string]interface{}{
+					"name":  "maxseg",
+					"field": "size",
+				}},
+				"value": float64(binaryutil.BigEndian.Uint16(padTo(src.data, 2))),
+			}})
+
+		case *expr.Reject:
+			emit(map[string]interface{}{"reject": nil})
+
+		case *expr.Connlimit:
+			emit(connlimitExpr(e))
+
+		case *expr.Dynset:
+			// Only the per address meters and timed additions the compiler emits
+			src := regs[e.SrcRegKey]
+			op := map[uint32]string{unix.NFT_DYNSET_OP_ADD: "add", unix.NFT_DYNSET_OP_UPDATE: "update"}[e.Operation]
+			if src == nil || op == "" || len(e.Exprs) > 1 {
+				return nil, fmt.Errorf("%w: dynset", errUnsupportedExpr)
+			}
+			var stmts []interface{}
+			for _, x := range e.Exprs {
+				switch x := x.(type) {
+				case *expr.Connlimit:
+					stmts = append(stmts, connlimitExpr(x))
+				case *expr.Limit:
+					stmts = append(stmts, limitExpr(x))
+				default:
+					return nil, fmt.Errorf("%w: dynset %T", errUnsupportedExpr, x)
+				}
+			}
+			left, err := d.leftOf(src, l4, l3)
+			if err != nil {
+				return nil, err
+			}
+			dropImplied(src)
+			var elem interface{} = left
+			if e.Timeout > 0 {
+				elem = map[string]interface{}{"elem": map[string]interface{}{
+					"val":     left,
+					"timeout": float64(e.Timeout / time.Second),
+				}}
+			}
+			set := map[string]interface{}{
+				"op":   op,
+				"elem": elem,
+				"set":  "@" + e.SetName,
+			}
+			if len(stmts) > 0 {
+				set["stmt"] = stmts
+			}
+			emit(map[string]interface{}{"set": set})
+
+		case *expr.Verdict:
+			v, err := verdictExpr(e)
+			if err != nil {
+				return nil, err
+			}
+			emit(v)
+
+		default:
+			return nil, fmt.Errorf("%w: %T", errUnsupportedExpr, e)
+		}
+	}
+	flush()
+
+	comment, _ := userdata.GetString(r.UserData, userdata.TypeComment)
+	return &NFTRule{
+		Family:  d.family,
+		Table:   table,
+		Chain:   chain,
+		Handle:  int64(r.Handle),
+		Expr:    out,
+		Comment: comment,
+	}, nil
+}
+
+// limitExpr renders a rate limit like nft: {"limit": {"rate": 10, "per": "second", "inv": false}}
+func limitExpr(e *expr.Limit) map[string]interface{} {
+	l := map[string]interface{}{
+		"per": limitPer(e.Unit),
+		"inv": e.Over,
+	}
+	if e.Type == expr.LimitTypePktBytes {
+		rate, unit := nftByteUnit(e.Rate)
+		l["rate"] = float64(rate)
+		l["rate_unit"] = unit
+	} else {
+		l["rate"] = float64(e.Rate)
+	}
+	if e.Burst > 0 {
+		l["burst"] = float64(e.Burst)
+	}
+	return map[string]interface{}{"limit": l}
+}
+
+// connlimitExpr renders a connection count like nft: {"ct count": {"val": 5, "inv": true}}
+func connlimitExpr(e *expr.Connlimit) map[string]interface{} {
+	cc := map[string]interface{}{"val": float64(e.Count)}
+	if e.Flags&expr.NFT_CONNLIMIT_F_INV != 0 {
+		cc["inv"] = true
+	}
+	return map[string]interface{}{"ct count": cc}
+}
+
+// leftOf builds the left-hand side of a match from a register source
+func (d *nlDecoder) leftOf(src *nlReg, l4, l3 string) (map[string]interface{}, error) {
+	switch src.kind {
+	case "meta":
+		return map[string]interface{}{"meta": map[string]interface{}{"key": src.key}}, nil
+	case "ct":
+		if src.key == "" {
+			return nil, fmt.Errorf("%w: ct key", errUnsupportedExpr)
+		}
+		return map[string]interface{}{"ct": map[string]interface{}{"key": src.key}}, nil
+	case "payload":
+		proto, field := payloadField(src, l4, l3)
+		if field == "" {
+			return nil, fmt.Errorf("%w: payload base %d offset %d", errUnsupportedExpr, src.base, src.offset)
+		}
+		return map[string]interface{}{"payload": map[string]interface{}{"protocol": proto, "field": field}}, nil
+	}
+	return nil, fmt.Errorf("%w: register kind %s", errUnsupportedExpr, src.kind)
+}
+
+// lookupSet returns a set of the table by name, listing the sets on first use
+func (d *nlDecoder) lookupSet(name string) (*nftables.Set, error) {
+	if d.sets == nil {
+		d.sets = make(map[string]*nftables.Set)
+		sets, err := d.conn.GetSets(d.table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list sets: %w", err)
+		}
+		for _, s := range sets {
+			d.sets[s.Name] = s
+		}
+	}
+
+	set, ok := d.sets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown set %s", errUnsupportedExpr, name)
+	}
+	return set, nil
+}
+
+// setElements returns the elements of a set, listing them on first use
+func (d *nlDecoder) setElements(set *nftables.Set) ([]nftables.SetElement, error) {
+	if elements, ok := d.elements[set.Name]; ok {
+		return elements, nil
+	}
+	elements, err := d.conn.GetSetElements(set)
+	if err != nil {
+		return nil, err
+	}
+	if d.elements == nil {
+		d.elements = make(map[string][]nftables.SetElement)
+	}
+	d.elements[set.Name] = elements
+	return elements, nil
+}
+
+// mapRef renders the elements of an anonymous integer-to-address map, like
+// the load balancing maps of a DNAT rule: {"set": [[0, "10.0.0.2"], ...]}
+func (d *nlDecoder) mapRef(name string) (interface{}, error) {
+	set, err := d.lookupSet(name)
+	if err != nil {
+		return nil, err
+	}
+	if !set.Anonymous || !set.IsMap || set.Interval || set.KeyType.Bytes != 4 ||
+		(set.DataType.Bytes != 4 && set.DataType.Bytes != 16) {
+		return nil, fmt.Errorf("%w: map %s", errUnsupportedExpr, name)
+	}
+
+	elements, err := d.setElements(set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list map %s: %w", name, err)
+	}
+	// The kernel returns elements in no particular order
+	sort.Slice(elements, func(i, j int) bool {
+		return binaryutil.NativeEndian.Uint32(padTo(elements[i].Key, 4)) < binaryutil.NativeEndian.Uint32(padTo(elements[j].Key, 4))
+	})
+	var values []interface{}
+	for _, el := range elements {
+		values = append(values, []interface{}{
+			float64(binaryutil.NativeEndian.Uint32(padTo(el.Key, 4))),
+			net.IP(el.Val).String(),
+		})
+	}
+	return map[string]interface{}{"set": values}, nil
+}
+
+// setRef renders the right-hand side of a lookup: inline elements for anonymous sets, "@name" otherwise
+func (d *nlDecoder) setRef(name string, src *nlReg, l4 string) (interface{}, error) {
+	set, err := d.lookupSet(name)
+	if err != nil {
+		return nil, err
+	}
+	if !set.Anonymous {
+		return "@" + name, nil
+	}
+	if set.Interval || set.IsMap || set.Concatenation {
+		return nil, fmt.Errorf("%w: anonymous set flags", errUnsupportedExpr)
+	}
+
+	elements, err := d.setElements(set)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list set %s: %w", name, err)
+	}
+	var values []interface{}
+	for _, el := range elements {
+		v, err := valueOf(src, el.Key, l4)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return map[string]interface{}{"set": values}, nil
+}
+
+// payloadField names a payload load the way nft does ("th sport", "ip daddr", ...)
+func payloadField(src *nlReg, l4, l3 string) (string, string) {
+	switch src.base {
+	case expr.PayloadBaseTransportHeader:
+		if src.offset == 0 && src.length == 1 && (l4 == "icmp" || l4 == "ipv6-icmp") {
+			return map[string]string{"icmp": "icmp", "ipv6-icmp": "icmpv6"}[l4], "type"
+		}
+		proto := l4
+		if proto != "tcp" && proto != "udp" {
+			proto = "th"
+		}
+		switch {
+		case src.offset == 0 && src.length == 2:
+			return proto, "sport"
+		case src.offset == 2 && src.length == 2:
+			return proto, "dport"
+		case src.offset == 13 && src.length == 1 && proto == "tcp":
+			return proto, "flags"
+		}
+	case expr.PayloadBaseNetworkHeader:
+		switch l3 {
+		case "ip":
+			switch {
+			case src.offset == 12 && src.length == 4:
+				return "ip", "saddr"
+			case src.offset == 16 && src.length == 4:
+				return "ip", "daddr"
+			case src.offset == 9 && src.length == 1:
+				return "ip", "protocol"
+			}
+		case "ip6":
+			switch {
+			case src.offset == 8 && src.length == 16:
+				return "ip6", "saddr"
+			case src.offset == 24 && src.length == 16:
+				return "ip6", "daddr"
+			case src.offset == 6 && src.length == 1:
+				return "ip6", "nexthdr"
+			}
+		}
+	}
+	return "", ""
+}
+
+// valueOf decodes raw register data into the JSON value nft would print
+func valueOf(src *nlReg, data []byte, l4 string) (interface{}, error) {
+	switch src.kind {
+	case "meta":
+		switch src.key {
+		case "l4proto":
+			return protoName(data[0]), nil
+		case "nfproto":
+			return nfprotoName(data[0]), nil
+		case "iifname", "oifname":
+			return strings.TrimRight(string(data), "\x00"), nil
+		case "mark":
+			return float64(binaryutil.NativeEndian.Uint32(padTo(data, 4))), nil
+		}
+	case "payload":
+		_, field := payloadField(src, l4, "ip")
+		if src.base == expr.PayloadBaseNetworkHeader && (src.length == 4 || src.length == 16) {
+			return net.IP(data).String(), nil
+		}
+		switch field {
+		case "type":
+			if name, ok := icmpTypeNames[l4][data[0]]; ok {
+				return name, nil
+			}
+			return float64(data[0]), nil
+		case "sport", "dport":
+			return float64(binaryutil.BigEndian.Uint16(padTo(data, 2))), nil
+		case "protocol":
+			return protoName(data[0]), nil
+		}
+		if src.base == expr.PayloadBaseNetworkHeader && src.length == 1 {
+			return protoName(data[0]), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: value for %s %s", errUnsupportedExpr, src.kind, src.key)
+}
+
+// flagNames decodes a bitmask test into flag names
+func flagNames(src *nlReg, l4 string) (interface{}, error) {
+	var names []interface{}
+	switch {
+	case src.kind == "ct" && src.key == "state":
+		mask := binaryutil.NativeEndian.Uint32(padTo(src.mask, 4))
+		for _, st := range ctStates {
+			if mask&st.bit != 0 {
+				names = append(names, st.name)
+			}
+		}
+	case src.kind == "payload" && src.base == expr.PayloadBaseTransportHeader && src.offset == 13:
+		for i, name := range tcpFlagNames {
+			if src.mask[0]&(1<<uint(i)) != 0 {
+				names = append(names, name)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: bitmask on %s %s", errUnsupportedExpr, src.kind, src.key)
+	}
+	if len(names) == 1 {
+		return names[0], nil
+	}
+	return names, nil
+}
+
+// verdictExpr renders a verdict
+func verdictExpr(v *expr.Verdict) (map[string]interface{}, error) {
+	switch v.Kind {
+	case expr.VerdictAccept:
+		return map[string]interface{}{"accept": nil}, nil
+	case expr.VerdictDrop:
+		return map[string]interface{}{"drop": nil}, nil
+	case expr.VerdictReturn:
+		return map[string]interface{}{"return": nil}, nil
+	case expr.VerdictContinue:
+		return map[string]interface{}{"continue": nil}, nil
+	case expr.VerdictJump:
+		return map[string]interface{}{"jump": map[string]interface{}{"target": v.Chain}}, nil
+	case expr.VerdictGoto:
+		return map[string]interface{}{"goto": map[string]interface{}{"target": v.Chain}}, nil
+	}
+	return nil, fmt.Errorf("%w: verdict %d", errUnsupportedExpr, v.Kind)
+}
+
+// matchExpr builds an nft JSON match statement
+func matchExpr(op string, left map[string]interface{}, right interface{}) map[string]interface{} {
+	return map[string]interface{}{"match": map[string]interface{}{
+		"op":    op,
+		"left":  left,
+		"right": right,
+	}}
+}
+
+// Encoding: nft syntax -> netlink expressions
+
+// nlAnonSet is an anonymous set created in the same batch as the rule using it
+type nlAnonSet struct {
+	set      *nftables.Set
+	elements []nftables.SetElement
+	lookup   *expr.Lookup
+}
+
+// nlCompiler translates the subset of nft syntax that nft-ui generates
+type nlCompiler struct {
+	family  string
+	l4      string // protocol matched so far ("tcp", "udp", "any")
+	l3      string // network protocol matched so far ("ip", "ip6")
+	exprs   []expr.Any
+	sets    []*nlAnonSet
+	comment string
+}
+
+// tokenizeNFT splits an nft rule into tokens, keeping quoted strings intact
+// and treating braces and commas as separate tokens
+func tokenizeNFT(s string) []string {
+	var tokens []string
+	var cur strings.Builder
+	inQuote := false
+
+	flushCur := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for _, r := range s {
+		switch {
+		case r == '"':
+			cur.WriteRune(r)
+			if inQuote {
+				flushCur()
+			}
+			inQuote = !inQuote
+		case inQuote:
+			cur.WriteRune(r)
+		case r == ' ' || r == '\t':
+			flushCur()
+		case r == '{' || r == '}' || r == ',':
+			flushCur()
+			tokens = append(tokens, string(r))
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flushCur()
+	return tokens
+}
+
+// compile consumes the tokens of a rule
+func (c *nlCompiler) compile(tokens []string) error {
+	next := func(i *int) (string, error) {
+		*i++
+		if *i >= len(tokens) {
+			return "", fmt.Errorf("%w: unexpected end of rule", errUnsupportedExpr)
+		}
+		return tokens[*i], nil
+	}
+	// connlimit parses the rest of "ct count [over] <n>"
+	connlimit := func(i *int) (*expr.Connlimit, error) {
+		val, err := next(i)
+		if err != nil {
+			return nil, err
+		}
+		cl := &expr.Connlimit{}
+		if val == "over" {
+			cl.Flags = expr.NFT_CONNLIMIT_F_INV
+			if val, err = next(i); err != nil {
+				return nil, err
+			}
+		}
+		n, err := strconv.ParseUint(val, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: ct count %s", errUnsupportedExpr, val)
+		}
+		cl.Count = uint32(n)
+		return cl, nil
+	}
+
+	// rateLimit parses the rest of "limit rate [over] <n> <unit>/<time> [burst <n> packets]"
+	rateLimit := func(i *int) (*expr.Limit, error) {
+		if w, err := next(i); err != nil || w != "rate" {
+			return nil, fmt.Errorf("%w: limit syntax", errUnsupportedExpr)
+		}
+		l := &expr.Limit{Type: expr.LimitTypePktBytes}
+		val, err := next(i)
+		if err != nil {
+			return nil, err
+		}
+		if val == "over" {
+			l.Over = true
+			if val, err = next(i); err != nil {
+				return nil, err
+			}
+		}
+		if strings.Contains(val, "/") {
+			// packet rate: "10/second"
+			parts := strings.SplitN(val, "/", 2)
+			rate, err := strconv.ParseUint(parts[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: limit rate %s", errUnsupportedExpr, val)
+			}
+			l.Type = expr.LimitTypePkts
+			l.Rate = rate
+			if l.Unit, err = parseLimitTime(parts[1]); err != nil {
+				return nil, err
+			}
+		} else {
+			per, err := next(i)
+			if err != nil {
+				return nil, err
+			}
+			parts := strings.SplitN(per, "/", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("%w: limit unit %s", errUnsupportedExpr, per)
+			}
+			if l.Rate, err = parseByteValue(val, parts[0]); err != nil {
+				return nil, err
+			}
+			if l.Unit, err = parseLimitTime(parts[1]); err != nil {
+				return nil, err
+			}
+		}
+		if *i+1 < len(tokens) && tokens[*i+1] == "burst" && l.Type == expr.LimitTypePkts {
+			*i++
+			val, err := next(i)
+			if err != nil {
+				return nil, err
+			}
+			burst, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%w: limit burst %s", errUnsupportedExpr, val)
+			}
+			if unit, err := next(i); err != nil || unit != "packets" {
+				return nil, fmt.Errorf("%w: limit burst unit", errUnsupportedExpr)
+			}
+			l.Burst = uint32(burst)
+		}
+		return l, nil
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		switch tok {
+		case "meta":
+			key, err := next(&i)
+			if err != nil {
+				return err
+			}
+			if key == "mark" {
+				// meta mark set <n>
+				if w, err := next(&i); err != nil || w != "set" {
+					return fmt.Errorf("%w: meta mark syntax", errUnsupportedExpr)
+				}
+				val, err := next(&i)
+				if err != nil {
+					return err
+				}
+				mark, err := strconv.ParseUint(val, 0, 32)
+				if err != nil {
+					return fmt.Errorf("%w: mark %s", errUnsupportedExpr, val)
+				}
+				c.exprs = append(c.exprs,
+					&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(uint32(mark))},
+					&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+				)
+				continue
+			}
+			if key != "l4proto" {
+				return fmt.Errorf("%w: meta %s", errUnsupportedExpr, key)
+			}
+			val, err := next(&i)
+			if err != nil {
+				return err
+			}
+			if val == "{" {
+				var protos []string
+				for {
+					p, err := next(&i)
+					if err != nil {
+						return err
+					}
+					if p == "}" {
+						break
+					}
+					if p != "," {
+						protos = append(protos, p)
+					}
+				}
+				var elements []nftables.SetElement
+				for _, p := range protos {
+					num, ok := protoNumber(p)
+					if !ok {
+						return fmt.Errorf("%w: protocol %s", errUnsupportedExpr, p)
+					}
+					elements = append(elements, nftables.SetElement{Key: []byte{num}})
+				}
+				c.exprs = append(c.exprs, &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1})
+				c.lookupAnon(nftables.TypeInetProto, elements)
+				c.l4 = "any"
+			} else {
+				if err := c.matchL4(val); err != nil {
+					return err
+				}
+			}
+
+		case "iifname":
+			// iifname "<name>", compared with the name NUL-padded to IFNAMSIZ
+			val, err := next(&i)
+			if err != nil {
+				return err
+			}
+			name := strings.Trim(val, `"`)
+			if name == "" || len(name) >= unix.IFNAMSIZ || strings.HasSuffix(name, "*") {
+				return fmt.Errorf("%w: iifname %s", errUnsupportedExpr, val)
+			}
+			data := make([]byte, unix.IFNAMSIZ)
+			copy(data, name)
+			c.exprs = append(c.exprs,
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+			)
+
+		case "icmp", "icmpv6":
+			// icmp type <name> | icmp type { <name>, ... }
+			if w, err := next(&i); err != nil || w != "type" {
+				return fmt.Errorf("%w: %s syntax", errUnsupportedExpr, tok)
+			}
+			val, err := next(&i)
+			if err != nil {
+				return err
+			}
+			names := []string{val}
+			if val == "{" {
+				names = nil
+				for {
+					n, err := next(&i)
+					if err != nil {
+						return err
+					}
+					if n == "}" {
+						break
+					}
+					if n != "," {
+						names = append(names, n)
+					}
+				}
+			}
+			proto, keyType := "icmp", nftables.TypeICMPType
+			if tok == "icmpv6" {
+				proto, keyType = "ipv6-icmp", nftables.TypeICMP6Type
+			}
+			var elements []nftables.SetElement
+			for _, n := range names {
+				num, ok := icmpTypeNumber(proto, n)
+				if !ok {
+					return fmt.Errorf("%w: %s type %s", errUnsupportedExpr, tok, n)
+				}
+				elements = append(elements, nftables.SetElement{Key: []byte{num}})
+			}
+			if err := c.matchL4(proto); err != nil {
+				return err
+			}
+			c.exprs = append(c.exprs,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1})
+			if val == "{" {
+				c.lookupAnon(keyType, elements)
+			} else {
+				c.exprs = append(c.exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: elements[0].Key})
+			}
+
+		case "tcp", "udp", "th":
+			field, err := next(&i)
+			if err != nil {
+				return err
+			}
+			switch field {
+			case "sport", "dport":
+				val, err := next(&i)
+				if err != nil {
+					return err
+				}
+				port, last, err := parsePortRange(val)
+				if err != nil {
+					return fmt.Errorf("%w: port %s", errUnsupportedExpr, val)
+				}
+				if tok != "th" {
+					if err := c.matchL4(tok); err != nil {
+						return err
+					}
+				}
+				offset := uint32(0)
+				if field == "dport" {
+					offset = 2
+				}
+				c.exprs = append(c.exprs,
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2})
+				if last != port {
+					c.exprs = append(c.exprs, &expr.Range{
+						Op:       expr.CmpOpEq,
+						Register: 1,
+						FromData: binaryutil.BigEndian.PutUint16(uint16(port)),
+						ToData:   binaryutil.BigEndian.PutUint16(uint16(last)),
+					})
+				} else {
+					c.exprs = append(c.exprs,
+						&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port))})
+				}
+			case "flags":
+				flag, err := next(&i)
+				if err != nil {
+					return err
+				}
+				if tok != "tcp" || flag != "syn" {
+					return fmt.Errorf("%w: %s flags %s", errUnsupportedExpr, tok, flag)
+				}
+				if err := c.matchL4("tcp"); err != nil {
+					return err
+				}
+				c.exprs = append(c.exprs,
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+					&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{0x02}, Xor: []byte{0x00}},
+					&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0x00}},
+				)
+			case "option":
+				// tcp option maxseg size set <n>
+				var words []string
+				for j := 0; j < 4; j++ {
+					w, err := next(&i)
+					if err != nil {
+						return err
+					}
+					words = append(words, w)
+				}
+				if tok != "tcp" || strings.Join(words[:3], " ") != "maxseg size set" {
+					return fmt.Errorf("%w: tcp option %s", errUnsupportedExpr, strings.Join(words, " "))
+				}
+				size, err := strconv.Atoi(words[3])
+				if err != nil {
+					return fmt.Errorf("%w: maxseg size %s", errUnsupportedExpr, words[3])
+				}
+				if err := c.matchL4("tcp"); err != nil {
+					return err
+				}
+				c.exprs = append(c.exprs,
+					&expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(size))},
+					&expr.Exthdr{SourceRegister: 1, Type: 2, Offset: 2, Len: 2, Op: expr.ExthdrOpTcpopt},
+				)
+			default:
+				return fmt.Errorf("%w: %s %s", errUnsupportedExpr, tok, field)
+			}
+
+		case "ip", "ip6":
+			field, err := next(&i)
+			if err != nil {
+				return err
+			}
+			val, err := next(&i)
+			if err != nil {
+				return err
+			}
+			// ip saddr/daddr at 12/16, ip6 saddr/daddr at 8/24
+			size, offset := 4, uint32(12)
+			if tok == "ip6" {
+				size, offset = 16, 8
+			}
+			if field == "daddr" {
+				offset += uint32(size)
+			} else if field != "saddr" {
+				return fmt.Errorf("%w: %s %s", errUnsupportedExpr, tok, field)
+			}
+			if err := c.matchL3(tok); err != nil {
+				return err
+			}
+			if strings.HasPrefix(val, "@") {
+				c.exprs = append(c.exprs,
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(size)},
+					&expr.Lookup{SourceRegister: 1, SetName: val[1:]},
+				)
+				continue
+			}
+			if val == "{" {
+				keyType := nftables.TypeIPAddr
+				if tok == "ip6" {
+					keyType = nftables.TypeIP6Addr
+				}
+				var elements []nftables.SetElement
+				for {
+					v, err := next(&i)
+					if err != nil {
+						return err
+					}
+					if v == "}" {
+						break
+					}
+					if v == "," {
+						continue
+					}
+					v = strings.TrimSuffix(v, ",")
+					addr := ipBytes(net.ParseIP(v), tok)
+					if addr == nil {
+						return fmt.Errorf("%w: %s address %s", errUnsupportedExpr, tok, v)
+					}
+					elements = append(elements, nftables.SetElement{Key: addr})
+				}
+				c.exprs = append(c.exprs, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(size)})
+				c.lookupAnon(keyType, elements)
+				continue
+			}
+			ip, ipNet, err := net.ParseCIDR(val)
+			if err != nil {
+				ip = net.ParseIP(val)
+				ipNet = nil
+			}
+			addr := ipBytes(ip, tok)
+			if addr == nil {
+				return fmt.Errorf("%w: %s address %s", errUnsupportedExpr, tok, val)
+			}
+			c.exprs = append(c.exprs, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: uint32(size)})
+			if ipNet != nil {
+				c.exprs = append(c.exprs,
+					&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: uint32(size), Mask: ipNet.Mask, Xor: make([]byte, size)},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ipBytes(ipNet.IP, tok)},
+				)
+			} else {
+				c.exprs = append(c.exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: addr})
+			}
+
+		case "ct":
+			key, err := next(&i)
+			if err != nil {
+				return err
+			}
+			if key == "count" {
+				cl, err := connlimit(&i)
+				if err != nil {
+					return err
+				}
+				c.exprs = append(c.exprs, cl)
+				continue
+			}
+			if key != "state" {
+				return fmt.Errorf("%w: ct %s", errUnsupportedExpr, key)
+			}
+			var mask uint32
+			for {
+				name, err := next(&i)
+				if err != nil {
+					return err
+				}
+				bit, ok := ctStateBit(name)
+				if !ok {
+					return fmt.Errorf("%w: ct state %s", errUnsupportedExpr, name)
+				}
+				mask |= bit
+				if i+1 < len(tokens) && tokens[i+1] == "," {
+					i++
+					continue
+				}
+				break
+			}
+			c.exprs = append(c.exprs,
+				&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4,
+					Mask: binaryutil.NativeEndian.PutUint32(mask), Xor: make([]byte, 4)},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+			)
+
+		case "add", "update":
+			// add @<set> { ip saddr [<stmt>] }, where the statement is a connection count
+			// "ct count over <n>", a rate "limit rate over <n>/<time> ..." or a "timeout <n>s"
+			set, err := next(&i)
+			if err != nil {
+				return err
+			}
+			var words [3]string
+			for j := range words {
+				if words[j], err = next(&i); err != nil {
+					return err
+				}
+			}
+			l3, field := words[1], words[2]
+			if !strings.HasPrefix(set, "@") || words[0] != "{" || (l3 != "ip" && l3 != "ip6") || field != "saddr" {
+				return fmt.Errorf("%w: %s %s %s", errUnsupportedExpr, tok, set, strings.Join(words[:], " "))
+			}
+			dynset := &expr.Dynset{SrcRegKey: 1, SetName: set[1:], Operation: unix.NFT_DYNSET_OP_ADD}
+			if tok == "update" {
+				dynset.Operation = unix.NFT_DYNSET_OP_UPDATE
+			}
+			stmt, err := next(&i)
+			if err != nil {
+				return err
+			}
+			switch stmt {
+			case "ct":
+				if w, err := next(&i); err != nil || w != "count" {
+					return fmt.Errorf("%w: %s %s ct syntax", errUnsupportedExpr, tok, set)
+				}
+				cl, err := connlimit(&i)
+				if err != nil {
+					return err
+				}
+				dynset.Exprs = []expr.Any{cl}
+			case "limit":
+				l, err := rateLimit(&i)
+				if err != nil {
+					return err
+				}
+				dynset.Exprs = []expr.Any{l}
+			case "timeout":
+				val, err := next(&i)
+				if err != nil {
+					return err
+				}
+				if dynset.Timeout, err = time.ParseDuration(val); err != nil || dynset.Timeout <= 0 {
+					return fmt.Errorf("%w: %s %s timeout %s", errUnsupportedExpr, tok, set, val)
+				}
+			case "}":
+				i--
+			default:
+				return fmt.Errorf("%w: %s %s %s", errUnsupportedExpr, tok, set, stmt)
+			}
+			if end, err := next(&i); err != nil || end != "}" {
+				return fmt.Errorf("%w: %s %s syntax", errUnsupportedExpr, tok, set)
+			}
+			if err := c.matchL3(l3); err != nil {
+				return err
+			}
+			size, offset := uint32(4), uint32(12)
+			if l3 == "ip6" {
+				size, offset = 16, 8
+			}
+			c.exprs = append(c.exprs,
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+				dynset,
+			)
+
+		case "quota":
+			q := &expr.Quota{}
+			val, err := next(&i)
+			if err != nil {
+				return err
+			}
+			if val == "over" {
+				q.Over = true
+				if val, err = next(&i); err != nil {
+					return err
+				}
+			}
+			unit, err := next(&i)
+			if err != nil {
+				return err
+			}
+			if q.Bytes, err = parseByteValue(val, unit); err != nil {
+				return err
+			}
+			if i+1 < len(tokens) && tokens[i+1] == "used" {
+				i++
+				used, err := next(&i)
+				if err != nil {
+					return err
+				}
+				usedUnit, err := next(&i)
+				if err != nil {
+					return err
+				}
+				if q.Consumed, err = parseByteValue(used, usedUnit); err != nil {
+					return err
+				}
+			}
+			c.exprs = append(c.exprs, q)
+
+		case "limit":
+			l, err := rateLimit(&i)
+			if err != nil {
+				return err
+			}
+			c.exprs = append(c.exprs, l)
+
+		case "counter":
+			// counter [packets <n> bytes <n>]
+			ctr := &expr.Counter{}
+			if i+1 < len(tokens) && tokens[i+1] == "packets" {
+				var words []string
+				for j := 0; j < 4; j++ {
+					w, err := next(&i)
+					if err != nil {
+						return err
+					}
+					words = append(words, w)
+				}
+				packets, perr := strconv.ParseUint(words[1], 10, 64)
+				bytes, berr := strconv.ParseUint(words[3], 10, 64)
+				if words[2] != "bytes" || perr != nil || berr != nil {
+					return fmt.Errorf("%w: counter %s", errUnsupportedExpr, strings.Join(words, " "))
+				}
+				ctr.Packets, ctr.Bytes = packets, bytes
+			}
+			c.exprs = append(c.exprs, ctr)
+
+		case "accept":
+			c.exprs = append(c.exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+
+		case "drop":
+			c.exprs = append(c.exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+
+		case "reject":
+			// Plain reject answers with port unreachable, like nft does
+			switch c.family {
+			case "inet":
+				c.exprs = append(c.exprs, &expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_PORT_UNREACH})
+			case "ip6":
+				c.exprs = append(c.exprs, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 4})
+			default:
+				c.exprs = append(c.exprs, &expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 3})
+			}
+
+		case "jump":
+			target, err := next(&i)
+			if err != nil {
+				return err
+			}
+			c.exprs = append(c.exprs, &expr.Verdict{Kind: expr.VerdictJump, Chain: target})
+
+		case "masquerade":
+			c.exprs = append(c.exprs, &expr.Masq{})
+
+		case "snat":
+			// snat to <addr>, the ports are left alone
+			if w, err := next(&i); err != nil || w != "to" {
+				return fmt.Errorf("%w: snat syntax", errUnsupportedExpr)
+			}
+			target, err := next(&i)
+			if err != nil {
+				return err
+			}
+			l3, natFamily := "ip", uint32(unix.NFPROTO_IPV4)
+			if c.family == "ip6" {
+				l3, natFamily = "ip6", unix.NFPROTO_IPV6
+			}
+			addr := ipBytes(net.ParseIP(target), l3)
+			if addr == nil {
+				return fmt.Errorf("%w: snat target %s", errUnsupportedExpr, target)
+			}
+			c.exprs = append(c.exprs,
+				&expr.Immediate{Register: 1, Data: addr},
+				&expr.NAT{
+					Type:       expr.NATTypeSourceNAT,
+					Family:     natFamily,
+					RegAddrMin: 1,
+				},
+			)
+
+		case "dnat":
+			if w, err := next(&i); err != nil || w != "to" {
+				return fmt.Errorf("%w: dnat syntax", errUnsupportedExpr)
+			}
+			target, err := next(&i)
+			if err != nil {
+				return err
+			}
+			// ip tables take IPv4 targets, ip6 tables IPv6 targets in brackets
+			l3, natFamily := "ip", uint32(unix.NFPROTO_IPV4)
+			if c.family == "ip6" {
+				l3, natFamily = "ip6", unix.NFPROTO_IPV6
+			}
+			var portStr string
+			if target == "numgen" || target == "jhash" {
+				// dnat to numgen random|inc mod <n> map { <n> : <addr>, ... } : <ports>
+				// dnat to jhash ip saddr mod <n> map { <n> : <addr>, ... } : <ports>
+				gen := []string{target}
+				for gen[len(gen)-1] != "{" {
+					w, err := next(&i)
+					if err != nil {
+						return err
+					}
+					gen = append(gen, w)
+				}
+				if err := c.balanceMap(gen, l3, func() (string, error) { return next(&i) }); err != nil {
+					return err
+				}
+				if w, err := next(&i); err != nil || w != ":" {
+					return fmt.Errorf("%w: dnat map without port", errUnsupportedExpr)
+				}
+				if portStr, err = next(&i); err != nil {
+					return err
+				}
+			} else {
+				host, hostPort, err := net.SplitHostPort(target)
+				addr := ipBytes(net.ParseIP(host), l3)
+				if err != nil || addr == nil {
+					return fmt.Errorf("%w: dnat target %s", errUnsupportedExpr, target)
+				}
+				c.exprs = append(c.exprs, &expr.Immediate{Register: 1, Data: addr})
+				portStr = hostPort
+			}
+			port, last, err := parsePortRange(portStr)
+			if err != nil {
+				return fmt.Errorf("%w: dnat port %s", errUnsupportedExpr, portStr)
+			}
+			nat := &expr.NAT{
+				Type:        expr.NATTypeDestNAT,
+				Family:      natFamily,
+				RegAddrMin:  1,
+				RegProtoMin: 2,
+				Specified:   true,
+			}
+			c.exprs = append(c.exprs,
+				&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(port))},
+			)
+			// A port range keeps each connection's port when it lies in the range
+			if last != port {
+				c.exprs = append(c.exprs, &expr.Immediate{Register: 3, Data: binaryutil.BigEndian.PutUint16(uint16(last))})
+				nat.RegProtoMax = 3
+			}
+			c.exprs = append(c.exprs, nat)
+
+		case "comment":
+			val, err := next(&i)
+			if err != nil {
+				return err
+			}
+			c.comment = strings.Trim(val, `"`)
+
+		default:
+			return fmt.Errorf("%w: %s", errUnsupportedExpr, tok)
+		}
+	}
+	return nil
+}
+
+// matchL4 adds a "meta l4proto <proto>" match unless the rule already has one
+func (c *nlCompiler) matchL4(proto string) error {
+	if c.l4 == proto {
+		return nil
+	}
+	if c.l4 != "" {
+		return fmt.Errorf("%w: conflicting protocols %s/%s", errUnsupportedExpr, c.l4, proto)
+	}
+	num, ok := protoNumber(proto)
+	if !ok {
+		return fmt.Errorf("%w: protocol %s", errUnsupportedExpr, proto)
+	}
+	c.exprs = append(c.exprs,
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{num}},
+	)
+	c.l4 = proto
+	return nil
+}
+
+// matchL3 adds a "meta nfproto" dependency in inet tables
+func (c *nlCompiler) matchL3(l3 string) error {
+	if c.l3 == l3 {
+		return nil
+	}
+	c.l3 = l3
+	switch c.family {
+	case "ip", "ip6":
+		if l3 != c.family {
+			return fmt.Errorf("%w: %s match in %s table", errUnsupportedExpr, l3, c.family)
+		}
+		return nil
+	case "inet":
+		proto := byte(unix.NFPROTO_IPV4)
+		if l3 == "ip6" {
+			proto = unix.NFPROTO_IPV6
+		}
+		c.exprs = append(c.exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		)
+		return nil
+	}
+	return fmt.Errorf("%w: %s match in %s table", errUnsupportedExpr, l3, c.family)
+}
+
+// balanceMap loads register 1 with the address picked by a numgen or jhash
+// expression from an anonymous map. gen holds the tokens up to the opening
+// brace ("numgen random mod 4 map {"); the elements are read with next.
+func (c *nlCompiler) balanceMap(gen []string, l3 string, next func() (string, error)) error {
+	n := len(gen)
+	if n < 6 || gen[n-1] != "{" || gen[n-2] != "map" || gen[n-4] != "mod" {
+		return fmt.Errorf("%w: %s", errUnsupportedExpr, strings.Join(gen, " "))
+	}
+	mod, err := strconv.ParseUint(gen[n-3], 10, 32)
+	if err != nil || mod == 0 {
+		return fmt.Errorf("%w: mod %s", errUnsupportedExpr, gen[n-3])
+	}
+	source := gen[1 : n-4]
+
+	switch {
+	case gen[0] == "numgen" && len(source) == 1 && (source[0] == "random" || source[0] == "inc"):
+		ngType := uint32(unix.NFT_NG_INCREMENTAL)
+		if source[0] == "random" {
+			ngType = unix.NFT_NG_RANDOM
+		}
+		c.exprs = append(c.exprs, &expr.Numgen{Register: 1, Modulus: uint32(mod), Type: ngType})
+	case gen[0] == "jhash" && len(source) == 2 && source[0] == l3 && (source[1] == "saddr" || source[1] == "daddr"):
+		size, offset := uint32(4), uint32(12)
+		if l3 == "ip6" {
+			size, offset = 16, 8
+		}
+		if source[1] == "daddr" {
+			offset += size
+		}
+		c.exprs = append(c.exprs,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+			&expr.Hash{SourceRegister: 1, DestRegister: 1, Length: size, Modulus: uint32(mod), Type: expr.HashTypeJenkins},
+		)
+	default:
+		return fmt.Errorf("%w: %s", errUnsupportedExpr, strings.Join(gen, " "))
+	}
+
+	dataType := nftables.TypeIPAddr
+	if l3 == "ip6" {
+		dataType = nftables.TypeIP6Addr
+	}
+	var elements []nftables.SetElement
+	for {
+		k, err := next()
+		if err != nil {
+			return err
+		}
+		if k == "}" {
+			break
+		}
+		if k == "," {
+			continue
+		}
+		if sep, err := next(); err != nil || sep != ":" {
+			return fmt.Errorf("%w: map element %s", errUnsupportedExpr, k)
+		}
+		v, err := next()
+		if err != nil {
+			return err
+		}
+		key, err := strconv.ParseUint(k, 10, 32)
+		addr := ipBytes(net.ParseIP(strings.TrimSuffix(v, ",")), l3)
+		if err != nil || addr == nil {
+			return fmt.Errorf("%w: map element %s : %s", errUnsupportedExpr, k, v)
+		}
+		elements = append(elements, nftables.SetElement{Key: binaryutil.NativeEndian.PutUint32(uint32(key)), Val: addr})
+	}
+
+	lookup := &expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true}
+	c.sets = append(c.sets, &nlAnonSet{
+		set:      &nftables.Set{Anonymous: true, Constant: true, IsMap: true, KeyType: nftables.TypeInteger, DataType: dataType},
+		elements: elements,
+		lookup:   lookup,
+	})
+	c.exprs = append(c.exprs, lookup)
+	return nil
+}
+
+// lookupAnon matches register 1 against an anonymous constant set
+func (c *nlCompiler) lookupAnon(keyType nftables.SetDatatype, elements []nftables.SetElement) {
+	lookup := &expr.Lookup{SourceRegister: 1}
+	c.sets = append(c.sets, &nlAnonSet{
+		set:      &nftables.Set{Anonymous: true, Constant: true, KeyType: keyType},
+		elements: elements,
+		lookup:   lookup,
+	})
+	c.exprs = append(c.exprs, lookup)
+}
+
+// Name tables and unit helpers
+
+var ctStates = []struct {
+	name string
+	bit  uint32
+}{
+	{"invalid", expr.CtStateBitINVALID},
+	{"established", expr.CtStateBitESTABLISHED},
+	{"related", expr.CtStateBitRELATED},
+	{"new", expr.CtStateBitNEW},
+	{"untracked", expr.CtStateBitUNTRACKED},
+}
+
+var tcpFlagNames = []string{"fin", "syn", "rst", "psh", "ack", "urg", "ecn", "cwr"}
+
+func ctStateBit(name string) (uint32, bool) {
+	for _, st := range ctStates {
+		if st.name == name {
+			return st.bit, true
+		}
+	}
+	return 0, false
+}
+
+var protoNames = map[byte]string{
+	unix.IPPROTO_ICMP:   "icmp",
+	unix.IPPROTO_TCP:    "tcp",
+	unix.IPPROTO_UDP:    "udp",
+	unix.IPPROTO_ICMPV6: "ipv6-icmp",
+	unix.IPPROTO_SCTP:   "sctp",
+}
+
+func protoName(p byte) string {
+	if name, ok := protoNames[p]; ok {
+		return name
+	}
+	return strconv.Itoa(int(p))
+}
+
+func protoNumber(name string) (byte, bool) {
+	for num, n := range protoNames {
+		if n == name {
+			return num, true
+		}
+	}
+	return 0, false
+}
+
+// icmpTypeNames names the ICMP and ICMPv6 types by l4 protocol
+var icmpTypeNames = map[string]map[byte]string{
+	"icmp": {
+		0:  "echo-reply",
+		3:  "destination-unreachable",
+		8:  "echo-request",
+		11: "time-exceeded",
+		12: "parameter-problem",
+	},
+	"ipv6-icmp": {
+		1:   "destination-unreachable",
+		2:   "packet-too-big",
+		3:   "time-exceeded",
+		4:   "parameter-problem",
+		128: "echo-request",
+		129: "echo-reply",
+		133: "nd-router-solicit",
+		134: "nd-router-advert",
+		135: "nd-neighbor-solicit",
+		136: "nd-neighbor-advert",
+	},
+}
+
+func icmpTypeNumber(proto, name string) (byte, bool) {
+	for num, n := range icmpTypeNames[proto] {
+		if n == name {
+			return num, true
+		}
+	}
+	return 0, false
+}
+
+func nfprotoName(p byte) string {
+	switch p {
+	case unix.NFPROTO_IPV4:
+		return "ipv4"
+	case unix.NFPROTO_IPV6:
+		return "ipv6"
+	}
+	return strconv.Itoa(int(p))
+}
+
+func metaKeyName(k expr.MetaKey) string {
+	switch k {
+	case expr.MetaKeyL4PROTO:
+		return "l4proto"
+	case expr.MetaKeyNFPROTO:
+		return "nfproto"
+	case expr.MetaKeyIIFNAME:
+		return "iifname"
+	case expr.MetaKeyOIFNAME:
+		return "oifname"
+	case expr.MetaKeyMARK:
+		return "mark"
+	}
+	return ""
+}
+
+func ctKeyName(k expr.CtKey) string {
+	if k == expr.CtKeySTATE {
+		return "state"
+	}
+	return ""
+}
+
+func cmpOpName(op expr.CmpOp) string {
+	switch op {
+	case expr.CmpOpNeq:
+		return "!="
+	case expr.CmpOpLt:
+		return "<"
+	case expr.CmpOpLte:
+		return "<="
+	case expr.CmpOpGt:
+		return ">"
+	case expr.CmpOpGte:
+		return ">="
+	}
+	return "=="
+}
+
+func limitPer(t expr.LimitTime) string {
+	switch t {
+	case expr.LimitTimeMinute:
+		return "minute"
+	case expr.LimitTimeHour:
+		return "hour"
+	case expr.LimitTimeDay:
+		return "day"
+	case expr.LimitTimeWeek:
+		return "week"
+	}
+	return "second"
+}
+
+func parseLimitTime(s string) (expr.LimitTime, error) {
+	switch s {
+	case "second":
+		return expr.LimitTimeSecond, nil
+	case "minute":
+		return expr.LimitTimeMinute, nil
+	case "hour":
+		return expr.LimitTimeHour, nil
+	case "day":
+		return expr.LimitTimeDay, nil
+	case "week":
+		return expr.LimitTimeWeek, nil
+	}
+	return 0, fmt.Errorf("%w: limit time %s", errUnsupportedExpr, s)
+}
+
+// nftByteUnits are nft's byte units, which are 1024-based
+var nftByteUnits = []struct {
+	name string
+	size uint64
+}{
+	{"gbytes", 1 << 30},
+	{"mbytes", 1 << 20},
+	{"kbytes", 1 << 10},
+}
+
+// nftByteUnit picks the largest unit dividing n exactly, as nft does when listing
+func nftByteUnit(n uint64) (uint64, string) {
+	for _, u := range nftByteUnits {
+		if n >= u.size && n%u.size == 0 {
+			return n / u.size, u.name
+		}
+	}
+	return n, "bytes"
+}
+
+// parseByteValue converts "<n> <unit>" into bytes
+func parseByteValue(val, unit string) (uint64, error) {
+	n, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: byte value %s", errUnsupportedExpr, val)
+	}
+	if unit == "bytes" {
+		return n, nil
+	}
+	for _, u := range nftByteUnits {
+		if u.name == unit {
+			return n * u.size, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: byte unit %s", errUnsupportedExpr, unit)
+}
+
+// ipBytes returns the address in the byte form of an ip or ip6 match, or nil
+// if it belongs to the other family
+func ipBytes(ip net.IP, l3 string) []byte {
+	if ip == nil {
+		return nil
+	}
+	if l3 == "ip" {
+		return ip.To4()
+	}
+	if ip.To4() != nil {
+		return nil
+	}
+	return ip.To16()
+}
+
+func padTo(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b[:n]
+	}
+	return append(b, make([]byte, n-len(b))...)
+}
+
+func isZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func maskLen(mask []byte) int {
+	n := 0
+	for _, b := range mask {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
@@ -0,0 +1,470 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+)
+
+// decodedBackend lists the rules of a transaction like the netlink backend
+// would once it is applied, without a kernel: every rule is compiled, its
+// expressions take a round trip through their netlink encoding and it is
+// decoded again. Only listing chains and set elements is implemented.
+type decodedBackend struct {
+	Backend
+	rules    []*NFTRule
+	elements map[string][]string // elements added to the named sets, by family, table and set
+}
+
+// newDecodedBackend compiles and decodes the rules a transaction adds
+func newDecodedBackend(t *testing.T, tx *Transaction) *decodedBackend {
+	t.Helper()
+
+	b := &decodedBackend{elements: make(map[string][]string)}
+	decoders := make(map[string]*nlDecoder)
+	decoder := func(family, table string) *nlDecoder {
+		key := family + " " + table
+		if decoders[key] == nil {
+			decoders[key] = &nlDecoder{
+				family:   family,
+				sets:     make(map[string]*nftables.Set),
+				elements: make(map[string][]nftables.SetElement),
+			}
+		}
+		return decoders[key]
+	}
+
+	for _, op := range tx.ops {
+		switch op.verb {
+		case "add set":
+			decoder(op.family, op.table).sets[op.chain] = &nftables.Set{Name: op.chain}
+		case "add element":
+			key := op.family + " " + op.table + " " + op.chain
+			b.elements[key] = append(b.elements[key], op.rule...)
+		case "add rule", "insert rule":
+			rule := strings.Join(op.rule, " ")
+			fam, err := nlFamily(op.family)
+			if err != nil {
+				t.Fatalf("%s: %v", rule, err)
+			}
+			comp := &nlCompiler{family: op.family}
+			if err := comp.compile(tokenizeNFT(rule)); err != nil {
+				t.Fatalf("compiling %s: %v", rule, err)
+			}
+
+			// The kernel names anonymous sets when they are added
+			dec := decoder(op.family, op.table)
+			for _, s := range comp.sets {
+				s.set.Name = fmt.Sprintf("__set%d", len(dec.sets))
+				s.lookup.SetName = s.set.Name
+				dec.sets[s.set.Name] = s.set
+				dec.elements[s.set.Name] = s.elements
+			}
+
+			r := &nftables.Rule{Handle: uint64(len(b.rules) + 1)}
+			for _, e := range comp.exprs {
+				r.Exprs = append(r.Exprs, roundTripExpr(t, byte(fam), e))
+			}
+			if comp.comment != "" {
+				r.UserData = userdata.AppendString(nil, userdata.TypeComment, comp.comment)
+			}
+			decoded, err := dec.decodeRule(r, op.table, op.chain)
+			if err != nil {
+				t.Fatalf("decoding %s: %v", rule, err)
+			}
+			b.rules = append(b.rules, decoded)
+		}
+	}
+	return b
+}
+
+// roundTripExpr encodes an expression like it is sent to the kernel and decodes it again
+func roundTripExpr(t *testing.T, fam byte, e expr.Any) expr.Any {
+	t.Helper()
+
+	data, err := expr.MarshalExprData(fam, e)
+	if err != nil {
+		t.Fatalf("encoding %T: %v", e, err)
+	}
+	out := reflect.New(reflect.TypeOf(e).Elem()).Interface().(expr.Any)
+	if err := expr.Unmarshal(fam, data, out); err != nil {
+		t.Fatalf("decoding %T: %v", e, err)
+	}
+	return out
+}
+
+func (b *decodedBackend) ListChain(family, table, chain string) (*NFTRuleset, error) {
+	ruleset := &NFTRuleset{}
+	for _, r := range b.rules {
+		if r.Family == family && r.Table == table && r.Chain == chain {
+			ruleset.NFTables = append(ruleset.NFTables, NFTObject{Rule: r})
+		}
+	}
+	return ruleset, nil
+}
+
+func (b *decodedBackend) ListSetElements(family, table, set string) ([]string, error) {
+	return b.elements[family+" "+table+" "+set], nil
+}
+
+func TestNetlinkQuotaRoundTrip(t *testing.T) {
+	drop := QuotaAction{Action: QuotaActionDrop}
+
+	tests := []struct {
+		name   string
+		limits quotaLimits
+		action QuotaAction
+		prev   quotaRules
+	}{
+		{
+			name:   "egress with usage",
+			limits: quotaLimits{egress: 10_000_000},
+			action: drop,
+			prev:   quotaRules{egress: &quotaPart{usedBytes: 4096}},
+		},
+		{
+			name:   "egress in larger units",
+			limits: quotaLimits{egress: 10 << 20},
+			action: drop,
+			prev:   quotaRules{egress: &quotaPart{usedBytes: 3 << 30}},
+		},
+		{
+			name:   "ingress with reject",
+			limits: quotaLimits{ingress: 5_000_000},
+			action: QuotaAction{Action: QuotaActionReject},
+			prev:   quotaRules{ingress: &quotaPart{usedBytes: 100}},
+		},
+		{
+			name:   "separate limits with a rate limit",
+			limits: quotaLimits{egress: 10_000_000, ingress: 20_000_000},
+			action: QuotaAction{Action: QuotaActionRateLimit, RateMbps: 10},
+			prev:   quotaRules{egress: &quotaPart{usedBytes: 1}, ingress: &quotaPart{usedBytes: 2}},
+		},
+		{
+			name:   "egress with a mark",
+			limits: quotaLimits{egress: 1 << 30},
+			action: QuotaAction{Action: QuotaActionMark, Mark: 0x2a},
+		},
+		{
+			name:   "shared limit",
+			limits: quotaLimits{shared: 30_000_000},
+			action: drop,
+			prev: quotaRules{
+				egress:  &quotaPart{usedBytes: 600},
+				ingress: &quotaPart{usedBytes: 400},
+				shared:  &quotaPart{usedBytes: 1000},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNFTManager(DefaultConfig(), nil)
+			tx := &Transaction{}
+			n.queueQuotaRules(tx, 8080, tt.limits, tt.action, "app", &tt.prev)
+			n.backend = newDecodedBackend(t, tx)
+
+			entries, err := n.loadQuotas()
+			if err != nil {
+				t.Fatalf("loadQuotas: %v", err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("loaded %d quotas, want 1", len(entries))
+			}
+			e := entries[0]
+			if e.Port != 8080 || e.Comment != "app" {
+				t.Errorf("quota of port %d with comment %q, want 8080 and %q", e.Port, e.Comment, "app")
+			}
+			if got := e.local.limits(); got != tt.limits {
+				t.Errorf("limits = %+v, want %+v", got, tt.limits)
+			}
+			if got := e.local.action(); got != tt.action {
+				t.Errorf("action = %+v, want %+v", got, tt.action)
+			}
+			for _, d := range []struct {
+				name      string
+				got, want *quotaPart
+			}{
+				{"egress", e.local.egress, tt.prev.egress},
+				{"ingress", e.local.ingress, tt.prev.ingress},
+				{"shared", e.local.shared, tt.prev.shared},
+			} {
+				if got, want := d.got.used(), d.want.used(); got != want {
+					t.Errorf("%s usage = %d, want %d", d.name, got, want)
+				}
+			}
+			if tt.limits.shared > 0 && e.local.jumpTarget() != sharedQuotaChain(8080) {
+				t.Errorf("shared quota chain = %q, want %q", e.local.jumpTarget(), sharedQuotaChain(8080))
+			}
+		})
+	}
+}
+
+func TestNetlinkForwardQuotaRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		addrs    []string
+		limits   quotaLimits
+		action   QuotaAction
+		used     int64
+	}{
+		{
+			name:     "egress of several backends",
+			protocol: "tcp",
+			addrs:    []string{"10.0.0.2", "10.0.0.3"},
+			limits:   quotaLimits{egress: 10_000_000},
+			action:   QuotaAction{Action: QuotaActionDrop},
+			used:     4096,
+		},
+		{
+			name:     "shared limit of both protocols",
+			protocol: "both",
+			addrs:    []string{"10.0.0.5"},
+			limits:   quotaLimits{shared: 20_000_000},
+			action:   QuotaAction{Action: QuotaActionReject},
+			used:     512,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := NewNFTManager(DefaultConfig(), nil)
+			refs := []forwardRef{{port: 7104}, {port: 7104, bind: "+eth0@192.0.2.1"}}
+
+			tx := &Transaction{}
+			for _, ref := range refs {
+				prev := &quotaRules{egress: &quotaPart{usedBytes: tt.used}}
+				n.addForwardQuotaRules(tx, "ip", ref, tt.addrs, 80, tt.protocol, tt.limits, tt.action, prev)
+			}
+			n.backend = newDecodedBackend(t, tx)
+
+			quotas := n.loadForwardQuotas()[7104]
+			if len(quotas) != len(refs) {
+				t.Fatalf("loaded quotas of %d forwards, want %d", len(quotas), len(refs))
+			}
+			for _, ref := range refs {
+				r, ok := quotas[forwardQuotaKey{family: "ip", bind: ref.bind}]
+				if !ok {
+					t.Errorf("no quota of forward %s", ref)
+					continue
+				}
+				if got := r.limits(); got != tt.limits {
+					t.Errorf("%s: limits = %+v, want %+v", ref, got, tt.limits)
+				}
+				if got := r.action(); got != tt.action {
+					t.Errorf("%s: action = %+v, want %+v", ref, got, tt.action)
+				}
+				if got := r.egress.used(); got != tt.used {
+					t.Errorf("%s: egress usage = %d, want %d", ref, got, tt.used)
+				}
+				if tt.limits.shared > 0 && r.jumpTarget() != forwardSharedQuotaChain(ref) {
+					t.Errorf("%s: shared quota chain = %q, want %q", ref, r.jumpTarget(), forwardSharedQuotaChain(ref))
+				}
+			}
+		})
+	}
+}
+
+func TestNetlinkForwardingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		rule ForwardingRule
+	}{
+		{
+			name: "single port",
+			rule: ForwardingRule{SrcPort: 8080, DstIP: "10.0.0.5", DstPort: 80, Protocol: "tcp", Comment: "web"},
+		},
+		{
+			name: "port range of both protocols",
+			rule: ForwardingRule{SrcPort: 30000, SrcPortEnd: 30100, DstIP: "10.0.0.5", DstPort: 30000, Protocol: "both"},
+		},
+		{
+			name: "bound to an interface and address with SNAT",
+			rule: ForwardingRule{SrcPort: 443, Interface: "eth0", ListenIP: "192.0.2.1", DstIP: "10.0.0.5", DstPort: 8443,
+				Protocol: "tcp", SnatMode: SnatPrefix + "192.0.2.9"},
+		},
+		{
+			name: "allowed sources without SNAT",
+			rule: ForwardingRule{SrcPort: 2222, DstIP: "10.0.0.5", DstPort: 22, Protocol: "tcp",
+				Sources: []string{"198.51.100.0/24", "203.0.113.7"}, SnatMode: SnatNone},
+		},
+		{
+			name: "weighted random backends",
+			rule: ForwardingRule{SrcPort: 8081, DstPort: 80, Protocol: "tcp", Balance: BalanceRandom,
+				Backends: []ForwardBackend{{IP: "10.0.0.2", Weight: 2}, {IP: "10.0.0.3", Weight: 1}}},
+		},
+		{
+			name: "round robin backends",
+			rule: ForwardingRule{SrcPort: 8082, DstPort: 80, Protocol: "udp", Balance: BalanceRoundRobin,
+				Backends: []ForwardBackend{{IP: "10.0.0.2", Weight: 1}, {IP: "10.0.0.3", Weight: 1}}},
+		},
+		{
+			name: "source hash backends",
+			rule: ForwardingRule{SrcPort: 8083, DstPort: 80, Protocol: "tcp", Balance: BalanceSourceHash,
+				Backends: []ForwardBackend{{IP: "10.0.0.2", Weight: 1}, {IP: "10.0.0.3", Weight: 3}}},
+		},
+		{
+			name: "dual stack",
+			rule: ForwardingRule{SrcPort: 8084, DstIP: "10.0.0.5", DstIP6: "2001:db8::5", DstPort: 80, Protocol: "tcp",
+				Sources: []string{"198.51.100.0/24", "2001:db8:1::/48"}},
+		},
+		{
+			name: "limits",
+			rule: ForwardingRule{SrcPort: 8085, DstIP: "10.0.0.5", DstPort: 80, Protocol: "tcp",
+				LimitMbps: 10, MaxConns: 100, MaxPerIP: 5},
+		},
+		{
+			name: "per client limit of several backends",
+			rule: ForwardingRule{SrcPort: 8086, DstPort: 80, Protocol: "both", MaxPerIP: 3,
+				Backends: []ForwardBackend{{IP: "10.0.0.2", Weight: 1}, {IP: "10.0.0.3", Weight: 1}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule := tt.rule
+			if err := rule.normalize(); err != nil {
+				t.Fatalf("normalize: %v", err)
+			}
+
+			m := NewForwardingManager(DefaultConfig(), nil)
+			tx := &Transaction{}
+			m.queueForwardingRules(tx, rule)
+			m.backend = newDecodedBackend(t, tx)
+
+			rules, err := m.readEnabledRules()
+			if err != nil {
+				t.Fatalf("readEnabledRules: %v", err)
+			}
+			if len(rules) != 1 {
+				t.Fatalf("read %d forwards, want 1: %+v", len(rules), rules)
+			}
+			got := rules[0]
+			if got.PreHandle == 0 || (rule.SnatMode != SnatNone && got.PostHandle == 0) {
+				t.Errorf("handles = %d and %d, want the DNAT and source NAT rules", got.PreHandle, got.PostHandle)
+			}
+			if len(rule.Sources) > 0 && got.sourceSet != sourceSetName(rule.ref()) {
+				t.Errorf("source set = %q, want %q", got.sourceSet, sourceSetName(rule.ref()))
+			}
+
+			// Limits are read from the filter forward chains
+			limits := m.extractLimitsFromForwardChain()[rule.ref()]
+			if want := (forwardLimits{mbps: rule.LimitMbps, conns: rule.MaxConns, perIP: rule.MaxPerIP}); limits != want {
+				t.Errorf("limits = %+v, want %+v", limits, want)
+			}
+
+			want := rule
+			want.ID = rule.forwardingID()
+			want.Enabled, want.Managed = true, true
+			want.PreHandle, want.PostHandle = got.PreHandle, got.PostHandle
+			want.LimitMbps, want.MaxConns, want.MaxPerIP = 0, 0, 0
+			want.sourceSet = got.sourceSet
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("read forward\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
+
+func TestNetlinkAutoBanRoundTrip(t *testing.T) {
+	tx := &Transaction{}
+	tx.AddRule("inet", "filter", "blocklist_input",
+		"ip", "saddr", "@autoban_ip_22", "tcp", "dport", "22", "drop", "comment", `"nft-ui autoban port_22/tcp"`)
+	tx.AddRule("inet", "filter", "blocklist_input",
+		"tcp", "dport", "22", "ct", "state", "new",
+		"update", "@abmeter_ip_22", "{", "ip", "saddr", "limit", "rate", "over", "10/minute", "burst", "10", "packets", "}",
+		"add", "@autoban_ip_22", "{", "ip", "saddr", "timeout", "3600s", "}",
+		"drop", "comment", `"nft-ui autoban port_22/tcp"`)
+	tx.ops = append([]txOp{{verb: "add set", family: "inet", table: "filter", chain: "autoban_ip_22"}}, tx.ops...)
+	b := newDecodedBackend(t, tx)
+
+	r := &autoBanRules{}
+	for _, rule := range b.rules {
+		if rule.Comment != "nft-ui autoban port_22/tcp" {
+			t.Errorf("comment = %q, want %q", rule.Comment, "nft-ui autoban port_22/tcp")
+		}
+		r.parse(rule)
+	}
+	if r.ban.Connections != 10 || r.ban.Per != "minute" || r.ban.BanTime != 3600 {
+		t.Errorf("auto-ban = %d per %s banned for %ds, want 10 per minute banned for 3600s",
+			r.ban.Connections, r.ban.Per, r.ban.BanTime)
+	}
+	if want := []string{"autoban_ip_22", "abmeter_ip_22"}; !reflect.DeepEqual(r.sets, want) {
+		t.Errorf("sets = %v, want %v", r.sets, want)
+	}
+	if want := []string{"autoban_ip_22"}; !reflect.DeepEqual(r.banSets, want) {
+		t.Errorf("ban sets = %v, want %v", r.banSets, want)
+	}
+}
+
+func TestNetlinkCompileUnsupported(t *testing.T) {
+	// Rules the compiler can't express fall back to the nft binary
+	for _, rule := range []string{
+		`ip saddr 10.0.0.1 log prefix "dropped: " drop`,
+		`tcp dport 22 ct mark set 1`,
+		`meta skuid 0 accept`,
+		`tcp dport 80 queue num 1`,
+		`ip saddr 10.0.0.1-10.0.0.9 drop`,
+		`tcp dport 80 dnat to 10.0.0.2-10.0.0.3:80`,
+		`ip dscp cs1 accept`,
+		`goto other_chain`,
+	} {
+		comp := &nlCompiler{family: "inet"}
+		if err := comp.compile(tokenizeNFT(rule)); !errors.Is(err, errUnsupportedExpr) {
+			t.Errorf("compile(%s) = %v, want %v", rule, err, errUnsupportedExpr)
+		}
+	}
+}
+
+func TestNetlinkDecodeUnsupported(t *testing.T) {
+	// Rules the decoder can't express are listed with the nft binary instead
+	tests := []struct {
+		name  string
+		exprs []expr.Any
+	}{
+		{
+			name:  "unknown expression",
+			exprs: []expr.Any{&expr.Log{Key: 1 << 1, Data: []byte("dropped")}, &expr.Verdict{Kind: expr.VerdictDrop}},
+		},
+		{
+			name: "lookup of an unknown set",
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+				&expr.Lookup{SourceRegister: 1, SetName: "missing"},
+			},
+		},
+		{
+			name: "payload write",
+			exprs: []expr.Any{
+				&expr.Payload{OperationType: expr.PayloadWrite, SourceRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 1},
+			},
+		},
+		{
+			name:  "compare on an empty register",
+			exprs: []expr.Any{&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{6}}},
+		},
+		{
+			name:  "ct set",
+			exprs: []expr.Any{&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &nlDecoder{family: "ip", sets: make(map[string]*nftables.Set)}
+			_, err := d.decodeRule(&nftables.Rule{Exprs: tt.exprs}, "filter", "input")
+			if !errors.Is(err, errUnsupportedExpr) {
+				t.Errorf("decodeRule = %v, want %v", err, errUnsupportedExpr)
+			}
+		})
+	}
+}
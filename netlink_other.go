@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// NetlinkBackend is only available on Linux
+type NetlinkBackend struct {
+	*ExecBackend
+}
+
+// NewNetlinkBackend always fails on non-Linux platforms
+func NewNetlinkBackend(cfg *Config) (*NetlinkBackend, error) {
+	return nil, errors.New("netlink backend is only supported on linux")
+}
@@ -0,0 +1,134 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// testManagers are the managers of a test running against the netlink backend
+type testManagers struct {
+	cfg     *Config
+	backend *NetlinkBackend
+	nft     *NFTManager
+	fwd     *ForwardingManager
+	meta    *ForwardMetaStore
+}
+
+// newTestManagers wires the quota and forwarding managers to a netlink backend
+// in a network namespace of their own, with loopback up. The test goroutine
+// stays on the namespace's thread, which exits with it. Tests are skipped
+// where a namespace can't be created (no CAP_NET_ADMIN or no ip command).
+func newTestManagers(t *testing.T) *testManagers {
+	t.Helper()
+
+	runtime.LockOSThread()
+	if err := unix.Unshare(unix.CLONE_NEWNET); err != nil {
+		t.Skipf("can't create a network namespace: %v", err)
+	}
+	if out, err := exec.Command("ip", "link", "set", "lo", "up").CombinedOutput(); err != nil {
+		t.Skipf("can't bring up loopback: %v: %s", err, out)
+	}
+
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.DisabledForwardsPath = dir + "/disabled-forwards.json"
+	cfg.RulesetPath = dir + "/ruleset.nft"
+	cfg.QuotaMetaPath = dir + "/quota-meta.json"
+	cfg.HealthChecksPath = dir + "/health-checks.json"
+	cfg.ForwardMetaPath = dir + "/forward-meta.json"
+
+	backend, err := NewNetlinkBackend(cfg)
+	if err != nil {
+		t.Skipf("netlink backend unavailable: %v", err)
+	}
+
+	m := &testManagers{
+		cfg:     cfg,
+		backend: backend,
+		nft:     NewNFTManager(cfg, backend),
+		fwd:     NewForwardingManager(cfg, backend),
+		meta:    NewForwardMetaStore(cfg),
+	}
+	m.fwd.SetForwardMetaStore(m.meta)
+	m.nft.SetForwardingManager(m.fwd)
+	m.fwd.SetNFTManager(m.nft)
+	return m
+}
+
+// seedForwardUsage recreates the forward chain quota rules of a port as if
+// the egress rule of each forward had counted used bytes
+func (m *testManagers) seedForwardUsage(t *testing.T, port int, used int64) {
+	t.Helper()
+
+	m.nft.mu.Lock()
+	defer m.nft.mu.Unlock()
+
+	entries, err := m.nft.loadQuotas()
+	if err != nil {
+		t.Fatalf("loadQuotas: %v", err)
+	}
+	for _, e := range entries {
+		if e.Port != port {
+			continue
+		}
+		rules := m.nft.findForwardingRulesForPort(port)
+		if len(rules) == 0 || len(e.fwd) == 0 {
+			t.Fatalf("port %d has no forward chain quota", port)
+		}
+		tx := &Transaction{}
+		for key, r := range e.fwd {
+			queueDeleteQuotaRules(tx, key.family, "filter", r, false)
+			r.egress.usedBytes = used
+		}
+		for _, rule := range rules {
+			m.nft.queueForwardQuota(tx, rule, port, e.local.limits(), e.local.action(), e.fwd)
+		}
+		if err := m.backend.Apply(tx); err != nil {
+			t.Fatalf("seeding forward quota usage: %v", err)
+		}
+		return
+	}
+	t.Fatalf("no quota on port %d", port)
+}
+
+// forwardQuotaRules returns the egress forward chain quota rules of a forward, as JSON
+func (m *testManagers) forwardQuotaRules(t *testing.T, family string, ref forwardRef) []string {
+	t.Helper()
+
+	ruleset, err := m.backend.ListChain(family, "filter", "forward")
+	if err != nil {
+		t.Fatalf("listing %s forward chain: %v", family, err)
+	}
+	var rules []string
+	for _, obj := range ruleset.NFTables {
+		if obj.Rule == nil || obj.Rule.Comment != forwardQuotaComment(ref, DirectionEgress) {
+			continue
+		}
+		data, err := json.Marshal(obj.Rule.Expr)
+		if err != nil {
+			t.Fatalf("marshalling rule: %v", err)
+		}
+		rules = append(rules, string(data))
+	}
+	return rules
+}
+
+// forwardQuotaUsed returns the bytes counted by the forward chain quota rules of a forward
+func (m *testManagers) forwardQuotaUsed(ref forwardRef) int64 {
+	m.nft.mu.Lock()
+	defer m.nft.mu.Unlock()
+
+	var used int64
+	for key, r := range m.nft.loadForwardQuotas()[ref.port] {
+		if key.bind == ref.bind {
+			used += r.used()
+		}
+	}
+	return used
+}
@@ -1,18 +1,15 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 )
 
 // ManagedComment is the comment used to identify rules managed by nft-ui
@@ -21,25 +18,56 @@ const ManagedComment = "nft-ui managed"
 // ForwardQuotaComment is the prefix for quota rules in the forward chain
 const ForwardQuotaComment = "nft-ui quota fwd"
 
+// SharedQuotaChainPrefix names the regular chains holding a limit shared by
+// both directions of a port; the egress and ingress rules count and jump to them
+const SharedQuotaChainPrefix = "nftui_quota_"
+
+// Quota directions
+const (
+	DirectionEgress  = "egress"  // traffic sent from the port
+	DirectionIngress = "ingress" // traffic received on the port
+	DirectionBoth    = "both"
+)
+
+// Over-quota actions
+const (
+	QuotaActionDrop      = "drop"
+	QuotaActionReject    = "reject"
+	QuotaActionRateLimit = "ratelimit" // throttle to RateMbps instead of cutting off
+	QuotaActionMark      = "mark"      // set a packet mark, e.g. for tc shaping, and let traffic pass
+)
+
+// bytesPerMbps converts Mbit/s to bytes per second
+const bytesPerMbps = 1000 * 1000 / 8
+
 // NFTManager handles all nftables operations
 type NFTManager struct {
-	mu          sync.Mutex
-	binary      string
-	tableFamily string
-	tableName   string
-	chainName   string
-	rulesetPath string
-	fwd         *ForwardingManager
+	mu           sync.Mutex
+	backend      Backend
+	tableFamily  string
+	tableName    string
+	chainName    string
+	ingressChain string
+	rulesetPath  string
+	fwd          *ForwardingManager
+	scheduler    *ResetScheduler
+	meta         *QuotaMetaStore
+	thresholds   QuotaThresholds
 }
 
 // NewNFTManager creates a new NFTManager
-func NewNFTManager(cfg *Config) *NFTManager {
+func NewNFTManager(cfg *Config, backend Backend) *NFTManager {
 	return &NFTManager{
-		binary:      cfg.NFTBinary,
-		tableFamily: cfg.TableFamily,
-		tableName:   cfg.TableName,
-		chainName:   cfg.ChainName,
-		rulesetPath: cfg.RulesetPath,
+		backend:      backend,
+		tableFamily:  cfg.TableFamily,
+		tableName:    cfg.TableName,
+		chainName:    cfg.ChainName,
+		ingressChain: cfg.IngressChainName,
+		rulesetPath:  cfg.RulesetPath,
+		thresholds: QuotaThresholds{
+			WarningPercent:  cfg.WarningPercent,
+			ExceededPercent: cfg.ExceededPercent,
+		},
 	}
 }
 
@@ -48,74 +76,428 @@ func (n *NFTManager) SetForwardingManager(fwd *ForwardingManager) {
 	n.fwd = fwd
 }
 
-// execNFT executes an nft command and returns the output
-func (n *NFTManager) execNFT(args ...string) ([]byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+// SetResetScheduler sets the scheduler reference used to report next/last reset times
+func (n *NFTManager) SetResetScheduler(s *ResetScheduler) {
+	n.scheduler = s
+}
 
-	cmd := exec.CommandContext(ctx, n.binary, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return nil, fmt.Errorf("nft %s: %w (output: %s)", strings.Join(args, " "), err, string(output))
+// SetQuotaMetaStore sets the store holding per-quota settings such as thresholds
+func (n *NFTManager) SetQuotaMetaStore(meta *QuotaMetaStore) {
+	n.meta = meta
+}
+
+// thresholdsFor returns the status thresholds of a port: its own, or the global defaults
+func (n *NFTManager) thresholdsFor(port int) QuotaThresholds {
+	if n.meta != nil {
+		if m, ok := n.meta.Get(port); ok && m.Thresholds != nil {
+			return *m.Thresholds
+		}
+	}
+	return n.thresholds
+}
+
+// updateUsage recalculates usage percent, thresholds and status from the byte counters
+func (n *NFTManager) updateUsage(rule *QuotaRule) {
+	rule.UsagePercent = usagePercent(rule.UsedBytes, rule.QuotaBytes)
+	// With a limit per direction, the direction closest to its limit decides
+	if rule.Egress != nil && rule.Ingress != nil && rule.Egress.QuotaBytes > 0 && rule.Ingress.QuotaBytes > 0 {
+		rule.UsagePercent = math.Max(
+			usagePercent(rule.Egress.UsedBytes, rule.Egress.QuotaBytes),
+			usagePercent(rule.Ingress.UsedBytes, rule.Ingress.QuotaBytes))
+	}
+	t := n.thresholdsFor(rule.Port)
+	rule.WarningPercent = t.WarningPercent
+	rule.ExceededPercent = t.ExceededPercent
+	rule.Status = quotaStatus(rule.UsagePercent, t)
+}
+
+// usagePercent returns used bytes as a percentage of the limit
+func usagePercent(used, limit int64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+	return float64(used) / float64(limit) * 100
+}
+
+// quotaPart is one rule of a quota: an inline quota, or a counter jumping to a shared quota chain
+type quotaPart struct {
+	chain      string
+	handle     int64
+	comment    string
+	quotaBytes int64       // inline limit, 0 for a rule jumping to a shared chain
+	usedBytes  int64       // inline usage, or the counted bytes of a rule jumping to a shared chain
+	jump       string      // shared quota chain the rule jumps to
+	action     QuotaAction // what the inline quota does to traffic over the limit
+}
+
+// used returns the bytes counted by the rule (0 for a missing rule)
+func (p *quotaPart) used() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.usedBytes
+}
+
+// portQuotaPart is a quota rule matched to one of its ports
+type portQuotaPart struct {
+	port int
+	part *quotaPart
+}
+
+// quotaRules are the rules limiting one port in one table
+type quotaRules struct {
+	egress  *quotaPart
+	ingress *quotaPart
+	shared  *quotaPart // rule in the shared chain both directions jump to
+}
+
+// jumpTarget returns the shared quota chain the rules jump to, if any
+func (r quotaRules) jumpTarget() string {
+	for _, p := range []*quotaPart{r.egress, r.ingress} {
+		if p != nil && p.jump != "" {
+			return p.jump
+		}
+	}
+	return ""
+}
+
+// limits returns the limits the rules enforce
+func (r quotaRules) limits() quotaLimits {
+	var l quotaLimits
+	if r.jumpTarget() != "" {
+		if r.shared != nil {
+			l.shared = r.shared.quotaBytes
+		}
+		return l
+	}
+	if r.egress != nil {
+		l.egress = r.egress.quotaBytes
+	}
+	if r.ingress != nil {
+		l.ingress = r.ingress.quotaBytes
+	}
+	return l
+}
+
+// action returns the over-quota action of the rules
+func (r quotaRules) action() QuotaAction {
+	for _, p := range []*quotaPart{r.shared, r.egress, r.ingress} {
+		if p != nil && p.jump == "" {
+			return p.action
+		}
+	}
+	return QuotaAction{Action: QuotaActionDrop}
+}
+
+// used returns the bytes counted against the limits
+func (r quotaRules) used() int64 {
+	if r.shared != nil {
+		return r.shared.usedBytes
+	}
+	return r.egress.used() + r.ingress.used()
+}
+
+// forwardQuotaKey identifies the forward chain rules of a quota by the family
+// of the forward's destination ("ip" or "ip6") and the forward's binding
+type forwardQuotaKey struct {
+	family string
+	bind   string
+}
+
+// forwardQuotas are the forward chain rules of a quota, one set for each
+// forward serving its port and family of the forward's destination. Each
+// counts its own traffic.
+type forwardQuotas map[forwardQuotaKey]quotaRules
+
+// used returns the bytes counted by the rules of every family
+func (f forwardQuotas) used() int64 {
+	var used int64
+	for _, r := range f {
+		used += r.used()
+	}
+	return used
+}
+
+// directionUsed returns the bytes counted by the egress or ingress rules of every family
+func (f forwardQuotas) directionUsed(direction string) int64 {
+	var used int64
+	for _, r := range f {
+		if direction == DirectionIngress {
+			used += r.ingress.used()
+		} else {
+			used += r.egress.used()
+		}
+	}
+	return used
+}
+
+// quotaLimits are the limits of a quota: one per direction, or one shared by both
+type quotaLimits struct {
+	egress  int64 // 0 leaves egress traffic unlimited
+	ingress int64 // 0 leaves ingress traffic unlimited
+	shared  int64 // limit for both directions together, replaces egress and ingress
+}
+
+// total returns the sum of the limits
+func (l quotaLimits) total() int64 {
+	return l.egress + l.ingress + l.shared
+}
+
+// newQuotaLimits builds the limits of a new quota. With direction "both", a
+// positive ingressBytes gives each direction its own limit, otherwise both
+// directions share bytes.
+func newQuotaLimits(direction string, bytes, ingressBytes int64) (quotaLimits, error) {
+	if bytes <= 0 {
+		return quotaLimits{}, errors.New("quota limit must be positive")
+	}
+	if ingressBytes < 0 || (ingressBytes > 0 && direction != DirectionBoth) {
+		return quotaLimits{}, errors.New("a separate ingress limit requires direction both")
+	}
+
+	switch direction {
+	case "", DirectionEgress:
+		return quotaLimits{egress: bytes}, nil
+	case DirectionIngress:
+		return quotaLimits{ingress: bytes}, nil
+	case DirectionBoth:
+		if ingressBytes > 0 {
+			return quotaLimits{egress: bytes, ingress: ingressBytes}, nil
+		}
+		return quotaLimits{shared: bytes}, nil
+	}
+	return quotaLimits{}, fmt.Errorf("invalid direction: %s", direction)
+}
+
+// normalize validates the action and fills in the default drop action
+func (a QuotaAction) normalize() (QuotaAction, error) {
+	switch a.Action {
+	case "", QuotaActionDrop, QuotaActionReject:
+		if a.Action == "" {
+			a.Action = QuotaActionDrop
+		}
+		return QuotaAction{Action: a.Action}, nil
+	case QuotaActionRateLimit:
+		if a.RateMbps <= 0 {
+			return a, errors.New("rate limit must be a positive number of Mbps")
+		}
+		return QuotaAction{Action: a.Action, RateMbps: a.RateMbps}, nil
+	case QuotaActionMark:
+		if a.Mark == 0 {
+			return a, errors.New("packet mark must be non-zero")
+		}
+		return QuotaAction{Action: a.Action, Mark: a.Mark}, nil
+	}
+	return a, fmt.Errorf("invalid over-quota action: %s", a.Action)
+}
+
+// args builds the statements applied to traffic over the limit
+func (a QuotaAction) args() []string {
+	switch a.Action {
+	case QuotaActionReject:
+		return []string{"reject"}
+	case QuotaActionRateLimit:
+		// Traffic above the rate is dropped, the rest falls through to later rules
+		rate := strconv.FormatInt(a.RateMbps*bytesPerMbps, 10)
+		return []string{"limit", "rate", "over", rate, "bytes/second", "drop"}
+	case QuotaActionMark:
+		return []string{"meta", "mark", "set", fmt.Sprintf("0x%x", a.Mark)}
+	default:
+		return []string{"drop"}
 	}
-	return output, nil
 }
 
-// ListQuotas returns all quota rules from the output chain, merged with forward chain usage
+// quotaEntry is a quota together with the rules it is made of
+type quotaEntry struct {
+	QuotaRule
+	local quotaRules    // egress, ingress and shared chains of the quota table
+	fwd   forwardQuotas // ip/ip6 filter forward chains, one per forward of the port
+}
+
+// ListQuotas returns all quota rules from the egress and ingress chains, merged with forward chain usage
 func (n *NFTManager) ListQuotas() ([]QuotaRule, error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	// Get JSON output with handles
-	output, err := n.execNFT("-j", "-a", "list", "chain", n.tableFamily, n.tableName, n.chainName)
+	entries, err := n.loadQuotas()
 	if err != nil {
-		// If chain doesn't exist, return empty list instead of error
-		if strings.Contains(err.Error(), "No such file or directory") ||
-			strings.Contains(err.Error(), "does not exist") {
-			return []QuotaRule{}, nil
-		}
 		return nil, err
 	}
 
-	rules, err := n.parseQuotaRules(output)
+	rules := make([]QuotaRule, 0, len(entries))
+	for _, e := range entries {
+		rules = append(rules, e.QuotaRule)
+	}
+
+	if n.scheduler != nil {
+		n.scheduler.annotate(rules)
+	}
+
+	return rules, nil
+}
+
+// QuotaCounters returns the raw local and forward counters of every quota, keyed by port
+func (n *NFTManager) QuotaCounters() (map[int]QuotaCounters, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	entries, err := n.loadQuotas()
 	if err != nil {
 		return nil, err
 	}
 
-	// Merge forward chain quota usage
-	fwdUsage := n.getForwardQuotaUsage()
-	for i, rule := range rules {
-		if used, ok := fwdUsage[rule.Port]; ok {
-			rules[i].UsedBytes += used
-			// Recalculate usage percent and status
-			if rules[i].QuotaBytes > 0 {
-				rules[i].UsagePercent = float64(rules[i].UsedBytes) / float64(rules[i].QuotaBytes) * 100
-			}
-			if rules[i].UsagePercent >= 100 {
-				rules[i].Status = "exceeded"
-			} else if rules[i].UsagePercent >= 70 {
-				rules[i].Status = "warning"
-			} else {
-				rules[i].Status = "ok"
+	counters := make(map[int]QuotaCounters)
+	for _, e := range entries {
+		if _, ok := counters[e.Port]; ok || e.Port == 0 {
+			continue
+		}
+		counters[e.Port] = QuotaCounters{Local: e.local.used(), Forward: e.fwd.used()}
+	}
+
+	return counters, nil
+}
+
+// loadQuotas reads every quota from the egress, ingress and forward chains.
+// An egress rule and an ingress rule on the same port form one quota.
+// (requires lock to be held)
+func (n *NFTManager) loadQuotas() ([]quotaEntry, error) {
+	egress, err := n.listQuotaParts(n.chainName)
+	if err != nil {
+		return nil, err
+	}
+	ingress, err := n.listQuotaParts(n.ingressChain)
+	if err != nil {
+		return nil, err
+	}
+	fwd := n.loadForwardQuotas()
+
+	var entries []quotaEntry
+	paired := make([]bool, len(ingress))
+	for _, e := range egress {
+		local := quotaRules{egress: e.part}
+		for i, in := range ingress {
+			if !paired[i] && in.port == e.port {
+				local.ingress = in.part
+				paired[i] = true
+				break
 			}
 		}
+		entries = append(entries, n.newQuotaEntry(e.port, local, fwd[e.port]))
+	}
+	for i, in := range ingress {
+		if !paired[i] {
+			entries = append(entries, n.newQuotaEntry(in.port, quotaRules{ingress: in.part}, fwd[in.port]))
+		}
 	}
 
-	return rules, nil
+	return entries, nil
 }
 
-// getForwardQuotaUsage returns a map of srcPort -> usedBytes from forward chain quota rules
-func (n *NFTManager) getForwardQuotaUsage() map[int]int64 {
-	usage := make(map[int]int64)
+// newQuotaEntry builds the API view of a port's quota from its local and forward rules
+// (requires lock to be held)
+func (n *NFTManager) newQuotaEntry(port int, local quotaRules, fwd forwardQuotas) quotaEntry {
+	local.shared = n.readSharedQuota(n.tableFamily, n.tableName, local.jumpTarget())
+
+	// The egress rule identifies the quota, or the ingress rule if it has no egress limit
+	primary := local.egress
+	if primary == nil {
+		primary = local.ingress
+	}
+
+	q := QuotaRule{
+		Handle:     primary.handle,
+		ID:         fmt.Sprintf("%s_%s_%s_%d_%d", n.tableFamily, n.tableName, primary.chain, primary.handle, port),
+		Comment:    primary.comment,
+		Port:       port,
+		QuotaBytes: local.limits().total(),
+		UsedBytes:  local.used() + fwd.used(),
+	}
+	q.QuotaAction = local.action()
 
-	output, err := n.execNFT("-j", "-a", "list", "chain", "ip", "filter", "forward")
+	switch {
+	case local.egress != nil && local.ingress != nil:
+		q.Direction = DirectionBoth
+	case local.ingress != nil:
+		q.Direction = DirectionIngress
+	default:
+		q.Direction = DirectionEgress
+	}
+	if local.egress != nil {
+		q.Egress = &QuotaDirection{
+			QuotaBytes: local.egress.quotaBytes,
+			UsedBytes:  local.egress.usedBytes + fwd.directionUsed(DirectionEgress),
+		}
+	}
+	if local.ingress != nil {
+		q.Ingress = &QuotaDirection{
+			QuotaBytes: local.ingress.quotaBytes,
+			UsedBytes:  local.ingress.usedBytes + fwd.directionUsed(DirectionIngress),
+		}
+	}
+
+	n.updateUsage(&q)
+	return quotaEntry{QuotaRule: q, local: local, fwd: fwd}
+}
+
+// listQuotaParts returns the quota rules of a local chain, one per matched port
+// (requires lock to be held)
+func (n *NFTManager) listQuotaParts(chain string) ([]portQuotaPart, error) {
+	ruleset, err := n.backend.ListChain(n.tableFamily, n.tableName, chain)
 	if err != nil {
-		return usage
+		// If chain doesn't exist, it holds no quotas
+		if isNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(output, &ruleset); err != nil {
-		return usage
+	var parts []portQuotaPart
+	for _, obj := range ruleset.NFTables {
+		if obj.Rule == nil || obj.Rule.Chain != chain {
+			continue
+		}
+
+		part, ports := n.extractQuotaPart(obj.Rule)
+		if part == nil {
+			continue
+		}
+
+		// If no ports found, still return a single rule with port 0
+		if len(ports) == 0 {
+			ports = []int{0}
+		}
+		for _, port := range ports {
+			parts = append(parts, portQuotaPart{port: port, part: part})
+		}
+	}
+
+	return parts, nil
+}
+
+// loadForwardQuotas returns the forward chain quota rules per source port
+// (requires lock to be held)
+func (n *NFTManager) loadForwardQuotas() map[int]forwardQuotas {
+	quotas := make(map[int]forwardQuotas)
+
+	for _, family := range forwardFamilies {
+		for ref, r := range n.loadFamilyForwardQuotas(family) {
+			if quotas[ref.port] == nil {
+				quotas[ref.port] = make(forwardQuotas)
+			}
+			quotas[ref.port][forwardQuotaKey{family: family, bind: ref.bind}] = r
+		}
+	}
+
+	return quotas
+}
+
+// loadFamilyForwardQuotas returns the quota rules of one family's forward chain
+// per source port and forward binding (requires lock to be held)
+func (n *NFTManager) loadFamilyForwardQuotas(family string) map[forwardRef]quotaRules {
+	quotas := make(map[forwardRef]quotaRules)
+
+	ruleset, err := n.backend.ListChain(family, "filter", "forward")
+	if err != nil {
+		return quotas
 	}
 
 	for _, obj := range ruleset.NFTables {
@@ -126,92 +508,143 @@ func (n *NFTManager) getForwardQuotaUsage() map[int]int64 {
 			continue
 		}
 
-		// Extract srcPort from comment: "nft-ui quota fwd <srcPort>"
-		srcPort := n.extractFwdQuotaSrcPort(obj.Rule.Comment)
-		if srcPort == 0 {
+		// Extract the forward from comment: "nft-ui quota fwd <srcPort>[<binding>] [ingress]"
+		ref, ok := extractFwdQuotaRef(obj.Rule.Comment)
+		if !ok {
 			continue
 		}
 
-		// Extract used bytes from quota expression
-		for _, expr := range obj.Rule.Expr {
-			if quotaData, ok := expr["quota"]; ok {
-				if qm, ok := quotaData.(map[string]interface{}); ok {
-					if used, ok := qm["used"].(float64); ok {
-						usedUnit, _ := qm["used_unit"].(string)
-						usage[srcPort] += convertToBytes(int64(used), usedUnit)
-					}
-				}
+		part, _ := n.extractQuotaPart(obj.Rule)
+		if part == nil {
+			continue
+		}
+
+		r := quotas[ref]
+		if obj.Rule.Comment == forwardQuotaComment(ref, DirectionIngress) {
+			if r.ingress == nil {
+				r.ingress = part
 			}
+		} else if r.egress == nil {
+			r.egress = part
 		}
+		quotas[ref] = r
 	}
 
-	return usage
-}
-
-// extractFwdQuotaSrcPort extracts source port from comment like "nft-ui quota fwd 12103"
-func (n *NFTManager) extractFwdQuotaSrcPort(comment string) int {
-	parts := strings.Fields(comment)
-	if len(parts) >= 4 {
-		port, err := strconv.Atoi(parts[3])
-		if err == nil {
-			return port
+	for ref, r := range quotas {
+		if target := r.jumpTarget(); target != "" {
+			r.shared = n.readSharedQuota(family, "filter", target)
+			quotas[ref] = r
 		}
 	}
-	return 0
+
+	return quotas
 }
 
-// parseQuotaRules parses the JSON output and extracts quota rules
-func (n *NFTManager) parseQuotaRules(data []byte) ([]QuotaRule, error) {
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(data, &ruleset); err != nil {
-		return nil, fmt.Errorf("failed to parse nft JSON: %w", err)
+// readSharedQuota returns the quota rule of a shared quota chain, or nil if
+// there is none (requires lock to be held)
+func (n *NFTManager) readSharedQuota(family, table, chain string) *quotaPart {
+	if chain == "" {
+		return nil
 	}
 
-	var rules []QuotaRule
+	ruleset, err := n.backend.ListChain(family, table, chain)
+	if err != nil {
+		return nil
+	}
 
 	for _, obj := range ruleset.NFTables {
-		if obj.Rule == nil {
+		if obj.Rule == nil || obj.Rule.Chain != chain {
 			continue
 		}
-
-		rule := obj.Rule
-		if rule.Chain != n.chainName {
-			continue
+		if part, _ := n.extractQuotaPart(obj.Rule); part != nil && part.jump == "" {
+			return part
 		}
+	}
+	return nil
+}
+
+// extractFwdQuotaRef extracts the source port and forward binding from a
+// comment like "nft-ui quota fwd 12103" or "nft-ui quota fwd 443+eth0 ingress"
+func extractFwdQuotaRef(comment string) (forwardRef, bool) {
+	parts := strings.Fields(comment)
+	if len(parts) < 4 {
+		return forwardRef{}, false
+	}
+	ref, err := parseForwardKey(parts[3])
+	if err != nil {
+		return forwardRef{}, false
+	}
+	return ref, true
+}
 
-		// Extract quota rules (may return multiple for port sets)
-		quotaRules := n.extractQuotaRules(rule)
-		rules = append(rules, quotaRules...)
+// forwardQuotaComment returns the comment of a forward chain quota rule:
+// "nft-ui quota fwd <srcPort>[<binding>]" for egress, suffixed with " ingress"
+// for ingress
+func forwardQuotaComment(ref forwardRef, direction string) string {
+	if direction == DirectionIngress {
+		return fmt.Sprintf("%s %s %s", ForwardQuotaComment, ref, DirectionIngress)
 	}
+	return fmt.Sprintf("%s %s", ForwardQuotaComment, ref)
+}
 
-	return rules, nil
+// sharedQuotaChain returns the name of the chain holding a port's shared limit
+func sharedQuotaChain(port int) string {
+	return SharedQuotaChainPrefix + strconv.Itoa(port)
 }
 
-// extractQuotaRules extracts quota information from a rule (supports multiple ports)
-func (n *NFTManager) extractQuotaRules(rule *NFTRule) []QuotaRule {
+// forwardSharedQuotaChain returns the name of the forward chain's counterpart
+// of sharedQuotaChain for one forward; bound forwards get a hash of their
+// binding like their sets
+func forwardSharedQuotaChain(ref forwardRef) string {
+	if ref.bind == "" {
+		return sharedQuotaChain(ref.port)
+	}
+	return forwardSetName(strings.TrimSuffix(SharedQuotaChainPrefix, "_"), ref)
+}
+
+// extractQuotaPart extracts the quota of a rule: an inline quota, or a counter
+// jumping to a shared quota chain. The matched ports are returned separately
+// since one rule may match a set of ports.
+func (n *NFTManager) extractQuotaPart(rule *NFTRule) (*quotaPart, []int) {
+	part := &quotaPart{chain: rule.Chain, handle: rule.Handle, comment: rule.Comment,
+		action: QuotaAction{Action: QuotaActionDrop}}
 	var hasQuota bool
-	var quotaBytes, usedBytes int64
+	var counted int64
 	var ports []int
 
 	for _, expr := range rule.Expr {
 		// Look for quota expression
 		if quotaData, ok := expr["quota"]; ok {
 			hasQuota = true
-			if qm, ok := quotaData.(map[string]interface{}); ok {
-				// Get quota value (limit) with unit conversion
-				if val, ok := qm["val"].(float64); ok {
-					valUnit, _ := qm["val_unit"].(string)
-					quotaBytes = convertToBytes(int64(val), valUnit)
-				}
-				// Get used value with unit conversion
-				if used, ok := qm["used"].(float64); ok {
-					usedUnit, _ := qm["used_unit"].(string)
-					usedBytes = convertToBytes(int64(used), usedUnit)
-				}
+			part.quotaBytes, part.usedBytes = quotaValues(quotaData)
+		}
+
+		// Look for the action applied over the quota
+		if hasQuota {
+			if _, ok := expr["reject"]; ok {
+				part.action = QuotaAction{Action: QuotaActionReject}
+			}
+			if lm, ok := expr["limit"].(map[string]interface{}); ok {
+				part.action = QuotaAction{Action: QuotaActionRateLimit, RateMbps: limitRateMbps(lm)}
+			}
+			if mark, ok := markValue(expr); ok {
+				part.action = QuotaAction{Action: QuotaActionMark, Mark: mark}
 			}
 		}
 
-		// Look for port match (th sport)
+		// Look for counter and jump to a shared quota chain
+		if cm, ok := expr["counter"].(map[string]interface{}); ok {
+			if bytes, ok := cm["bytes"].(float64); ok {
+				counted = int64(bytes)
+			}
+		}
+		if jm, ok := expr["jump"].(map[string]interface{}); ok {
+			if target, _ := jm["target"].(string); strings.HasPrefix(target, SharedQuotaChainPrefix) {
+				part.jump = target
+			}
+		}
+
+		// Look for port match (th sport / th dport)
 		if matchData, ok := expr["match"]; ok {
 			if mm, ok := matchData.(map[string]interface{}); ok {
 				extractedPorts := n.extractPorts(mm)
@@ -222,48 +655,67 @@ func (n *NFTManager) extractQuotaRules(rule *NFTRule) []QuotaRule {
 		}
 	}
 
-	if !hasQuota {
-		return nil
+	switch {
+	case hasQuota:
+		part.jump = ""
+	case part.jump != "":
+		part.usedBytes = counted
+	default:
+		return nil, nil
 	}
 
-	// If no ports found, still return a single rule with port 0
-	if len(ports) == 0 {
-		ports = []int{0}
-	}
+	return part, ports
+}
 
-	// Calculate usage percent
-	var usagePercent float64
-	if quotaBytes > 0 {
-		usagePercent = float64(usedBytes) / float64(quotaBytes) * 100
+// quotaValues returns the limit and used bytes of a quota expression
+func quotaValues(quotaData interface{}) (limit, used int64) {
+	qm, ok := quotaData.(map[string]interface{})
+	if !ok {
+		return 0, 0
 	}
-
-	// Determine status
-	var status string
-	if usagePercent >= 100 {
-		status = "exceeded"
-	} else if usagePercent >= 70 {
-		status = "warning"
-	} else {
-		status = "ok"
+	// Get quota value (limit) with unit conversion
+	if val, ok := qm["val"].(float64); ok {
+		valUnit, _ := qm["val_unit"].(string)
+		limit = convertToBytes(int64(val), valUnit)
+	}
+	// Get used value with unit conversion
+	if u, ok := qm["used"].(float64); ok {
+		usedUnit, _ := qm["used_unit"].(string)
+		used = convertToBytes(int64(u), usedUnit)
 	}
+	return limit, used
+}
 
-	// Create a QuotaRule for each port
-	var rules []QuotaRule
-	for _, port := range ports {
-		qr := QuotaRule{
-			Handle:       rule.Handle,
-			ID:           fmt.Sprintf("%s_%s_%s_%d_%d", rule.Family, rule.Table, rule.Chain, rule.Handle, port),
-			Comment:      rule.Comment,
-			Port:         port,
-			QuotaBytes:   quotaBytes,
-			UsedBytes:    usedBytes,
-			UsagePercent: usagePercent,
-			Status:       status,
-		}
-		rules = append(rules, qr)
+// limitRateMbps returns the rate of a "limit rate <n> <unit>/second" expression in Mbps.
+// nft limit units are 1024-based.
+func limitRateMbps(limit map[string]interface{}) int64 {
+	rate, _ := limit["rate"].(float64)
+	unit, _ := limit["rate_unit"].(string)
+	bytes := int64(rate)
+	switch unit {
+	case "kbytes":
+		bytes <<= 10
+	case "mbytes":
+		bytes <<= 20
+	case "gbytes":
+		bytes <<= 30
 	}
+	return int64(math.Round(float64(bytes) / bytesPerMbps))
+}
 
-	return rules
+// markValue returns the value of a "meta mark set <n>" expression
+func markValue(expr map[string]interface{}) (uint32, bool) {
+	mangle, ok := expr["mangle"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	key, _ := mangle["key"].(map[string]interface{})
+	meta, _ := key["meta"].(map[string]interface{})
+	if meta["key"] != "mark" {
+		return 0, false
+	}
+	value, ok := mangle["value"].(float64)
+	return uint32(value), ok
 }
 
 // extractPorts extracts port numbers from a match expression (supports single port or port set)
@@ -324,26 +776,17 @@ func (n *NFTManager) ResetQuota(id string) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	// Find the rule
-	rule, err := n.findRuleByID(id)
+	// Find the quota
+	entry, err := n.findQuotaByID(id)
 	if err != nil {
 		return err
 	}
 
-	// Delete the existing rule
-	if err := n.deleteRuleByHandle(rule.Handle); err != nil {
-		return fmt.Errorf("failed to delete rule: %w", err)
-	}
-
-	// Recreate the rule with used=0
-	if err := n.addQuotaRule(rule.Port, rule.QuotaBytes, rule.Comment); err != nil {
-		return fmt.Errorf("failed to recreate rule: %w", err)
+	// Recreate the rules with used=0, including the forward chain quota if it exists
+	if err := n.rebuildQuota(entry, entry.local.limits(), entry.QuotaAction, false); err != nil {
+		return fmt.Errorf("failed to reset quota: %w", err)
 	}
 
-	// Also reset forward chain quota if exists
-	n.deleteForwardQuotaRule(rule.Port)
-	n.addForwardQuotaIfNeeded(rule.Port, rule.QuotaBytes)
-
 	return nil
 }
 
@@ -357,40 +800,159 @@ func (n *NFTManager) BatchResetQuotas(ids []string) error {
 	return nil
 }
 
-// ModifyQuota changes the quota limit
-func (n *NFTManager) ModifyQuota(id string, newBytes int64) error {
+// errQuotaLimit means a limit change doesn't fit the quota's directions
+var errQuotaLimit = errors.New("invalid quota limit")
+
+// ModifyQuota changes the quota limit, carrying the used counters over into
+// the recreated rules unless resetUsage is set. For quotas with a limit per
+// direction, bytes is the egress limit and ingressBytes the ingress limit
+// (0 keeps it); other quotas take no ingressBytes. An empty action keeps the
+// current one. It returns the total limit before and after.
+func (n *NFTManager) ModifyQuota(id string, bytes, ingressBytes int64, action QuotaAction, resetUsage bool) (QuotaLimitChange, error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	// Find the rule
-	rule, err := n.findRuleByID(id)
+	// Find the quota
+	entry, err := n.findQuotaByID(id)
 	if err != nil {
-		return err
+		return QuotaLimitChange{}, err
 	}
 
-	// Delete the existing rule
-	if err := n.deleteRuleByHandle(rule.Handle); err != nil {
-		return fmt.Errorf("failed to delete rule: %w", err)
+	if action.Action == "" {
+		action = entry.QuotaAction
+	} else if action, err = action.normalize(); err != nil {
+		return QuotaLimitChange{}, err
 	}
 
-	// Recreate with new limit (preserve current usage for modify, not reset)
-	// Actually, for modify we want to keep the used value? Let me reconsider...
-	// Based on the requirement, modify changes the limit but should preserve used bytes
-	// However, nft doesn't support modifying in place, so we recreate
-	// For now, we'll reset used to 0 when modifying (can be changed if needed)
-	if err := n.addQuotaRule(rule.Port, newBytes, rule.Comment); err != nil {
-		return fmt.Errorf("failed to recreate rule: %w", err)
+	limits := entry.local.limits()
+	if limits.total() == 0 {
+		// e.g. the shared chain is gone; rebuilding would guess the direction
+		return QuotaLimitChange{}, fmt.Errorf("failed to read the limit of quota %s", id)
+	}
+	separate := limits.egress > 0 && limits.ingress > 0
+	if ingressBytes != 0 && !separate {
+		return QuotaLimitChange{}, fmt.Errorf("%w: ingress_bytes only applies to a quota with a limit per direction", errQuotaLimit)
+	}
+	if ingressBytes < 0 {
+		return QuotaLimitChange{}, fmt.Errorf("%w: ingress_bytes must not be negative", errQuotaLimit)
 	}
 
-	// Also update forward chain quota if exists
-	n.deleteForwardQuotaRule(rule.Port)
-	n.addForwardQuotaIfNeeded(rule.Port, newBytes)
+	switch {
+	case limits.shared > 0:
+		limits.shared = bytes
+	case separate:
+		limits.egress = bytes
+		if ingressBytes > 0 {
+			limits.ingress = ingressBytes
+		}
+	case limits.ingress > 0:
+		limits.ingress = bytes
+	default:
+		limits.egress = bytes
+	}
 
-	return nil
+	if err := n.rebuildQuota(entry, limits, action, !resetUsage); err != nil {
+		return QuotaLimitChange{}, fmt.Errorf("failed to modify quota: %w", err)
+	}
+
+	return n.limitChange(entry)
+}
+
+// TopUpQuota increases the quota limit by bytes, keeping the used counters.
+// Quotas with a limit per direction get the bytes on the limit of direction
+// ("egress" or "ingress"); for other quotas direction may be empty. It
+// returns the total limit before and after.
+func (n *NFTManager) TopUpQuota(id string, bytes int64, direction string) (QuotaLimitChange, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if bytes <= 0 {
+		return QuotaLimitChange{}, errors.New("top-up must be positive")
+	}
+
+	// Find the quota
+	entry, err := n.findQuotaByID(id)
+	if err != nil {
+		return QuotaLimitChange{}, err
+	}
+
+	limits := entry.local.limits()
+	if limits.total() == 0 {
+		return QuotaLimitChange{}, fmt.Errorf("failed to read the limit of quota %s", id)
+	}
+
+	var limit *int64
+	switch {
+	case limits.egress > 0 && limits.ingress > 0:
+		switch direction {
+		case DirectionEgress:
+			limit = &limits.egress
+		case DirectionIngress:
+			limit = &limits.ingress
+		default:
+			return QuotaLimitChange{}, fmt.Errorf("%w: a quota with a limit per direction needs the direction to top up (egress or ingress)", errQuotaLimit)
+		}
+	case direction != "" && direction != entry.Direction:
+		return QuotaLimitChange{}, fmt.Errorf("%w: the quota has no separate %s limit", errQuotaLimit, direction)
+	case limits.shared > 0:
+		limit = &limits.shared
+	case limits.ingress > 0:
+		limit = &limits.ingress
+	default:
+		limit = &limits.egress
+	}
+	*limit += bytes
+
+	if err := n.rebuildQuota(entry, limits, entry.QuotaAction, true); err != nil {
+		return QuotaLimitChange{}, fmt.Errorf("failed to top up quota: %w", err)
+	}
+
+	return n.limitChange(entry)
 }
 
-// AddQuota adds a new quota rule
-func (n *NFTManager) AddQuota(port int, bytes int64, comment string) error {
+// limitChange reads a rebuilt quota back by port for its new ID and the limit
+// applied, against the limit of its entry before (requires lock to be held)
+func (n *NFTManager) limitChange(before *quotaEntry) (QuotaLimitChange, error) {
+	entries, err := n.loadQuotas()
+	if err != nil {
+		return QuotaLimitChange{}, err
+	}
+	for _, e := range entries {
+		if e.Port == before.Port {
+			return QuotaLimitChange{ID: e.ID, Port: e.Port, OldBytes: before.QuotaBytes, NewBytes: e.QuotaBytes}, nil
+		}
+	}
+	return QuotaLimitChange{}, fmt.Errorf("quota on port %d not found after rebuild", before.Port)
+}
+
+// rebuildQuota recreates a quota's local and forward chain rules with new
+// limits and action in one transaction (requires lock to be held)
+func (n *NFTManager) rebuildQuota(entry *quotaEntry, limits quotaLimits, action QuotaAction, keepUsage bool) error {
+	// nft can't change a quota in place, so recreate the rules with the
+	// current usage (used N bytes, counter ... bytes N) for local and forward chains
+	var local *quotaRules
+	var fwd forwardQuotas
+	if keepUsage {
+		local, fwd = &entry.local, entry.fwd
+	}
+
+	tx := &Transaction{}
+	queueDeleteQuotaRules(tx, n.tableFamily, n.tableName, entry.local, false)
+	n.queueQuotaRules(tx, entry.Port, limits, action, entry.Comment, local)
+
+	// Also recreate forward chain quota if exists
+	for key, r := range entry.fwd {
+		queueDeleteQuotaRules(tx, key.family, "filter", r, false)
+	}
+	n.addForwardQuotaIfNeeded(tx, entry.Port, limits, action, fwd)
+
+	return n.backend.Apply(tx)
+}
+
+// AddQuota adds a new quota on port. Direction is "egress" (default),
+// "ingress" or "both"; see newQuotaLimits for ingressBytes. An empty action drops
+// traffic over the limit.
+func (n *NFTManager) AddQuota(port int, direction string, bytes, ingressBytes int64, action QuotaAction, comment string) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
@@ -398,22 +960,37 @@ func (n *NFTManager) AddQuota(port int, bytes int64, comment string) error {
 	if port < 1 || port > 65535 {
 		return fmt.Errorf("invalid port: %d", port)
 	}
-	if bytes <= 0 {
-		return errors.New("quota limit must be positive")
+	limits, err := newQuotaLimits(direction, bytes, ingressBytes)
+	if err != nil {
+		return err
+	}
+	if action, err = action.normalize(); err != nil {
+		return err
 	}
 
 	// Sanitize comment
 	comment = sanitizeComment(comment)
 
-	// Add output chain rule (for local services)
-	if err := n.addQuotaRule(port, bytes, comment); err != nil {
-		return err
+	// Ensure filter table and the egress/ingress chains exist
+	if limits.egress > 0 || limits.shared > 0 {
+		if err := n.EnsureFilterOutputSetup(); err != nil {
+			return err
+		}
+	}
+	if limits.ingress > 0 || limits.shared > 0 {
+		if err := n.EnsureFilterIngressSetup(); err != nil {
+			return err
+		}
 	}
 
+	// Add local rules (for local services)
+	tx := &Transaction{}
+	n.queueQuotaRules(tx, port, limits, action, comment, nil)
+
 	// If port is forwarded, also add quota in forward chain
-	n.addForwardQuotaIfNeeded(port, bytes)
+	n.addForwardQuotaIfNeeded(tx, port, limits, action, nil)
 
-	return nil
+	return n.backend.Apply(tx)
 }
 
 // DeleteQuota deletes a quota rule
@@ -421,66 +998,95 @@ func (n *NFTManager) DeleteQuota(id string) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	rule, err := n.findRuleByID(id)
+	entry, err := n.findQuotaByID(id)
 	if err != nil {
 		return err
 	}
 
-	if err := n.deleteRuleByHandle(rule.Handle); err != nil {
-		return err
-	}
+	tx := &Transaction{}
+	queueDeleteQuotaRules(tx, n.tableFamily, n.tableName, entry.local, true)
 
 	// Also delete forward chain quota if exists
-	n.deleteForwardQuotaRule(rule.Port)
+	for key, r := range entry.fwd {
+		queueDeleteQuotaRules(tx, key.family, "filter", r, true)
+	}
+
+	if err := n.backend.Apply(tx); err != nil {
+		return err
+	}
 
+	if n.meta != nil {
+		if err := n.meta.Delete(entry.Port); err != nil {
+			return fmt.Errorf("quota deleted, but failed to remove its settings: %w", err)
+		}
+	}
 	return nil
 }
 
-// findRuleByID finds a rule by its ID (requires lock to be held)
-func (n *NFTManager) findRuleByID(id string) (*QuotaRule, error) {
-	// Get current rules (without lock since caller holds it)
-	output, err := n.execNFT("-j", "-a", "list", "chain", n.tableFamily, n.tableName, n.chainName)
+// SetQuotaThresholds overrides the status thresholds of a quota (zero values restore the defaults)
+func (n *NFTManager) SetQuotaThresholds(id string, t QuotaThresholds) error {
+	if t.WarningPercent != 0 || t.ExceededPercent != 0 {
+		if err := t.validate(); err != nil {
+			return err
+		}
+	}
+	if n.meta == nil {
+		return errors.New("quota settings are not available")
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	entry, err := n.findQuotaByID(id)
+	if err != nil {
+		return err
+	}
+	return n.meta.SetThresholds(entry.Port, t)
+}
+
+// GetQuota returns a single quota rule by its ID
+func (n *NFTManager) GetQuota(id string) (*QuotaRule, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	entry, err := n.findQuotaByID(id)
 	if err != nil {
 		return nil, err
 	}
+	return &entry.QuotaRule, nil
+}
 
-	rules, err := n.parseQuotaRules(output)
+// findQuotaByID finds a quota and its rules by ID (requires lock to be held)
+func (n *NFTManager) findQuotaByID(id string) (*quotaEntry, error) {
+	entries, err := n.loadQuotas()
 	if err != nil {
 		return nil, err
 	}
 
-	for _, rule := range rules {
-		if rule.ID == id {
-			return &rule, nil
+	for i := range entries {
+		if entries[i].ID == id {
+			return &entries[i], nil
 		}
 	}
 
 	return nil, fmt.Errorf("rule not found: %s", id)
 }
 
-// deleteRuleByHandle deletes a rule by its handle
-func (n *NFTManager) deleteRuleByHandle(handle int64) error {
-	_, err := n.execNFT("delete", "rule", n.tableFamily, n.tableName, n.chainName, "handle", strconv.FormatInt(handle, 10))
-	return err
-}
-
 // EnsureFilterOutputSetup ensures the filter table and output chain exist
 func (n *NFTManager) EnsureFilterOutputSetup() error {
 	// Check if table exists
-	_, err := n.execNFT("list", "table", n.tableFamily, n.tableName)
-	if err != nil {
+	if !n.backend.TableExists(n.tableFamily, n.tableName) {
 		// Create table
-		if _, err := n.execNFT("add", "table", n.tableFamily, n.tableName); err != nil {
+		if err := n.backend.AddTable(n.tableFamily, n.tableName); err != nil {
 			return fmt.Errorf("failed to create %s %s table: %w", n.tableFamily, n.tableName, err)
 		}
 	}
 
 	// Check if output chain exists
-	_, err = n.execNFT("list", "chain", n.tableFamily, n.tableName, n.chainName)
-	if err != nil {
+	if !n.backend.ChainExists(n.tableFamily, n.tableName, n.chainName) {
 		// Create output chain
-		if _, err := n.execNFT("add", "chain", n.tableFamily, n.tableName, n.chainName,
-			"{ type filter hook output priority filter ; policy accept ; }"); err != nil {
+		if err := n.backend.AddBaseChain(n.tableFamily, n.tableName, n.chainName,
+			ChainSpec{Type: "filter", Hook: "output", Priority: 0, Policy: "accept"}); err != nil {
 			return fmt.Errorf("failed to create %s chain: %w", n.chainName, err)
 		}
 	}
@@ -488,170 +1094,277 @@ func (n *NFTManager) EnsureFilterOutputSetup() error {
 	return nil
 }
 
-// addQuotaRule adds a new quota rule
-func (n *NFTManager) addQuotaRule(port int, bytes int64, comment string) error {
-	// Ensure filter table and output chain exist
-	if err := n.EnsureFilterOutputSetup(); err != nil {
-		return err
+// EnsureFilterIngressSetup ensures the filter table and the ingress quota chain exist.
+// The chain hooks input just before the input chain, so ingress quotas also
+// see traffic that allowed port rules accept.
+func (n *NFTManager) EnsureFilterIngressSetup() error {
+	// Check if table exists
+	if !n.backend.TableExists(n.tableFamily, n.tableName) {
+		// Create table
+		if err := n.backend.AddTable(n.tableFamily, n.tableName); err != nil {
+			return fmt.Errorf("failed to create %s %s table: %w", n.tableFamily, n.tableName, err)
+		}
 	}
 
-	// Convert bytes to mbytes for cleaner command
-	mbytes := bytes / (1000 * 1000)
-	if mbytes < 1 {
-		mbytes = 1
+	// Check if ingress chain exists
+	if !n.backend.ChainExists(n.tableFamily, n.tableName, n.ingressChain) {
+		// Create ingress chain
+		if err := n.backend.AddBaseChain(n.tableFamily, n.tableName, n.ingressChain,
+			ChainSpec{Type: "filter", Hook: "input", Priority: -1, Policy: "accept"}); err != nil {
+			return fmt.Errorf("failed to create %s chain: %w", n.ingressChain, err)
+		}
 	}
 
-	// Build the nft command
-	// nft add rule inet filter output meta l4proto { tcp, udp } th sport <port> quota over <limit> mbytes drop comment "<comment>"
-	args := []string{
-		"add", "rule", n.tableFamily, n.tableName, n.chainName,
-		"meta", "l4proto", "{", "tcp,", "udp", "}",
-		"th", "sport", strconv.Itoa(port),
-		"quota", "over", strconv.FormatInt(mbytes, 10), "mbytes",
-		"drop",
+	return nil
+}
+
+// quotaTarget describes where the rules of a quota are written and what they match
+type quotaTarget struct {
+	family, table  string
+	egressChain    string
+	ingressChain   string
+	egressMatch    []string // traffic sent from the port
+	ingressMatch   []string // traffic received on the port
+	egressComment  string
+	ingressComment string
+	sharedChain    string
+}
+
+// queueQuota queues the rules of a quota: an inline quota for each limited
+// direction, or a counter for each direction jumping to a chain that holds the
+// shared limit. Usage starts from the rules in prev (nil starts at zero).
+func queueQuota(tx *Transaction, t quotaTarget, limits quotaLimits, action QuotaAction, prev *quotaRules) {
+	var p quotaRules
+	if prev != nil {
+		p = *prev
+	}
+
+	if limits.shared > 0 {
+		tx.AddChain(t.family, t.table, t.sharedChain)
+		tx.AddRule(t.family, t.table, t.sharedChain,
+			ruleArgs(t.egressComment, quotaArgs(limits.shared, p.shared.used()), action.args())...)
+		tx.AddRule(t.family, t.table, t.egressChain,
+			ruleArgs(t.egressComment, t.egressMatch, counterArgs(p.egress.used()), []string{"jump", t.sharedChain})...)
+		tx.AddRule(t.family, t.table, t.ingressChain,
+			ruleArgs(t.ingressComment, t.ingressMatch, counterArgs(p.ingress.used()), []string{"jump", t.sharedChain})...)
+		return
 	}
 
+	if limits.egress > 0 {
+		tx.AddRule(t.family, t.table, t.egressChain,
+			ruleArgs(t.egressComment, t.egressMatch, quotaArgs(limits.egress, p.egress.used()), action.args())...)
+	}
+	if limits.ingress > 0 {
+		tx.AddRule(t.family, t.table, t.ingressChain,
+			ruleArgs(t.ingressComment, t.ingressMatch, quotaArgs(limits.ingress, p.ingress.used()), action.args())...)
+	}
+}
+
+// queueDeleteQuotaRules queues deleting the rules of a quota. The shared chain
+// is only deleted with dropChain, so it can be refilled in the same transaction.
+func queueDeleteQuotaRules(tx *Transaction, family, table string, r quotaRules, dropChain bool) {
+	for _, p := range []*quotaPart{r.egress, r.ingress, r.shared} {
+		if p != nil {
+			tx.DeleteRule(family, table, p.chain, p.handle)
+		}
+	}
+	if target := r.jumpTarget(); target != "" && dropChain {
+		tx.DeleteChain(family, table, target)
+	}
+}
+
+// ruleArgs joins rule statements and appends the comment, if any
+func ruleArgs(comment string, statements ...[]string) []string {
+	var args []string
+	for _, s := range statements {
+		args = append(args, s...)
+	}
 	if comment != "" {
 		args = append(args, "comment", fmt.Sprintf(`"%s"`, comment))
 	}
+	return args
+}
 
-	_, err := n.execNFT(args...)
-	return err
+// queueQuotaRules queues the local rules of a quota, starting at the usage in prev
+func (n *NFTManager) queueQuotaRules(tx *Transaction, port int, limits quotaLimits, action QuotaAction, comment string, prev *quotaRules) {
+	// Build the rules
+	// nft add rule inet filter output meta l4proto { tcp, udp } th sport <port> quota over <limit> bytes [used <n> bytes] drop comment "<comment>"
+	// nft add rule inet filter input_quota meta l4proto { tcp, udp } th dport <port> quota over <limit> bytes [used <n> bytes] drop comment "<comment>"
+	// A shared limit moves the quota to chain nftui_quota_<port>, which both rules "counter jump" to.
+	// Other actions replace drop: reject, "limit rate over <n> bytes/second drop" or "meta mark set <n>"
+	l4 := []string{"meta", "l4proto", "{", "tcp,", "udp", "}", "th"}
+	queueQuota(tx, quotaTarget{
+		family:         n.tableFamily,
+		table:          n.tableName,
+		egressChain:    n.chainName,
+		ingressChain:   n.ingressChain,
+		egressMatch:    ruleArgs("", l4, []string{"sport", strconv.Itoa(port)}),
+		ingressMatch:   ruleArgs("", l4, []string{"dport", strconv.Itoa(port)}),
+		egressComment:  comment,
+		ingressComment: comment,
+		sharedChain:    sharedQuotaChain(port),
+	}, limits, action, prev)
 }
 
-// addForwardQuotaIfNeeded checks if a port has a forwarding rule and adds a quota in the forward chain
-func (n *NFTManager) addForwardQuotaIfNeeded(port int, bytes int64) {
+// addForwardQuotaIfNeeded checks if a port has forwarding rules and adds a quota
+// in the forward chain of each destination family of each of them, starting
+// at the usage in prev
+func (n *NFTManager) addForwardQuotaIfNeeded(tx *Transaction, port int, limits quotaLimits, action QuotaAction, prev forwardQuotas) {
 	if n.fwd == nil {
 		return
 	}
 
-	// Look up forwarding rule for this port
-	fwdRule := n.findForwardingRuleForPort(port)
-	if fwdRule == nil {
-		return
+	// Forwards bound to different interfaces or addresses may share the port
+	for _, fwdRule := range n.findForwardingRulesForPort(port) {
+		n.queueForwardQuota(tx, fwdRule, port, limits, action, prev)
 	}
-
-	// Add quota rule in ip filter forward chain
-	// Match backend→client traffic: ip saddr <dstIP> th sport <dstPort>
-	n.addForwardQuotaRule(port, fwdRule.DstIP, fwdRule.DstPort, fwdRule.Protocol, bytes)
 }
 
-// findForwardingRuleForPort looks up a forwarding rule by source port (without locking fwd)
-func (n *NFTManager) findForwardingRuleForPort(port int) *ForwardingRule {
-	if n.fwd == nil {
-		return nil
-	}
+// queueForwardQuota queues the quota rules of a port in the forward chain of
+// each destination family of a forward, starting at the usage in prev
+func (n *NFTManager) queueForwardQuota(tx *Transaction, fwdRule ForwardingRule, port int, limits quotaLimits, action QuotaAction, prev forwardQuotas) {
+	ref := forwardRef{port: port, bind: fwdRule.binding()}
+	for _, dstIP := range fwdRule.destinations() {
+		family := ipFamily(dstIP)
 
-	// We need to read forwarding rules directly from nftables to avoid lock contention
-	// since NFTManager.mu is already held
-	preOutput, err := n.fwd.execNFT("-j", "-a", "list", "chain", "ip", "nat", "prerouting")
-	if err != nil {
-		return nil
-	}
-	postOutput, err := n.fwd.execNFT("-j", "-a", "list", "chain", "ip", "nat", "postrouting")
-	if err != nil {
-		postOutput = []byte(`{"nftables":[]}`)
+		// Ensure filter forward chain exists
+		n.fwd.EnsureFilterForwardSetup(family)
+
+		var familyPrev *quotaRules
+		if r, ok := prev[forwardQuotaKey{family: family, bind: ref.bind}]; ok {
+			familyPrev = &r
+		}
+
+		// Add quota rules in the family's filter forward chain; a port of a
+		// forwarded range keeps its number at the destination
+		dstPort := fwdRule.DstPort + port - fwdRule.SrcPort
+		n.addForwardQuotaRules(tx, family, ref, fwdRule.backendsFor(dstIP), dstPort, fwdRule.Protocol, limits, action, familyPrev)
 	}
+}
 
-	rules, err := n.fwd.parseForwardingRules(preOutput, postOutput)
+// queueForwardQuotaRebuild queues the forward chain quota rules of the ports
+// of a forward again, matching its new destinations and keeping their usage.
+// It is queued in the transaction that replaces the forward's rules; the
+// rules of other forwards bound to the same ports are left alone.
+func (n *NFTManager) queueForwardQuotaRebuild(tx *Transaction, rule ForwardingRule) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	entries, err := n.loadQuotas()
 	if err != nil {
-		return nil
+		return err
 	}
 
-	for _, r := range rules {
-		if r.SrcPort == port && r.Enabled {
-			return &r
+	seen := make(map[int]bool)
+	for _, e := range entries {
+		if e.Port < rule.SrcPort || e.Port > rule.lastSrcPort() || seen[e.Port] {
+			continue
 		}
+		seen[e.Port] = true
+
+		for key, r := range e.fwd {
+			if key.bind == rule.binding() {
+				queueDeleteQuotaRules(tx, key.family, "filter", r, false)
+			}
+		}
+		n.queueForwardQuota(tx, rule, e.Port, e.local.limits(), e.local.action(), e.fwd)
 	}
 	return nil
 }
 
-// addForwardQuotaRule adds a quota rule in the ip filter forward chain
-func (n *NFTManager) addForwardQuotaRule(srcPort int, dstIP string, dstPort int, protocol string, bytes int64) error {
-	// Ensure filter forward chain exists
-	if n.fwd != nil {
-		n.fwd.EnsureFilterForwardSetup()
+// findForwardingRulesForPort looks up the enabled forwarding rules whose
+// source ports include port, one per binding (without locking fwd)
+func (n *NFTManager) findForwardingRulesForPort(port int) []ForwardingRule {
+	if n.fwd == nil {
+		return nil
 	}
 
-	mbytes := bytes / (1000 * 1000)
-	if mbytes < 1 {
-		mbytes = 1
+	// We need to read forwarding rules directly from nftables to avoid lock contention
+	// since NFTManager.mu is already held
+	rules, err := n.fwd.readEnabledRules()
+	if err != nil {
+		return nil
 	}
 
-	comment := fmt.Sprintf("%s %d", ForwardQuotaComment, srcPort)
-
-	// Match backend→client (download) traffic
-	var args []string
-	switch protocol {
-	case "tcp":
-		args = []string{
-			"add", "rule", "ip", "filter", "forward",
-			"ip", "saddr", dstIP,
-			"tcp", "sport", strconv.Itoa(dstPort),
-			"quota", "over", strconv.FormatInt(mbytes, 10), "mbytes",
-			"drop",
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
-	case "udp":
-		args = []string{
-			"add", "rule", "ip", "filter", "forward",
-			"ip", "saddr", dstIP,
-			"udp", "sport", strconv.Itoa(dstPort),
-			"quota", "over", strconv.FormatInt(mbytes, 10), "mbytes",
-			"drop",
-			"comment", fmt.Sprintf(`"%s"`, comment),
-		}
-	default: // "both"
-		args = []string{
-			"add", "rule", "ip", "filter", "forward",
-			"ip", "saddr", dstIP,
-			"meta", "l4proto", "{", "tcp,", "udp", "}",
-			"th", "sport", strconv.Itoa(dstPort),
-			"quota", "over", strconv.FormatInt(mbytes, 10), "mbytes",
-			"drop",
-			"comment", fmt.Sprintf(`"%s"`, comment),
+	var found []ForwardingRule
+	for _, r := range rules {
+		if r.Enabled && port >= r.SrcPort && port <= r.lastSrcPort() {
+			found = append(found, r)
 		}
 	}
+	return found
+}
 
-	_, err := n.execNFT(args...)
-	return err
+// addForwardQuotaRules adds quota rules in the ip or ip6 filter forward chain,
+// counting the traffic of every backend address of the forward
+func (n *NFTManager) addForwardQuotaRules(tx *Transaction, family string, ref forwardRef, addrs []string, dstPort int, protocol string, limits quotaLimits, action QuotaAction, prev *quotaRules) {
+	var l4 []string
+	switch protocol {
+	case "tcp", "udp":
+		l4 = []string{protocol}
+	default: // "both"
+		l4 = []string{"meta", "l4proto", "{", "tcp,", "udp", "}", "th"}
+	}
+
+	// Egress is backend→client (download) traffic, ingress is client→backend traffic
+	queueQuota(tx, quotaTarget{
+		family:         family,
+		table:          "filter",
+		egressChain:    "forward",
+		ingressChain:   "forward",
+		egressMatch:    ruleArgs("", addrMatch(family, "saddr", addrs), l4, []string{"sport", strconv.Itoa(dstPort)}),
+		ingressMatch:   ruleArgs("", addrMatch(family, "daddr", addrs), l4, []string{"dport", strconv.Itoa(dstPort)}),
+		egressComment:  forwardQuotaComment(ref, DirectionEgress),
+		ingressComment: forwardQuotaComment(ref, DirectionIngress),
+		sharedChain:    forwardSharedQuotaChain(ref),
+	}, limits, action, prev)
 }
 
-// deleteForwardQuotaRule deletes forward chain quota rules for a given source port
-func (n *NFTManager) deleteForwardQuotaRule(srcPort int) error {
-	output, err := n.execNFT("-j", "-a", "list", "chain", "ip", "filter", "forward")
-	if err != nil {
-		return nil // chain might not exist
+// addrMatch builds an "ip saddr 10.0.0.2" match, or "ip saddr { 10.0.0.2, 10.0.0.3 }" for several addresses
+func addrMatch(family, field string, addrs []string) []string {
+	if len(addrs) == 1 {
+		return []string{family, field, addrs[0]}
 	}
+	args := []string{family, field, "{"}
+	for i, addr := range addrs {
+		if i < len(addrs)-1 {
+			addr += ","
+		}
+		args = append(args, addr)
+	}
+	return append(args, "}")
+}
 
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(output, &ruleset); err != nil {
-		return err
+// quotaArgs builds the "quota over <n> bytes [used <n> bytes]" statement. The
+// limit is exact: nft's larger units are 1024-based and would round it.
+func quotaArgs(bytes, used int64) []string {
+	args := []string{"quota", "over", strconv.FormatInt(bytes, 10), "bytes"}
+	if used > 0 {
+		args = append(args, "used", strconv.FormatInt(used, 10), "bytes")
 	}
+	return args
+}
 
-	comment := fmt.Sprintf("%s %d", ForwardQuotaComment, srcPort)
-	for _, obj := range ruleset.NFTables {
-		if obj.Rule == nil || obj.Rule.Chain != "forward" {
-			continue
-		}
-		if obj.Rule.Comment == comment {
-			n.execNFT("delete", "rule", "ip", "filter", "forward", "handle", strconv.FormatInt(obj.Rule.Handle, 10))
-		}
+// counterArgs builds the "counter [packets 0 bytes <n>]" statement, starting at used bytes
+func counterArgs(used int64) []string {
+	if used > 0 {
+		return []string{"counter", "packets", "0", "bytes", strconv.FormatInt(used, 10)}
 	}
-	return nil
+	return []string{"counter"}
 }
 
-// convertToBytes converts a value with unit to bytes
+// convertToBytes converts a value with an nft byte unit to bytes; like the
+// limit units, nft's kbytes, mbytes and gbytes are 1024-based
 func convertToBytes(val int64, unit string) int64 {
 	switch unit {
 	case "kbytes":
-		return val * 1000
+		return val << 10
 	case "mbytes":
-		return val * 1000 * 1000
+		return val << 20
 	case "gbytes":
-		return val * 1000 * 1000 * 1000
+		return val << 30
 	case "tbytes":
-		return val * 1000 * 1000 * 1000 * 1000
+		return val << 40
 	default:
 		// "bytes" or empty string means already in bytes
 		return val
@@ -675,29 +1388,31 @@ func (n *NFTManager) ListAllowedPorts() ([]AllowedPort, error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	// Get JSON output from input chain
-	output, err := n.execNFT("-j", "-a", "list", "chain", n.tableFamily, n.tableName, "input")
+	// Get rules from input chain
+	ruleset, err := n.backend.ListChain(n.tableFamily, n.tableName, "input")
 	if err != nil {
 		// If chain doesn't exist, return empty list instead of error
-		if strings.Contains(err.Error(), "No such file or directory") ||
-			strings.Contains(err.Error(), "does not exist") {
+		if isNotFoundErr(err) {
 			return []AllowedPort{}, nil
 		}
 		return nil, err
 	}
 
-	return n.parseAllowedPorts(output)
+	return n.parseAllowedPorts(ruleset), nil
 }
 
-// parseAllowedPorts extracts allowed ports from nft JSON output
-func (n *NFTManager) parseAllowedPorts(data []byte) ([]AllowedPort, error) {
-	var ruleset NFTRuleset
-	if err := json.Unmarshal(data, &ruleset); err != nil {
-		return nil, fmt.Errorf("failed to parse nft JSON: %w", err)
+// parseAllowedPorts extracts allowed ports from an input chain listing. Every
+// port or range of a rule is an entry of its own; a port open for TCP and UDP
+// in separate rules is listed once per rule. The per-family rules of a port
+// restricted to some sources are merged into one entry.
+func (n *NFTManager) parseAllowedPorts(ruleset *NFTRuleset) []AllowedPort {
+	type portKey struct {
+		port, end  int
+		protocol   string
+		restricted bool
 	}
-
 	var ports []AllowedPort
-	seen := make(map[int]bool)
+	seen := make(map[portKey]int)
 
 	for _, obj := range ruleset.NFTables {
 		if obj.Rule == nil {
@@ -705,8 +1420,8 @@ func (n *NFTManager) parseAllowedPorts(data []byte) ([]AllowedPort, error) {
 		}
 
 		rule := obj.Rule
-		if rule.Chain != "input" {
-			continue
+		if rule.Chain != "input" || rule.Comment == BaselineComment {
+			continue // the baseline's listen port rules aren't allowed ports
 		}
 
 		// Check if this rule has an accept verdict
@@ -721,7 +1436,11 @@ func (n *NFTManager) parseAllowedPorts(data []byte) ([]AllowedPort, error) {
 			continue
 		}
 
-		// Look for tcp/udp dport matches
+		// Look for tcp/udp/th dport matches, th takes its protocols from a meta l4proto match
+		l4proto := "both"
+		var extracted []AllowedPort
+		var sources, sets []string
+		restricted := false
 		for _, expr := range rule.Expr {
 			matchData, ok := expr["match"]
 			if !ok {
@@ -733,26 +1452,127 @@ func (n *NFTManager) parseAllowedPorts(data []byte) ([]AllowedPort, error) {
 				continue
 			}
 
-			extractedPorts := n.extractDPorts(mm)
-			for _, port := range extractedPorts {
-				if !seen[port] {
-					seen[port] = true
-					ports = append(ports, AllowedPort{
-						Port:    port,
-						Handle:  rule.Handle,
-						Managed: rule.Comment == ManagedComment,
-						Comment: rule.Comment,
-					})
+			if proto, ok := extractL4Proto(mm); ok {
+				l4proto = proto
+				continue
+			}
+			if srcs, set, ok := n.extractSources(mm); ok {
+				restricted = true
+				sources = append(sources, srcs...)
+				if strings.HasPrefix(set, "port_src") {
+					sets = append(sets, set) // only nft-ui's own sets are updated and deleted
+				}
+				continue
+			}
+			extracted = append(extracted, n.extractDPorts(mm)...)
+		}
+
+		for _, p := range extracted {
+			if p.Protocol == "th" {
+				p.Protocol = l4proto
+			}
+			key := portKey{port: p.Port, end: p.PortEnd, protocol: p.Protocol, restricted: restricted}
+			if i, ok := seen[key]; ok {
+				if restricted {
+					// Another family's rule of the same port
+					ports[i].Sources = append(ports[i].Sources, sources...)
+					ports[i].handles = append(ports[i].handles, rule.Handle)
+					ports[i].sets = append(ports[i].sets, sets...)
+					if rule.Handle < ports[i].Handle {
+						ports[i].Handle = rule.Handle
+					}
 				}
+				continue
+			}
+			seen[key] = len(ports)
+			p.Sources = append([]string(nil), sources...)
+			p.Handle = rule.Handle
+			p.Managed = rule.Comment == ManagedComment
+			p.Comment = rule.Comment
+			p.handles = []int64{rule.Handle}
+			p.sets = append([]string(nil), sets...)
+			ports = append(ports, p)
+		}
+	}
+
+	return ports
+}
+
+// extractSources returns the client addresses a source match (ip saddr ...)
+// allows, read from the named set it refers to if any
+func (n *NFTManager) extractSources(match map[string]interface{}) ([]string, string, bool) {
+	left, ok := match["left"].(map[string]interface{})
+	if !ok {
+		return nil, "", false
+	}
+	payload, ok := left["payload"].(map[string]interface{})
+	if !ok || payload["field"] != "saddr" {
+		return nil, "", false
+	}
+
+	var sources []string
+	add := func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			sources = append(sources, v)
+		case map[string]interface{}:
+			// {"prefix": {"addr": "10.0.0.0", "len": 8}}
+			if prefix, ok := v["prefix"].(map[string]interface{}); ok {
+				addr, _ := prefix["addr"].(string)
+				length, _ := prefix["len"].(float64)
+				sources = append(sources, fmt.Sprintf("%s/%d", addr, int(length)))
+			}
+		}
+	}
+
+	switch right := match["right"].(type) {
+	case string:
+		if strings.HasPrefix(right, "@") {
+			set := strings.TrimPrefix(right, "@")
+			elements, _ := n.backend.ListSetElements(n.tableFamily, n.tableName, set)
+			return elements, set, true
+		}
+		add(right)
+	case map[string]interface{}:
+		if set, ok := right["set"].([]interface{}); ok {
+			for _, v := range set {
+				add(v)
 			}
+		} else {
+			add(right)
 		}
 	}
+	return sources, "", true
+}
+
+// extractL4Proto returns the protocol a "meta l4proto" match selects: "tcp", "udp",
+// or "both" for a set of the two
+func extractL4Proto(match map[string]interface{}) (string, bool) {
+	left, ok := match["left"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	meta, ok := left["meta"].(map[string]interface{})
+	if !ok || meta["key"] != "l4proto" {
+		return "", false
+	}
 
-	return ports, nil
+	switch right := match["right"].(type) {
+	case string:
+		return right, true
+	case map[string]interface{}:
+		if set, ok := right["set"].([]interface{}); ok && len(set) == 1 {
+			if proto, ok := set[0].(string); ok {
+				return proto, true
+			}
+		}
+	}
+	return "both", true
 }
 
-// extractDPorts extracts destination ports from a match expression
-func (n *NFTManager) extractDPorts(match map[string]interface{}) []int {
+// extractDPorts extracts destination ports and ranges from a match expression,
+// with the protocol of the match ("tcp", "udp" or "th")
+func (n *NFTManager) extractDPorts(match map[string]interface{}) []AllowedPort {
 	left, ok := match["left"].(map[string]interface{})
 	if !ok {
 		return nil
@@ -768,61 +1588,88 @@ func (n *NFTManager) extractDPorts(match map[string]interface{}) []int {
 	if field != "dport" {
 		return nil
 	}
+	protocol, _ := payload["protocol"].(string)
 
-	// Get the right side (port number or set of ports)
+	// Get the right side (port number, range, or set of them)
 	right := match["right"]
 	if right == nil {
 		return nil
 	}
 
-	var ports []int
-
-	// Single port
-	if port, ok := right.(float64); ok {
-		ports = append(ports, int(port))
-		return ports
-	}
-
-	// Set of ports: {"set": [22, 80, 443]}
-	if rightMap, ok := right.(map[string]interface{}); ok {
-		if set, ok := rightMap["set"].([]interface{}); ok {
-			for _, p := range set {
-				if port, ok := p.(float64); ok {
-					ports = append(ports, int(port))
-				}
+	var ports []AllowedPort
+	add := func(v interface{}) {
+		switch v := v.(type) {
+		case float64:
+			// Single port
+			ports = append(ports, AllowedPort{Port: int(v), Protocol: protocol})
+		case map[string]interface{}:
+			// Range: {"range": [30000, 30100]}
+			if first, last, ok := rangeBounds(v); ok {
+				ports = append(ports, AllowedPort{Port: first, PortEnd: last, Protocol: protocol})
 			}
 		}
 	}
 
-	// Direct array of ports
-	if set, ok := right.([]interface{}); ok {
-		for _, p := range set {
-			if port, ok := p.(float64); ok {
-				ports = append(ports, int(port))
+	switch right := right.(type) {
+	case map[string]interface{}:
+		// Set of ports: {"set": [22, 80, 443]}
+		if set, ok := right["set"].([]interface{}); ok {
+			for _, p := range set {
+				add(p)
 			}
+		} else {
+			add(right)
 		}
+	case []interface{}:
+		// Direct array of ports
+		for _, p := range right {
+			add(p)
+		}
+	default:
+		add(right)
 	}
 
 	return ports
 }
 
+// ports returns the port or port range of an allowed port in nft syntax
+func (p AllowedPort) ports() string {
+	if p.PortEnd > 0 {
+		return fmt.Sprintf("%d-%d", p.Port, p.PortEnd)
+	}
+	return strconv.Itoa(p.Port)
+}
+
+// overlaps reports whether two allowed ports open some of the same ports for the same protocol
+func (p AllowedPort) overlaps(o AllowedPort) bool {
+	if p.Protocol != o.Protocol && p.Protocol != "both" && o.Protocol != "both" {
+		return false
+	}
+	last, otherLast := p.Port, o.Port
+	if p.PortEnd > 0 {
+		last = p.PortEnd
+	}
+	if o.PortEnd > 0 {
+		otherLast = o.PortEnd
+	}
+	return p.Port <= otherLast && o.Port <= last
+}
+
 // EnsureFilterInputSetup ensures the filter table and input chain exist
 func (n *NFTManager) EnsureFilterInputSetup() error {
 	// Check if table exists
-	_, err := n.execNFT("list", "table", n.tableFamily, n.tableName)
-	if err != nil {
+	if !n.backend.TableExists(n.tableFamily, n.tableName) {
 		// Create table
-		if _, err := n.execNFT("add", "table", n.tableFamily, n.tableName); err != nil {
+		if err := n.backend.AddTable(n.tableFamily, n.tableName); err != nil {
 			return fmt.Errorf("failed to create %s %s table: %w", n.tableFamily, n.tableName, err)
 		}
 	}
 
 	// Check if input chain exists
-	_, err = n.execNFT("list", "chain", n.tableFamily, n.tableName, "input")
-	if err != nil {
+	if !n.backend.ChainExists(n.tableFamily, n.tableName, "input") {
 		// Create input chain
-		if _, err := n.execNFT("add", "chain", n.tableFamily, n.tableName, "input",
-			"{ type filter hook input priority filter ; policy accept ; }"); err != nil {
+		if err := n.backend.AddBaseChain(n.tableFamily, n.tableName, "input",
+			ChainSpec{Type: "filter", Hook: "input", Priority: 0, Policy: "accept"}); err != nil {
 			return fmt.Errorf("failed to create input chain: %w", err)
 		}
 	}
@@ -830,68 +1677,229 @@ func (n *NFTManager) EnsureFilterInputSetup() error {
 	return nil
 }
 
-// AddAllowedPort adds a new allowed inbound port rule
-func (n *NFTManager) AddAllowedPort(port int) error {
+// AddAllowedPort adds a new allowed inbound port or port range rule for tcp, udp
+// or both, open to everyone or only to the port's allowed sources
+func (n *NFTManager) AddAllowedPort(port AllowedPort) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
 	// Validate port
-	if port < 1 || port > 65535 {
-		return fmt.Errorf("invalid port: %d", port)
+	if port.Port < 1 || port.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", port.Port)
+	}
+	if port.PortEnd != 0 && (port.PortEnd <= port.Port || port.PortEnd > 65535) {
+		return fmt.Errorf("invalid port range: %d-%d", port.Port, port.PortEnd)
+	}
+	if port.Protocol == "" {
+		port.Protocol = "tcp"
 	}
+	if port.Protocol != "tcp" && port.Protocol != "udp" && port.Protocol != "both" {
+		return fmt.Errorf("invalid protocol: %s", port.Protocol)
+	}
+	sources, err := n.normalizePortSources(port.Sources)
+	if err != nil {
+		return err
+	}
+	port.Sources = sources
 
 	// Ensure filter table and input chain exist
 	if err := n.EnsureFilterInputSetup(); err != nil {
 		return err
 	}
 
+	// Reject ports that are already open
+	ruleset, err := n.backend.ListChain(n.tableFamily, n.tableName, "input")
+	if err != nil {
+		return err
+	}
+	for _, p := range n.parseAllowedPorts(ruleset) {
+		if p.overlaps(port) {
+			return fmt.Errorf("port %s/%s is already allowed", p.ports(), p.Protocol)
+		}
+	}
+
 	// nft insert rule inet filter input tcp dport <port> accept comment "nft-ui managed"
-	args := []string{
-		"insert", "rule", n.tableFamily, n.tableName, "input",
-		"tcp", "dport", strconv.Itoa(port),
-		"accept",
-		"comment", fmt.Sprintf(`"%s"`, ManagedComment),
+	tx := &Transaction{}
+	if len(port.Sources) == 0 {
+		tx.InsertRule(n.tableFamily, n.tableName, "input", n.allowedPortRule(port, "")...)
+		return n.backend.Apply(tx)
+	}
+
+	// A rule per family matches clients against the family's set, even an empty
+	// one, so the sources can later change without touching the rules
+	families := n.inputFamilies()
+	for i := len(families) - 1; i >= 0; i-- {
+		n.queuePortSourceSet(tx, port, families[i])
+		tx.InsertRule(n.tableFamily, n.tableName, "input", n.allowedPortRule(port, families[i])...)
+	}
+	return n.backend.Apply(tx)
+}
+
+// SetAllowedPortSources replaces the sources allowed to connect to a managed
+// port. The port keeps its handle: the sets of a restricted port are updated in
+// place, and when the port becomes restricted or open to everyone, its rule is
+// replaced rather than deleted.
+func (n *NFTManager) SetAllowedPortSources(handle int64, sources []string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	sources, err := n.normalizePortSources(sources)
+	if err != nil {
+		return err
+	}
+
+	port, err := n.findManagedPort(handle)
+	if err != nil {
+		return err
+	}
+	port.Sources = sources
+
+	tx := &Transaction{}
+	families := n.inputFamilies()
+	switch {
+	case len(port.sets) > 0 && len(sources) > 0:
+		for _, family := range families {
+			n.queuePortSourceSet(tx, port, family)
+		}
+
+	case len(port.sets) > 0:
+		// Open to everyone again: one rule without sets is left
+		tx.ReplaceRule(n.tableFamily, n.tableName, "input", handle, n.allowedPortRule(port, "")...)
+		for _, h := range port.handles {
+			if h != handle {
+				tx.DeleteRule(n.tableFamily, n.tableName, "input", h)
+			}
+		}
+		for _, set := range port.sets {
+			tx.DeleteSet(n.tableFamily, n.tableName, set)
+		}
+
+	case len(sources) > 0:
+		// Restricted from now on: the rule becomes the first family's, the others are added
+		for i, family := range families {
+			n.queuePortSourceSet(tx, port, family)
+			if i == 0 {
+				tx.ReplaceRule(n.tableFamily, n.tableName, "input", handle, n.allowedPortRule(port, family)...)
+			} else {
+				tx.InsertRule(n.tableFamily, n.tableName, "input", n.allowedPortRule(port, family)...)
+			}
+		}
+
+	default:
+		return nil // open to everyone already
 	}
 
-	_, err := n.execNFT(args...)
-	return err
+	if err := n.backend.Apply(tx); err != nil {
+		return fmt.Errorf("failed to update allowed sources: %w", err)
+	}
+	return nil
 }
 
-// DeleteAllowedPort deletes an allowed inbound port rule by handle
+// DeleteAllowedPort deletes an allowed inbound port by handle, with every
+// rule and set of a source-restricted port
 func (n *NFTManager) DeleteAllowedPort(handle int64) error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
 	// First verify the rule exists and has the managed comment
-	output, err := n.execNFT("-j", "-a", "list", "chain", n.tableFamily, n.tableName, "input")
+	port, err := n.findManagedPort(handle)
 	if err != nil {
 		return err
 	}
 
-	ports, err := n.parseAllowedPorts(output)
+	// Delete the rules, then the sets they referred to
+	tx := &Transaction{}
+	for _, h := range port.handles {
+		tx.DeleteRule(n.tableFamily, n.tableName, "input", h)
+	}
+	for _, set := range port.sets {
+		tx.DeleteSet(n.tableFamily, n.tableName, set)
+	}
+	return n.backend.Apply(tx)
+}
+
+// GetAllowedPort returns the managed allowed port with handle
+func (n *NFTManager) GetAllowedPort(handle int64) (AllowedPort, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.findManagedPort(handle)
+}
+
+// findManagedPort returns the allowed port with handle, which must be managed by nft-ui
+func (n *NFTManager) findManagedPort(handle int64) (AllowedPort, error) {
+	ruleset, err := n.backend.ListChain(n.tableFamily, n.tableName, "input")
 	if err != nil {
-		return err
+		return AllowedPort{}, err
 	}
 
 	// Find the port with this handle and verify it's managed
-	var found bool
-	for _, p := range ports {
+	for _, p := range n.parseAllowedPorts(ruleset) {
 		if p.Handle == handle {
 			if !p.Managed {
-				return errors.New("cannot delete: rule is not managed by nft-ui")
+				return AllowedPort{}, errors.New("cannot modify: rule is not managed by nft-ui")
 			}
-			found = true
-			break
+			return p, nil
 		}
 	}
+	return AllowedPort{}, fmt.Errorf("rule not found: handle %d", handle)
+}
 
-	if !found {
-		return fmt.Errorf("rule not found: handle %d", handle)
+// inputFamilies returns the address families the input chain's table sees
+func (n *NFTManager) inputFamilies() []string {
+	if n.tableFamily == "ip" || n.tableFamily == "ip6" {
+		return []string{n.tableFamily}
 	}
+	return []string{"ip", "ip6"}
+}
+
+// normalizePortSources validates the sources of an allowed port against the
+// families of the input chain's table
+func (n *NFTManager) normalizePortSources(sources []string) ([]string, error) {
+	families := n.inputFamilies()
+	return normalizeSourceList(sources, func(src, family string) error {
+		for _, f := range families {
+			if f == family {
+				return nil
+			}
+		}
+		return fmt.Errorf("allowed source %s doesn't match the %s %s table", src, n.tableFamily, n.tableName)
+	})
+}
 
-	// Delete the rule
-	_, err = n.execNFT("delete", "rule", n.tableFamily, n.tableName, "input", "handle", strconv.FormatInt(handle, 10))
-	return err
+// allowedPortRule builds the rule that accepts a port, behind a match of the
+// family's source set if family is set
+func (n *NFTManager) allowedPortRule(port AllowedPort, family string) []string {
+	var args []string
+	if family != "" {
+		args = []string{family, "saddr", "@" + portSourceSetName(port, family)}
+	}
+	args = append(args, l4Match(port.Protocol)...)
+	return append(args, "dport", port.ports(),
+		"accept",
+		"comment", fmt.Sprintf(`"%s"`, ManagedComment))
+}
+
+// queuePortSourceSet creates or replaces the elements of an allowed port's source set of a family
+func (n *NFTManager) queuePortSourceSet(tx *Transaction, port AllowedPort, family string) {
+	keyType := "ipv4_addr"
+	if family == "ip6" {
+		keyType = "ipv6_addr"
+	}
+	set := portSourceSetName(port, family)
+	tx.AddIntervalSet(n.tableFamily, n.tableName, set, keyType)
+	tx.FlushSet(n.tableFamily, n.tableName, set)
+	tx.AddElements(n.tableFamily, n.tableName, set, sourcesOfFamily(port.Sources, family)...)
+}
+
+// portSourceSetName returns the name of the set holding an allowed port's
+// sources of a family, e.g. "port_src_22_tcp" or "port_src6_30000_30100_udp"
+func portSourceSetName(port AllowedPort, family string) string {
+	prefix := "port_src"
+	if family == "ip6" {
+		prefix = "port_src6"
+	}
+	return fmt.Sprintf("%s_%s_%s", prefix, strings.Replace(port.ports(), "-", "_", 1), port.Protocol)
 }
 
 // GetRawRuleset returns the raw output of 'nft list ruleset'
@@ -899,7 +1907,7 @@ func (n *NFTManager) GetRawRuleset() (string, error) {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 
-	output, err := n.execNFT("list", "ruleset")
+	output, err := n.backend.ListRuleset()
 	if err != nil {
 		return "", err
 	}
@@ -909,7 +1917,7 @@ func (n *NFTManager) GetRawRuleset() (string, error) {
 
 // SaveRuleset dumps the current nftables ruleset to the configured file path
 func (n *NFTManager) SaveRuleset() error {
-	output, err := n.execNFT("list", "ruleset")
+	output, err := n.backend.ListRuleset()
 	if err != nil {
 		return fmt.Errorf("failed to list ruleset: %w", err)
 	}
@@ -940,11 +1948,11 @@ func (n *NFTManager) RestoreRuleset() error {
 	}
 
 	// Flush existing ruleset before restoring
-	if _, err := n.execNFT("flush", "ruleset"); err != nil {
+	if err := n.backend.FlushRuleset(); err != nil {
 		return fmt.Errorf("failed to flush ruleset: %w", err)
 	}
 
-	if _, err := n.execNFT("-f", n.rulesetPath); err != nil {
+	if err := n.backend.LoadFile(n.rulesetPath); err != nil {
 		return fmt.Errorf("failed to restore ruleset from %s: %w", n.rulesetPath, err)
 	}
 
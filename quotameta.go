@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// QuotaMetaStore keeps per-port quota settings that have no place in the nft rule itself.
+// Like schedules, metadata is keyed by port because quota IDs change on every reset.
+type QuotaMetaStore struct {
+	mu   sync.Mutex
+	path string
+	meta map[int]QuotaMeta
+}
+
+// NewQuotaMetaStore creates a new QuotaMetaStore
+func NewQuotaMetaStore(cfg *Config) *QuotaMetaStore {
+	path := cfg.QuotaMetaPath
+	if path == "" {
+		path = "/var/lib/nft-ui/quota-meta.json"
+	}
+	return &QuotaMetaStore{
+		path: path,
+		meta: make(map[int]QuotaMeta),
+	}
+}
+
+// Load reads persisted metadata from disk
+func (s *QuotaMetaStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var file QuotaMetaFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+	for _, m := range file.Quotas {
+		s.meta[m.Port] = m
+	}
+	return nil
+}
+
+// Get returns the metadata for a port
+func (s *QuotaMetaStore) Get(port int) (QuotaMeta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.meta[port]
+	return m, ok
+}
+
+// SetThresholds overrides the status thresholds for a port (zero values restore the defaults)
+func (s *QuotaMetaStore) SetThresholds(port int, t QuotaThresholds) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.meta[port]
+	m.Port = port
+	m.Thresholds = nil
+	if t.WarningPercent != 0 || t.ExceededPercent != 0 {
+		m.Thresholds = &t
+	}
+	s.put(m)
+	return s.save()
+}
+
+// Delete removes all metadata for a port
+func (s *QuotaMetaStore) Delete(port int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.meta[port]; !ok {
+		return nil
+	}
+	delete(s.meta, port)
+	return s.save()
+}
+
+// put stores m, dropping entries that no longer carry any setting (requires lock to be held)
+func (s *QuotaMetaStore) put(m QuotaMeta) {
+	if m.Thresholds == nil {
+		delete(s.meta, m.Port)
+		return
+	}
+	s.meta[m.Port] = m
+}
+
+// save writes all metadata to disk (requires lock to be held)
+func (s *QuotaMetaStore) save() error {
+	// Ensure directory exists
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file := QuotaMetaFile{Quotas: make([]QuotaMeta, 0, len(s.meta))}
+	for _, m := range s.meta {
+		file.Quotas = append(file.Quotas, m)
+	}
+	sort.Slice(file.Quotas, func(i, j int) bool {
+		return file.Quotas[i].Port < file.Quotas[j].Port
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.path, data, 0644)
+}
+
+// validate checks that warning < exceeded and both are positive
+func (t QuotaThresholds) validate() error {
+	if t.WarningPercent <= 0 || t.ExceededPercent <= 0 {
+		return fmt.Errorf("thresholds must be positive")
+	}
+	if t.WarningPercent >= t.ExceededPercent {
+		return fmt.Errorf("warning threshold (%v%%) must be below exceeded threshold (%v%%)", t.WarningPercent, t.ExceededPercent)
+	}
+	return nil
+}
+
+// quotaStatus returns "ok", "warning" or "exceeded" for a usage percentage
+func quotaStatus(usagePercent float64, t QuotaThresholds) string {
+	switch {
+	case usagePercent >= t.ExceededPercent:
+		return "exceeded"
+	case usagePercent >= t.WarningPercent:
+		return "warning"
+	default:
+		return "ok"
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// HostResolver re-resolves the destination hostnames of forwards and
+// re-points a forward when its hostname resolves to a new address
+type HostResolver struct {
+	nft      *NFTManager
+	fwd      *ForwardingManager
+	meta     *ForwardMetaStore
+	health   *HealthChecker
+	logger   *log.Logger
+	interval time.Duration
+}
+
+// NewHostResolver creates a new HostResolver
+func NewHostResolver(cfg *Config, nft *NFTManager, fwd *ForwardingManager, meta *ForwardMetaStore, health *HealthChecker, logger *log.Logger) *HostResolver {
+	interval := time.Duration(cfg.ResolveInterval) * time.Second
+	if interval <= 0 {
+		interval = 300 * time.Second
+	}
+	return &HostResolver{
+		nft:      nft,
+		fwd:      fwd,
+		meta:     meta,
+		health:   health,
+		logger:   logger,
+		interval: interval,
+	}
+}
+
+// Run re-resolves destination hostnames every interval until the process exits
+func (r *HostResolver) Run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	r.resolveAll()
+	for range ticker.C {
+		r.resolveAll()
+	}
+}
+
+// resolveAll resolves the hostname of every enabled forward that has one.
+// A forward is re-pointed in one transaction; one that fails to resolve
+// keeps its last address.
+func (r *HostResolver) resolveAll() {
+	metas := r.meta.List()
+	if len(metas) == 0 {
+		return
+	}
+
+	rules, err := r.fwd.ListForwardingRules()
+	if err != nil {
+		r.logger.Printf("Error listing forwarding rules for hostname resolution: %v", err)
+		return
+	}
+	forwards := make(map[forwardRef]ForwardingRule)
+	for _, rule := range rules {
+		if rule.Managed && rule.Enabled {
+			forwards[rule.ref()] = rule
+		}
+	}
+
+	changed := false
+	for _, m := range metas {
+		rule, ok := forwards[m.ref()]
+		if !ok || rule.DstHost != m.DstHost {
+			continue // disabled, or edited since listing
+		}
+
+		ip, err := r.fwd.ResolveHost(m.DstHost)
+		if err != nil {
+			if m.ResolveError == "" {
+				r.logger.Printf("Error resolving destination of forward %s, keeping %s: %v", m.ref(), rule.DstIP, err)
+			}
+			m.ResolveError = err.Error()
+			if err := r.meta.Set(m); err != nil {
+				r.logger.Printf("Error saving forward metadata: %v", err)
+			}
+			continue
+		}
+
+		// Compared with the last resolution rather than the rule, which a
+		// health check failover may point at its standby
+		now := time.Now().Truncate(time.Second)
+		if ip == m.ResolvedIP {
+			m.ResolvedAt = &now
+			m.ResolveError = ""
+			if err := r.meta.Set(m); err != nil {
+				r.logger.Printf("Error saving forward metadata: %v", err)
+			}
+			continue
+		}
+		if r.health.failedOver(m.ref()) {
+			continue // re-pointed once it fails back
+		}
+
+		edited := rule
+		edited.DstIP = ip
+		edited.ResolvedAt = &now
+		edited.resolved = true
+		if err := r.fwd.EditForwardingRule(rule.ID, edited); err != nil {
+			r.logger.Printf("Error re-pointing forward %s to %s (%s): %v", m.ref(), ip, m.DstHost, err)
+			continue
+		}
+		r.logger.Printf("Forward %s re-pointed from %s to %s, %s resolved to a new address", m.ref(), rule.DstIP, ip, m.DstHost)
+		changed = true
+	}
+
+	if changed {
+		if err := r.nft.SaveRuleset(); err != nil {
+			r.logger.Printf("Error saving ruleset: %v", err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestResolverRepointsForwardAndQuota(t *testing.T) {
+	m := newTestManagers(t)
+
+	addrs := map[string]string{"app.internal": "10.0.0.5"}
+	m.fwd.lookupIP = func(ctx context.Context, host string) ([]net.IP, error) {
+		addr, ok := addrs[host]
+		if !ok {
+			return nil, fmt.Errorf("no such host: %s", host)
+		}
+		return []net.IP{net.ParseIP(addr)}, nil
+	}
+
+	rule := ForwardingRule{SrcPort: 7102, DstHost: "app.internal", DstPort: 80, Protocol: "tcp"}
+	if err := m.fwd.AddForwardingRule(rule); err != nil {
+		t.Fatalf("AddForwardingRule: %v", err)
+	}
+	if err := m.nft.AddQuota(7102, DirectionEgress, 10_000_000, 0, QuotaAction{}, "app"); err != nil {
+		t.Fatalf("AddQuota: %v", err)
+	}
+	m.seedForwardUsage(t, 7102, 4096)
+
+	health := NewHealthChecker(m.cfg, m.nft, m.fwd, log.New(io.Discard, "", 0))
+	resolver := NewHostResolver(m.cfg, m.nft, m.fwd, m.meta, health, log.New(io.Discard, "", 0))
+
+	// An unchanged address leaves the forward alone
+	resolver.resolveAll()
+	if got := m.forwardQuotaRules(t, "ip", forwardRef{port: 7102}); len(got) != 1 || !strings.Contains(got[0], `"10.0.0.5"`) {
+		t.Fatalf("forward quota before the change = %v, want one rule matching 10.0.0.5", got)
+	}
+
+	addrs["app.internal"] = "10.0.0.6"
+	resolver.resolveAll()
+
+	fwd, err := m.fwd.GetForwardingRule("fwd_7102")
+	if err != nil {
+		t.Fatalf("GetForwardingRule: %v", err)
+	}
+	if fwd.DstIP != "10.0.0.6" {
+		t.Errorf("forward destination = %s, want 10.0.0.6", fwd.DstIP)
+	}
+
+	got := m.forwardQuotaRules(t, "ip", forwardRef{port: 7102})
+	if len(got) != 1 || !strings.Contains(got[0], `"10.0.0.6"`) || strings.Contains(got[0], `"10.0.0.5"`) {
+		t.Errorf("forward quota after the change = %v, want one rule matching only 10.0.0.6", got)
+	}
+	if used := m.forwardQuotaUsed(forwardRef{port: 7102}); used != 4096 {
+		t.Errorf("forward quota usage = %d, want 4096 carried over", used)
+	}
+
+	quotas, err := m.nft.ListQuotas()
+	if err != nil {
+		t.Fatalf("ListQuotas: %v", err)
+	}
+	if len(quotas) != 1 || quotas[0].QuotaBytes != 10_000_000 || quotas[0].UsedBytes != 4096 {
+		t.Errorf("quotas = %+v, want one 10000000 byte quota with 4096 bytes used", quotas)
+	}
+}
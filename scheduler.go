@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// schedulerInterval is how often the scheduler checks for due resets
+const schedulerInterval = 30 * time.Second
+
+// ResetScheduler resets quotas automatically according to per-port schedules.
+// Schedules and their next/last reset times are persisted, so a reset that
+// fell due while nft-ui was down runs once right after startup.
+type ResetScheduler struct {
+	mu        sync.Mutex
+	nft       *NFTManager
+	logger    *log.Logger
+	path      string
+	schedules map[int]*ResetSchedule
+}
+
+// NewResetScheduler creates a new ResetScheduler
+func NewResetScheduler(cfg *Config, nft *NFTManager, logger *log.Logger) *ResetScheduler {
+	path := cfg.SchedulesPath
+	if path == "" {
+		path = "/var/lib/nft-ui/reset-schedules.json"
+	}
+	return &ResetScheduler{
+		nft:       nft,
+		logger:    logger,
+		path:      path,
+		schedules: make(map[int]*ResetSchedule),
+	}
+}
+
+// Load reads persisted schedules from disk
+func (s *ResetScheduler) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var file ResetSchedulesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", s.path, err)
+	}
+
+	for i := range file.Schedules {
+		sch := file.Schedules[i]
+		if sch.NextReset == nil {
+			next, err := sch.next(time.Now())
+			if err != nil {
+				s.logger.Printf("Warning: ignoring invalid reset schedule for port %d: %v", sch.Port, err)
+				continue
+			}
+			sch.NextReset = &next
+		}
+		s.schedules[sch.Port] = &sch
+	}
+
+	return nil
+}
+
+// Run checks for due resets until the process exits
+func (s *ResetScheduler) Run() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+
+	s.runDue(time.Now())
+	for now := range ticker.C {
+		s.runDue(now)
+	}
+}
+
+// runDue resets every quota whose schedule is due at now
+func (s *ResetScheduler) runDue(now time.Time) {
+	s.mu.Lock()
+	var due []ResetSchedule
+	for _, sch := range s.schedules {
+		if sch.NextReset != nil && !sch.NextReset.After(now) {
+			due = append(due, *sch)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+
+	// NFTManager is called without holding s.mu: ListQuotas takes the
+	// scheduler lock while holding its own
+	quotas, err := s.nft.ListQuotas()
+	if err != nil {
+		s.logger.Printf("Error listing quotas for scheduled reset: %v", err)
+		return // retry on the next tick
+	}
+
+	resetCount := 0
+	for _, sch := range due {
+		var id string
+		for _, q := range quotas {
+			if q.Port == sch.Port {
+				id = q.ID
+				break
+			}
+		}
+
+		if id == "" {
+			s.logger.Printf("Warning: scheduled reset skipped, no quota on port %d", sch.Port)
+		} else if err := s.nft.ResetQuota(id); err != nil {
+			s.logger.Printf("Error in scheduled reset of port %d: %v", sch.Port, err)
+			continue // retry on the next tick
+		} else {
+			s.logger.Printf("Scheduled reset: port %d", sch.Port)
+			resetCount++
+		}
+
+		s.mu.Lock()
+		if cur, ok := s.schedules[sch.Port]; ok {
+			if id != "" {
+				last := now.Truncate(time.Second)
+				cur.LastReset = &last
+			}
+			if next, err := cur.next(now); err == nil {
+				cur.NextReset = &next
+			}
+		}
+		s.mu.Unlock()
+	}
+
+	if resetCount > 0 {
+		if err := s.nft.SaveRuleset(); err != nil {
+			s.logger.Printf("Error saving ruleset: %v", err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(); err != nil {
+		s.logger.Printf("Error saving reset schedules: %v", err)
+	}
+}
+
+// Get returns the schedule for a port
+func (s *ResetScheduler) Get(port int) (*ResetSchedule, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sch, ok := s.schedules[port]
+	if !ok {
+		return nil, false
+	}
+	cp := *sch
+	return &cp, true
+}
+
+// Set creates or replaces the schedule for a port
+func (s *ResetScheduler) Set(port int, req SetResetScheduleRequest) (*ResetSchedule, error) {
+	sch := ResetSchedule{
+		Port:     port,
+		Type:     req.Type,
+		Time:     req.Time,
+		Weekday:  req.Weekday,
+		Day:      req.Day,
+		Cron:     req.Cron,
+		Timezone: req.Timezone,
+	}
+	if err := sch.validate(); err != nil {
+		return nil, err
+	}
+
+	next, err := sch.next(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sch.NextReset = &next
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Keep the last reset time when a schedule is edited
+	if old, ok := s.schedules[port]; ok {
+		sch.LastReset = old.LastReset
+	}
+	s.schedules[port] = &sch
+
+	if err := s.save(); err != nil {
+		return nil, fmt.Errorf("failed to save reset schedules: %w", err)
+	}
+	cp := sch
+	return &cp, nil
+}
+
+// Delete removes the schedule for a port
+func (s *ResetScheduler) Delete(port int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.schedules[port]; !ok {
+		return nil
+	}
+	delete(s.schedules, port)
+	return s.save()
+}
+
+// annotate fills next/last reset times into quota rules
+func (s *ResetScheduler) annotate(rules []QuotaRule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range rules {
+		if sch, ok := s.schedules[rules[i].Port]; ok {
+			rules[i].NextReset = sch.NextReset
+			rules[i].LastReset = sch.LastReset
+		}
+	}
+}
+
+// save writes all schedules to disk (requires lock to be held)
+func (s *ResetScheduler) save() error {
+	// Ensure directory exists
+	dir := filepath.Dir(s.path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	file := ResetSchedulesFile{Schedules: make([]ResetSchedule, 0, len(s.schedules))}
+	for _, sch := range s.schedules {
+		file.Schedules = append(file.Schedules, *sch)
+	}
+	sort.Slice(file.Schedules, func(i, j int) bool {
+		return file.Schedules[i].Port < file.Schedules[j].Port
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.path, data, 0644)
+}
+
+// validate checks the schedule fields for its type
+func (sch *ResetSchedule) validate() error {
+	if sch.Port < 1 || sch.Port > 65535 {
+		return fmt.Errorf("invalid port: %d", sch.Port)
+	}
+	if _, err := sch.location(); err != nil {
+		return err
+	}
+
+	switch sch.Type {
+	case "daily":
+	case "weekly":
+		if sch.Weekday < 0 || sch.Weekday > 6 {
+			return fmt.Errorf("invalid weekday: %d (must be 0-6, 0 = Sunday)", sch.Weekday)
+		}
+	case "monthly":
+		if sch.Day < 1 || sch.Day > 31 {
+			return fmt.Errorf("invalid day of month: %d (must be 1-31)", sch.Day)
+		}
+	case "cron":
+		if _, err := cron.ParseStandard(sch.Cron); err != nil {
+			return fmt.Errorf("invalid cron expression %q: %w", sch.Cron, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid schedule type: %s", sch.Type)
+	}
+
+	_, _, err := parseClock(sch.Time)
+	return err
+}
+
+// location returns the schedule's time zone
+func (sch *ResetSchedule) location() (*time.Location, error) {
+	if sch.Timezone == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(sch.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %s", sch.Timezone)
+	}
+	return loc, nil
+}
+
+// next returns the first reset time strictly after the given time
+func (sch *ResetSchedule) next(after time.Time) (time.Time, error) {
+	loc, err := sch.location()
+	if err != nil {
+		return time.Time{}, err
+	}
+	t := after.In(loc)
+
+	if sch.Type == "cron" {
+		spec, err := cron.ParseStandard(sch.Cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		next := spec.Next(t)
+		if next.IsZero() {
+			return time.Time{}, fmt.Errorf("cron expression %q never fires", sch.Cron)
+		}
+		return next, nil
+	}
+
+	hour, minute, err := parseClock(sch.Time)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	switch sch.Type {
+	case "daily":
+		next := time.Date(t.Year(), t.Month(), t.Day(), hour, minute, 0, 0, loc)
+		if !next.After(t) {
+			next = time.Date(t.Year(), t.Month(), t.Day()+1, hour, minute, 0, 0, loc)
+		}
+		return next, nil
+	case "weekly":
+		days := (sch.Weekday - int(t.Weekday()) + 7) % 7
+		next := time.Date(t.Year(), t.Month(), t.Day()+days, hour, minute, 0, 0, loc)
+		if !next.After(t) {
+			next = time.Date(t.Year(), t.Month(), t.Day()+days+7, hour, minute, 0, 0, loc)
+		}
+		return next, nil
+	case "monthly":
+		next := monthlyResetTime(t.Year(), t.Month(), sch.Day, hour, minute, loc)
+		if !next.After(t) {
+			next = monthlyResetTime(t.Year(), t.Month()+1, sch.Day, hour, minute, loc)
+		}
+		return next, nil
+	}
+
+	return time.Time{}, fmt.Errorf("invalid schedule type: %s", sch.Type)
+}
+
+// monthlyResetTime returns day N of a month, clamped to the month's last day
+func monthlyResetTime(year int, month time.Month, day, hour, minute int, loc *time.Location) time.Time {
+	// Day 0 of the following month is the last day of this one
+	lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+	if day > lastDay {
+		day = lastDay
+	}
+	return time.Date(year, month, day, hour, minute, 0, 0, loc)
+}
+
+// parseClock parses "HH:MM" (empty means midnight)
+func parseClock(s string) (int, int, error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, errors.New("invalid time: must be HH:MM")
+	}
+	return t.Hour(), t.Minute(), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // time zones without a system zoneinfo database
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%s): %v", name, err)
+	}
+	return loc
+}
+
+func TestResetScheduleNext(t *testing.T) {
+	utc := time.UTC
+	newYork := mustLoadLocation(t, "America/New_York")
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+
+	tests := []struct {
+		name  string
+		sch   ResetSchedule
+		after time.Time
+		want  time.Time
+	}{
+		{
+			name:  "daily later today",
+			sch:   ResetSchedule{Type: "daily", Time: "06:00", Timezone: "UTC"},
+			after: time.Date(2026, 5, 10, 5, 59, 0, 0, utc),
+			want:  time.Date(2026, 5, 10, 6, 0, 0, 0, utc),
+		},
+		{
+			name:  "daily at the reset time moves to tomorrow",
+			sch:   ResetSchedule{Type: "daily", Time: "06:00", Timezone: "UTC"},
+			after: time.Date(2026, 5, 10, 6, 0, 0, 0, utc),
+			want:  time.Date(2026, 5, 11, 6, 0, 0, 0, utc),
+		},
+		{
+			name:  "daily into daylight saving time",
+			sch:   ResetSchedule{Type: "daily", Time: "01:00", Timezone: "America/New_York"},
+			after: time.Date(2026, 3, 8, 1, 0, 0, 0, newYork),
+			want:  time.Date(2026, 3, 9, 1, 0, 0, 0, newYork), // 23 hours later
+		},
+		{
+			name:  "daily out of daylight saving time",
+			sch:   ResetSchedule{Type: "daily", Time: "01:00", Timezone: "America/New_York"},
+			after: time.Date(2026, 10, 31, 1, 0, 0, 0, newYork),
+			want:  time.Date(2026, 11, 1, 1, 0, 0, 0, newYork),
+		},
+		{
+			name:  "daily in another time zone than the input",
+			sch:   ResetSchedule{Type: "daily", Time: "00:00", Timezone: "Europe/Berlin"},
+			after: time.Date(2026, 7, 1, 21, 30, 0, 0, utc), // 23:30 in Berlin
+			want:  time.Date(2026, 7, 2, 0, 0, 0, 0, berlin),
+		},
+		{
+			name:  "weekly on the weekday before the reset time",
+			sch:   ResetSchedule{Type: "weekly", Time: "10:00", Weekday: int(time.Wednesday), Timezone: "UTC"},
+			after: time.Date(2026, 10, 14, 9, 0, 0, 0, utc), // a Wednesday
+			want:  time.Date(2026, 10, 14, 10, 0, 0, 0, utc),
+		},
+		{
+			name:  "weekly on the weekday at the reset time",
+			sch:   ResetSchedule{Type: "weekly", Time: "10:00", Weekday: int(time.Wednesday), Timezone: "UTC"},
+			after: time.Date(2026, 10, 14, 10, 0, 0, 0, utc),
+			want:  time.Date(2026, 10, 21, 10, 0, 0, 0, utc),
+		},
+		{
+			name:  "weekly on the weekday after the reset time",
+			sch:   ResetSchedule{Type: "weekly", Time: "10:00", Weekday: int(time.Wednesday), Timezone: "UTC"},
+			after: time.Date(2026, 10, 14, 11, 0, 0, 0, utc),
+			want:  time.Date(2026, 10, 21, 10, 0, 0, 0, utc),
+		},
+		{
+			name:  "weekly on an earlier weekday",
+			sch:   ResetSchedule{Type: "weekly", Time: "10:00", Weekday: int(time.Monday), Timezone: "UTC"},
+			after: time.Date(2026, 10, 14, 11, 0, 0, 0, utc),
+			want:  time.Date(2026, 10, 19, 10, 0, 0, 0, utc),
+		},
+		{
+			name:  "monthly day 31 in January",
+			sch:   ResetSchedule{Type: "monthly", Day: 31, Timezone: "UTC"},
+			after: time.Date(2027, 1, 15, 0, 0, 0, 0, utc),
+			want:  time.Date(2027, 1, 31, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "monthly day 31 clamped in February",
+			sch:   ResetSchedule{Type: "monthly", Day: 31, Timezone: "UTC"},
+			after: time.Date(2027, 1, 31, 0, 0, 0, 0, utc),
+			want:  time.Date(2027, 2, 28, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "monthly day 31 clamped in a leap February",
+			sch:   ResetSchedule{Type: "monthly", Day: 31, Timezone: "UTC"},
+			after: time.Date(2028, 1, 31, 0, 0, 0, 0, utc),
+			want:  time.Date(2028, 2, 29, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "monthly day 31 back in March",
+			sch:   ResetSchedule{Type: "monthly", Day: 31, Timezone: "UTC"},
+			after: time.Date(2027, 2, 28, 0, 0, 0, 0, utc),
+			want:  time.Date(2027, 3, 31, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "monthly day 31 clamped in April",
+			sch:   ResetSchedule{Type: "monthly", Day: 31, Timezone: "UTC"},
+			after: time.Date(2027, 3, 31, 0, 0, 0, 0, utc),
+			want:  time.Date(2027, 4, 30, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "monthly from December to January",
+			sch:   ResetSchedule{Type: "monthly", Day: 15, Time: "08:30", Timezone: "UTC"},
+			after: time.Date(2026, 12, 20, 0, 0, 0, 0, utc),
+			want:  time.Date(2027, 1, 15, 8, 30, 0, 0, utc),
+		},
+		{
+			name:  "monthly day 31 from December to January",
+			sch:   ResetSchedule{Type: "monthly", Day: 31, Timezone: "UTC"},
+			after: time.Date(2026, 12, 31, 0, 0, 0, 0, utc),
+			want:  time.Date(2027, 1, 31, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "cron in a time zone",
+			sch:   ResetSchedule{Type: "cron", Cron: "0 3 * * 1", Timezone: "Europe/Berlin"},
+			after: time.Date(2026, 10, 14, 12, 0, 0, 0, utc), // a Wednesday
+			want:  time.Date(2026, 10, 19, 3, 0, 0, 0, berlin),
+		},
+		{
+			name:  "cron across the end of daylight saving time",
+			sch:   ResetSchedule{Type: "cron", Cron: "0 3 * * *", Timezone: "Europe/Berlin"},
+			after: time.Date(2026, 10, 25, 1, 30, 0, 0, utc), // 02:30 CET, just after the change
+			want:  time.Date(2026, 10, 25, 3, 0, 0, 0, berlin),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.sch.next(tt.after)
+			if err != nil {
+				t.Fatalf("next: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("next(%s) = %s, want %s", tt.after, got, tt.want)
+			}
+			if got.Location().String() != tt.sch.Timezone {
+				t.Errorf("next(%s) is in %s, want %s", tt.after, got.Location(), tt.sch.Timezone)
+			}
+		})
+	}
+}
+
+func TestResetScheduleNextDSTLength(t *testing.T) {
+	sch := ResetSchedule{Type: "daily", Time: "01:00", Timezone: "America/New_York"}
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	// The wall clock time stays, so the day of the change is an hour short
+	after := time.Date(2026, 3, 8, 1, 0, 0, 0, newYork)
+	got, err := sch.next(after)
+	if err != nil {
+		t.Fatalf("next: %v", err)
+	}
+	if d := got.Sub(after); d != 23*time.Hour {
+		t.Errorf("next reset is %s after the last, want 23h", d)
+	}
+}
+
+func TestMonthlyResetTime(t *testing.T) {
+	tests := []struct {
+		year  int
+		month time.Month
+		day   int
+		want  time.Time
+	}{
+		{2027, time.January, 31, time.Date(2027, 1, 31, 4, 0, 0, 0, time.UTC)},
+		{2027, time.February, 31, time.Date(2027, 2, 28, 4, 0, 0, 0, time.UTC)},
+		{2028, time.February, 30, time.Date(2028, 2, 29, 4, 0, 0, 0, time.UTC)},
+		{2027, time.April, 31, time.Date(2027, 4, 30, 4, 0, 0, 0, time.UTC)},
+		{2027, time.April, 15, time.Date(2027, 4, 15, 4, 0, 0, 0, time.UTC)},
+		{2026, time.December + 1, 31, time.Date(2027, 1, 31, 4, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		got := monthlyResetTime(tt.year, tt.month, tt.day, 4, 0, time.UTC)
+		if !got.Equal(tt.want) {
+			t.Errorf("monthlyResetTime(%d, %d, %d) = %s, want %s", tt.year, tt.month, tt.day, got, tt.want)
+		}
+	}
+}
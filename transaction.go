@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Transaction collects nft commands that must be applied together.
+// The exec backend renders it as one script for 'nft -f'; the netlink
+// backend sends it as a single batch. Either way the kernel commits all
+// commands or none of them.
+type Transaction struct {
+	ops []txOp
+}
+
+// meterSetSize is the number of addresses a meter set can hold
+const meterSetSize = 65535
+
+// txOp is a single command inside a transaction
+type txOp struct {
+	verb   string // "add table" | "add chain" | "delete chain" | "add rule" | "insert rule" | "replace rule" | "delete rule" | "add set" | "flush set" | "delete set" | "add element" | "delete element"
+	family string
+	table  string
+	chain  string // set name for set commands
+	spec   ChainSpec
+	rule   []string // set elements for "add element" and "delete element"
+	handle int64
+	ttl    time.Duration // timeout of the elements added, 0 = the set's default
+	note   string        // comment of the elements added
+}
+
+// AddTable queues creation of a table (no-op if it exists)
+func (t *Transaction) AddTable(family, table string) {
+	t.ops = append(t.ops, txOp{verb: "add table", family: family, table: table})
+}
+
+// AddBaseChain queues creation of a base chain (no-op if it exists)
+func (t *Transaction) AddBaseChain(family, table, chain string, spec ChainSpec) {
+	t.ops = append(t.ops, txOp{verb: "add chain", family: family, table: table, chain: chain, spec: spec})
+}
+
+// AddChain queues creation of a regular chain, reachable only by jump (no-op if it exists)
+func (t *Transaction) AddChain(family, table, chain string) {
+	t.ops = append(t.ops, txOp{verb: "add chain", family: family, table: table, chain: chain})
+}
+
+// DeleteChain queues deleting a chain; it must be empty and unreferenced
+// once the preceding commands are applied
+func (t *Transaction) DeleteChain(family, table, chain string) {
+	t.ops = append(t.ops, txOp{verb: "delete chain", family: family, table: table, chain: chain})
+}
+
+// AddRule queues appending a rule to a chain
+func (t *Transaction) AddRule(family, table, chain string, rule ...string) {
+	t.ops = append(t.ops, txOp{verb: "add rule", family: family, table: table, chain: chain, rule: rule})
+}
+
+// InsertRule queues prepending a rule to a chain
+func (t *Transaction) InsertRule(family, table, chain string, rule ...string) {
+	t.ops = append(t.ops, txOp{verb: "insert rule", family: family, table: table, chain: chain, rule: rule})
+}
+
+// ReplaceRule queues replacing a rule by handle; the rule keeps its handle and position
+func (t *Transaction) ReplaceRule(family, table, chain string, handle int64, rule ...string) {
+	t.ops = append(t.ops, txOp{verb: "replace rule", family: family, table: table, chain: chain, rule: rule, handle: handle})
+}
+
+// DeleteRule queues deleting a rule by handle
+func (t *Transaction) DeleteRule(family, table, chain string, handle int64) {
+	t.ops = append(t.ops, txOp{verb: "delete rule", family: family, table: table, chain: chain, handle: handle})
+}
+
+// AddIntervalSet queues creation of a named set of address prefixes (no-op if it exists).
+// keyType is "ipv4_addr" or "ipv6_addr".
+func (t *Transaction) AddIntervalSet(family, table, set, keyType string) {
+	t.ops = append(t.ops, txOp{verb: "add set", family: family, table: table, chain: set, rule: []string{keyType}})
+}
+
+// AddMeterSet queues creation of a named set the packet path adds addresses to,
+// with per-element statements such as a connection count (no-op if it exists).
+// keyType is "ipv4_addr" or "ipv6_addr".
+func (t *Transaction) AddMeterSet(family, table, set, keyType string) {
+	t.ops = append(t.ops, txOp{verb: "add set", family: family, table: table, chain: set, rule: []string{keyType, "dynamic"}})
+}
+
+// AddTimedMeterSet queues creation of a meter set whose addresses expire after
+// timeout unless the packet path renews them (no-op if it exists).
+// keyType is "ipv4_addr" or "ipv6_addr".
+func (t *Transaction) AddTimedMeterSet(family, table, set, keyType string, timeout time.Duration) {
+	t.ops = append(t.ops, txOp{verb: "add set", family: family, table: table, chain: set, rule: []string{keyType, "dynamic"}, ttl: timeout})
+}
+
+// AddTimeoutSet queues creation of a named set of address prefixes whose
+// elements may expire (no-op if it exists). keyType is "ipv4_addr" or "ipv6_addr".
+func (t *Transaction) AddTimeoutSet(family, table, set, keyType string) {
+	t.ops = append(t.ops, txOp{verb: "add set", family: family, table: table, chain: set, rule: []string{keyType, "timeout"}})
+}
+
+// FlushSet queues removing all elements of a named set
+func (t *Transaction) FlushSet(family, table, set string) {
+	t.ops = append(t.ops, txOp{verb: "flush set", family: family, table: table, chain: set})
+}
+
+// DeleteSet queues deleting a named set; it must be unreferenced once the
+// preceding commands are applied
+func (t *Transaction) DeleteSet(family, table, set string) {
+	t.ops = append(t.ops, txOp{verb: "delete set", family: family, table: table, chain: set})
+}
+
+// AddElements queues adding elements (addresses or prefixes) to a named set
+func (t *Transaction) AddElements(family, table, set string, elements ...string) {
+	if len(elements) == 0 {
+		return
+	}
+	t.ops = append(t.ops, txOp{verb: "add element", family: family, table: table, chain: set, rule: elements})
+}
+
+// AddTimedElement queues adding an element to a set created with AddTimeoutSet,
+// removed by the kernel once timeout passes (0 = never) and carrying a comment
+func (t *Transaction) AddTimedElement(family, table, set, element string, timeout time.Duration, comment string) {
+	t.ops = append(t.ops, txOp{verb: "add element", family: family, table: table, chain: set, rule: []string{element}, ttl: timeout, note: comment})
+}
+
+// DeleteElements queues removing elements from a named set; they must exist
+func (t *Transaction) DeleteElements(family, table, set string, elements ...string) {
+	if len(elements) == 0 {
+		return
+	}
+	t.ops = append(t.ops, txOp{verb: "delete element", family: family, table: table, chain: set, rule: elements})
+}
+
+// Empty reports whether the transaction has no commands
+func (t *Transaction) Empty() bool {
+	return len(t.ops) == 0
+}
+
+// Script renders the transaction as an nft script
+func (t *Transaction) Script() string {
+	var b strings.Builder
+	for _, op := range t.ops {
+		b.WriteString(op.String())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// String renders a single command in nft syntax
+func (op txOp) String() string {
+	switch op.verb {
+	case "add table":
+		return fmt.Sprintf("add table %s %s", op.family, op.table)
+	case "add chain":
+		if op.spec.Hook == "" {
+			return fmt.Sprintf("add chain %s %s %s", op.family, op.table, op.chain)
+		}
+		return fmt.Sprintf("add chain %s %s %s %s", op.family, op.table, op.chain, op.spec.String())
+	case "delete chain":
+		return fmt.Sprintf("delete chain %s %s %s", op.family, op.table, op.chain)
+	case "replace rule":
+		return fmt.Sprintf("replace rule %s %s %s handle %d %s", op.family, op.table, op.chain, op.handle, strings.Join(op.rule, " "))
+	case "delete rule":
+		return fmt.Sprintf("delete rule %s %s %s handle %d", op.family, op.table, op.chain, op.handle)
+	case "add set":
+		if len(op.rule) > 1 && op.rule[1] == "dynamic" && op.ttl > 0 {
+			return fmt.Sprintf("add set %s %s %s { type %s ; size %d ; flags dynamic, timeout ; timeout %ds ; }",
+				op.family, op.table, op.chain, op.rule[0], meterSetSize, int64(op.ttl/time.Second))
+		}
+		if len(op.rule) > 1 && op.rule[1] == "dynamic" {
+			return fmt.Sprintf("add set %s %s %s { type %s ; size %d ; flags dynamic ; }", op.family, op.table, op.chain, op.rule[0], meterSetSize)
+		}
+		if len(op.rule) > 1 && op.rule[1] == "timeout" {
+			return fmt.Sprintf("add set %s %s %s { type %s ; flags interval, timeout ; }", op.family, op.table, op.chain, op.rule[0])
+		}
+		return fmt.Sprintf("add set %s %s %s { type %s ; flags interval ; }", op.family, op.table, op.chain, op.rule[0])
+	case "flush set", "delete set":
+		return fmt.Sprintf("%s %s %s %s", op.verb, op.family, op.table, op.chain)
+	case "add element":
+		elements := strings.Join(op.rule, ", ")
+		if op.ttl > 0 {
+			elements += fmt.Sprintf(" timeout %ds", int64(op.ttl/time.Second))
+		}
+		if op.note != "" {
+			elements += fmt.Sprintf(` comment "%s"`, op.note)
+		}
+		return fmt.Sprintf("add element %s %s %s { %s }", op.family, op.table, op.chain, elements)
+	case "delete element":
+		return fmt.Sprintf("delete element %s %s %s { %s }", op.family, op.table, op.chain, strings.Join(op.rule, ", "))
+	}
+	return fmt.Sprintf("%s %s %s %s %s", op.verb, op.family, op.table, op.chain, strings.Join(op.rule, " "))
+}
@@ -1,28 +1,63 @@
 package main
 
+import "time"
+
 // QuotaRule represents a parsed nftables quota rule
 type QuotaRule struct {
-	ID           string  `json:"id"`            // inet_filter_output_<handle>
-	Handle       int64   `json:"handle"`        // nft handle for deletion
-	Port         int     `json:"port"`          // source port
-	QuotaBytes   int64   `json:"quota_bytes"`   // quota limit in bytes
-	UsedBytes    int64   `json:"used_bytes"`    // current usage in bytes
-	UsagePercent float64 `json:"usage_percent"` // calculated: used/quota * 100
-	Status       string  `json:"status"`        // "ok" | "warning" | "exceeded"
-	Comment      string  `json:"comment"`       // rule comment
+	ID           string     `json:"id"`                   // inet_filter_output_<handle>
+	Handle       int64      `json:"handle"`               // nft handle for deletion
+	Port         int        `json:"port"`                 // source port
+	QuotaBytes   int64      `json:"quota_bytes"`          // quota limit in bytes
+	UsedBytes    int64      `json:"used_bytes"`           // current usage in bytes
+	UsagePercent float64    `json:"usage_percent"`        // calculated: used/quota * 100
+	Status       string     `json:"status"`               // "ok" | "warning" | "exceeded"
+	Comment      string     `json:"comment"`              // rule comment
+	NextReset    *time.Time `json:"next_reset,omitempty"` // next scheduled automatic reset
+	LastReset    *time.Time `json:"last_reset,omitempty"` // last scheduled automatic reset
+
+	WarningPercent  float64 `json:"warning_percent"`  // usage percent from which status is "warning"
+	ExceededPercent float64 `json:"exceeded_percent"` // usage percent from which status is "exceeded"
+
+	Direction string          `json:"direction"`         // "egress" | "ingress" | "both"
+	Egress    *QuotaDirection `json:"egress,omitempty"`  // traffic sent from the port
+	Ingress   *QuotaDirection `json:"ingress,omitempty"` // traffic received on the port
+
+	QuotaAction // what happens to traffic over the limit
+}
+
+// QuotaAction is what a quota does to traffic once its limit is exceeded
+type QuotaAction struct {
+	Action   string `json:"action"`              // "drop" (default) | "reject" | "ratelimit" | "mark"
+	RateMbps int64  `json:"rate_mbps,omitempty"` // ratelimit: throughput still allowed over the limit
+	Mark     uint32 `json:"mark,omitempty"`      // mark: packet mark set on traffic over the limit
+}
+
+// QuotaDirection is the limit and usage of one traffic direction of a quota
+type QuotaDirection struct {
+	QuotaBytes int64 `json:"quota_bytes"` // 0 when both directions share the quota limit
+	UsedBytes  int64 `json:"used_bytes"`
 }
 
 // AllowedPort represents an allowed inbound port from the input chain
 type AllowedPort struct {
-	Port    int    `json:"port"`
-	Handle  int64  `json:"handle"`
-	Managed bool   `json:"managed"` // true if comment == "nft-ui managed"
-	Comment string `json:"comment,omitempty"`
+	Port     int      `json:"port"`                      // First port of a range
+	PortEnd  int      `json:"port_end,omitempty"`        // Last port of a range (0 = single port)
+	Protocol string   `json:"protocol"`                  // "tcp" | "udp" | "both"
+	Sources  []string `json:"allowed_sources,omitempty"` // Client addresses or CIDRs allowed to connect (empty = any)
+	Handle   int64    `json:"handle"`
+	Managed  bool     `json:"managed"` // true if comment == "nft-ui managed"
+	Comment  string   `json:"comment,omitempty"`
+
+	handles []int64  // Every rule of the port, one per address family if it has sources
+	sets    []string // Named sets holding the allowed sources
 }
 
 // AddPortRequest is the request body for adding a new allowed port
 type AddPortRequest struct {
-	Port int `json:"port"`
+	Port     int      `json:"port"`
+	PortEnd  int      `json:"port_end"`        // 0 = single port
+	Protocol string   `json:"protocol"`        // "tcp" (default) | "udp" | "both"
+	Sources  []string `json:"allowed_sources"` // empty = any source
 }
 
 // QuotasResponse is the API response for listing quotas
@@ -38,11 +73,43 @@ type AddQuotaRequest struct {
 	Port    int    `json:"port"`
 	Bytes   int64  `json:"bytes"`
 	Comment string `json:"comment"`
+
+	Direction    string `json:"direction"`     // "egress" (default) | "ingress" | "both"
+	IngressBytes int64  `json:"ingress_bytes"` // "both" only: separate ingress limit, Bytes then limits egress alone
+
+	QuotaAction // over-quota action, drop if empty
 }
 
 // ModifyQuotaRequest is the request body for modifying a quota
 type ModifyQuotaRequest struct {
-	Bytes int64 `json:"bytes"`
+	Bytes        int64 `json:"bytes"`
+	IngressBytes int64 `json:"ingress_bytes"` // new ingress limit of quotas with separate limits
+	ResetUsage   bool  `json:"reset_usage"`   // zero the used counter instead of carrying it over
+
+	QuotaAction // new over-quota action, the current one is kept if empty
+}
+
+// TopUpQuotaRequest is the request body for adding bytes to a quota
+type TopUpQuotaRequest struct {
+	Bytes     int64  `json:"bytes"`
+	Direction string `json:"direction"` // limit topped up of quotas with separate limits: "egress" | "ingress"
+	Note      string `json:"note"`      // e.g. the add-on pack or order reference
+}
+
+// QuotaLimitChange is the outcome of a quota limit change. Rebuilding the
+// rules gives them new handles, so the quota has a new ID.
+type QuotaLimitChange struct {
+	ID       string `json:"id"`
+	Port     int    `json:"port"`
+	OldBytes int64  `json:"old_bytes"` // Total limit before the change
+	NewBytes int64  `json:"new_bytes"` // Total limit applied
+}
+
+// QuotaLimitResponse is the API response for modifying or topping up a quota
+type QuotaLimitResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message,omitempty"`
+	QuotaLimitChange
 }
 
 // BatchResetRequest is the request body for batch resetting quotas
@@ -73,12 +140,23 @@ type QuotasResponseWithTokens struct {
 
 // PublicQueryResponse is the API response for public token-based queries
 type PublicQueryResponse struct {
-	Port         int     `json:"port"`
-	UsedBytes    int64   `json:"used_bytes"`
-	QuotaBytes   int64   `json:"quota_bytes"`
-	UsagePercent float64 `json:"usage_percent"`
-	Status       string  `json:"status"`
-	Comment      string  `json:"comment,omitempty"`
+	Port            int        `json:"port"`
+	UsedBytes       int64      `json:"used_bytes"`
+	QuotaBytes      int64      `json:"quota_bytes"`
+	UsagePercent    float64    `json:"usage_percent"`
+	Status          string     `json:"status"`
+	WarningPercent  float64    `json:"warning_percent"`
+	ExceededPercent float64    `json:"exceeded_percent"`
+	Comment         string     `json:"comment,omitempty"`
+	NextReset       *time.Time `json:"next_reset,omitempty"`
+	LastReset       *time.Time `json:"last_reset,omitempty"`
+
+	Direction string          `json:"direction"`
+	Egress    *QuotaDirection `json:"egress,omitempty"`
+	Ingress   *QuotaDirection `json:"ingress,omitempty"`
+
+	Action   string `json:"action"`              // over-quota action
+	RateMbps int64  `json:"rate_mbps,omitempty"` // throughput over the limit with action "ratelimit"
 }
 
 // NFT JSON structures for parsing nft -j output
@@ -93,6 +171,16 @@ type NFTObject struct {
 	Metainfo *NFTMetainfo `json:"metainfo,omitempty"`
 	Chain    *NFTChain    `json:"chain,omitempty"`
 	Rule     *NFTRule     `json:"rule,omitempty"`
+	Set      *NFTSet      `json:"set,omitempty"`
+}
+
+// NFTSet represents a named nftables set
+type NFTSet struct {
+	Family string        `json:"family"`
+	Table  string        `json:"table"`
+	Name   string        `json:"name"`
+	Type   string        `json:"type"`
+	Elem   []interface{} `json:"elem,omitempty"` // "10.0.0.1", {"prefix": {...}} or {"range": [...]}
 }
 
 // NFTMetainfo contains nftables version info
@@ -124,36 +212,101 @@ type NFTRule struct {
 
 // ForwardingRule represents a port forwarding rule (DNAT + MASQUERADE)
 type ForwardingRule struct {
-	ID         string `json:"id"`          // "fwd_<srcPort>"
-	SrcPort    int    `json:"src_port"`    // Local port to forward from
-	DstIP      string `json:"dst_ip"`      // Destination IP address
-	DstPort    int    `json:"dst_port"`    // Destination port
-	Protocol   string `json:"protocol"`    // "tcp" | "udp" | "both"
-	Enabled    bool   `json:"enabled"`     // Whether the rule is active in nftables
-	Managed    bool   `json:"managed"`     // Whether the rule is managed by nft-ui (has comment)
-	Comment    string `json:"comment"`     // User-provided description
-	PreHandle  int64  `json:"pre_handle"`  // nft handle for prerouting DNAT rule
-	PostHandle int64  `json:"post_handle"` // nft handle for postrouting MASQUERADE rule
-	LimitMbps  int    `json:"limit_mbps"`  // Bandwidth limit in Mbps (0 = no limit)
+	ID         string           `json:"id"`                     // "fwd_<srcPort>" or "fwd_<first>-<last>", then "+<interface>" and "@<listen ip>" if bound
+	SrcPort    int              `json:"src_port"`               // Local port to forward from, the first port of a range
+	SrcPortEnd int              `json:"src_port_end,omitempty"` // Last port of a forwarded port range (0 = single port)
+	Interface  string           `json:"in_interface,omitempty"` // Only forward traffic arriving on this interface (empty = any)
+	ListenIP   string           `json:"listen_ip,omitempty"`    // Only forward traffic to this local address (empty = any)
+	DstIP      string           `json:"dst_ip"`                 // Destination IP address (IPv4 or IPv6)
+	DstHost    string           `json:"dst_host,omitempty"`     // Destination hostname, DstIP is its last resolved address
+	ResolvedAt *time.Time       `json:"resolved_at,omitempty"`  // When DstHost was last resolved
+	DstIP6     string           `json:"dst_ip6,omitempty"`      // IPv6 destination for IPv6 clients of an IPv4 forward (dual-stack)
+	Backends   []ForwardBackend `json:"backends,omitempty"`     // Load-balanced destinations, DstIP is the first one
+	Balance    string           `json:"balance,omitempty"`      // "random" | "round-robin" | "source-hash" for load-balanced forwards
+	Sources    []string         `json:"allowed_sources"`        // Client addresses or CIDRs allowed to use the forward (empty = any)
+	SnatMode   string           `json:"snat_mode,omitempty"`    // "masquerade" | "snat:<ip>" | "none": how client addresses are rewritten
+	DstPort    int              `json:"dst_port"`               // Destination port
+	Protocol   string           `json:"protocol"`               // "tcp" | "udp" | "both"
+	Enabled    bool             `json:"enabled"`                // Whether the rule is active in nftables
+	Managed    bool             `json:"managed"`                // Whether the rule is managed by nft-ui (has comment)
+	Comment    string           `json:"comment"`                // User-provided description
+	PreHandle  int64            `json:"pre_handle"`             // nft handle for prerouting DNAT rule
+	PostHandle int64            `json:"post_handle"`            // nft handle for postrouting MASQUERADE or SNAT rule
+	LimitMbps  int              `json:"limit_mbps"`             // Bandwidth limit in Mbps (0 = no limit)
+	MaxConns   int              `json:"max_connections"`        // Concurrent connections to the forward (0 = no limit)
+	MaxPerIP   int              `json:"max_connections_per_ip"` // Concurrent connections per client address (0 = no limit)
+	Bytes      int64            `json:"bytes"`                  // Bytes forwarded in both directions
+	Packets    int64            `json:"packets"`                // Packets forwarded in both directions
+	Health     *ForwardHealth   `json:"health,omitempty"`       // Destination health, for forwards with a health check
+
+	resolved  bool   // DstIP was just resolved from DstHost
+	sourceSet string // Named set the DNAT rule matches client addresses against
+}
+
+// ForwardBackend is one destination of a load-balanced forward
+type ForwardBackend struct {
+	IP     string `json:"ip"`
+	Weight int    `json:"weight"` // Share of new connections relative to the other backends (default 1)
+}
+
+// ForwardHealth is the health of a forward's destination as seen by its health check
+type ForwardHealth struct {
+	Status       string     `json:"status"`                  // "unknown" | "up" | "down"
+	Target       string     `json:"target"`                  // Address probed, the primary destination
+	LastCheck    *time.Time `json:"last_check,omitempty"`    // Time of the last probe
+	LastChange   *time.Time `json:"last_change,omitempty"`   // Time of the last status change
+	LastError    string     `json:"last_error,omitempty"`    // Error of the last failed probe
+	FailedOver   bool       `json:"failed_over,omitempty"`   // Traffic goes to the standby destination
+	AutoDisabled bool       `json:"auto_disabled,omitempty"` // The forward was disabled by its health check
+}
+
+// ForwardCounters holds the traffic counters of a forward
+type ForwardCounters struct {
+	Bytes   int64
+	Packets int64
 }
 
 // AddForwardingRequest is the request body for adding a new forwarding rule
 type AddForwardingRequest struct {
-	SrcPort   int    `json:"src_port"`
-	DstIP     string `json:"dst_ip"`
-	DstPort   int    `json:"dst_port"`
-	Protocol  string `json:"protocol"`
-	Comment   string `json:"comment"`
-	LimitMbps int    `json:"limit_mbps"`
+	SrcPort    int              `json:"src_port"`
+	SrcPortEnd int              `json:"src_port_end"`
+	Interface  string           `json:"in_interface"`
+	ListenIP   string           `json:"listen_ip"`
+	DstIP      string           `json:"dst_ip"`
+	DstHost    string           `json:"dst_host"` // Resolved to DstIP, takes precedence over it
+	DstIP6     string           `json:"dst_ip6"`
+	Backends   []ForwardBackend `json:"backends"`
+	Balance    string           `json:"balance"`
+	Sources    []string         `json:"allowed_sources"`
+	SnatMode   string           `json:"snat_mode"` // "masquerade" (default) | "snat:<ip>" | "none"
+	DstPort    int              `json:"dst_port"`
+	Protocol   string           `json:"protocol"`
+	Comment    string           `json:"comment"`
+	LimitMbps  int              `json:"limit_mbps"`
+	MaxConns   int              `json:"max_connections"`
+	MaxPerIP   int              `json:"max_connections_per_ip"`
 }
 
 // EditForwardingRequest is the request body for editing a forwarding rule
 type EditForwardingRequest struct {
-	DstIP     string `json:"dst_ip"`
-	DstPort   int    `json:"dst_port"`
-	Protocol  string `json:"protocol"`
-	Comment   string `json:"comment"`
-	LimitMbps int    `json:"limit_mbps"`
+	DstIP     string           `json:"dst_ip"`
+	DstHost   string           `json:"dst_host"`
+	DstIP6    string           `json:"dst_ip6"`
+	Backends  []ForwardBackend `json:"backends"`
+	Balance   string           `json:"balance"`
+	Sources   *[]string        `json:"allowed_sources"` // nil keeps the current allowlist
+	SnatMode  string           `json:"snat_mode"`       // empty keeps the current mode
+	DstPort   int              `json:"dst_port"`
+	Protocol  string           `json:"protocol"`
+	Comment   string           `json:"comment"`
+	LimitMbps int              `json:"limit_mbps"`
+	MaxConns  int              `json:"max_connections"`
+	MaxPerIP  int              `json:"max_connections_per_ip"`
+}
+
+// SetAllowedSourcesRequest is the request body for replacing the allowlist of a forward
+type SetAllowedSourcesRequest struct {
+	Sources []string `json:"allowed_sources"` // empty = any source
 }
 
 // ForwardingResponse is the API response for listing forwarding rules
@@ -166,3 +319,260 @@ type ForwardingResponse struct {
 type DisabledForwardsFile struct {
 	Rules []ForwardingRule `json:"rules"`
 }
+
+// ResetSchedule is an automatic reset policy for the quota on a port.
+// Schedules are keyed by port because quota IDs change on every reset.
+type ResetSchedule struct {
+	Port      int        `json:"port"`
+	Type      string     `json:"type"`               // "daily" | "weekly" | "monthly" | "cron"
+	Time      string     `json:"time,omitempty"`     // "HH:MM" for daily/weekly/monthly (default "00:00")
+	Weekday   int        `json:"weekday,omitempty"`  // 0 (Sunday) - 6 for weekly
+	Day       int        `json:"day,omitempty"`      // 1-31 for monthly, clamped to the last day of short months
+	Cron      string     `json:"cron,omitempty"`     // standard 5-field cron expression
+	Timezone  string     `json:"timezone,omitempty"` // IANA zone name, empty = server local time
+	NextReset *time.Time `json:"next_reset,omitempty"`
+	LastReset *time.Time `json:"last_reset,omitempty"`
+}
+
+// SetResetScheduleRequest is the request body for setting a quota's reset schedule
+type SetResetScheduleRequest struct {
+	Type     string `json:"type"`
+	Time     string `json:"time"`
+	Weekday  int    `json:"weekday"`
+	Day      int    `json:"day"`
+	Cron     string `json:"cron"`
+	Timezone string `json:"timezone"`
+}
+
+// ResetSchedulesFile represents the JSON structure for storing reset schedules
+type ResetSchedulesFile struct {
+	Schedules []ResetSchedule `json:"schedules"`
+}
+
+// BlockedAddress is an address or CIDR banned by the blocklist
+type BlockedAddress struct {
+	Address   string     `json:"address"`
+	Reason    string     `json:"reason,omitempty"`
+	Timeout   int64      `json:"timeout"`              // Ban duration in seconds, 0 = until removed
+	ExpiresIn int64      `json:"expires_in,omitempty"` // Seconds left until the ban is lifted
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// BlocklistResponse is the API response for listing the blocklist
+type BlocklistResponse struct {
+	Addresses []BlockedAddress `json:"addresses"`
+}
+
+// BlockAddressesRequest is the request body for adding addresses to the blocklist
+type BlockAddressesRequest struct {
+	Addresses []string `json:"addresses"` // Addresses or CIDRs
+	Timeout   int64    `json:"timeout"`   // Ban duration in seconds, 0 = until removed
+	Reason    string   `json:"reason"`
+}
+
+// BlocklistImportResponse is the API response for importing a blocklist file
+type BlocklistImportResponse struct {
+	Success bool     `json:"success"`
+	Added   int      `json:"added"`
+	Skipped []string `json:"skipped,omitempty"` // Lines not imported, with the reason
+}
+
+// AutoBan bans the sources that open new connections to an allowed port or a
+// forward faster than a rate, with the addresses it currently bans
+type AutoBan struct {
+	Target      string           `json:"target"`      // "port_<ports>/<protocol>" or the ID of a forward
+	Connections int              `json:"connections"` // New connections allowed per period from one address
+	Per         string           `json:"per"`         // "second" | "minute" | "hour"
+	BanTime     int64            `json:"ban_time"`    // Ban duration in seconds
+	Banned      []BlockedAddress `json:"banned"`
+}
+
+// AutoBanResponse is the API response for listing the auto-bans
+type AutoBanResponse struct {
+	AutoBans []AutoBan `json:"auto_bans"`
+}
+
+// SetAutoBanRequest is the request body for setting the auto-ban of a port or forward
+type SetAutoBanRequest struct {
+	Connections int    `json:"connections"`
+	Per         string `json:"per"`      // "second" | "minute" | "hour"
+	BanTime     int64  `json:"ban_time"` // Ban duration in seconds
+}
+
+// FirewallBaseline is the state of the input chain's default-drop baseline
+type FirewallBaseline struct {
+	Enabled     bool     `json:"enabled"`
+	Policy      string   `json:"policy"`       // Policy of the input chain: "accept" | "drop"
+	ListenPorts []int    `json:"listen_ports"` // nft-ui ports the baseline keeps open
+	Rules       []string `json:"rules"`        // Rules the baseline inserts, in nft syntax
+}
+
+// SetBaselineRequest is the request body for turning the firewall baseline on or off
+type SetBaselineRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// HealthCheck is the health check policy of a forward, keyed by its source
+// port. Primary and AutoDisabled record what the check changed so it can be
+// undone after a restart.
+type HealthCheck struct {
+	Port         int    `json:"port"`                    // Source port of the forward
+	Bind         string `json:"bind,omitempty"`          // Binding of the forward ("+<interface>@<listen ip>"), empty if unbound
+	Protocol     string `json:"protocol"`                // "tcp" (connect) | "udp" (probe, down on ICMP port unreachable)
+	Payload      string `json:"payload,omitempty"`       // Datagram sent by a UDP probe
+	OnFailure    string `json:"on_failure"`              // "none" | "failover" | "disable"
+	Standby      string `json:"standby,omitempty"`       // Destination to fail over to
+	FailAfter    int    `json:"fail_after"`              // Failed probes in a row before the destination is down
+	RecoverAfter int    `json:"recover_after"`           // Successful probes in a row before it is up again
+	Primary      string `json:"primary,omitempty"`       // Original destination while failed over to the standby
+	AutoDisabled bool   `json:"auto_disabled,omitempty"` // The check disabled the forward and re-enables it on recovery
+}
+
+// SetHealthCheckRequest is the request body for setting a forward's health check
+type SetHealthCheckRequest struct {
+	Protocol     string `json:"protocol"`
+	Payload      string `json:"payload"`
+	OnFailure    string `json:"on_failure"`
+	Standby      string `json:"standby"`
+	FailAfter    int    `json:"fail_after"`
+	RecoverAfter int    `json:"recover_after"`
+}
+
+// HealthChecksFile represents the JSON structure for storing health checks
+type HealthChecksFile struct {
+	Checks []HealthCheck `json:"checks"`
+}
+
+// LedgerEntry records a change of a quota's limit
+type LedgerEntry struct {
+	Time       time.Time `json:"time"`
+	Port       int       `json:"port"`
+	Action     string    `json:"action"` // "add" | "modify" | "topup"
+	DeltaBytes int64     `json:"delta_bytes"`
+	OldBytes   int64     `json:"old_bytes"`
+	NewBytes   int64     `json:"new_bytes"`
+	Note       string    `json:"note,omitempty"`
+}
+
+// QuotaLedgerFile represents the JSON structure for storing the quota ledger
+type QuotaLedgerFile struct {
+	Entries []LedgerEntry `json:"entries"`
+}
+
+// QuotaLedgerResponse is the API response for a port's limit change history
+type QuotaLedgerResponse struct {
+	Port    int           `json:"port"`
+	Entries []LedgerEntry `json:"entries"`
+}
+
+// QuotaCounters holds the raw counters of a port's quota rules
+type QuotaCounters struct {
+	Local   int64 // output chain (traffic served by this host)
+	Forward int64 // forward chain (traffic to a forwarding target)
+}
+
+// HistoryPoint is the traffic of one time step
+type HistoryPoint struct {
+	Time         time.Time `json:"time"`
+	Bytes        int64     `json:"bytes"`         // total traffic in the step
+	ForwardBytes int64     `json:"forward_bytes"` // part of Bytes that was forwarded
+}
+
+// QuotaHistoryResponse is the API response for a port's usage history
+type QuotaHistoryResponse struct {
+	Port       int            `json:"port"`
+	From       time.Time      `json:"from"`
+	To         time.Time      `json:"to"`
+	Step       int64          `json:"step"` // seconds
+	TotalBytes int64          `json:"total_bytes"`
+	Points     []HistoryPoint `json:"points"`
+}
+
+// AlertEvent is the payload sent to webhooks
+type AlertEvent struct {
+	Type           string    `json:"type"` // "quota_status" | "quota_threshold" | "forward_missing" | "test"
+	Time           time.Time `json:"time"`
+	Port           int       `json:"port,omitempty"`
+	Comment        string    `json:"comment,omitempty"`
+	Status         string    `json:"status,omitempty"`
+	PreviousStatus string    `json:"previous_status,omitempty"`
+	Threshold      float64   `json:"threshold,omitempty"` // percent, for quota_threshold
+	UsedBytes      int64     `json:"used_bytes,omitempty"`
+	QuotaBytes     int64     `json:"quota_bytes,omitempty"`
+	UsagePercent   float64   `json:"usage_percent,omitempty"`
+	Message        string    `json:"message"`
+}
+
+// AlertDelivery records the delivery of an event to one webhook
+type AlertDelivery struct {
+	ID          int64      `json:"id"`
+	Webhook     string     `json:"webhook"`
+	Event       AlertEvent `json:"event"`
+	Status      string     `json:"status"` // "pending" | "retrying" | "delivered" | "failed"
+	Attempts    int        `json:"attempts"`
+	StatusCode  int        `json:"status_code,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	LastAttempt time.Time  `json:"last_attempt,omitempty"`
+}
+
+// AlertPortState is the persisted alert state of the quota on a port
+type AlertPortState struct {
+	Status     string    `json:"status,omitempty"`     // last seen quota status
+	Thresholds []float64 `json:"thresholds,omitempty"` // per-quota alert thresholds (percent), overriding the defaults
+	Fired      []float64 `json:"fired,omitempty"`      // thresholds already alerted since usage last dropped below them
+}
+
+// AlertsFile represents the JSON structure for storing alert state
+type AlertsFile struct {
+	Ports    map[int]*AlertPortState `json:"ports"`
+	Forwards []int                   `json:"forwards"` // managed forwards seen by the last check
+}
+
+// SetAlertThresholdsRequest is the request body for setting a quota's alert thresholds
+type SetAlertThresholdsRequest struct {
+	Thresholds []float64 `json:"thresholds"`
+}
+
+// AlertThresholdsResponse is the API response for a quota's alert thresholds
+type AlertThresholdsResponse struct {
+	Port       int       `json:"port"`
+	Thresholds []float64 `json:"thresholds"`
+	Custom     bool      `json:"custom"` // false if the global defaults apply
+}
+
+// AlertDeliveriesResponse is the API response for the webhook delivery log
+type AlertDeliveriesResponse struct {
+	Deliveries []AlertDelivery `json:"deliveries"`
+}
+
+// QuotaThresholds are the usage percentages at which a quota's status changes
+type QuotaThresholds struct {
+	WarningPercent  float64 `json:"warning_percent"`
+	ExceededPercent float64 `json:"exceeded_percent"`
+}
+
+// ForwardMeta holds per-forward settings kept outside of nftables, keyed by source port
+type ForwardMeta struct {
+	Port         int        `json:"port"`
+	Bind         string     `json:"bind,omitempty"`          // Binding of the forward ("+<interface>@<listen ip>"), empty if unbound
+	DstHost      string     `json:"dst_host"`                // Hostname the destination is resolved from
+	ResolvedIP   string     `json:"resolved_ip,omitempty"`   // Last address DstHost resolved to
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty"`   // Time of the last successful resolution
+	ResolveError string     `json:"resolve_error,omitempty"` // Error of the last resolution, if it failed
+}
+
+// ForwardMetaFile represents the JSON structure for storing forward metadata
+type ForwardMetaFile struct {
+	Forwards []ForwardMeta `json:"forwards"`
+}
+
+// QuotaMeta holds per-quota settings kept outside of nftables, keyed by port
+type QuotaMeta struct {
+	Port       int              `json:"port"`
+	Thresholds *QuotaThresholds `json:"thresholds,omitempty"` // nil = global defaults
+}
+
+// QuotaMetaFile represents the JSON structure for storing quota metadata
+type QuotaMetaFile struct {
+	Quotas []QuotaMeta `json:"quotas"`
+}